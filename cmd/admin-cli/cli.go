@@ -1,51 +1,85 @@
 package main
 
 import (
+	"bufio"
 	"context"
-	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	pb "github.com/rexlx/squall/proto"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 func main() {
 	// CLI Flags
-	adminEmail := flag.String("admin", "", "Existing Admin email")
-	adminPass := flag.String("pass", "", "Existing Admin password")
+	action := flag.String("action", "create", "What to do: create|list|delete|reset-pass|set-role")
+	configPath := flag.String("config", "", "JSON file with host, ca, cert, key, insecure, admin and pass; flags override it")
+	cfg := defaultConfig()
+	cfg.registerFlags(flag.CommandLine)
 	newEmail := flag.String("new-email", "", "New user email")
-	newPass := flag.String("new-pass", "", "New user password")
+	newPass := flag.String("new-pass", "", "New user password (create, reset-pass)")
 	newName := flag.String("new-name", "", "New user name")
-	newRole := flag.String("new-role", "user", "New user role (user|admin)")
-	host := flag.String("host", "localhost:8080", "Server host:port")
+	newRole := flag.String("new-role", "user", "New user role (user|admin) (create, set-role)")
+	jsonOut := flag.Bool("json", false, "Print results as JSON (list)")
+	target := flag.String("target", "", "Email of the user to act on (delete, reset-pass, set-role)")
+	force := flag.Bool("force", false, "Skip the confirmation prompt (delete)")
+	purgeMessages := flag.Bool("purge-messages", false, "Delete the user's messages instead of anonymizing them (delete)")
 
 	flag.Parse()
 
-	if *adminEmail == "" || *adminPass == "" || *newEmail == "" || *newPass == "" {
-		log.Fatal("Usage: go run cmd/admin-cli/main.go -admin <email> -pass <pass> -new-email <target> -new-pass <pass> ...")
+	if *configPath != "" {
+		var err error
+		if cfg, err = loadConfig(*configPath, flag.CommandLine); err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
 	}
 
-	// 1. Load Client Certificates (mTLS)
-	// We must present a certificate to the server, or it will reject the connection.
-	cert, err := tls.LoadX509KeyPair("data/client-cert.pem", "data/client-key.pem")
-	if err != nil {
-		log.Fatalf("Failed to load client certs: %v", err)
+	if cfg.Admin == "" || cfg.Pass == "" {
+		log.Fatal("Usage: go run cmd/admin-cli/main.go [-config <file>] -admin <email> -pass <pass> [-action create|list|delete|reset-pass|set-role] ...")
 	}
-
-	// 2. Configure TLS
-	tlsConfig := &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		InsecureSkipVerify: true, // Still needed for self-signed server certs
+	switch *action {
+	case "create":
+		if *newEmail == "" || *newPass == "" {
+			log.Fatal("Usage: go run cmd/admin-cli/main.go -admin <email> -pass <pass> -new-email <target> -new-pass <pass> ...")
+		}
+	case "list":
+	case "delete":
+		if *target == "" {
+			log.Fatal("Usage: go run cmd/admin-cli/main.go -admin <email> -pass <pass> -action delete -target <email> [-force]")
+		}
+		// Ask before connecting so the RPC deadline doesn't run while we wait
+		if !confirmDelete(cfg.Admin, *target, *force, *purgeMessages) {
+			fmt.Println("Aborted.")
+			return
+		}
+	case "reset-pass":
+		if *target == "" || *newPass == "" {
+			log.Fatal("Usage: go run cmd/admin-cli/main.go -admin <email> -pass <pass> -action reset-pass -target <email> -new-pass <pass>")
+		}
+		if len(*newPass) < minPasswordLength {
+			log.Fatalf("New password must be at least %d characters", minPasswordLength)
+		}
+	case "set-role":
+		if *target == "" {
+			log.Fatal("Usage: go run cmd/admin-cli/main.go -admin <email> -pass <pass> -action set-role -target <email> -new-role <user|admin>")
+		}
+		if *newRole != "user" && *newRole != "admin" {
+			log.Fatalf("Invalid role %q (want user or admin)", *newRole)
+		}
+	default:
+		log.Fatalf("Unknown action %q (want create, list, delete, reset-pass or set-role)", *action)
 	}
-	creds := credentials.NewTLS(tlsConfig)
 
-	// 3. Connect to Server
-	conn, err := grpc.Dial(*host, grpc.WithTransportCredentials(creds))
+	// 1. Connect to Server over mTLS, verifying it against the CA
+	conn, err := cfg.dial()
 	if err != nil {
 		log.Fatalf("Failed to connect: %v", err)
 	}
@@ -55,11 +89,11 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// 4. Login as Admin
-	fmt.Printf("Logging in as %s...\n", *adminEmail)
+	// 2. Login as Admin. Progress goes to stderr so -json output stays clean.
+	fmt.Fprintf(os.Stderr, "Logging in as %s...\n", cfg.Admin)
 	loginResp, err := client.Login(ctx, &pb.LoginRequest{
-		Email:    *adminEmail,
-		Password: *adminPass,
+		Email:    cfg.Admin,
+		Password: cfg.Pass,
 	})
 	if err != nil {
 		log.Fatalf("Login RPC failed: %v", err)
@@ -68,26 +102,209 @@ func main() {
 		log.Fatalf("Login refused: %s", loginResp.Message)
 	}
 
-	fmt.Println("Login successful. Creating new user...")
-
-	// 5. Create New User
 	// Attach token to context
 	md := metadata.Pairs("authorization", loginResp.Token)
 	authCtx := metadata.NewOutgoingContext(ctx, md)
 
-	createResp, err := client.CreateUser(authCtx, &pb.CreateUserRequest{
-		Email:     *newEmail,
-		Password:  *newPass,
-		FirstName: *newName,
-		Role:      *newRole,
+	// 3. Run the action
+	switch *action {
+	case "create":
+		createUser(authCtx, client, *newEmail, *newPass, *newName, *newRole)
+	case "list":
+		listUsers(authCtx, client, *jsonOut)
+	case "delete":
+		deleteUser(authCtx, client, *target, *purgeMessages)
+	case "reset-pass":
+		resetPassword(authCtx, client, cfg.Admin, cfg.Pass, *target, *newPass)
+	case "set-role":
+		setRole(authCtx, client, *target, *newRole)
+	}
+}
+
+// minPasswordLength mirrors the server's default MinPasswordLength so a
+// short password is rejected before connecting. The server's configured
+// policy has the final say.
+const minPasswordLength = 8
+
+// fatalRPC exits with a readable message for a failed admin RPC.
+func fatalRPC(name string, err error) {
+	if status.Code(err) == codes.PermissionDenied {
+		log.Fatalf("%s refused: this account is not an admin", name)
+	}
+	log.Fatalf("%s RPC failed: %v", name, err)
+}
+
+func createUser(ctx context.Context, client pb.ChatServiceClient, email, pass, name, role string) {
+	fmt.Fprintln(os.Stderr, "Login successful. Creating new user...")
+
+	createResp, err := client.CreateUser(ctx, &pb.CreateUserRequest{
+		Email:     email,
+		Password:  pass,
+		FirstName: name,
+		Role:      role,
 	})
 	if err != nil {
-		log.Fatalf("CreateUser RPC failed: %v", err)
+		fatalRPC("CreateUser", err)
 	}
 
 	if createResp.Success {
-		fmt.Printf("SUCCESS: User '%s' created (ID: %s)\n", *newEmail, createResp.UserId)
+		fmt.Printf("SUCCESS: User '%s' created (ID: %s)\n", email, createResp.UserId)
 	} else {
 		fmt.Printf("FAILED: Server returned error: %s\n", createResp.Message)
 	}
 }
+
+// listedUser is one row of -action list output.
+type listedUser struct {
+	ID      string    `json:"id"`
+	Email   string    `json:"email"`
+	Name    string    `json:"name"`
+	Role    string    `json:"role"`
+	Created time.Time `json:"created"`
+	// nil when the user has never logged in or been active
+	LastLogin  *time.Time `json:"last_login"`
+	LastActive *time.Time `json:"last_active"`
+}
+
+// optionalTime converts a Unix timestamp where 0 means "never".
+func optionalTime(unix int64) *time.Time {
+	if unix == 0 {
+		return nil
+	}
+	t := time.Unix(unix, 0).UTC()
+	return &t
+}
+
+// formatOptional renders t for the table, or "never".
+func formatOptional(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+func listUsers(ctx context.Context, client pb.ChatServiceClient, jsonOut bool) {
+	resp, err := client.ListUsers(ctx, &pb.ListUsersRequest{})
+	if err != nil {
+		fatalRPC("ListUsers", err)
+	}
+
+	users := make([]listedUser, 0, len(resp.Users))
+	for _, u := range resp.Users {
+		users = append(users, listedUser{
+			ID:      u.Id,
+			Email:   u.Email,
+			Name:    u.Name,
+			Role:    u.Role,
+			Created: time.Unix(u.Created, 0).UTC(),
+
+			LastLogin:  optionalTime(u.LastLogin),
+			LastActive: optionalTime(u.LastActive),
+		})
+	}
+
+	if jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(users); err != nil {
+			log.Fatalf("Failed to write JSON: %v", err)
+		}
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tEMAIL\tROLE\tCREATED\tLAST LOGIN\tLAST ACTIVE")
+	for _, u := range users {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", u.ID, u.Email, u.Role, u.Created.Format("2006-01-02 15:04"),
+			formatOptional(u.LastLogin), formatOptional(u.LastActive))
+	}
+	tw.Flush()
+	fmt.Fprintf(os.Stderr, "%d users\n", len(users))
+}
+
+// confirm asks a yes/no question on stdin and reports whether the answer
+// was yes.
+func confirm(in *bufio.Reader, prompt string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N]: ", prompt)
+	answer, _ := in.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// confirmDelete asks before deleting target unless force is set. Deleting
+// the account we log in as always needs the email typed back, even with
+// -force.
+func confirmDelete(adminEmail, target string, force, purgeMessages bool) bool {
+	in := bufio.NewReader(os.Stdin)
+	what := "anonymizing their messages"
+	if purgeMessages {
+		what = "deleting their messages"
+	}
+	if !force && !confirm(in, fmt.Sprintf("Delete user %s, %s?", target, what)) {
+		return false
+	}
+	if strings.EqualFold(target, adminEmail) {
+		fmt.Fprintf(os.Stderr, "You are about to delete your own account. Type your email to confirm: ")
+		typed, _ := in.ReadString('\n')
+		return strings.EqualFold(strings.TrimSpace(typed), adminEmail)
+	}
+	return true
+}
+
+// deleteUser removes an account through PurgeUserData, which also drops it
+// from the whitelist and writes the audit log.
+func deleteUser(ctx context.Context, client pb.ChatServiceClient, target string, purgeMessages bool) {
+	resp, err := client.PurgeUserData(ctx, &pb.PurgeUserDataRequest{
+		Email:          target,
+		DeleteMessages: purgeMessages,
+	})
+	if err != nil {
+		fatalRPC("PurgeUserData", err)
+	}
+	if !resp.Success {
+		fmt.Printf("FAILED: Server returned error: %s\n", resp.Message)
+		return
+	}
+	fmt.Printf("SUCCESS: User '%s' deleted (%d messages affected)\n", target, resp.MessagesAffected)
+}
+
+// resetPassword sets target's password through the admin path of
+// ChangePassword. The server logs the reset. Resetting our own password
+// goes through the normal check, so the admin password is sent as the old
+// one.
+func resetPassword(ctx context.Context, client pb.ChatServiceClient, adminEmail, adminPass, target, newPass string) {
+	req := &pb.ChangePasswordRequest{
+		Email:       target,
+		NewPassword: newPass,
+	}
+	if strings.EqualFold(target, adminEmail) {
+		req.Email = adminEmail
+		req.OldPassword = adminPass
+	}
+
+	resp, err := client.ChangePassword(ctx, req)
+	if err != nil {
+		fatalRPC("ChangePassword", err)
+	}
+	if !resp.Success {
+		fmt.Printf("FAILED: Server returned error: %s\n", resp.Message)
+		return
+	}
+	fmt.Printf("SUCCESS: Password for '%s' reset\n", target)
+}
+
+// setRole changes target's role through UpdateUser and prints the change.
+func setRole(ctx context.Context, client pb.ChatServiceClient, target, role string) {
+	resp, err := client.UpdateUser(ctx, &pb.UpdateUserRequest{
+		User: &pb.User{Email: target},
+		Role: role,
+	})
+	if err != nil {
+		fatalRPC("UpdateUser", err)
+	}
+	if !resp.Success {
+		fmt.Printf("FAILED: Server returned error: %s\n", resp.Message)
+		return
+	}
+	fmt.Printf("SUCCESS: Role for '%s' changed: %s -> %s\n", target, resp.PreviousRole, resp.Role)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rexlx/squall/internal"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// cliConfig holds the connection and admin login settings. It can be read
+// from a -config JSON file; flags given on the command line win over it.
+type cliConfig struct {
+	Host     string `json:"host"`
+	CAFile   string `json:"ca"`
+	CertFile string `json:"cert"`
+	KeyFile  string `json:"key"`
+	Insecure bool   `json:"insecure"`
+	Admin    string `json:"admin"`
+	Pass     string `json:"pass"`
+}
+
+// defaultConfig is what the CLI used before it had a config file.
+func defaultConfig() cliConfig {
+	return cliConfig{
+		Host:     "localhost:8080",
+		CAFile:   internal.DefaultCAFile,
+		CertFile: "data/client-cert.pem",
+		KeyFile:  "data/client-key.pem",
+	}
+}
+
+// registerFlags binds the config flags to cfg, whose values become the
+// flag defaults.
+func (cfg *cliConfig) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.Host, "host", cfg.Host, "Server host:port")
+	fs.StringVar(&cfg.CAFile, "ca", cfg.CAFile, "CA certificate the server must be signed by (empty uses the system roots)")
+	fs.StringVar(&cfg.CertFile, "cert", cfg.CertFile, "Client certificate file")
+	fs.StringVar(&cfg.KeyFile, "key", cfg.KeyFile, "Client key file")
+	fs.BoolVar(&cfg.Insecure, "insecure", cfg.Insecure, "Skip server certificate verification (development only)")
+	fs.StringVar(&cfg.Admin, "admin", cfg.Admin, "Existing Admin email")
+	fs.StringVar(&cfg.Pass, "pass", cfg.Pass, "Existing Admin password")
+}
+
+// loadConfig returns the settings from path, overridden by any of the
+// config flags that were set explicitly on fs.
+func loadConfig(path string, fs *flag.FlagSet) (cliConfig, error) {
+	cfg := defaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	// Re-apply explicit flags on top of the file
+	overrides := flag.NewFlagSet("overrides", flag.ContinueOnError)
+	cfg.registerFlags(overrides)
+	var setErr error
+	fs.Visit(func(f *flag.Flag) {
+		if overrides.Lookup(f.Name) != nil && setErr == nil {
+			setErr = overrides.Set(f.Name, f.Value.String())
+		}
+	})
+	return cfg, setErr
+}
+
+// dial connects to the server over mTLS, verifying it against the CA.
+func (cfg cliConfig) dial() (*grpc.ClientConn, error) {
+	tlsConfig, err := internal.ClientTLSConfig(internal.ClientTLS{
+		CAFile:             cfg.CAFile,
+		CertFile:           cfg.CertFile,
+		KeyFile:            cfg.KeyFile,
+		InsecureSkipVerify: cfg.Insecure,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("configure TLS: %w", err)
+	}
+	return grpc.Dial(cfg.Host, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+}
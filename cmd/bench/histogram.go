@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+// Latencies are bucketed HDR-style: exact below 2^histSubBits microseconds,
+// then 2^histSubBits buckets per power of two, which keeps every bucket
+// within about 6% of the values it holds.
+const (
+	histSubBits    = 4
+	histSubBuckets = 1 << histSubBits
+	histMaxExp     = 40 // 2^40us is ~12 days, far beyond any send; longer clamps to the top bucket
+	histBuckets    = (histMaxExp - histSubBits + 1) * histSubBuckets
+)
+
+// latencyHistogram counts latencies in microseconds. Record is safe to call
+// from any goroutine alongside Snapshot.
+type latencyHistogram struct {
+	counts [histBuckets]atomic.Uint64
+}
+
+func histBucket(us int64) int {
+	if us < 0 {
+		us = 0
+	}
+	v := uint64(us)
+	if v < histSubBuckets {
+		return int(v)
+	}
+	k := bits.Len64(v) - 1
+	if k >= histMaxExp {
+		return histBuckets - 1
+	}
+	shift := k - histSubBits
+	return (k-histSubBits+1)*histSubBuckets + int(v>>shift) - histSubBuckets
+}
+
+// histBucketMax is the largest value that lands in bucket i.
+func histBucketMax(i int) int64 {
+	if i < histSubBuckets {
+		return int64(i)
+	}
+	shift := i/histSubBuckets - 1
+	sub := i % histSubBuckets
+	lower := int64(histSubBuckets+sub) << shift
+	return lower + int64(1)<<shift - 1
+}
+
+// Record adds one latency sample.
+func (h *latencyHistogram) Record(us int64) {
+	h.counts[histBucket(us)].Add(1)
+}
+
+// Snapshot returns the counts recorded so far and starts a new window.
+func (h *latencyHistogram) Snapshot() latencySnapshot {
+	var s latencySnapshot
+	for i := range h.counts {
+		n := h.counts[i].Swap(0)
+		s.counts[i] = n
+		s.total += n
+	}
+	return s
+}
+
+// latencySnapshot is one window's worth of histogram counts.
+type latencySnapshot struct {
+	counts [histBuckets]uint64
+	total  uint64
+}
+
+// Merge adds other's counts into s.
+func (s *latencySnapshot) Merge(other *latencySnapshot) {
+	for i, n := range other.counts {
+		s.counts[i] += n
+	}
+	s.total += other.total
+}
+
+// Percentile returns the latency in microseconds at or below which q (0-1)
+// of the samples fall, or 0 with no samples.
+func (s *latencySnapshot) Percentile(q float64) int64 {
+	if s.total == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(s.total) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range s.counts {
+		seen += n
+		if seen >= rank {
+			return histBucketMax(i)
+		}
+	}
+	return histBucketMax(histBuckets - 1)
+}
@@ -2,15 +2,18 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
+	"os"
+	"os/signal"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/rexlx/squall/internal"
 	pb "github.com/rexlx/squall/proto"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -22,11 +25,20 @@ var (
 	host       = flag.String("host", "neo.nullferatu.com:8085", "Server address")
 	adminEmail = flag.String("admin", "rex@aol.com", "Admin email")
 	adminPass  = flag.String("pass", "admin", "Admin password")
+	caFile     = flag.String("ca", internal.DefaultCAFile, "CA certificate the server must be signed by (empty uses the system roots)")
+	insecure   = flag.Bool("insecure", false, "Skip server certificate verification (development only)")
 
 	// Benchmark control
 	numUsers = flag.Int("users", 50, "Concurrent users")
 	numRooms = flag.Int("rooms", 10, "Rooms per user")
 	msgRate  = flag.Int("rate", 1000, "Interval (ms) between messages per user")
+	rampUp   = flag.Duration("ramp", 0, "Spread bot start-up evenly over this long (0 starts one every 20ms)")
+	msgSize  = flag.Int("msg-size", 0, "Bytes of random text per message (0 sends the fixed \"ping\")")
+	encrypt  = flag.Bool("encrypt", false, "AES-GCM encrypt each message with a throwaway key, as the client does")
+	sustain  = flag.Duration("sustain", 0, "Keep full load this long after ramp-up, then stop and print the summary (0 runs until interrupted)")
+
+	// Output
+	outFile = flag.String("out", "", "Append per-second stats and a final summary to this file (CSV if it ends in .csv, JSON lines otherwise)")
 
 	// Feature flags
 	ensurePrune = flag.Bool("prune-heavy", false, "Overrides rates/users to GUARANTEE hitting prune limits")
@@ -34,15 +46,22 @@ var (
 
 // Stats Collection
 type Stats struct {
-	Sent     uint64
-	Recv     uint64
-	Errors   uint64
-	TotalLat int64 // Microseconds
-	MaxLat   int64 // Microseconds
+	Sent      uint64
+	SentBytes uint64 // message_content bytes
+	Recv      uint64
+	Errors    uint64
+	TotalLat  int64 // Microseconds
+	MaxLat    int64 // Microseconds
 }
 
 var globalStats Stats
 
+// payloads builds the content of every bench message.
+var payloads *payloadMaker
+
+// sendLatency holds the current reporting window's send latencies.
+var sendLatency latencyHistogram
+
 func main() {
 	flag.Parse()
 	log.SetFlags(log.Ltime | log.Lmicroseconds)
@@ -52,51 +71,189 @@ func main() {
 		*numUsers = 50
 		*msgRate = 100
 		log.Printf("Adjusted configuration: %d Users @ %dms interval", *numUsers, *msgRate)
+		// -ramp and -sustain still apply, now spread over the adjusted users
 	}
 
-	cert, err := tls.LoadX509KeyPair("data/client-cert.pem", "data/client-key.pem")
+	tlsConfig, err := internal.ClientTLSConfig(internal.ClientTLS{
+		CAFile:             *caFile,
+		CertFile:           "data/client-cert.pem",
+		KeyFile:            "data/client-key.pem",
+		InsecureSkipVerify: *insecure,
+	})
 	if err != nil {
-		log.Fatalf("Cert load failed: %v", err)
+		log.Fatalf("TLS setup failed: %v", err)
 	}
-	creds := credentials.NewTLS(&tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		InsecureSkipVerify: true,
-	})
+	creds := credentials.NewTLS(tlsConfig)
+
+	if payloads, err = newPayloadMaker(*msgSize, *encrypt); err != nil {
+		log.Fatalf("Payload setup failed: %v", err)
+	}
+
+	var out *statsWriter
+	if *outFile != "" {
+		if out, err = openStatsWriter(*outFile); err != nil {
+			log.Fatalf("Failed to open %s: %v", *outFile, err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	token := setupEnv(creds)
 
-	go runReporter()
+	// The run length is timed from the first bot, not from user setup
+	if *sustain > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *rampUp+*sustain)
+		defer cancel()
+		log.Printf("Fixed-length run: %s ramp-up + %s sustain", *rampUp, *sustain)
+	}
+
+	stopReporter := make(chan struct{})
+	reporterDone := make(chan struct{})
+	go func() {
+		defer close(reporterDone)
+		runReporter(stopReporter, out)
+	}()
 
-	log.Printf("Launching %d bots...", *numUsers)
-	var wg sync.WaitGroup
-	wg.Add(*numUsers)
+	stagger := 20 * time.Millisecond
+	if *rampUp > 0 && *numUsers > 0 {
+		stagger = max(*rampUp/time.Duration(*numUsers), time.Millisecond)
+	}
+	log.Printf("Launching %d bots, one every %s...", *numUsers, stagger)
 
+	var bots sync.WaitGroup
+	launch := time.NewTicker(stagger)
+launching:
 	for i := 0; i < *numUsers; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				break launching
+			case <-launch.C:
+			}
+		}
+		bots.Add(1)
 		go func(id int) {
-			defer wg.Done()
-			runBot(id, creds, token)
+			defer bots.Done()
+			runBot(ctx, id, creds, token)
 		}(i)
-		time.Sleep(20 * time.Millisecond)
 	}
-	wg.Wait()
+	launch.Stop()
+
+	// Let every stream stop sending before the final summary is taken
+	<-ctx.Done()
+	log.Println("Stopping bots...")
+	bots.Wait()
+	close(stopReporter)
+	<-reporterDone
+	if out != nil {
+		if err := out.Close(); err != nil {
+			log.Printf("Failed to close %s: %v", *outFile, err)
+		}
+	}
 }
 
-func runReporter() {
+// runReporter logs (and writes to out, if set) the stats for each second
+// until stop is closed, then the summary for the whole run.
+func runReporter(stop <-chan struct{}, out *statsWriter) {
 	ticker := time.NewTicker(1 * time.Second)
-	for range ticker.C {
-		sent := atomic.SwapUint64(&globalStats.Sent, 0)
-		recv := atomic.SwapUint64(&globalStats.Recv, 0)
-		totLat := atomic.SwapInt64(&globalStats.TotalLat, 0)
-		maxLat := atomic.SwapInt64(&globalStats.MaxLat, 0)
-
-		var avgLat float64
-		if sent > 0 {
-			avgLat = float64(totLat) / float64(sent) / 1000.0
+	defer ticker.Stop()
+
+	start := time.Now()
+	var total statsRecord
+	var totalLat int64
+	var totalHist latencySnapshot
+
+	addTotal := func(r statsRecord, lat int64, hist *latencySnapshot) {
+		total.Sent += r.Sent
+		total.Bytes += r.Bytes
+		total.Recv += r.Recv
+		total.Errors += r.Errors
+		totalLat += lat
+		total.MaxMs = max(total.MaxMs, r.MaxMs)
+		totalHist.Merge(hist)
+	}
+
+	for {
+		select {
+		case <-stop:
+			// Fold in whatever arrived since the last tick
+			r, lat, hist := collectInterval(time.Now())
+			addTotal(r, lat, &hist)
+
+			total.Time = time.Now()
+			elapsed := time.Since(start)
+			if elapsed > 0 {
+				total.BytesPerSec = float64(total.Bytes) / elapsed.Seconds()
+			}
+			total.Kind = "summary"
+			if total.Sent > 0 {
+				total.AvgMs = float64(totalLat) / float64(total.Sent) / 1000.0
+			}
+			total.P50Ms = float64(totalHist.Percentile(0.50)) / 1000.0
+			total.P99Ms = float64(totalHist.Percentile(0.99)) / 1000.0
+			log.Printf("SUMMARY [%s]: Sent: %d (%s/s) | Recv: %d | Errors: %d | Latency: Avg %.2fms / Max %.2fms | p50 %.2fms p99 %.2fms",
+				elapsed.Round(time.Second), total.Sent, formatBytes(total.BytesPerSec), total.Recv, total.Errors, total.AvgMs, total.MaxMs, total.P50Ms, total.P99Ms)
+			writeRecord(out, total)
+			return
+		case now := <-ticker.C:
+			r, lat, hist := collectInterval(now)
+			ms := func(q float64) float64 { return float64(hist.Percentile(q)) / 1000.0 }
+
+			log.Printf("STATS [1s]: Sent: %d (%s/s) | Recv: %d | Latency: Avg %.2fms / Max %.2fms | p50 %.2fms p90 %.2fms p99 %.2fms p99.9 %.2fms",
+				r.Sent, formatBytes(r.BytesPerSec), r.Recv, r.AvgMs, r.MaxMs, r.P50Ms, ms(0.90), r.P99Ms, ms(0.999))
+
+			writeRecord(out, r)
+			addTotal(r, lat, &hist)
 		}
-		maxLatMs := float64(maxLat) / 1000.0
+	}
+}
+
+// collectInterval swaps out the counters gathered since the last call. It
+// also returns the summed latency and the histogram so the caller can keep
+// run totals.
+func collectInterval(now time.Time) (statsRecord, int64, latencySnapshot) {
+	r := statsRecord{
+		Time:   now,
+		Kind:   "interval",
+		Sent:   atomic.SwapUint64(&globalStats.Sent, 0),
+		Bytes:  atomic.SwapUint64(&globalStats.SentBytes, 0),
+		Recv:   atomic.SwapUint64(&globalStats.Recv, 0),
+		Errors: atomic.SwapUint64(&globalStats.Errors, 0),
+	}
+	// Intervals are one reporter tick long
+	r.BytesPerSec = float64(r.Bytes)
+	totLat := atomic.SwapInt64(&globalStats.TotalLat, 0)
+	maxLat := atomic.SwapInt64(&globalStats.MaxLat, 0)
+	hist := sendLatency.Snapshot()
+
+	if r.Sent > 0 {
+		r.AvgMs = float64(totLat) / float64(r.Sent) / 1000.0
+	}
+	r.MaxMs = float64(maxLat) / 1000.0
+	r.P50Ms = float64(hist.Percentile(0.50)) / 1000.0
+	r.P99Ms = float64(hist.Percentile(0.99)) / 1000.0
+	return r, totLat, hist
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. "12.3 KiB".
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
 
-		log.Printf("STATS [1s]: Sent: %d | Recv: %d | Latency: Avg %.2fms / Max %.2fms",
-			sent, recv, avgLat, maxLatMs)
+func writeRecord(out *statsWriter, r statsRecord) {
+	if out == nil {
+		return
+	}
+	if err := out.Write(r); err != nil {
+		log.Printf("Failed to write stats: %v", err)
 	}
 }
 
@@ -128,7 +285,9 @@ func setupEnv(creds credentials.TransportCredentials) string {
 	return resp.Token
 }
 
-func runBot(id int, creds credentials.TransportCredentials, adminToken string) {
+// runBot logs in as one bench user and streams to its rooms until ctx is
+// done.
+func runBot(ctx context.Context, id int, creds credentials.TransportCredentials, adminToken string) {
 	conn, err := grpc.Dial(*host, grpc.WithTransportCredentials(creds))
 	if err != nil {
 		return
@@ -137,20 +296,25 @@ func runBot(id int, creds credentials.TransportCredentials, adminToken string) {
 	client := pb.NewChatServiceClient(conn)
 
 	email := fmt.Sprintf("bench_%d@test.com", id)
-	lResp, err := client.Login(context.Background(), &pb.LoginRequest{Email: email, Password: "password"})
+	lResp, err := client.Login(ctx, &pb.LoginRequest{Email: email, Password: "password"})
 	if err != nil || lResp.User == nil {
 		log.Printf("Bot %d login failed", id)
 		return
 	}
 
-	authCtx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("authorization", lResp.Token))
+	authCtx := metadata.NewOutgoingContext(ctx, metadata.Pairs("authorization", lResp.Token))
 
+	var streams sync.WaitGroup
 	for r := 0; r < *numRooms; r++ {
 		roomName := fmt.Sprintf("stress_room_%d", r)
 		client.JoinRoom(authCtx, &pb.JoinRoomRequest{Email: email, RoomName: roomName})
-		go startStream(client, authCtx, lResp.User.Id, roomName)
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			startStream(client, authCtx, lResp.User.Id, roomName)
+		}()
 	}
-	select {}
+	streams.Wait()
 }
 
 func startStream(client pb.ChatServiceClient, ctx context.Context, userID, roomID string) {
@@ -172,27 +336,49 @@ func startStream(client pb.ChatServiceClient, ctx context.Context, userID, roomI
 	}()
 
 	ticker := time.NewTicker(time.Duration(*msgRate) * time.Millisecond)
-	time.Sleep(time.Duration(rand.Intn(1000)) * time.Millisecond)
+	defer ticker.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Duration(rand.Intn(1000)) * time.Millisecond):
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			stream.CloseSend()
+			return
+		case <-ticker.C:
+		}
+
+		content, iv, keyName, err := payloads.Make()
+		if err != nil {
+			atomic.AddUint64(&globalStats.Errors, 1)
+			continue
+		}
 
-	for range ticker.C {
 		// FIXED: Use Payload wrapper for oneof and set Type explicitly
 		msg := &pb.ChatMessage{
 			UserId: userID,
 			RoomId: roomID,
 			Type:   pb.ChatMessage_TEXT,
 			Payload: &pb.ChatMessage_MessageContent{
-				MessageContent: "cGluZw==", // "ping"
+				MessageContent: content,
 			},
+			Iv:        iv,
+			HotSauce:  keyName,
 			Timestamp: time.Now().Unix(),
 		}
 
 		start := time.Now()
-		err := stream.Send(msg)
+		err = stream.Send(msg)
 		dur := time.Since(start).Microseconds()
 
 		if err == nil {
 			atomic.AddUint64(&globalStats.Sent, 1)
+			atomic.AddUint64(&globalStats.SentBytes, uint64(len(content)))
 			atomic.AddInt64(&globalStats.TotalLat, dur)
+			sendLatency.Record(dur)
 
 			for {
 				currMax := atomic.LoadInt64(&globalStats.MaxLat)
@@ -204,7 +390,10 @@ func startStream(client pb.ChatServiceClient, ctx context.Context, userID, roomI
 				}
 			}
 		} else {
-			atomic.AddUint64(&globalStats.Errors, 1)
+			// A send cut off by the end of the run isn't a server error
+			if ctx.Err() == nil {
+				atomic.AddUint64(&globalStats.Errors, 1)
+			}
 			return
 		}
 	}
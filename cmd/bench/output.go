@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsRecord is one line of -out output: a reporting interval, or the
+// summary of the whole run written at shutdown.
+type statsRecord struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"` // "interval" or "summary"
+	Sent   uint64    `json:"sent"`
+	Bytes  uint64    `json:"bytes"` // message_content bytes sent
+	Recv   uint64    `json:"recv"`
+	Errors uint64    `json:"errors"`
+	AvgMs  float64   `json:"avg_ms"`
+	MaxMs  float64   `json:"max_ms"`
+	P50Ms  float64   `json:"p50_ms"`
+	P99Ms  float64   `json:"p99_ms"`
+
+	BytesPerSec float64 `json:"bytes_per_sec"`
+}
+
+var csvHeader = []string{"time", "kind", "sent", "bytes", "recv", "errors", "avg_ms", "max_ms", "p50_ms", "p99_ms", "bytes_per_sec"}
+
+// statsWriter appends records to a file, as CSV when the name ends in .csv
+// and as JSON lines otherwise.
+type statsWriter struct {
+	f   *os.File
+	csv *csv.Writer
+	enc *json.Encoder
+}
+
+func openStatsWriter(path string) (*statsWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &statsWriter{f: f}
+	if !strings.EqualFold(filepath.Ext(path), ".csv") {
+		w.enc = json.NewEncoder(f)
+		return w, nil
+	}
+
+	w.csv = csv.NewWriter(f)
+	// Only a new file gets a header, so repeated runs append cleanly
+	if info, err := f.Stat(); err == nil && info.Size() == 0 {
+		w.csv.Write(csvHeader)
+	}
+	return w, nil
+}
+
+func (w *statsWriter) Write(r statsRecord) error {
+	if w.enc != nil {
+		return w.enc.Encode(r)
+	}
+	ms := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	w.csv.Write([]string{
+		r.Time.UTC().Format(time.RFC3339),
+		r.Kind,
+		strconv.FormatUint(r.Sent, 10),
+		strconv.FormatUint(r.Bytes, 10),
+		strconv.FormatUint(r.Recv, 10),
+		strconv.FormatUint(r.Errors, 10),
+		ms(r.AvgMs), ms(r.MaxMs), ms(r.P50Ms), ms(r.P99Ms),
+		strconv.FormatFloat(r.BytesPerSec, 'f', 0, 64),
+	})
+	// Flush every record so an interrupted run still leaves usable data
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+func (w *statsWriter) Close() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			w.f.Close()
+			return fmt.Errorf("write csv: %w", err)
+		}
+	}
+	return w.f.Close()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// pingContent is the fixed message sent when -msg-size is 0.
+const pingContent = "cGluZw==" // "ping"
+
+// benchKeyName is sent as hot_sauce on -encrypt messages. Nobody holds the
+// key, which is generated per run; the server only stores and relays the
+// ciphertext.
+const benchKeyName = "bench"
+
+// payloadMaker builds message content the way the client does: base64 text,
+// optionally AES-GCM encrypted with the IV and key name alongside.
+type payloadMaker struct {
+	size int
+	aead cipher.AEAD // nil sends plain base64
+}
+
+func newPayloadMaker(size int, encrypt bool) (*payloadMaker, error) {
+	p := &payloadMaker{size: size}
+	if !encrypt {
+		return p, nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if p.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Make returns the content, IV and key name for one message. IV and key
+// name are empty unless encrypting.
+func (p *payloadMaker) Make() (content, iv, keyName string, err error) {
+	if p.size <= 0 && p.aead == nil {
+		return pingContent, "", "", nil
+	}
+
+	text := []byte("ping")
+	if p.size > 0 {
+		// Printable random text of exactly size bytes, like a typed message
+		raw := make([]byte, base64.StdEncoding.DecodedLen(p.size)+3)
+		if _, err := rand.Read(raw); err != nil {
+			return "", "", "", err
+		}
+		text = []byte(base64.StdEncoding.EncodeToString(raw)[:p.size])
+	}
+
+	if p.aead == nil {
+		return base64.StdEncoding.EncodeToString(text), "", "", nil
+	}
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", "", err
+	}
+	sealed := p.aead.Seal(nil, nonce, text, nil)
+	return base64.StdEncoding.EncodeToString(sealed), base64.StdEncoding.EncodeToString(nonce), benchKeyName, nil
+}
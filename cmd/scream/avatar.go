@@ -0,0 +1,70 @@
+package main
+
+import (
+	"hash/fnv"
+	"image/color"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/theme"
+)
+
+// senderPalette holds the colors senders are drawn in. They share the VFD
+// cyan's brightness so every name stays readable on the dark background
+// without any one of them shouting.
+var senderPalette = []color.RGBA{
+	{0, 240, 255, 255},   // VFD cyan
+	{0, 255, 170, 255},   // Teal
+	{90, 180, 255, 255},  // Sky
+	{160, 150, 255, 255}, // Lavender
+	{255, 120, 220, 255}, // Magenta
+	{255, 176, 0, 255},   // Amber
+	{26, 255, 128, 255},  // Phosphor green
+	{255, 130, 110, 255}, // Coral
+}
+
+// avatarSize is the side of the initial swatch in message headers.
+const avatarSize = 14
+
+// senderColor derives a stable color for a sender from their user ID, or
+// their email for messages without one.
+func senderColor(userID, email string) color.Color {
+	key := userID
+	if key == "" {
+		key = email
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return senderPalette[h.Sum32()%uint32(len(senderPalette))]
+}
+
+// senderInitial is the uppercased first letter or digit of name.
+func senderInitial(name string) string {
+	for _, r := range name {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return string(unicode.ToUpper(r))
+		}
+	}
+	if r, _ := utf8.DecodeRuneInString(name); r != utf8.RuneError {
+		return string(r)
+	}
+	return "?"
+}
+
+// newAvatar draws a small swatch in col with the sender's initial on it.
+func newAvatar(name string, col color.Color) (fyne.CanvasObject, *canvas.Text) {
+	swatch := canvas.NewRectangle(col)
+	swatch.CornerRadius = 3
+	swatch.SetMinSize(fyne.NewSize(avatarSize, avatarSize))
+
+	initial := canvas.NewText(senderInitial(strings.TrimSpace(name)), theme.Color(theme.ColorNameBackground))
+	initial.TextSize = 9
+	initial.TextStyle = fyne.TextStyle{Bold: true}
+	initial.Alignment = fyne.TextAlignCenter
+
+	return container.NewStack(swatch, container.NewCenter(initial)), initial
+}
@@ -2,7 +2,11 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -10,10 +14,13 @@ import (
 	"time"
 
 	"fyne.io/fyne/v2"
+	"github.com/rexlx/squall/internal"
 	pb "github.com/rexlx/squall/proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -37,10 +44,50 @@ type APIClient struct {
 	Cancels map[string]context.CancelFunc
 	mu      sync.RWMutex
 
-	Token   string
+	// Multiplex carries every room over one shared stream instead of one
+	// stream per room. Rooms are added and removed with control commands.
+	Multiplex bool
+	muxStream pb.ChatService_StreamClient
+	muxCancel context.CancelFunc
+
+	// Access and refresh tokens, guarded by authMu since a refresh can happen
+	// on any goroutine that makes a call
+	Token        string
+	RefreshToken string
+	authMu       sync.RWMutex
+
 	User    *pb.User
 	MsgChan chan *pb.ChatMessage
 
+	// Notification preferences by RoomID as of login; rooms at NOTIFY_ALL
+	// are left out
+	NotificationPrefs map[string]pb.NotificationPref
+
+	// Map of RoomID -> GetHistory cursor for the next older page (0 = none left)
+	HistoryCursors map[string]int64
+
+	// Map of RoomID -> when we last sent a typing signal (guarded by mu)
+	lastTyping map[string]time.Time
+
+	// Map of RoomID -> name of the key every message in that room is
+	// encrypted with (guarded by mu). Unbound rooms use a random key.
+	roomKeys map[string]string
+
+	// Map of RoomID -> messages waiting for the stream to come back (guarded
+	// by mu). flushMu keeps two flushes from sending the same message.
+	outbox     map[string][]pendingMessage
+	nextLocal  int64
+	flushMu    sync.Mutex
+	OnQueued   func(roomName string, localID int64, text string) // Message held in the outbox
+	OnUnqueued func(roomName string, localID int64)              // Held message sent or discarded
+
+	// Map of UserID -> fetched profile and when it goes stale, plus the
+	// fetches in flight (guarded by profileMu)
+	profiles     map[string]cachedProfile
+	profileFetch map[string]bool
+	profileMu    sync.Mutex
+	OnProfile    func(p *pb.ProfileResponse) // A profile arrived or changed
+
 	// Security: Tracks files we have offered for P2P transfer
 	ActiveOffers sync.Map // Map[string]PendingFile (Key: FileHash)
 
@@ -50,6 +97,10 @@ type APIClient struct {
 	OnHistoryUpdate func()   // Callback when history changes
 	OnRoomsUpdate   func()   // Callback when saved rooms change
 
+	// Called from any goroutine when a room's stream drops and is being
+	// re-dialed (true), and again once it is back or given up (false)
+	OnReconnecting func(roomName string, reconnecting bool)
+
 	// Saved rooms tracking (separate from User.Rooms which may contain visited rooms from server)
 	SavedRoomsMu sync.RWMutex
 	SavedRooms   []string
@@ -59,31 +110,80 @@ var Client = &APIClient{
 	MsgChan: make(chan *pb.ChatMessage, 100),
 	Streams: make(map[string]pb.ChatService_StreamClient),
 	Cancels: make(map[string]context.CancelFunc),
+
+	HistoryCursors: make(map[string]int64),
+	lastTyping:     make(map[string]time.Time),
+	roomKeys:       make(map[string]string),
+	outbox:         make(map[string][]pendingMessage),
 }
 
-func LoadTLSConfig() (*tls.Config, error) {
-	// Use the bundled resources generated by 'fyne bundle'
-	// resourceClientCertPem and resourceClientKeyPem are defined in bundle.go
-	cert, err := tls.X509KeyPair(resourceClientCertPem.Content(), resourceClientKeyPem.Content())
-	if err != nil {
-		return nil, err
-	}
+// maxOutbox caps how many unsent messages are held per room.
+const maxOutbox = 50
+
+// ErrOutboxFull is returned by SendMessage when a room's stream is down and
+// its outbox already holds maxOutbox messages.
+var ErrOutboxFull = errors.New("too many unsent messages; wait for the connection to return")
+
+// pendingMessage is an encrypted message held until its room reconnects.
+type pendingMessage struct {
+	localID int64
+	msg     *pb.ChatMessage
+}
+
+// typingInterval throttles outgoing typing signals per room.
+const typingInterval = time.Second
+
+// DefaultHost is the server scream connects to when none is configured.
+const DefaultHost = "localhost:8080"
+
+// ClientConfig says where the server is, how to verify it and which client
+// certificate to present. Empty CertFile and KeyFile use the certificate
+// bundled into the binary; NoClientCert presents none at all. Insecure skips
+// server verification and is meant for development only.
+type ClientConfig struct {
+	Host         string
+	CAFile       string
+	CertFile     string
+	KeyFile      string
+	NoClientCert bool
+	Insecure     bool
+}
 
-	cfh := &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		InsecureSkipVerify: true,
+func LoadTLSConfig(cfg ClientConfig) (*tls.Config, error) {
+	opts := internal.ClientTLS{
+		CAFile:             cfg.CAFile,
+		CertFile:           cfg.CertFile,
+		KeyFile:            cfg.KeyFile,
+		InsecureSkipVerify: cfg.Insecure,
 	}
-	return cfh, nil
+	if cfg.NoClientCert {
+		opts.CertFile, opts.KeyFile = "", ""
+	} else if cfg.CertFile == "" && cfg.KeyFile == "" {
+		// Use the bundled resources generated by 'fyne bundle'
+		// resourceClientCertPem and resourceClientKeyPem are defined in bundle.go
+		cert, err := tls.X509KeyPair(resourceClientCertPem.Content(), resourceClientKeyPem.Content())
+		if err != nil {
+			return nil, err
+		}
+		opts.Certificate = &cert
+	}
+	return internal.ClientTLSConfig(opts)
 }
 
-func InitClient() error {
-	tlsConfig, err := LoadTLSConfig()
+func InitClient(cfg ClientConfig) error {
+	tlsConfig, err := LoadTLSConfig(cfg)
 	if err != nil {
 		return err
 	}
+	if cfg.Host == "" {
+		cfg.Host = DefaultHost
+	}
 
 	creds := credentials.NewTLS(tlsConfig)
-	conn, err := grpc.Dial("localhost:8080", grpc.WithTransportCredentials(creds))
+	conn, err := grpc.Dial(cfg.Host,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithUnaryInterceptor(Client.refreshInterceptor),
+	)
 	if err != nil {
 		return err
 	}
@@ -110,7 +210,11 @@ func (c *APIClient) Login(email, password string) error {
 	}
 
 	c.User = resp.User
+	c.NotificationPrefs = resp.NotificationPrefs
+	c.authMu.Lock()
 	c.Token = resp.Token
+	c.RefreshToken = resp.RefreshToken
+	c.authMu.Unlock()
 
 	// Initialize SavedRooms from User.Rooms
 	c.SavedRoomsMu.Lock()
@@ -121,11 +225,90 @@ func (c *APIClient) Login(email, password string) error {
 }
 
 func (c *APIClient) getAuthContext(ctx context.Context) context.Context {
+	c.authMu.RLock()
 	md := metadata.Pairs("authorization", c.Token)
+	c.authMu.RUnlock()
 	return metadata.NewOutgoingContext(ctx, md)
 }
 
-func (c *APIClient) JoinRoom(roomName string) error {
+// refreshInterceptor retries a call once with a fresh access token when the
+// server rejects the current one as expired or invalid.
+func (c *APIClient) refreshInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if status.Code(err) != codes.Unauthenticated {
+		return err
+	}
+	switch method {
+	case pb.ChatService_Login_FullMethodName, pb.ChatService_RefreshToken_FullMethodName, pb.ChatService_Logout_FullMethodName:
+		return err
+	}
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if !ok || len(md.Get("authorization")) == 0 {
+		return err
+	}
+
+	token, rerr := c.refreshAccessToken(md.Get("authorization")[0])
+	if rerr != nil {
+		return err
+	}
+
+	md = md.Copy()
+	md.Set("authorization", token)
+	return invoker(metadata.NewOutgoingContext(ctx, md), method, req, reply, cc, opts...)
+}
+
+// refreshAccessToken exchanges the refresh token for a new access token. If
+// another goroutine already replaced the stale token, that one is reused.
+func (c *APIClient) refreshAccessToken(stale string) (string, error) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	if c.Token != stale {
+		return c.Token, nil
+	}
+	if c.RefreshToken == "" {
+		return "", fmt.Errorf("no refresh token")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	resp, err := c.GrpcClient.RefreshToken(ctx, &pb.RefreshTokenRequest{RefreshToken: c.RefreshToken})
+	if err != nil {
+		return "", err
+	}
+	c.Token = resp.Token
+	c.RefreshToken = resp.RefreshToken
+	return c.Token, nil
+}
+
+func (c *APIClient) hasToken() bool {
+	c.authMu.RLock()
+	defer c.authMu.RUnlock()
+	return c.Token != ""
+}
+
+// Logout revokes our refresh token on the server.
+func (c *APIClient) Logout() error {
+	c.authMu.Lock()
+	refresh := c.RefreshToken
+	c.Token, c.RefreshToken = "", ""
+	c.authMu.Unlock()
+
+	if refresh == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := c.GrpcClient.Logout(ctx, &pb.LogoutRequest{RefreshToken: refresh})
+	return err
+}
+
+// JoinRoom joins roomName, queues its recent history and starts streaming
+// it. It returns the room's topic.
+func (c *APIClient) JoinRoom(roomName string) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
 	ctx = c.getAuthContext(ctx)
@@ -135,9 +318,13 @@ func (c *APIClient) JoinRoom(roomName string) error {
 		RoomName: roomName,
 	})
 	if err != nil {
-		return err
+		return "", err
 	}
 
+	c.mu.Lock()
+	c.HistoryCursors[roomName] = resp.NextBeforeId
+	c.mu.Unlock()
+
 	if len(resp.History) > 0 {
 		for _, msg := range resp.History {
 			c.MsgChan <- msg
@@ -146,7 +333,71 @@ func (c *APIClient) JoinRoom(roomName string) error {
 
 	// Update local history when joining a room
 	c.AddToLocalHistory(roomName)
-	return c.StartStream(roomName)
+	return resp.Topic, c.StartStream(roomName)
+}
+
+// OpenDirectMessage sets up the private room shared with the user who has
+// email and returns its room ID, which can then be joined like any room.
+func (c *APIClient) OpenDirectMessage(email string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	ctx = c.getAuthContext(ctx)
+
+	resp, err := c.GrpcClient.OpenDirectMessage(ctx, &pb.OpenDirectMessageRequest{Email: email})
+	if err != nil {
+		return "", err
+	}
+	return resp.RoomId, nil
+}
+
+// RoomPresence returns the users currently streaming in roomName.
+func (c *APIClient) RoomPresence(roomName string) ([]*pb.PresentUser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	ctx = c.getAuthContext(ctx)
+
+	resp, err := c.GrpcClient.RoomPresence(ctx, &pb.RoomRequest{Name: roomName})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Users, nil
+}
+
+// HasOlderHistory reports whether GetHistory can fetch anything further back.
+func (c *APIClient) HasOlderHistory(roomName string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.HistoryCursors[roomName] != 0
+}
+
+// GetHistory fetches the page of messages preceding what has been loaded so
+// far for roomName, oldest first, and advances the room's cursor.
+func (c *APIClient) GetHistory(roomName string) ([]*pb.ChatMessage, error) {
+	c.mu.RLock()
+	cursor := c.HistoryCursors[roomName]
+	c.mu.RUnlock()
+
+	if cursor == 0 {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	ctx = c.getAuthContext(ctx)
+
+	resp, err := c.GrpcClient.GetHistory(ctx, &pb.HistoryRequest{
+		RoomId:   roomName,
+		BeforeId: cursor,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.HistoryCursors[roomName] = resp.NextBeforeId
+	c.mu.Unlock()
+
+	return resp.Messages, nil
 }
 
 func (c *APIClient) AddRoomToCache(roomName string) {
@@ -188,8 +439,8 @@ func (c *APIClient) RemoveRoomFromCache(roomName string) {
 		if r == roomName {
 			c.SavedRooms = append(c.SavedRooms[:i], c.SavedRooms[i+1:]...)
 
-			// Persist to server
-			go c.persistSavedRooms()
+			// Tell the server to forget the room and drop our streams there
+			go c.forgetRoom(roomName)
 
 			// Notify UI of rooms update
 			if c.OnRoomsUpdate != nil {
@@ -200,6 +451,46 @@ func (c *APIClient) RemoveRoomFromCache(roomName string) {
 	}
 }
 
+func (c *APIClient) forgetRoom(roomName string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	ctx = c.getAuthContext(ctx)
+
+	if _, err := c.GrpcClient.LeaveRoom(ctx, &pb.RoomRequest{Name: roomName}); err != nil {
+		fmt.Printf("Error leaving room %s: %v\n", roomName, err)
+	}
+}
+
+// SetRoomKey binds roomName to the named key; an empty keyName goes back to
+// picking a random key per message.
+func (c *APIClient) SetRoomKey(roomName, keyName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if keyName == "" {
+		delete(c.roomKeys, roomName)
+		return
+	}
+	c.roomKeys[roomName] = keyName
+}
+
+// RoomKey returns the key name bound to roomName, or "" if there is none.
+func (c *APIClient) RoomKey(roomName string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.roomKeys[roomName]
+}
+
+// RoomKeys returns a copy of every room's key binding.
+func (c *APIClient) RoomKeys() map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	keys := make(map[string]string, len(c.roomKeys))
+	for room, name := range c.roomKeys {
+		keys[room] = name
+	}
+	return keys
+}
+
 func (c *APIClient) GetSavedRooms() []string {
 	c.SavedRoomsMu.RLock()
 	defer c.SavedRoomsMu.RUnlock()
@@ -232,6 +523,115 @@ func (c *APIClient) persistSavedRooms() {
 	}
 }
 
+// Profile limits, matching the server's checks in UpdateUser.
+const (
+	maxNameLength  = 64
+	maxAboutLength = 500
+)
+
+// UpdateProfile changes the display name and about text of the logged in
+// user and mirrors the change into c.User once the server accepts it.
+func (c *APIClient) UpdateProfile(name, about string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	ctx = c.getAuthContext(ctx)
+
+	resp, err := c.GrpcClient.UpdateUser(ctx, &pb.UpdateUserRequest{
+		User: &pb.User{
+			Email:     c.User.Email,
+			FirstName: name,
+			About:     about,
+		},
+		UpdateProfile: true,
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("profile update failed: %s", resp.Message)
+	}
+
+	c.User.FirstName = name
+	c.User.About = about
+	return nil
+}
+
+// cachedProfile is a GetProfile answer kept until expires.
+type cachedProfile struct {
+	profile *pb.ProfileResponse
+	expires time.Time
+}
+
+// GetProfile fetches another user's public profile, reusing a cached answer
+// for as long as the server's cache_seconds allows.
+func (c *APIClient) GetProfile(userID string) (*pb.ProfileResponse, error) {
+	c.profileMu.Lock()
+	if cp, ok := c.profiles[userID]; ok && time.Now().Before(cp.expires) {
+		c.profileMu.Unlock()
+		return cp.profile, nil
+	}
+	c.profileMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	ctx = c.getAuthContext(ctx)
+
+	resp, err := c.GrpcClient.GetProfile(ctx, &pb.ProfileRequest{UserId: userID})
+	if err != nil {
+		return nil, err
+	}
+
+	c.profileMu.Lock()
+	if c.profiles == nil {
+		c.profiles = make(map[string]cachedProfile)
+	}
+	c.profiles[userID] = cachedProfile{
+		profile: resp,
+		expires: time.Now().Add(time.Duration(resp.CacheSeconds) * time.Second),
+	}
+	c.profileMu.Unlock()
+	return resp, nil
+}
+
+// DisplayName is the name to show for a sender: their profile name when it
+// is known and set, otherwise email. It never blocks; an unknown or stale
+// profile is fetched in the background and OnProfile is called when it
+// arrives.
+func (c *APIClient) DisplayName(userID, email string) string {
+	if userID == "" || userID == "system" {
+		return email
+	}
+
+	c.profileMu.Lock()
+	cp, ok := c.profiles[userID]
+	stale := !ok || time.Now().After(cp.expires)
+	fetching := c.profileFetch[userID]
+	if stale && !fetching {
+		if c.profileFetch == nil {
+			c.profileFetch = make(map[string]bool)
+		}
+		c.profileFetch[userID] = true
+	}
+	c.profileMu.Unlock()
+
+	if stale && !fetching {
+		go func() {
+			p, err := c.GetProfile(userID)
+			c.profileMu.Lock()
+			delete(c.profileFetch, userID)
+			c.profileMu.Unlock()
+			if err == nil && c.OnProfile != nil {
+				c.OnProfile(p)
+			}
+		}()
+	}
+
+	if ok && cp.profile.Name != "" {
+		return cp.profile.Name
+	}
+	return email
+}
+
 func (c *APIClient) AddToLocalHistory(roomName string) {
 	c.HistoryMu.Lock()
 	defer c.HistoryMu.Unlock()
@@ -269,6 +669,15 @@ func (c *APIClient) LeaveRoom(roomName string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	delete(c.HistoryCursors, roomName)
+	delete(c.lastTyping, roomName)
+	delete(c.outbox, roomName)
+
+	if c.Multiplex {
+		c.leaveMuxRoom(roomName)
+		return
+	}
+
 	if cancel, ok := c.Cancels[roomName]; ok {
 		cancel()
 	}
@@ -284,15 +693,39 @@ func (c *APIClient) StartStream(roomName string) error {
 		return nil
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	ctx = c.getAuthContext(ctx)
+	if c.Multiplex {
+		return c.joinMuxRoom(roomName)
+	}
 
-	stream, err := c.GrpcClient.Stream(ctx)
+	// ctx spans reconnects; LeaveRoom cancels it to stop the room for good
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, stop, err := c.dialRoom(ctx, roomName)
 	if err != nil {
 		cancel()
 		return err
 	}
 
+	c.Streams[roomName] = stream
+	c.Cancels[roomName] = cancel
+
+	go c.receiveRoom(ctx, roomName, stream, stop)
+	go c.flushOutbox(roomName)
+
+	return nil
+}
+
+// dialRoom opens a stream for roomName and sends the handshake. stop ends
+// just this connection; canceling ctx ends it too.
+func (c *APIClient) dialRoom(ctx context.Context, roomName string) (pb.ChatService_StreamClient, context.CancelFunc, error) {
+	connCtx, stop := context.WithCancel(ctx)
+	raw, err := c.GrpcClient.Stream(c.getAuthContext(connCtx))
+	if err != nil {
+		stop()
+		return nil, nil, err
+	}
+	// Typing signals and chat messages may be sent from different goroutines
+	stream := lockedStream{ChatService_StreamClient: raw, mu: &sync.Mutex{}}
+
 	handshake := &pb.ChatMessage{
 		UserId: c.User.Id,
 		RoomId: roomName,
@@ -302,44 +735,321 @@ func (c *APIClient) StartStream(roomName string) error {
 		},
 	}
 	if err := stream.Send(handshake); err != nil {
+		stop()
+		return nil, nil, err
+	}
+	return stream, stop, nil
+}
+
+// receiveRoom pumps roomName's stream into MsgChan. When the stream ends it
+// is re-dialed with backoff until LeaveRoom cancels ctx. That includes a
+// clean EOF, which the server sends on shutdown as well as after a kick or
+// a room deletion; in those last two the new handshake is refused and the
+// room stops there.
+func (c *APIClient) receiveRoom(ctx context.Context, rName string, s pb.ChatService_StreamClient, stop context.CancelFunc) {
+	defer func() {
+		stop()
+		c.mu.Lock()
+		if c.Streams[rName] == s {
+			delete(c.Streams, rName)
+			delete(c.Cancels, rName)
+		}
+		c.mu.Unlock()
+	}()
+
+	for {
+		err := c.pump(s)
+		if ctx.Err() != nil || refused(err) {
+			return
+		}
+		fmt.Printf("Stream Error [%s]: %v\n", rName, err)
+		stop()
+
+		next, nextStop, ok := c.redial(ctx, []string{rName}, func(ctx context.Context) (pb.ChatService_StreamClient, context.CancelFunc, error) {
+			return c.dialRoom(ctx, rName)
+		})
+		if !ok {
+			return
+		}
+		c.mu.Lock()
+		if c.Streams[rName] != s {
+			// Left (and perhaps rejoined) while we were reconnecting
+			c.mu.Unlock()
+			nextStop()
+			return
+		}
+		c.Streams[rName] = next
+		c.mu.Unlock()
+		s, stop = next, nextStop
+		go c.flushOutbox(rName)
+	}
+}
+
+// pump delivers messages from s to MsgChan until Recv fails.
+func (c *APIClient) pump(s pb.ChatService_StreamClient) error {
+	for {
+		msg, err := s.Recv()
+		if err != nil {
+			return err
+		}
+		if msg.Command == "ping" {
+			continue // Server heartbeat
+		}
+		if msg.Command == "kicked" && msg.UserId == c.User.Id {
+			c.forgetKicked(s, msg.RoomId)
+		}
+		c.MsgChan <- msg
+	}
+}
+
+// forgetKicked stops a shared stream from resubscribing a room this user
+// was kicked from when it reconnects. A room's own stream needs nothing:
+// its reconnect is refused.
+func (c *APIClient) forgetKicked(s pb.ChatService_StreamClient, roomName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Multiplex && c.Streams[roomName] == s {
+		delete(c.Streams, roomName)
+	}
+}
+
+// refused reports whether the server turned a stream's handshake away, as it
+// does once the user is kicked or banned or the room is deleted. Retrying
+// won't help.
+func refused(err error) bool {
+	switch status.Code(err) {
+	case codes.PermissionDenied, codes.NotFound:
+		return true
+	}
+	return false
+}
+
+const (
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = 30 * time.Second
+)
+
+// redial retries dial with exponential backoff until it succeeds or ctx is
+// canceled, flagging rooms as reconnecting in the meantime.
+func (c *APIClient) redial(ctx context.Context, rooms []string, dial func(context.Context) (pb.ChatService_StreamClient, context.CancelFunc, error)) (pb.ChatService_StreamClient, context.CancelFunc, bool) {
+	c.setReconnecting(rooms, true)
+	defer c.setReconnecting(rooms, false)
+
+	delay := reconnectMinDelay
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, nil, false
+		case <-time.After(delay):
+		}
+		s, stop, err := dial(ctx)
+		if err == nil {
+			return s, stop, true
+		}
+		delay = min(delay*2, reconnectMaxDelay)
+		fmt.Printf("Reconnect failed, retrying in %s: %v\n", delay, err)
+	}
+}
+
+func (c *APIClient) setReconnecting(rooms []string, reconnecting bool) {
+	if c.OnReconnecting == nil {
+		return
+	}
+	for _, r := range rooms {
+		c.OnReconnecting(r, reconnecting)
+	}
+}
+
+// lockedStream serializes Send calls, since several goroutines (and, when
+// multiplexing, several rooms) write to the same stream concurrently.
+type lockedStream struct {
+	pb.ChatService_StreamClient
+	mu *sync.Mutex
+}
+
+func (l lockedStream) Send(msg *pb.ChatMessage) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ChatService_StreamClient.Send(msg)
+}
+
+// joinMuxRoom subscribes roomName on the shared stream, opening it first if
+// needed. The caller must hold c.mu.
+func (c *APIClient) joinMuxRoom(roomName string) error {
+	subscribe := &pb.ChatMessage{
+		UserId:  c.User.Id,
+		RoomId:  roomName,
+		Command: "subscribe",
+	}
+
+	if c.muxStream != nil {
+		if err := c.muxStream.Send(subscribe); err != nil {
+			return err
+		}
+		c.Streams[roomName] = c.muxStream
+		go c.flushOutbox(roomName)
+		return nil
+	}
+
+	// ctx spans reconnects; leaveMuxRoom cancels it once no rooms are left
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, stop, err := c.dialMux(ctx, []string{roomName})
+	if err != nil {
 		cancel()
 		return err
 	}
 
+	c.muxStream = stream
+	c.muxCancel = cancel
 	c.Streams[roomName] = stream
-	c.Cancels[roomName] = cancel
 
-	go func(rName string, s pb.ChatService_StreamClient) {
-		defer cancel()
-		for {
-			msg, err := s.Recv()
-			if err == io.EOF {
-				return
+	go c.receiveMux(ctx, cancel, stream, stop, roomName)
+	go c.flushOutbox(roomName)
+
+	return nil
+}
+
+// dialMux opens a shared stream and subscribes it to rooms.
+func (c *APIClient) dialMux(ctx context.Context, rooms []string) (pb.ChatService_StreamClient, context.CancelFunc, error) {
+	connCtx, stop := context.WithCancel(ctx)
+	raw, err := c.GrpcClient.Stream(c.getAuthContext(connCtx))
+	if err != nil {
+		stop()
+		return nil, nil, err
+	}
+	stream := lockedStream{ChatService_StreamClient: raw, mu: &sync.Mutex{}}
+
+	for _, roomName := range rooms {
+		subscribe := &pb.ChatMessage{
+			UserId:  c.User.Id,
+			RoomId:  roomName,
+			Command: "subscribe",
+		}
+		if err := stream.Send(subscribe); err != nil {
+			stop()
+			return nil, nil, err
+		}
+	}
+	return stream, stop, nil
+}
+
+// muxRooms lists the rooms carried by s. The caller must hold c.mu.
+func (c *APIClient) muxRooms(s pb.ChatService_StreamClient) []string {
+	var rooms []string
+	for room, rs := range c.Streams {
+		if rs == s {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms
+}
+
+// receiveMux is receiveRoom for the shared stream: when it ends it re-dials
+// and resubscribes every room the stream was carrying. handshake is the room
+// the stream was opened with; if the server refuses it, that room is dropped
+// and the rest carry on.
+func (c *APIClient) receiveMux(ctx context.Context, cancel context.CancelFunc, s pb.ChatService_StreamClient, stop context.CancelFunc, handshake string) {
+	defer func() {
+		stop()
+		c.mu.Lock()
+		if c.muxStream == s {
+			c.muxStream = nil
+			c.muxCancel = nil
+			for _, room := range c.muxRooms(s) {
+				delete(c.Streams, room)
 			}
-			if err != nil {
-				if ctx.Err() == context.Canceled {
-					return
-				}
-				fmt.Printf("Stream Error [%s]: %v\n", rName, err)
-				return
+		}
+		c.mu.Unlock()
+		cancel()
+	}()
+
+	for {
+		err := c.pump(s)
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Printf("Stream Error [multiplexed]: %v\n", err)
+		stop()
+
+		c.mu.Lock()
+		if refused(err) && c.Streams[handshake] == s {
+			delete(c.Streams, handshake)
+		}
+		rooms := c.muxRooms(s)
+		c.mu.Unlock()
+		if len(rooms) == 0 {
+			return // Kicked or refused from every room it carried
+		}
+		next, nextStop, ok := c.redial(ctx, rooms, func(ctx context.Context) (pb.ChatService_StreamClient, context.CancelFunc, error) {
+			c.mu.RLock()
+			current := c.muxRooms(s)
+			c.mu.RUnlock()
+			if len(current) > 0 {
+				handshake = current[0]
 			}
-			c.MsgChan <- msg
+			return c.dialMux(ctx, current)
+		})
+		if !ok {
+			return
+		}
+		c.mu.Lock()
+		if c.muxStream != s {
+			c.mu.Unlock()
+			nextStop()
+			return
 		}
-	}(roomName, stream)
+		c.muxStream = next
+		rooms = c.muxRooms(s)
+		for _, room := range rooms {
+			c.Streams[room] = next
+		}
+		c.mu.Unlock()
+		s, stop = next, nextStop
+		for _, room := range rooms {
+			go c.flushOutbox(room)
+		}
+	}
+}
 
-	return nil
+// leaveMuxRoom unsubscribes roomName and closes the shared stream once no
+// rooms are left on it. The caller must hold c.mu.
+func (c *APIClient) leaveMuxRoom(roomName string) {
+	if _, ok := c.Streams[roomName]; !ok {
+		return
+	}
+	delete(c.Streams, roomName)
+
+	if c.muxStream == nil {
+		return
+	}
+	if len(c.Streams) == 0 {
+		c.muxCancel()
+		c.muxStream = nil
+		c.muxCancel = nil
+		return
+	}
+	_ = c.muxStream.Send(&pb.ChatMessage{
+		UserId:  c.User.Id,
+		RoomId:  roomName,
+		Command: "unsubscribe",
+	})
 }
 
+// SendMessage encrypts text and sends it to roomName. If the room's stream
+// is down, or earlier messages are still waiting, the message is queued and
+// sent in order once the room reconnects.
 func (c *APIClient) SendMessage(roomName, text string) error {
-	c.mu.RLock()
-	stream, ok := c.Streams[roomName]
-	c.mu.RUnlock()
+	return c.sendText(roomName, text, nil)
+}
 
-	if !ok {
-		return fmt.Errorf("not connected to room %s", roomName)
-	}
+// SendAttachment posts an uploaded attachment to the room, with an
+// optional caption.
+func (c *APIClient) SendAttachment(roomName string, a *pb.Attachment, caption string) error {
+	return c.sendText(roomName, caption, &pb.Attachment{Id: a.Id})
+}
 
-	enc, err := EncryptMessage(text)
+func (c *APIClient) sendText(roomName, text string, attachment *pb.Attachment) error {
+	enc, err := EncryptMessage(text, c.RoomKey(roomName))
 	if err != nil {
 		return err
 	}
@@ -353,11 +1063,173 @@ func (c *APIClient) SendMessage(roomName, text string) error {
 		Payload: &pb.ChatMessage_MessageContent{
 			MessageContent: enc.Data,
 		},
-		Iv:       enc.IV,
-		HotSauce: enc.KeyName,
+		Iv:         enc.IV,
+		HotSauce:   enc.KeyName,
+		Attachment: attachment,
+		// Kept through the outbox, so a resend the server already got is
+		// dropped rather than posted twice
+		IdempotencyKey: newIdempotencyKey(),
 	}
 
-	return stream.Send(msg)
+	c.mu.RLock()
+	stream, ok := c.Streams[roomName]
+	backlog := len(c.outbox[roomName]) > 0
+	c.mu.RUnlock()
+
+	if ok && !backlog {
+		if err := stream.Send(msg); err == nil {
+			return nil
+		}
+	}
+	return c.enqueue(roomName, text, msg)
+}
+
+// newIdempotencyKey returns a random (version 4) UUID.
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// enqueue holds msg in roomName's outbox and shows it as pending.
+func (c *APIClient) enqueue(roomName, text string, msg *pb.ChatMessage) error {
+	c.mu.Lock()
+	if len(c.outbox[roomName]) >= maxOutbox {
+		c.mu.Unlock()
+		return ErrOutboxFull
+	}
+	c.nextLocal++
+	id := c.nextLocal
+	c.outbox[roomName] = append(c.outbox[roomName], pendingMessage{localID: id, msg: msg})
+	c.mu.Unlock()
+
+	if c.OnQueued != nil {
+		c.OnQueued(roomName, id, text)
+	}
+	return nil
+}
+
+// flushOutbox sends roomName's held messages in order, stopping at the
+// first failure so the rest wait for the next reconnect.
+func (c *APIClient) flushOutbox(roomName string) {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	for {
+		c.mu.RLock()
+		queue := c.outbox[roomName]
+		stream, ok := c.Streams[roomName]
+		c.mu.RUnlock()
+		if len(queue) == 0 || !ok {
+			return
+		}
+
+		head := queue[0]
+		if err := stream.Send(head.msg); err != nil {
+			return
+		}
+
+		c.mu.Lock()
+		if q := c.outbox[roomName]; len(q) > 0 && q[0].localID == head.localID {
+			c.outbox[roomName] = q[1:]
+		}
+		if len(c.outbox[roomName]) == 0 {
+			delete(c.outbox, roomName)
+		}
+		c.mu.Unlock()
+
+		if c.OnUnqueued != nil {
+			c.OnUnqueued(roomName, head.localID)
+		}
+	}
+}
+
+// SendTyping tells the room we are typing, at most once per typingInterval.
+func (c *APIClient) SendTyping(roomName string) error {
+	c.mu.Lock()
+	stream, ok := c.Streams[roomName]
+	if !ok || time.Since(c.lastTyping[roomName]) < typingInterval {
+		c.mu.Unlock()
+		return nil
+	}
+	c.lastTyping[roomName] = time.Now()
+	c.mu.Unlock()
+
+	return stream.Send(&pb.ChatMessage{
+		UserId:  c.User.Id,
+		RoomId:  roomName,
+		Command: "typing",
+	})
+}
+
+// EditMessage re-encrypts text with roomName's key and replaces the content
+// of one of our own stored messages.
+func (c *APIClient) EditMessage(roomName string, messageID int64, text string) error {
+	enc, err := EncryptMessage(text, c.RoomKey(roomName))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	ctx = c.getAuthContext(ctx)
+
+	_, err = c.GrpcClient.EditMessage(ctx, &pb.EditMessageRequest{
+		MessageId:      messageID,
+		MessageContent: enc.Data,
+		Iv:             enc.IV,
+		HotSauce:       enc.KeyName,
+	})
+	return err
+}
+
+// DeleteMessage removes a stored message. The server only allows this for
+// our own messages, or any message if we are an admin.
+func (c *APIClient) DeleteMessage(messageID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	ctx = c.getAuthContext(ctx)
+
+	_, err := c.GrpcClient.DeleteMessage(ctx, &pb.DeleteMessageRequest{MessageId: messageID})
+	return err
+}
+
+// MarkRead marks everything currently stored in roomName as read.
+func (c *APIClient) MarkRead(roomName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	ctx = c.getAuthContext(ctx)
+
+	_, err := c.GrpcClient.MarkRead(ctx, &pb.MarkReadRequest{RoomId: roomName})
+	return err
+}
+
+// UnreadCounts returns the number of unread messages in each of rooms.
+func (c *APIClient) UnreadCounts(rooms []string) (map[string]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	ctx = c.getAuthContext(ctx)
+
+	resp, err := c.GrpcClient.UnreadCounts(ctx, &pb.UnreadCountsRequest{RoomIds: rooms})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Counts, nil
+}
+
+// SetRoomNotificationPref saves how the user wants to be notified about a
+// room, for every device they sign in on.
+func (c *APIClient) SetRoomNotificationPref(roomName string, pref pb.NotificationPref) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	ctx = c.getAuthContext(ctx)
+
+	_, err := c.GrpcClient.SetRoomNotificationPref(ctx, &pb.SetRoomNotificationPrefRequest{RoomId: roomName, Pref: pref})
+	return err
 }
 
 func (c *APIClient) UpdatePassword(email, oldPass, newPass string) error {
@@ -365,7 +1237,7 @@ func (c *APIClient) UpdatePassword(email, oldPass, newPass string) error {
 	defer cancel()
 
 	// If the client is already logged in, attach the authorization token
-	if c.Token != "" {
+	if c.hasToken() {
 		ctx = c.getAuthContext(ctx)
 	}
 
@@ -440,6 +1312,78 @@ func (c *APIClient) SendFileChunks(roomID string, data []byte) error {
 	return nil
 }
 
+// attachmentChunkSize is how much of a file goes in each upload message.
+const attachmentChunkSize = 256 << 10
+
+// UploadAttachment encrypts data with the room's key, as messages are, and
+// stores it on the server. Send the result with SendAttachment.
+func (c *APIClient) UploadAttachment(roomName, fileName string, data []byte) (*pb.Attachment, error) {
+	sealed, enc, err := EncryptBytes(data, c.RoomKey(roomName))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(c.getAuthContext(context.Background()), 2*time.Minute)
+	defer cancel()
+	up, err := c.GrpcClient.UploadAttachment(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// The server can't see inside encrypted files, so it doesn't sniff them
+	first := &pb.AttachmentUpload{
+		RoomId:      roomName,
+		FileName:    fileName,
+		ContentType: "application/octet-stream",
+		Iv:          enc.IV,
+		HotSauce:    enc.KeyName,
+	}
+	for i := 0; i == 0 || i < len(sealed); i += attachmentChunkSize {
+		msg := &pb.AttachmentUpload{}
+		if i == 0 {
+			msg = first
+		}
+		msg.Data = sealed[i:min(i+attachmentChunkSize, len(sealed))]
+		if err := up.Send(msg); err != nil {
+			break // CloseAndRecv reports why
+		}
+	}
+	return up.CloseAndRecv()
+}
+
+// DownloadAttachment fetches an attachment, checks it against the hash the
+// server recorded at upload, and decrypts it.
+func (c *APIClient) DownloadAttachment(a *pb.Attachment) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(c.getAuthContext(context.Background()), 2*time.Minute)
+	defer cancel()
+	down, err := c.GrpcClient.DownloadAttachment(ctx, &pb.AttachmentRequest{Id: a.Id})
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	for {
+		chunk, err := down.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if chunk.Attachment != nil {
+			a = chunk.Attachment
+		}
+		data = append(data, chunk.Data...)
+	}
+
+	if sum := sha256.Sum256(data); a.Sha256 != "" && hex.EncodeToString(sum[:]) != a.Sha256 {
+		return nil, fmt.Errorf("attachment %s is corrupt", a.FileName)
+	}
+	if a.HotSauce == "" {
+		return data, nil
+	}
+	return DecryptBytes(data, a.HotSauce, a.Iv)
+}
+
 func (c *APIClient) StartOfferReaper(timeout time.Duration) {
 	go func() {
 		ticker := time.NewTicker(1 * time.Minute)
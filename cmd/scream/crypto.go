@@ -12,146 +12,330 @@ import (
 	"math/big"
 	"os"
 	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cipher algorithms a key can be tagged with. An empty tag means AlgAESGCM.
+const (
+	AlgAESGCM           = "aes-gcm"
+	AlgChaCha20Poly1305 = "chacha20-poly1305"
 )
 
+// Algorithms lists the supported cipher algorithms, default first.
+var Algorithms = []string{AlgAESGCM, AlgChaCha20Poly1305}
+
+// EncKey is a named 256-bit key and the cipher it is used with. A zero
+// Expires means the key never expires.
+type EncKey struct {
+	Name      string
+	Key       string
+	Algorithm string
+	Expires   time.Time
+}
+
+// Expired reports whether the key's lifetime has ended at now.
+func (k EncKey) Expired(now time.Time) bool {
+	return !k.Expires.IsZero() && now.After(k.Expires)
+}
+
 // Hardcoded keys from application.js
-var EncKeys = []struct {
-	Name string
-	Key  string
-}{
-	{"malfunctioning-unapproachability", "Em9k8X2SsEDHbC6mF9jwBug8BGfLYC2TR97hzKzCaAY="},
-	{"tegular-peripatopsidae", "eOSPDQfRMp+RwOKE4v7TQc5yGgeg2ABQ23pjWg8kWAg="},
-	{"elective-experience", "Wh7toVpICwu53zFH7+1PagoveuCK6uquyVfr8TSIwQw="},
-	{"heraldic-epacris", "QnyTODU7KLY9taRt7V2sNyRflu97U3LYmnx4uhCsLDM="},
+var EncKeys = []EncKey{
+	{Name: "malfunctioning-unapproachability", Key: "Em9k8X2SsEDHbC6mF9jwBug8BGfLYC2TR97hzKzCaAY="},
+	{Name: "tegular-peripatopsidae", Key: "eOSPDQfRMp+RwOKE4v7TQc5yGgeg2ABQ23pjWg8kWAg="},
+	{Name: "elective-experience", Key: "Wh7toVpICwu53zFH7+1PagoveuCK6uquyVfr8TSIwQw="},
+	{Name: "heraldic-epacris", Key: "QnyTODU7KLY9taRt7V2sNyRflu97U3LYmnx4uhCsLDM="},
 }
 
-// KeyPair matches the JSON structure from the nomenclator tool.
+// ErrKeyExpired is returned when encrypting with a key past its expiry.
+var ErrKeyExpired = errors.New("key has expired")
+
+// KeyPair matches the JSON structure from the nomenclator tool, plus an
+// optional algorithm and expiry.
 type KeyPair struct {
-	Name string `json:"name"`
-	Key  string `json:"key"`
+	Name      string     `json:"name"`
+	Key       string     `json:"key"`
+	Algorithm string     `json:"alg,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+}
+
+// validateKeyPair checks that a key library entry can actually be used to
+// encrypt, so a bad entry fails at load time rather than on first send.
+func validateKeyPair(kp KeyPair) error {
+	if kp.Name == "" {
+		return errors.New("missing name")
+	}
+	raw, err := base64.StdEncoding.DecodeString(kp.Key)
+	if err != nil {
+		return errors.New("key is not valid base64")
+	}
+	if len(raw) != keySize {
+		return fmt.Errorf("key is %d bytes, want %d", len(raw), keySize)
+	}
+	switch kp.Algorithm {
+	case "", AlgAESGCM, AlgChaCha20Poly1305:
+	default:
+		return fmt.Errorf("unsupported algorithm %q", kp.Algorithm)
+	}
+	return nil
 }
 
-// LoadKeys reads a JSON file and appends the keys to the EncKeys list.
-func LoadKeys(reader io.Reader) error {
+// LoadKeys reads a JSON file and appends the valid keys to the EncKeys list.
+// Invalid entries are skipped and reported together in err, which names
+// each one; accepted keys are loaded either way.
+func LoadKeys(reader io.Reader) (accepted, rejected int, err error) {
 	var loadedKeys []KeyPair
 	// The file contains a JSON array of pairs
 	if err := json.NewDecoder(reader).Decode(&loadedKeys); err != nil {
-		return err
+		return 0, 0, err
 	}
 
-	count := 0
-	for _, lk := range loadedKeys {
-		if lk.Name != "" && lk.Key != "" {
-			EncKeys = append(EncKeys, struct {
-				Name string
-				Key  string
-			}{Name: lk.Name, Key: lk.Key})
-			count++
+	var errs []error
+	for i, lk := range loadedKeys {
+		if verr := validateKeyPair(lk); verr != nil {
+			name := lk.Name
+			if name == "" {
+				name = fmt.Sprintf("entry %d", i)
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", name, verr))
+			rejected++
+			continue
 		}
+		k := EncKey{Name: lk.Name, Key: lk.Key, Algorithm: lk.Algorithm}
+		if lk.Expires != nil {
+			k.Expires = *lk.Expires
+		}
+		EncKeys = append(EncKeys, k)
+		accepted++
 	}
-	fmt.Printf("Loaded %d additional keys\n", count)
-	return nil
+	fmt.Printf("Loaded %d additional keys, rejected %d\n", accepted, rejected)
+	return accepted, rejected, errors.Join(errs...)
 }
 
 // LoadKeysFromFile opens the file and calls LoadKeys
-func LoadKeysFromFile(path string) error {
+func LoadKeysFromFile(path string) (accepted, rejected int, err error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 	defer f.Close()
 	return LoadKeys(f)
 }
 
-func GetRandomKey() (string, []byte, error) {
-	if len(EncKeys) == 0 {
-		return "", nil, errors.New("no keys available")
+// keySize is the length of generated AES-256 keys in bytes.
+const keySize = 32
+
+// HasKey reports whether a key with the given name is already loaded.
+func HasKey(name string) bool {
+	for _, k := range EncKeys {
+		if k.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateKey creates a random 256-bit key for alg, appends it to EncKeys
+// under name and returns it. Names must be unique, since keys are looked up
+// by name.
+func GenerateKey(name, alg string) (KeyPair, error) {
+	if name == "" {
+		return KeyPair{}, errors.New("key name is required")
+	}
+	if HasKey(name) {
+		return KeyPair{}, fmt.Errorf("a key named %q already exists", name)
+	}
+	if alg == AlgAESGCM {
+		// Leave the default implicit so the file stays readable by older clients
+		alg = ""
+	} else if alg != AlgChaCha20Poly1305 {
+		return KeyPair{}, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	raw := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return KeyPair{}, err
+	}
+	kp := KeyPair{Name: name, Key: base64.StdEncoding.EncodeToString(raw), Algorithm: alg}
+	EncKeys = append(EncKeys, EncKey{Name: kp.Name, Key: kp.Key, Algorithm: kp.Algorithm})
+	return kp, nil
+}
+
+// SaveKeys writes every loaded key as a JSON array that LoadKeys can read.
+func SaveKeys(writer io.Writer) error {
+	pairs := make([]KeyPair, 0, len(EncKeys))
+	for _, k := range EncKeys {
+		kp := KeyPair{Name: k.Name, Key: k.Key, Algorithm: k.Algorithm}
+		if !k.Expires.IsZero() {
+			expires := k.Expires
+			kp.Expires = &expires
+		}
+		pairs = append(pairs, kp)
+	}
+	enc := json.NewEncoder(writer)
+	enc.SetIndent("", "  ")
+	return enc.Encode(pairs)
+}
+
+// activeKeys returns the keys that have not expired at now.
+func activeKeys(now time.Time) []EncKey {
+	active := make([]EncKey, 0, len(EncKeys))
+	for _, k := range EncKeys {
+		if !k.Expired(now) {
+			active = append(active, k)
+		}
+	}
+	return active
+}
+
+// pickRandomKey picks one of the unexpired keys.
+func pickRandomKey() (EncKey, error) {
+	active := activeKeys(time.Now())
+	if len(active) == 0 {
+		return EncKey{}, errors.New("no keys available")
 	}
 
 	// Generate a cryptographically secure random index
-	max := big.NewInt(int64(len(EncKeys)))
+	max := big.NewInt(int64(len(active)))
 	n, err := rand.Int(rand.Reader, max)
 	if err != nil {
-		return "", nil, err
+		return EncKey{}, err
 	}
+	return active[n.Int64()], nil
+}
 
-	k := EncKeys[n.Int64()]
+// GetRandomKey picks one of the unexpired keys.
+func GetRandomKey() (string, []byte, error) {
+	k, err := pickRandomKey()
+	if err != nil {
+		return "", nil, err
+	}
 	keyBytes, err := base64.StdEncoding.DecodeString(k.Key)
 	return k.Name, keyBytes, err
 }
 
-func GetKeyByName(name string) ([]byte, error) {
+// findKey looks up a loaded key by name.
+func findKey(name string) (EncKey, error) {
 	for _, k := range EncKeys {
 		if k.Name == name {
-			return base64.StdEncoding.DecodeString(k.Key)
+			return k, nil
 		}
 	}
-	return nil, errors.New("key not found")
+	return EncKey{}, errors.New("key not found")
+}
+
+// GetKeyByName returns the named key whether or not it has expired, so old
+// messages stay readable. Use KeyExpired to flag them.
+func GetKeyByName(name string) ([]byte, error) {
+	k, err := findKey(name)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(k.Key)
+}
+
+// KeyExpired reports whether the named key is loaded and past its expiry.
+func KeyExpired(name string) bool {
+	k, err := findKey(name)
+	return err == nil && k.Expired(time.Now())
 }
 
-// Encrypt encrypts plainText using AES-GCM
-func EncryptMessage(plainText string) (EncryptedData, error) {
+// newAEAD builds the cipher named by the key's algorithm tag.
+func newAEAD(k EncKey) (cipher.AEAD, error) {
+	keyBytes, err := base64.StdEncoding.DecodeString(k.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	switch k.Algorithm {
+	case "", AlgAESGCM:
+		block, err := aes.NewCipher(keyBytes)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case AlgChaCha20Poly1305:
+		return chacha20poly1305.New(keyBytes)
+	default:
+		return nil, fmt.Errorf("key %s: unsupported algorithm %q", k.Name, k.Algorithm)
+	}
+}
+
+// Encrypt encrypts plainText with the named key, or a random key when
+// keyName is empty, using the cipher the key is tagged with
+func EncryptMessage(plainText, keyName string) (EncryptedData, error) {
 	start := time.Now()
-	keyName, keyBytes, err := GetRandomKey()
+	cipherText, enc, err := EncryptBytes([]byte(plainText), keyName)
 	if err != nil {
 		return EncryptedData{}, err
 	}
+	fmt.Println("Encryption took:", time.Since(start))
+	enc.Data = base64.StdEncoding.EncodeToString(cipherText)
+	return enc, nil
+}
 
-	block, err := aes.NewCipher(keyBytes)
+// EncryptBytes is EncryptMessage for binary data such as attachments. The
+// returned EncryptedData names the key and IV but leaves Data empty.
+func EncryptBytes(plain []byte, keyName string) ([]byte, EncryptedData, error) {
+	var k EncKey
+	var err error
+	if keyName == "" {
+		k, err = pickRandomKey()
+	} else if k, err = findKey(keyName); err == nil && k.Expired(time.Now()) {
+		err = fmt.Errorf("%w: %s", ErrKeyExpired, keyName)
+	}
 	if err != nil {
-		return EncryptedData{}, err
+		return nil, EncryptedData{}, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	aead, err := newAEAD(k)
 	if err != nil {
-		return EncryptedData{}, err
+		return nil, EncryptedData{}, err
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
+	nonce := make([]byte, aead.NonceSize())
 	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		return EncryptedData{}, err
+		return nil, EncryptedData{}, err
 	}
 
-	cipherText := gcm.Seal(nil, nonce, []byte(plainText), nil)
-	fmt.Println("Encryption took:", time.Since(start))
-	return EncryptedData{
-		KeyName: keyName,
-		Data:    base64.StdEncoding.EncodeToString(cipherText),
+	return aead.Seal(nil, nonce, plain, nil), EncryptedData{
+		KeyName: k.Name,
 		IV:      base64.StdEncoding.EncodeToString(nonce),
 	}, nil
 }
 
-// Decrypt decrypts base64 ciphertext using the named key and IV
+// Decrypt decrypts base64 ciphertext using the named key and IV, with the
+// cipher that key is tagged with
 func DecryptMessage(cipherBase64, keyName, ivBase64 string) (string, error) {
-	keyBytes, err := GetKeyByName(keyName)
-	if err != nil {
-		return "", err
-	}
-
 	cipherBytes, err := base64.StdEncoding.DecodeString(cipherBase64)
 	if err != nil {
 		return "", err
 	}
 
-	nonce, err := base64.StdEncoding.DecodeString(ivBase64)
+	plainBytes, err := DecryptBytes(cipherBytes, keyName, ivBase64)
 	if err != nil {
 		return "", err
 	}
 
-	block, err := aes.NewCipher(keyBytes)
+	return string(plainBytes), nil
+}
+
+// DecryptBytes reverses EncryptBytes.
+func DecryptBytes(cipherBytes []byte, keyName, ivBase64 string) ([]byte, error) {
+	k, err := findKey(keyName)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	nonce, err := base64.StdEncoding.DecodeString(ivBase64)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	plainBytes, err := gcm.Open(nil, nonce, cipherBytes, nil)
+	aead, err := newAEAD(k)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return string(plainBytes), nil
+	return aead.Open(nil, nonce, cipherBytes, nil)
 }
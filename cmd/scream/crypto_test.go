@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// withKeys replaces the loaded keys for the length of a test.
+func withKeys(t *testing.T, keys ...EncKey) {
+	t.Helper()
+	saved := EncKeys
+	EncKeys = keys
+	t.Cleanup(func() { EncKeys = saved })
+}
+
+func TestActiveKeysSkipsExpired(t *testing.T) {
+	now := time.Now()
+	withKeys(t,
+		EncKey{Name: "forever", Key: EncKeys[0].Key},
+		EncKey{Name: "expired", Key: EncKeys[1].Key, Expires: now.Add(-time.Hour)},
+		EncKey{Name: "tomorrow", Key: EncKeys[2].Key, Expires: now.Add(24 * time.Hour)},
+	)
+
+	for _, tc := range []struct {
+		at   time.Time
+		want []string
+	}{
+		{now, []string{"forever", "tomorrow"}},
+		{now.Add(48 * time.Hour), []string{"forever"}},
+	} {
+		var got []string
+		for _, k := range activeKeys(tc.at) {
+			got = append(got, k.Name)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("active keys at %v: %v, want %v", tc.at, got, tc.want)
+		}
+	}
+
+	// Random picks never land on the expired key
+	for range 50 {
+		name, _, err := GetRandomKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "expired" {
+			t.Fatal("GetRandomKey picked an expired key")
+		}
+	}
+}
+
+func TestExpiredKeyDecryptsButDoesNotEncrypt(t *testing.T) {
+	withKeys(t, EncKey{Name: "old", Key: EncKeys[0].Key})
+	enc, err := EncryptMessage("before expiry", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	EncKeys[0].Expires = time.Now().Add(-time.Minute)
+
+	if _, err := EncryptMessage("after expiry", "old"); !errors.Is(err, ErrKeyExpired) {
+		t.Errorf("encrypting with an expired key: %v, want ErrKeyExpired", err)
+	}
+	if !KeyExpired("old") {
+		t.Error("KeyExpired reports the key as live")
+	}
+	plain, err := DecryptMessage(enc.Data, "old", enc.IV)
+	if err != nil || plain != "before expiry" {
+		t.Errorf("decrypting with an expired key: %q, %v", plain, err)
+	}
+}
+
+func TestNoActiveKeys(t *testing.T) {
+	withKeys(t, EncKey{Name: "gone", Key: EncKeys[0].Key, Expires: time.Now().Add(-time.Hour)})
+	if _, _, err := GetRandomKey(); err == nil {
+		t.Error("GetRandomKey succeeded with every key expired")
+	}
+}
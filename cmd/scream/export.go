@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/storage"
+	"fyne.io/fyne/v2/widget"
+
+	pb "github.com/rexlx/squall/proto"
+)
+
+// Export formats offered by the EXPORT dialog.
+const (
+	exportText = "Plain text"
+	exportJSON = "JSON"
+)
+
+// exportedMessage is one message as written to an export file.
+type exportedMessage struct {
+	ID            int64  `json:"id,omitempty"`
+	Time          string `json:"time"`
+	Email         string `json:"email"`
+	Text          string `json:"text"`
+	ReplyTo       string `json:"reply_to,omitempty"`
+	Undecryptable bool   `json:"undecryptable,omitempty"`
+}
+
+// exportMessages converts a room's messages, decrypting where a key is
+// loaded. Messages that can't be decrypted keep their ciphertext.
+func exportMessages(msgs []*pb.ChatMessage) []exportedMessage {
+	out := make([]exportedMessage, 0, len(msgs))
+	for _, m := range msgs {
+		em := exportedMessage{
+			ID:      m.Id,
+			Time:    time.Unix(m.Timestamp, 0).Format(time.RFC3339),
+			Email:   m.Email,
+			Text:    m.GetMessageContent(),
+			ReplyTo: m.ReplyTo,
+		}
+		if m.HotSauce != "" {
+			if dec, err := DecryptMessage(em.Text, m.HotSauce, m.Iv); err == nil {
+				em.Text = dec
+			} else {
+				em.Undecryptable = true
+			}
+		}
+		out = append(out, em)
+	}
+	return out
+}
+
+// writeExport writes msgs to w in the given format.
+func writeExport(w io.Writer, format string, msgs []exportedMessage) error {
+	if format == exportJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(msgs)
+	}
+	for _, m := range msgs {
+		text := m.Text
+		if m.Undecryptable {
+			text = "[UNDECRYPTABLE] " + text
+		}
+		if _, err := fmt.Fprintf(w, "[%s] <%s> %s\n", m.Time, m.Email, text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// showExportDialog asks for a format and whether to pull the rest of the
+// room's history first, then saves the room's messages to a chosen file.
+func showExportDialog(roomName string) {
+	format := widget.NewRadioGroup([]string{exportText, exportJSON}, nil)
+	format.SetSelected(exportText)
+	fetchAll := widget.NewCheck("Fetch older history first", nil)
+	fetchAll.SetChecked(Client.HasOlderHistory(roomName))
+	if !Client.HasOlderHistory(roomName) {
+		fetchAll.Disable()
+	}
+
+	dialog.ShowForm("Export "+roomName, "EXPORT", "CANCEL", []*widget.FormItem{
+		widget.NewFormItem("Format", format),
+		widget.NewFormItem("", fetchAll),
+	}, func(ok bool) {
+		if !ok {
+			return
+		}
+		chosen := format.Selected
+		if !fetchAll.Checked {
+			saveExport(roomName, chosen)
+			return
+		}
+		if loadingHistory[roomName] {
+			dialog.ShowInformation("Export", "History is still loading, try again in a moment.", window)
+			return
+		}
+		loadingHistory[roomName] = true
+		go func() {
+			err := fetchAllHistory(roomName)
+			fyne.Do(func() {
+				loadingHistory[roomName] = false
+				if err != nil {
+					dialog.ShowError(err, window)
+					return
+				}
+				saveExport(roomName, chosen)
+			})
+		}()
+	}, window)
+}
+
+// fetchAllHistory pages through GetHistory until the room has nothing
+// older, adding each page to the room view. Call it off the main thread.
+func fetchAllHistory(roomName string) error {
+	for Client.HasOlderHistory(roomName) {
+		msgs, err := Client.GetHistory(roomName)
+		if err != nil {
+			return err
+		}
+		fyne.DoAndWait(func() { prependHistory(roomName, msgs) })
+	}
+	return nil
+}
+
+// saveExport prompts for a file and writes the room's loaded messages to it.
+func saveExport(roomName, format string) {
+	msgs := exportMessages(roomMessages[roomName])
+	d := dialog.NewFileSave(func(writer fyne.URIWriteCloser, err error) {
+		if err != nil || writer == nil {
+			return
+		}
+		defer writer.Close()
+		if err := writeExport(writer, format, msgs); err != nil {
+			dialog.ShowError(err, window)
+		}
+	}, window)
+	ext := ".txt"
+	if format == exportJSON {
+		ext = ".json"
+	}
+	d.SetFileName(roomName + ext)
+	d.SetFilter(storage.NewExtensionFileFilter([]string{ext}))
+	d.Show()
+}
@@ -1,16 +1,38 @@
 package main
 
 import (
+	"flag"
 	"log"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
+
+	"github.com/rexlx/squall/internal"
 )
 
 func main() {
-	// 1. Initialize the TLS Client immediately on startup
-	if err := InitClient(); err != nil {
-		log.Panic("Could not initialize TLS client: " + err.Error())
+	multiplex := flag.Bool("multiplex", false, "Carry all rooms over a single stream")
+	host := flag.String("host", DefaultHost, "Server host:port")
+	certFile := flag.String("cert", "", "Client certificate file (default: the bundled certificate)")
+	keyFile := flag.String("key", "", "Client key file (default: the bundled key)")
+	noClientCert := flag.Bool("no-client-cert", false, "Connect without presenting a client certificate")
+	caFile := flag.String("ca", internal.DefaultCAFile, "CA certificate the server must be signed by (empty uses the system roots)")
+	insecure := flag.Bool("insecure", false, "Skip server certificate verification (development only)")
+	flag.Parse()
+	Client.Multiplex = *multiplex
+
+	// 1. Initialize the TLS Client immediately on startup. A failure is shown
+	// on the login screen instead of taking the app down.
+	initErr := InitClient(ClientConfig{
+		Host:         *host,
+		CertFile:     *certFile,
+		KeyFile:      *keyFile,
+		NoClientCert: *noClientCert,
+		CAFile:       *caFile,
+		Insecure:     *insecure,
+	})
+	if initErr != nil {
+		log.Println("Could not initialize TLS client: " + initErr.Error())
 	}
 	mainApp = app.NewWithID("com.squall.terminal")
 
@@ -24,9 +46,14 @@ func main() {
 	go ListenForMessages()
 
 	// Show Login Screen initially
-	window.SetContent(MakeLoginScreen(func() {
+	window.SetContent(MakeLoginScreen(initErr, func() {
 		window.SetContent(MakeMainScreen())
 	}))
 
+	// Revoke the refresh token so the session cannot be resumed
+	window.SetOnClosed(func() {
+		_ = Client.Logout()
+	})
+
 	window.ShowAndRun()
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// NewMessageText renders a message body as rich text. Only a small, inert
+// subset of markdown is understood: **bold**, *italic* or _italic_ and
+// `inline code`. Bare http(s) URLs become hyperlinks; nothing else is
+// fetched or executed. @mentions of the signed in user are highlighted.
+func NewMessageText(text string) *widget.RichText {
+	rt := widget.NewRichText(messageSegments(text)...)
+	rt.Wrapping = fyne.TextWrapWord
+	return rt
+}
+
+// SetMessageText replaces the content of a RichText made by NewMessageText.
+func SetMessageText(rt *widget.RichText, text string) {
+	rt.Segments = messageSegments(text)
+	rt.Refresh()
+}
+
+// messageSegments splits text into styled segments and links.
+func messageSegments(text string) []widget.RichTextSegment {
+	var segs []widget.RichTextSegment
+	var plain strings.Builder
+	flush := func() {
+		if plain.Len() > 0 {
+			segs = append(segs, textSegment(plain.String(), widget.RichTextStyleInline))
+			plain.Reset()
+		}
+	}
+
+	for i := 0; i < len(text); {
+		rest := text[i:]
+		switch {
+		case rest[0] == '`':
+			if end := closingDelim(text, i+1, "`"); end > 0 {
+				flush()
+				segs = append(segs, textSegment(text[i+1:end], widget.RichTextStyleCodeInline))
+				i = end + 1
+				continue
+			}
+		case strings.HasPrefix(rest, "**"):
+			if end := closingDelim(text, i+2, "**"); end > 0 {
+				flush()
+				segs = append(segs, textSegment(text[i+2:end], widget.RichTextStyleStrong))
+				i = end + 2
+				continue
+			}
+		case rest[0] == '*' || rest[0] == '_':
+			delim := rest[:1]
+			if atWordStart(text, i) {
+				if end := closingDelim(text, i+1, delim); end > 0 && atWordEnd(text, end+1) {
+					flush()
+					segs = append(segs, textSegment(text[i+1:end], widget.RichTextStyleEmphasis))
+					i = end + 1
+					continue
+				}
+			}
+		case rest[0] == '@':
+			// Mentions of the signed in user stand out
+			if atWordStart(text, i) {
+				if token := mentionText(rest[1:]); isMyMention(token) {
+					flush()
+					segs = append(segs, textSegment("@"+token, mentionStyle))
+					i += 1 + len(token)
+					continue
+				}
+			}
+		case strings.HasPrefix(rest, "http://") || strings.HasPrefix(rest, "https://"):
+			if atWordStart(text, i) {
+				raw := linkText(rest)
+				if u, err := url.Parse(raw); err == nil && u.Host != "" {
+					flush()
+					segs = append(segs, &widget.HyperlinkSegment{Text: raw, URL: u})
+					i += len(raw)
+					continue
+				}
+			}
+		}
+		r, size := utf8.DecodeRuneInString(rest)
+		plain.WriteRune(r)
+		i += size
+	}
+	flush()
+	return segs
+}
+
+func textSegment(text string, style widget.RichTextStyle) *widget.TextSegment {
+	return &widget.TextSegment{Text: text, Style: style}
+}
+
+// closingDelim returns the index of the delim that closes a span opened
+// just before from, or -1. Spans must be non-empty and stay on one line.
+func closingDelim(text string, from int, delim string) int {
+	line := text[from:]
+	if nl := strings.IndexByte(line, '\n'); nl >= 0 {
+		line = line[:nl]
+	}
+	end := strings.Index(line, delim)
+	if end <= 0 {
+		return -1
+	}
+	return from + end
+}
+
+// atWordStart reports whether position i begins a word, so snake_case and
+// 2*3*4 are left alone.
+func atWordStart(text string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(text[:i])
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// atWordEnd reports whether position i ends a word.
+func atWordEnd(text string, i int) bool {
+	if i >= len(text) {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(text[i:])
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// mentionStyle highlights an @mention of the signed in user.
+var mentionStyle = widget.RichTextStyle{
+	ColorName: theme.ColorNamePrimary,
+	Inline:    true,
+	TextStyle: fyne.TextStyle{Bold: true},
+}
+
+// mentionText returns the name or email that an @ at the start of s
+// mentions, as the server parses it: letters, digits and ".-_+@", less any
+// trailing ".", "-" or "@".
+func mentionText(s string) string {
+	end := strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(".-_+@", r)
+	})
+	if end < 0 {
+		end = len(s)
+	}
+	return strings.TrimRight(s[:end], ".-@")
+}
+
+// linkText returns the URL at the start of s, stopping at whitespace and
+// dropping trailing punctuation that usually ends the sentence instead.
+func linkText(s string) string {
+	end := strings.IndexFunc(s, unicode.IsSpace)
+	if end < 0 {
+		end = len(s)
+	}
+	return strings.TrimRight(s[:end], ".,;:!?)'\"")
+}
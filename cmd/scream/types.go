@@ -2,7 +2,10 @@ package main
 
 // Configuration
 const API_BASE = "https://localhost:8080"
-const WS_BASE = "wss://localhost:8080"
+
+// WS_BASE is the server's browser gateway (-gateway-addr) chat socket.
+// scream itself speaks gRPC on API_BASE's port.
+const WS_BASE = "wss://localhost:8443/ws"
 
 // Data Models
 
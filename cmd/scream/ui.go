@@ -3,11 +3,16 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"image/color"
 	"io"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/canvas"
@@ -18,6 +23,7 @@ import (
 	"fyne.io/fyne/v2/widget"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 
 	pb "github.com/rexlx/squall/proto"
 )
@@ -31,6 +37,44 @@ var (
 	roomBoxes   map[string]*fyne.Container
 	roomScrolls map[string]*container.Scroll
 
+	// Rooms with a GetHistory request in flight (main thread only)
+	loadingHistory map[string]bool
+
+	// Per-room "X is typing..." line and when each typist was last heard from
+	typingLabels map[string]*widget.Label
+	typists      map[string]map[string]time.Time
+
+	// Per-room online member emails and the label showing their count
+	members      map[string]map[string]bool
+	memberLabels map[string]*widget.Label
+
+	// Per-room topic line in the room header, hidden when there is none
+	topicLabels map[string]*widget.Label
+
+	// Rendered stored messages by database ID, so edits can update in place
+	messageBodies map[int64]*messageBody
+
+	// Every rendered text message and date separator in the room boxes,
+	// keyed by the object in the box, for layoutRoom (main thread only)
+	shownMessages  map[fyne.CanvasObject]*shownMessage
+	dateSeparators map[fyne.CanvasObject]string // Separator -> dayKey
+
+	// Text messages shown in each room, oldest first, for export (main
+	// thread only)
+	roomMessages map[string][]*pb.ChatMessage
+
+	// Placeholders for messages waiting in the client outbox, by local ID
+	pendingLabels map[int64]pendingLabel
+
+	// Unread message counts for the sidebar room lists (main thread only),
+	// and the function that redraws them once MakeMainScreen has run
+	unreadCounts  map[string]int64
+	refreshBadges = func() {}
+
+	// Desktop notification preference by room, NOTIFY_ALL when missing
+	// (main thread only)
+	notifyPrefs map[string]pb.NotificationPref
+
 	// Reassembly buffer for incoming chunks
 	incomingChunks sync.Map
 )
@@ -39,8 +83,249 @@ func init() {
 	openTabs = make(map[string]*container.TabItem)
 	roomBoxes = make(map[string]*fyne.Container)
 	roomScrolls = make(map[string]*container.Scroll)
+	loadingHistory = make(map[string]bool)
+	typingLabels = make(map[string]*widget.Label)
+	typists = make(map[string]map[string]time.Time)
+	members = make(map[string]map[string]bool)
+	memberLabels = make(map[string]*widget.Label)
+	topicLabels = make(map[string]*widget.Label)
+	messageBodies = make(map[int64]*messageBody)
+	shownMessages = make(map[fyne.CanvasObject]*shownMessage)
+	dateSeparators = make(map[fyne.CanvasObject]string)
+	roomMessages = make(map[string][]*pb.ChatMessage)
+	pendingLabels = make(map[int64]pendingLabel)
+	unreadCounts = make(map[string]int64)
+	notifyPrefs = make(map[string]pb.NotificationPref)
+}
+
+// mutedRoomsPref is the preferences key that held the muted room names
+// before the server kept notification preferences.
+const mutedRoomsPref = "muted_rooms"
+
+// roomKeysPref is the preferences key holding the room to key name bindings
+// as a JSON object.
+const roomKeysPref = "room_keys"
+
+// loadRoomKeys restores the key bindings saved by setRoomKey.
+func loadRoomKeys() {
+	var keys map[string]string
+	if err := json.Unmarshal([]byte(mainApp.Preferences().String(roomKeysPref)), &keys); err != nil {
+		return
+	}
+	for room, name := range keys {
+		Client.SetRoomKey(room, name)
+	}
+}
+
+// setRoomKey binds a room to a key, or unbinds it when keyName is empty, and
+// remembers the choice across restarts.
+func setRoomKey(roomID, keyName string) {
+	Client.SetRoomKey(roomID, keyName)
+	data, err := json.Marshal(Client.RoomKeys())
+	if err != nil {
+		return
+	}
+	mainApp.Preferences().SetString(roomKeysPref, string(data))
+}
+
+// randomKeyOption is the key picker entry that unbinds a room's key.
+const randomKeyOption = "(random per message)"
+
+// keyButtonText labels a room header's key button with its bound key.
+func keyButtonText(roomID string) string {
+	if name := Client.RoomKey(roomID); name != "" {
+		return "KEY: " + name
+	}
+	return "KEY: random"
 }
 
+// showKeyPicker lets the user bind one of the loaded keys to a room.
+func showKeyPicker(roomID string, btn *widget.Button) {
+	options := []string{randomKeyOption}
+	for _, k := range EncKeys {
+		options = append(options, k.Name)
+	}
+	picker := widget.NewSelect(options, nil)
+	if name := Client.RoomKey(roomID); name != "" {
+		picker.SetSelected(name)
+	} else {
+		picker.SetSelected(randomKeyOption)
+	}
+	dialog.ShowForm("Room Key", "USE", "CANCEL", []*widget.FormItem{
+		widget.NewFormItem("Key", picker),
+	}, func(ok bool) {
+		if !ok {
+			return
+		}
+		name := picker.Selected
+		if name == randomKeyOption {
+			name = ""
+		}
+		setRoomKey(roomID, name)
+		btn.SetText(keyButtonText(roomID))
+	}, window)
+}
+
+// Labels for the notification preference picker, in NotificationPref order.
+var notifyOptions = []string{"All", "Mentions", "Muted"}
+
+// setNotifyPref changes when a room raises notifications and saves the
+// choice on the server, so it follows the user to other devices.
+func setNotifyPref(roomID string, pref pb.NotificationPref) {
+	if notifyPrefs[roomID] == pref {
+		return
+	}
+	if pref == pb.NotificationPref_NOTIFY_ALL {
+		delete(notifyPrefs, roomID)
+	} else {
+		notifyPrefs[roomID] = pref
+	}
+	go func() {
+		if err := Client.SetRoomNotificationPref(roomID, pref); err != nil {
+			fyne.Do(func() { dialog.ShowError(fmt.Errorf("notification setting not saved: %w", err), window) })
+		}
+	}()
+}
+
+// loadNotifyPrefs takes the preferences the server sent at login. Rooms
+// muted only on this device, before the server kept them, are saved there
+// once and the local list dropped.
+func loadNotifyPrefs() {
+	clear(notifyPrefs)
+	for room, pref := range Client.NotificationPrefs {
+		notifyPrefs[room] = pref
+	}
+	for _, r := range mainApp.Preferences().StringList(mutedRoomsPref) {
+		if _, ok := notifyPrefs[r]; !ok {
+			setNotifyPref(r, pb.NotificationPref_NOTIFY_MUTED)
+		}
+	}
+	mainApp.Preferences().RemoveValue(mutedRoomsPref)
+}
+
+// mentionsMe reports whether m mentions the signed in user: the server
+// flags plaintext messages, and encrypted ones are searched once text has
+// been decrypted.
+func mentionsMe(m *pb.ChatMessage, text string) bool {
+	if slices.Contains(m.Mentions, Client.User.Id) {
+		return true
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '@' && atWordStart(text, i) && isMyMention(mentionText(text[i+1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMyMention reports whether an @mention, without the @, names the signed
+// in user by email or name.
+func isMyMention(token string) bool {
+	if token == "" || Client == nil || Client.User == nil {
+		return false
+	}
+	return strings.EqualFold(token, Client.User.Email) ||
+		(Client.User.FirstName != "" && strings.EqualFold(token, Client.User.FirstName))
+}
+
+// unreadLabel is a sidebar room name with its unread count, if any.
+func unreadLabel(roomID string) string {
+	if n := unreadCounts[roomID]; n > 0 {
+		return fmt.Sprintf("%s (%d)", roomID, n)
+	}
+	return roomID
+}
+
+// unreadRooms lists the saved and recently visited rooms whose unread counts
+// the sidebar shows.
+func unreadRooms() []string {
+	rooms := Client.GetSavedRooms()
+	for _, r := range Client.GetLocalHistory() {
+		if !slices.Contains(rooms, r) {
+			rooms = append(rooms, r)
+		}
+	}
+	return rooms
+}
+
+// countUnread bumps a room's badge for a live message from someone else
+// that arrived while another room is being viewed. The next UnreadCounts
+// poll replaces the local count with the server's.
+func countUnread(m *pb.ChatMessage) {
+	if m.Id != 0 || m.Email == Client.User.Email {
+		return
+	}
+	if sel := docTabs.Selected(); sel != nil && sel.Text == m.RoomId {
+		return
+	}
+	unreadCounts[m.RoomId]++
+	refreshBadges()
+}
+
+// clearUnread drops a room's badge once it is opened.
+func clearUnread(roomID string) {
+	if _, ok := unreadCounts[roomID]; !ok {
+		return
+	}
+	delete(unreadCounts, roomID)
+	refreshBadges()
+}
+
+// notifyMessage raises a desktop notification for a live message that
+// arrived in a room other than the one being viewed.
+func notifyMessage(m *pb.ChatMessage) {
+	// Messages with an ID were loaded from history rather than just sent
+	pref := notifyPrefs[m.RoomId]
+	if m.Id != 0 || m.Email == Client.User.Email || pref == pb.NotificationPref_NOTIFY_MUTED {
+		return
+	}
+	if sel := docTabs.Selected(); sel != nil && sel.Text == m.RoomId {
+		return
+	}
+
+	preview := m.GetMessageContent()
+	if m.HotSauce != "" {
+		dec, err := DecryptMessage(preview, m.HotSauce, m.Iv)
+		if err != nil {
+			dec = "[encrypted message]"
+		}
+		preview = dec
+	}
+	if pref == pb.NotificationPref_NOTIFY_MENTIONS && !mentionsMe(m, preview) {
+		return
+	}
+	if r := []rune(preview); len(r) > 100 {
+		preview = string(r[:100]) + "…"
+	}
+	mainApp.SendNotification(fyne.NewNotification(fmt.Sprintf("%s in %s", m.Email, m.RoomId), preview))
+}
+
+// unreadRefreshInterval is how often the saved rooms badges are refreshed.
+const unreadRefreshInterval = 30 * time.Second
+
+// messageBody is the editable part of a rendered message. obj is the whole
+// bubble as added to the room's box.
+type messageBody struct {
+	roomID string
+	sender string // UserId, for redrawing the header when a profile arrives
+	obj    fyne.CanvasObject
+	// header holds the time and any markers ("(edited)"); name and initial
+	// show the sender
+	header  *canvas.Text
+	name    *canvas.Text
+	initial *canvas.Text
+	body    *widget.RichText
+	text    string // Decrypted source of body, for editing
+}
+
+type pendingLabel struct {
+	roomID string
+	obj    fyne.CanvasObject
+}
+
+// typingTimeout is how long a typing line lingers without a fresh signal.
+const typingTimeout = 3 * time.Second
+
 // --- THEME DEFINITIONS ---
 
 // VFD Theme (Original Cyan)
@@ -135,7 +420,9 @@ func ApplyTheme(name string) {
 	fyne.CurrentApp().Settings().SetTheme(t)
 }
 
-func MakeLoginScreen(onSuccess func()) fyne.CanvasObject {
+// MakeLoginScreen builds the login form. A non-nil initErr means the client
+// could not be set up; it is shown and logging in is disabled.
+func MakeLoginScreen(initErr error, onSuccess func()) fyne.CanvasObject {
 	emailEntry := widget.NewEntry()
 	emailEntry.SetPlaceHolder("Username/Email")
 	passEntry := widget.NewPasswordEntry()
@@ -160,6 +447,12 @@ func MakeLoginScreen(onSuccess func()) fyne.CanvasObject {
 		}
 	})
 	loginBtn.Importance = widget.HighImportance
+	if initErr != nil {
+		errorLabel.SetText("Cannot connect: " + initErr.Error())
+		errorLabel.Wrapping = fyne.TextWrapWord
+		errorLabel.Show()
+		loginBtn.Disable()
+	}
 
 	title := canvas.NewText("SCREAM-NG", theme.PrimaryColor())
 	title.TextSize = 24
@@ -174,13 +467,47 @@ func MakeLoginScreen(onSuccess func()) fyne.CanvasObject {
 }
 
 func MakeMainScreen() fyne.CanvasObject {
+	loadNotifyPrefs()
+	loadRoomKeys()
 	docTabs = container.NewDocTabs()
+	// Leaving a room's tab, by switching away or closing it, marks it read
+	docTabs.OnSelected = func(item *container.TabItem) {
+		go Client.MarkRead(item.Text)
+		clearUnread(item.Text)
+	}
+	docTabs.OnUnselected = func(item *container.TabItem) {
+		go Client.MarkRead(item.Text)
+	}
 	docTabs.OnClosed = func(item *container.TabItem) {
 		roomName := item.Text
+		go Client.MarkRead(roomName)
 		Client.LeaveRoom(roomName)
+		if box, ok := roomBoxes[roomName]; ok {
+			for _, o := range box.Objects {
+				delete(shownMessages, o)
+				delete(dateSeparators, o)
+			}
+		}
 		delete(openTabs, roomName)
 		delete(roomBoxes, roomName)
 		delete(roomScrolls, roomName)
+		delete(loadingHistory, roomName)
+		delete(typingLabels, roomName)
+		delete(typists, roomName)
+		delete(members, roomName)
+		delete(memberLabels, roomName)
+		delete(topicLabels, roomName)
+		delete(roomMessages, roomName)
+		for id, mb := range messageBodies {
+			if mb.roomID == roomName {
+				delete(messageBodies, id)
+			}
+		}
+		for id, p := range pendingLabels {
+			if p.roomID == roomName {
+				delete(pendingLabels, id)
+			}
+		}
 	}
 
 	savedRoomsList := container.NewVBox()
@@ -189,9 +516,14 @@ func MakeMainScreen() fyne.CanvasObject {
 		savedRoomsList.Objects = nil
 		for _, r := range Client.GetSavedRooms() {
 			rName := r
-			btn := widget.NewButton(rName, func() { loadRoom(rName) })
+			btn := widget.NewButton(unreadLabel(rName), func() { loadRoom(rName) })
 			btn.Alignment = widget.ButtonAlignLeading
 			deleteBtn := widget.NewButtonWithIcon("", theme.DeleteIcon(), func() {
+				// Close the room's tab first; the server is about to end its stream
+				if tab, ok := openTabs[rName]; ok {
+					docTabs.Remove(tab)
+					docTabs.OnClosed(tab)
+				}
 				Client.RemoveRoomFromCache(rName)
 				refreshSavedRooms()
 			})
@@ -223,7 +555,7 @@ func MakeMainScreen() fyne.CanvasObject {
 		localHistory := Client.GetLocalHistory()
 		for i := len(localHistory) - 1; i >= 0; i-- {
 			rName := localHistory[i]
-			btn := widget.NewButton(rName, func() { loadRoom(rName) })
+			btn := widget.NewButton(unreadLabel(rName), func() { loadRoom(rName) })
 			btn.Alignment = widget.ButtonAlignLeading
 			historyList.Add(btn)
 		}
@@ -231,15 +563,116 @@ func MakeMainScreen() fyne.CanvasObject {
 	}
 	refreshHistory()
 
+	refreshBadges = func() {
+		refreshSavedRooms()
+		refreshHistory()
+	}
+	go func() {
+		for {
+			counts, err := Client.UnreadCounts(unreadRooms())
+			if err == nil {
+				fyne.Do(func() {
+					unreadCounts = counts
+					// The room being read right now has nothing unread
+					if sel := docTabs.Selected(); sel != nil {
+						delete(unreadCounts, sel.Text)
+					}
+					refreshBadges()
+				})
+			}
+			time.Sleep(unreadRefreshInterval)
+		}
+	}()
+
+	nameEntry := widget.NewEntry()
+	nameEntry.SetText(Client.User.FirstName)
+	nameEntry.Validator = func(s string) error {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return fmt.Errorf("name is required")
+		}
+		if utf8.RuneCountInString(s) > maxNameLength {
+			return fmt.Errorf("name must be at most %d characters", maxNameLength)
+		}
+		return nil
+	}
+	aboutEntry := widget.NewMultiLineEntry()
+	aboutEntry.SetText(Client.User.About)
+	aboutEntry.SetPlaceHolder("About you...")
+	aboutEntry.Wrapping = fyne.TextWrapWord
+	aboutEntry.Validator = func(s string) error {
+		if utf8.RuneCountInString(s) > maxAboutLength {
+			return fmt.Errorf("about must be at most %d characters", maxAboutLength)
+		}
+		return nil
+	}
+	roomCountLabel := widget.NewLabel("")
+	refreshRoomCount := func() {
+		roomCountLabel.SetText(fmt.Sprintf("%d", len(Client.GetSavedRooms())))
+	}
+	refreshRoomCount()
+
+	var saveProfileBtn *widget.Button
+	saveProfileBtn = widget.NewButton("SAVE PROFILE", func() {
+		if err := nameEntry.Validate(); err != nil {
+			dialog.ShowError(err, window)
+			return
+		}
+		if err := aboutEntry.Validate(); err != nil {
+			dialog.ShowError(err, window)
+			return
+		}
+		name, about := strings.TrimSpace(nameEntry.Text), aboutEntry.Text
+		saveProfileBtn.Disable()
+		go func() {
+			err := Client.UpdateProfile(name, about)
+			fyne.Do(func() {
+				saveProfileBtn.Enable()
+				if err != nil {
+					dialog.ShowError(err, window)
+					return
+				}
+				nameEntry.SetText(name)
+			})
+		}()
+	})
+
+	profileSection := container.NewVBox(
+		widget.NewForm(
+			widget.NewFormItem("Email", widget.NewLabel(Client.User.Email)),
+			widget.NewFormItem("ID", widget.NewLabel(Client.User.Id)),
+			widget.NewFormItem("Rooms", roomCountLabel),
+			widget.NewFormItem("Name", nameEntry),
+			widget.NewFormItem("About", aboutEntry),
+		),
+		saveProfileBtn,
+	)
+
 	// Set up callbacks for real-time updates
 	Client.OnHistoryUpdate = refreshHistory
+	Client.OnProfile = func(p *pb.ProfileResponse) {
+		fyne.Do(func() { refreshSenderNames(p.UserId, p.Name) })
+	}
+	Client.OnQueued = func(roomName string, localID int64, text string) {
+		fyne.Do(func() { showPending(roomName, localID, text) })
+	}
+	Client.OnUnqueued = func(roomName string, localID int64) {
+		fyne.Do(func() { clearPending(localID) })
+	}
+	Client.OnReconnecting = func(roomName string, reconnecting bool) {
+		fyne.Do(func() { showReconnecting(roomName, reconnecting) })
+	}
 	Client.OnRoomsUpdate = func() {
-		fyne.Do(refreshSavedRooms)
+		fyne.Do(func() {
+			refreshSavedRooms()
+			refreshRoomCount()
+		})
 	}
 
 	accordion := widget.NewAccordion(
 		widget.NewAccordionItem("SAVED ROOMS", savedRoomsSection),
 		widget.NewAccordionItem("HISTORY", container.NewVScroll(historyList)),
+		widget.NewAccordionItem("PROFILE", profileSection),
 	)
 	accordion.Items[0].Open = true
 
@@ -252,18 +685,84 @@ func MakeMainScreen() fyne.CanvasObject {
 		}
 	})
 
+	dmEntry := widget.NewEntry()
+	dmEntry.SetPlaceHolder("USER EMAIL")
+	dmBtn := widget.NewButton("MESSAGE", func() {
+		email := dmEntry.Text
+		if email == "" {
+			return
+		}
+		dmEntry.SetText("")
+		go func() {
+			roomID, err := Client.OpenDirectMessage(email)
+			fyne.Do(func() {
+				if err != nil {
+					dialog.ShowError(err, window)
+					return
+				}
+				loadRoom(roomID)
+			})
+		}()
+	})
+
 	loadKeysBtn := widget.NewButton("LOAD KEY LIB", func() {
 		d := dialog.NewFileOpen(func(reader fyne.URIReadCloser, err error) {
 			if err != nil || reader == nil {
 				return
 			}
 			defer reader.Close()
-			LoadKeys(reader)
+			accepted, rejected, err := LoadKeys(reader)
+			if err != nil && accepted == 0 && rejected == 0 {
+				dialog.ShowError(err, window)
+				return
+			}
+			if rejected > 0 {
+				dialog.ShowError(fmt.Errorf("loaded %d keys, rejected %d:\n%w", accepted, rejected, err), window)
+				return
+			}
+			dialog.ShowInformation("Keys Loaded", fmt.Sprintf("Loaded %d keys.", accepted), window)
 		}, window)
 		d.SetFilter(storage.NewExtensionFileFilter([]string{".json"}))
 		d.Show()
 	})
 
+	genKeyBtn := widget.NewButton("GENERATE KEY", func() {
+		keyNameEntry := widget.NewEntry()
+		keyNameEntry.SetPlaceHolder("key-name")
+		algSelect := widget.NewSelect(Algorithms, nil)
+		algSelect.SetSelected(AlgAESGCM)
+		dialog.ShowForm("Generate Key", "GENERATE", "CANCEL", []*widget.FormItem{
+			widget.NewFormItem("Name", keyNameEntry),
+			widget.NewFormItem("Cipher", algSelect),
+		}, func(ok bool) {
+			if !ok {
+				return
+			}
+			name := strings.TrimSpace(keyNameEntry.Text)
+			if HasKey(name) {
+				dialog.ShowInformation("Name In Use", fmt.Sprintf("A key named %q already exists. Pick another name.", name), window)
+				return
+			}
+			if _, err := GenerateKey(name, algSelect.Selected); err != nil {
+				dialog.ShowError(err, window)
+				return
+			}
+			// Write the whole library out so it can be shared and loaded again
+			d := dialog.NewFileSave(func(writer fyne.URIWriteCloser, err error) {
+				if err != nil || writer == nil {
+					return
+				}
+				defer writer.Close()
+				if err := SaveKeys(writer); err != nil {
+					dialog.ShowError(err, window)
+				}
+			}, window)
+			d.SetFileName("keys.json")
+			d.SetFilter(storage.NewExtensionFileFilter([]string{".json"}))
+			d.Show()
+		}, window)
+	})
+
 	themeSelector := widget.NewSelect([]string{"VFD", "Amber", "PIPBOY"}, func(selected string) {
 		ApplyTheme(selected)
 	})
@@ -275,11 +774,15 @@ func MakeMainScreen() fyne.CanvasObject {
 			newRoomEntry,
 			joinBtn,
 			widget.NewSeparator(),
+			widget.NewLabelWithStyle("DIRECT MESSAGE", fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
+			dmEntry,
+			dmBtn,
+			widget.NewSeparator(),
 			widget.NewLabelWithStyle("INTERFACE", fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
 			themeSelector,
 			widget.NewSeparator(),
 		),
-		loadKeysBtn,
+		container.NewGridWithColumns(2, loadKeysBtn, genKeyBtn),
 		nil, nil,
 		container.NewVScroll(accordion),
 	)
@@ -297,24 +800,54 @@ func MakeMainScreen() fyne.CanvasObject {
 }
 
 func loadRoom(name string) {
+	clearUnread(name)
 	if item, ok := openTabs[name]; ok {
 		docTabs.Select(item)
 		return
 	}
-	go Client.JoinRoom(name)
+	go func() {
+		topic, err := Client.JoinRoom(name)
+		if err != nil {
+			return
+		}
+		fyne.Do(func() { setTopic(name, topic) })
+		users, err := Client.RoomPresence(name)
+		if err != nil {
+			return
+		}
+		fyne.Do(func() {
+			for _, u := range users {
+				updatePresence(name, u.Email, true)
+			}
+		})
+	}()
 
 	messagesBox := container.NewVBox()
 	scroll := container.NewVScroll(messagesBox)
+	scroll.OnScrolled = func(pos fyne.Position) {
+		if pos.Y <= 0 {
+			loadOlderHistory(name)
+		}
+	}
 	input := NewSubmitEntry()
 	input.SetPlaceHolder(fmt.Sprintf("Message %s...", name))
 
 	doSend := func(txt string) {
 		if txt != "" {
-			go Client.SendMessage(name, txt)
+			go func() {
+				if err := Client.SendMessage(name, txt); err != nil {
+					fyne.Do(func() { dialog.ShowError(err, window) })
+				}
+			}()
 			input.SetText("")
 		}
 	}
 	input.OnSubmit = doSend
+	input.OnChanged = func(txt string) {
+		if txt != "" {
+			go Client.SendTyping(name)
+		}
+	}
 	sendBtn := widget.NewButtonWithIcon("", theme.MailSendIcon(), func() { doSend(input.Text) })
 
 	fileBtn := widget.NewButtonWithIcon("", theme.FileIcon(), func() {
@@ -332,8 +865,55 @@ func loadRoom(name string) {
 		d.Show()
 	})
 
-	inputBar := container.NewBorder(nil, nil, nil, container.NewHBox(fileBtn, sendBtn), input)
-	tabLayout := container.NewBorder(nil, container.NewPadded(inputBar), nil, nil, container.NewPadded(scroll))
+	// Unlike fileBtn's direct offer, an attachment is stored on the server
+	// and stays in the room's history
+	attachBtn := widget.NewButtonWithIcon("", theme.UploadIcon(), func() {
+		d := dialog.NewFileOpen(func(reader fyne.URIReadCloser, err error) {
+			if err != nil || reader == nil {
+				return
+			}
+			defer reader.Close()
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				dialog.ShowError(err, window)
+				return
+			}
+			fileName := reader.URI().Name()
+			go func() {
+				a, err := Client.UploadAttachment(name, fileName, data)
+				if err == nil {
+					err = Client.SendAttachment(name, a, "")
+				}
+				if err != nil {
+					fyne.Do(func() { dialog.ShowError(err, window) })
+				}
+			}()
+		}, window)
+		d.Show()
+	})
+
+	typingLabel := widget.NewLabel("")
+	typingLabel.TextStyle = fyne.TextStyle{Italic: true}
+	typingLabel.Hide()
+
+	inputBar := container.NewBorder(nil, nil, nil, container.NewHBox(fileBtn, attachBtn, sendBtn), input)
+	bottom := container.NewVBox(typingLabel, container.NewPadded(inputBar))
+	memberLabel := widget.NewLabel("")
+	topicLabel := widget.NewLabel("")
+	topicLabel.Wrapping = fyne.TextWrapWord
+	topicLabel.Hide()
+	notifySelect := widget.NewSelect(notifyOptions, nil)
+	notifySelect.SetSelectedIndex(int(notifyPrefs[name]))
+	notifySelect.OnChanged = func(string) {
+		setNotifyPref(name, pb.NotificationPref(notifySelect.SelectedIndex()))
+	}
+	keyBtn := widget.NewButton(keyButtonText(name), nil)
+	keyBtn.OnTapped = func() { showKeyPicker(name, keyBtn) }
+	keyBtn.Importance = widget.LowImportance
+	exportBtn := widget.NewButton("EXPORT", func() { showExportDialog(name) })
+	exportBtn.Importance = widget.LowImportance
+	header := container.NewBorder(nil, nil, nil, container.NewHBox(exportBtn, keyBtn, notifySelect), container.NewVBox(topicLabel, memberLabel))
+	tabLayout := container.NewBorder(header, bottom, nil, nil, container.NewPadded(scroll))
 	tabItem := container.NewTabItem(name, tabLayout)
 	docTabs.Append(tabItem)
 	docTabs.Select(tabItem)
@@ -341,39 +921,597 @@ func loadRoom(name string) {
 	openTabs[name] = tabItem
 	roomBoxes[name] = messagesBox
 	roomScrolls[name] = scroll
+	typingLabels[name] = typingLabel
+	typists[name] = make(map[string]time.Time)
+	members[name] = make(map[string]bool)
+	memberLabels[name] = memberLabel
+	topicLabels[name] = topicLabel
 }
 
 func ListenForMessages() {
 	for msg := range Client.MsgChan {
 		m := msg
+		switch m.Command {
+		case "typing":
+			fyne.Do(func() { showTyping(m) })
+			continue
+		case "join", "leave":
+			fyne.Do(func() { updatePresence(m.RoomId, m.Email, m.Command == "join") })
+			continue
+		case "edited":
+			fyne.Do(func() { applyEdit(m) })
+			continue
+		case "deleted":
+			fyne.Do(func() { applyDelete(m) })
+			continue
+		case "system":
+			fyne.Do(func() { showSystemMessage(m) })
+			continue
+		case "kicked":
+			fyne.Do(func() { showNotice(m.RoomId, m.Email+" was removed from the room") })
+			continue
+		case "ack":
+			fyne.Do(func() { showAck(m) })
+			continue
+		case "topic":
+			fyne.Do(func() { changeTopic(m) })
+			continue
+		}
 		switch m.Type {
 		case pb.ChatMessage_FILE_CONTROL:
 			handleFileControl(m)
 		case pb.ChatMessage_TEXT:
-			fyne.Do(func() { renderTextMessage(m) })
+			fyne.Do(func() {
+				renderTextMessage(m)
+				countUnread(m)
+				notifyMessage(m)
+			})
 		case pb.ChatMessage_FILE_CHUNK:
 			handleFileChunk(m)
 		}
 	}
 }
 
+// showPending adds a placeholder for a message held in the outbox. It is
+// removed once the message is sent, and the server's echo takes its place.
+func showPending(roomID string, localID int64, text string) {
+	box, ok := roomBoxes[roomID]
+	if !ok {
+		return
+	}
+	label := widget.NewLabelWithStyle("(sending) "+text, fyne.TextAlignLeading, fyne.TextStyle{Italic: true})
+	label.Importance = widget.LowImportance
+	label.Wrapping = fyne.TextWrapWord
+	pendingLabels[localID] = pendingLabel{roomID: roomID, obj: label}
+	box.Add(label)
+	roomScrolls[roomID].ScrollToBottom()
+}
+
+func clearPending(localID int64) {
+	p, ok := pendingLabels[localID]
+	if !ok {
+		return
+	}
+	delete(pendingLabels, localID)
+	if box, ok := roomBoxes[p.roomID]; ok {
+		box.Remove(p.obj)
+	}
+}
+
+// showReconnecting swaps a room's member count for a notice while its stream
+// is being re-established.
+func showReconnecting(roomID string, reconnecting bool) {
+	label, ok := memberLabels[roomID]
+	if !ok {
+		return
+	}
+	if reconnecting {
+		label.SetText("reconnecting…")
+		return
+	}
+	label.SetText(fmt.Sprintf("%d online", len(members[roomID])))
+}
+
+// updatePresence adds or removes a member and refreshes the room's count.
+func updatePresence(roomID, email string, online bool) {
+	who, ok := members[roomID]
+	if !ok {
+		return
+	}
+	if online {
+		who[email] = true
+	} else {
+		delete(who, email)
+	}
+	memberLabels[roomID].SetText(fmt.Sprintf("%d online", len(who)))
+}
+
+// showTyping records a typing signal and schedules the line to expire.
+func showTyping(m *pb.ChatMessage) {
+	if m.Email == Client.User.Email {
+		return
+	}
+	who, ok := typists[m.RoomId]
+	if !ok {
+		return
+	}
+	who[m.Email] = time.Now()
+	refreshTyping(m.RoomId)
+	time.AfterFunc(typingTimeout, func() {
+		fyne.Do(func() { refreshTyping(m.RoomId) })
+	})
+}
+
+// refreshTyping redraws a room's typing line, dropping stale typists.
+func refreshTyping(roomID string) {
+	label, ok := typingLabels[roomID]
+	if !ok {
+		return
+	}
+	var names []string
+	for email, seen := range typists[roomID] {
+		if time.Since(seen) >= typingTimeout {
+			delete(typists[roomID], email)
+			continue
+		}
+		names = append(names, email)
+	}
+	if len(names) == 0 {
+		label.Hide()
+		return
+	}
+	sort.Strings(names)
+	verb := "is"
+	if len(names) > 1 {
+		verb = "are"
+	}
+	label.SetText(fmt.Sprintf("%s %s typing...", strings.Join(names, ", "), verb))
+	label.Show()
+}
+
+// showNotice adds a line from the server, such as a moderation event, to a room.
+func showNotice(roomID, text string) {
+	box, ok := roomBoxes[roomID]
+	if !ok {
+		return
+	}
+	notice := widget.NewLabelWithStyle(text, fyne.TextAlignCenter, fyne.TextStyle{Italic: true})
+	box.Add(notice)
+	roomScrolls[roomID].ScrollToBottom()
+}
+
+// setTopic shows a room's topic in its header, or hides the line when there
+// is none.
+func setTopic(roomID, topic string) {
+	label, ok := topicLabels[roomID]
+	if !ok {
+		return
+	}
+	label.SetText(topic)
+	if topic == "" {
+		label.Hide()
+	} else {
+		label.Show()
+	}
+}
+
+// changeTopic applies a live topic change and says who made it.
+func changeTopic(m *pb.ChatMessage) {
+	topic := m.GetMessageContent()
+	setTopic(m.RoomId, topic)
+	who := Client.DisplayName(m.UserId, m.Email)
+	if topic == "" {
+		showNotice(m.RoomId, who+" cleared the topic")
+		return
+	}
+	showNotice(m.RoomId, who+" set the topic: "+topic)
+}
+
+// showAck warns when one of our messages didn't make it into history. A
+// stored message needs nothing: the server's echo already shows it.
+func showAck(m *pb.ChatMessage) {
+	switch m.Ack {
+	case pb.ChatMessage_BROADCAST_ONLY:
+		showNotice(m.RoomId, "A message you sent was delivered but not saved to history")
+	case pb.ChatMessage_REJECTED:
+		showNotice(m.RoomId, "A message you sent was rejected by the server and not delivered")
+	}
+}
+
+// showSystemMessage renders an operator notice, set apart from chat.
+func showSystemMessage(m *pb.ChatMessage) {
+	box, ok := roomBoxes[m.RoomId]
+	if !ok {
+		return
+	}
+	text := fmt.Sprintf("[%s] SYSTEM: %s", sentAt(m).Format(clockFormat), m.GetMessageContent())
+	notice := widget.NewLabelWithStyle(text, fyne.TextAlignLeading, fyne.TextStyle{Bold: true})
+	notice.Importance = widget.WarningImportance
+	notice.Wrapping = fyne.TextWrapWord
+	box.Add(notice)
+	roomScrolls[m.RoomId].ScrollToBottom()
+}
+
 func renderTextMessage(m *pb.ChatMessage) {
 	box, ok := roomBoxes[m.RoomId]
 	if !ok {
 		return
 	}
+	box.Objects = slices.Insert(box.Objects, orderIndex(box.Objects, m), makeTextMessage(m))
+	layoutRoom(m.RoomId)
+	msgs := roomMessages[m.RoomId]
+	i := len(msgs)
+	for i > 0 && shownBefore(m, msgs[i-1]) {
+		i--
+	}
+	roomMessages[m.RoomId] = slices.Insert(msgs, i, m)
+	roomScrolls[m.RoomId].ScrollToBottom()
+
+	// Their message has landed, so they are no longer typing
+	if _, ok := typists[m.RoomId][m.Email]; ok {
+		delete(typists[m.RoomId], m.Email)
+		refreshTyping(m.RoomId)
+	}
+}
+
+// orderIndex is where m goes in a room box: after the last message that
+// doesn't belong after it, so one that arrives late still lands in the
+// room's order.
+func orderIndex(objs []fyne.CanvasObject, m *pb.ChatMessage) int {
+	i := len(objs)
+	for j := len(objs) - 1; j >= 0; j-- {
+		sm, ok := shownMessages[objs[j]]
+		if !ok {
+			continue
+		}
+		if !shownBefore(m, sm.msg) {
+			break
+		}
+		i = j
+	}
+	return i
+}
+
+// shownBefore reports whether a belongs above b: by seq when both have one,
+// otherwise by time. Ties keep arrival order.
+func shownBefore(a, b *pb.ChatMessage) bool {
+	if a.Seq != 0 && b.Seq != 0 {
+		return a.Seq < b.Seq
+	}
+	return sentAt(a).Before(sentAt(b))
+}
+
+func makeTextMessage(m *pb.ChatMessage) fyne.CanvasObject {
+	stamp := canvas.NewText(messageHeader(m), theme.PrimaryColor())
+	stamp.TextSize = 10
+	sender := Client.DisplayName(m.UserId, m.Email)
+	col := senderColor(m.UserId, m.Email)
+	name := canvas.NewText("<"+sender+">", col)
+	name.TextSize = 10
+	name.TextStyle = fyne.TextStyle{Bold: true}
+	avatar, initial := newAvatar(sender, col)
+	who := container.NewHBox(avatar, name)
+	header := container.NewHBox(who, stamp)
+	text := decryptContent(m)
+	body := NewMessageText(text)
+	content := fyne.CanvasObject(body)
+	if m.Attachment != nil {
+		content = container.NewVBox(body, newAttachmentButton(m.Attachment))
+	}
+
+	// Only messages that have been stored carry an ID we can edit by
+	if m.Id == 0 {
+		obj := container.NewVBox(header, content)
+		shownMessages[obj] = &shownMessage{msg: m, who: who}
+		return obj
+	}
+	mb := &messageBody{roomID: m.RoomId, sender: m.UserId, header: stamp, name: name, initial: initial, body: body, text: text}
+	messageBodies[m.Id] = mb
+
+	if m.Email != Client.User.Email {
+		mb.obj = container.NewVBox(header, content)
+		shownMessages[mb.obj] = &shownMessage{msg: m, who: who}
+		return mb.obj
+	}
+	id := m.Id
+	editBtn := widget.NewButtonWithIcon("", theme.DocumentCreateIcon(), func() {
+		showEditDialog(m.RoomId, id, mb.text)
+	})
+	editBtn.Importance = widget.LowImportance
+	deleteBtn := widget.NewButtonWithIcon("", theme.DeleteIcon(), func() {
+		dialog.ShowConfirm("Delete Message", "Delete this message for everyone?", func(ok bool) {
+			if !ok {
+				return
+			}
+			go func() {
+				if err := Client.DeleteMessage(id); err != nil {
+					fyne.Do(func() { dialog.ShowError(err, window) })
+				}
+			}()
+		}, window)
+	})
+	deleteBtn.Importance = widget.LowImportance
+	mb.obj = container.NewVBox(container.NewBorder(nil, nil, nil, container.NewHBox(editBtn, deleteBtn), header), content)
+	shownMessages[mb.obj] = &shownMessage{msg: m, who: who}
+	return mb.obj
+}
+
+// groupWindow is how soon after a sender's previous message another one
+// joins it under the same header.
+const groupWindow = 5 * time.Minute
+
+// shownMessage is a rendered text message. who, the sender's avatar and
+// name, is hidden when the message continues its sender's group.
+type shownMessage struct {
+	msg *pb.ChatMessage
+	who fyne.CanvasObject
+}
+
+// clockFormat shows message times to the millisecond, so quick messages
+// can be told apart.
+const clockFormat = "15:04:05.000"
+
+// sentAt is when the server received m, to the millisecond from servers
+// that send timestamp_ms.
+func sentAt(m *pb.ChatMessage) time.Time {
+	if m.TimestampMs != 0 {
+		return time.UnixMilli(m.TimestampMs)
+	}
+	return time.Unix(m.Timestamp, 0)
+}
+
+// dayKey identifies the local calendar day of a Unix time.
+func dayKey(ts int64) string {
+	return time.Unix(ts, 0).Format("2006-01-02")
+}
+
+// continuesGroup reports whether m can share prev's header: same sender,
+// same day and within groupWindow.
+func continuesGroup(prev, m *pb.ChatMessage) bool {
+	if prev == nil || prev.UserId != m.UserId || prev.Email != m.Email || dayKey(prev.Timestamp) != dayKey(m.Timestamp) {
+		return false
+	}
+	gap := time.Duration(m.Timestamp-prev.Timestamp) * time.Second
+	return gap >= 0 && gap <= groupWindow
+}
+
+func newDateSeparator(ts int64) fyne.CanvasObject {
+	label := widget.NewLabelWithStyle("── "+time.Unix(ts, 0).Format("Monday, January 2, 2006")+" ──", fyne.TextAlignCenter, fyne.TextStyle{Bold: true})
+	label.Importance = widget.LowImportance
+	return label
+}
+
+// layoutRoom puts a date separator before the first message of each day and
+// hides the sender of messages that continue a group. It works over the
+// whole box, so it stays right when older history is added above or a
+// message is removed. Anything else in the box (notices, pending messages)
+// ends a group. Existing separators are reused where they still fit.
+func layoutRoom(roomID string) {
+	box, ok := roomBoxes[roomID]
+	if !ok {
+		return
+	}
+	objs := make([]fyne.CanvasObject, 0, len(box.Objects)+1)
+	var prev *pb.ChatMessage
+	var lastDay string
+	var spare fyne.CanvasObject // A separator waiting to be reused or dropped
+	for _, o := range box.Objects {
+		if _, ok := dateSeparators[o]; ok {
+			if spare != nil {
+				delete(dateSeparators, spare)
+			}
+			spare = o
+			continue
+		}
+		sm, ok := shownMessages[o]
+		if !ok {
+			objs = append(objs, o)
+			prev = nil
+			continue
+		}
+		if day := dayKey(sm.msg.Timestamp); day != lastDay {
+			if spare != nil && dateSeparators[spare] == day {
+				objs = append(objs, spare)
+				spare = nil
+			} else {
+				sep := newDateSeparator(sm.msg.Timestamp)
+				dateSeparators[sep] = day
+				objs = append(objs, sep)
+			}
+			lastDay = day
+			prev = nil
+		}
+		if continuesGroup(prev, sm.msg) {
+			sm.who.Hide()
+		} else {
+			sm.who.Show()
+		}
+		objs = append(objs, o)
+		prev = sm.msg
+	}
+	if spare != nil {
+		delete(dateSeparators, spare)
+	}
+	box.Objects = objs
+	box.Refresh()
+}
+
+// refreshSenderNames shows name instead of the email in the headers of
+// userID's messages once their profile has been fetched.
+func refreshSenderNames(userID, name string) {
+	if name == "" {
+		return
+	}
+	for _, mb := range messageBodies {
+		if mb.sender != userID || mb.name.Text == "<"+name+">" {
+			continue
+		}
+		mb.name.Text = "<" + name + ">"
+		mb.name.Refresh()
+		mb.initial.Text = senderInitial(name)
+		mb.initial.Refresh()
+	}
+}
+
+// messageHeader is the time and key status shown after the sender's name.
+func messageHeader(m *pb.ChatMessage) string {
+	header := fmt.Sprintf("[%s]", sentAt(m).Format(clockFormat))
+	// Expired keys still decrypt, but say so
+	if m.HotSauce != "" && KeyExpired(m.HotSauce) {
+		header += " [expired key]"
+	}
+	return header
+}
+
+func decryptContent(m *pb.ChatMessage) string {
 	content := m.GetMessageContent()
 	if m.HotSauce != "" {
 		if dec, err := DecryptMessage(content, m.HotSauce, m.Iv); err == nil {
 			content = dec
 		}
 	}
-	header := canvas.NewText(fmt.Sprintf("[%s] <%s>", time.Unix(m.Timestamp, 0).Format("15:04:05"), m.Email), theme.PrimaryColor())
-	header.TextSize = 10
-	body := widget.NewLabel(content)
-	body.Wrapping = fyne.TextWrapWord
-	box.Add(container.NewVBox(header, body))
-	roomScrolls[m.RoomId].ScrollToBottom()
+	return content
+}
+
+// newAttachmentButton shows an attachment's name and size; tapping it
+// downloads the file and asks where to save it.
+func newAttachmentButton(a *pb.Attachment) fyne.CanvasObject {
+	btn := widget.NewButtonWithIcon(fmt.Sprintf("%s (%s)", a.FileName, formatSize(a.Size)), theme.DownloadIcon(), nil)
+	btn.Importance = widget.LowImportance
+	btn.Alignment = widget.ButtonAlignLeading
+	btn.OnTapped = func() {
+		go func() {
+			data, err := Client.DownloadAttachment(a)
+			fyne.Do(func() {
+				if err != nil {
+					dialog.ShowError(err, window)
+					return
+				}
+				save := dialog.NewFileSave(func(writer fyne.URIWriteCloser, err error) {
+					if err != nil || writer == nil {
+						return
+					}
+					defer writer.Close()
+					if _, err := writer.Write(data); err != nil {
+						dialog.ShowError(err, window)
+					}
+				}, window)
+				save.SetFileName(a.FileName)
+				save.Show()
+			})
+		}()
+	}
+	return btn
+}
+
+// formatSize renders a byte count for people.
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+func showEditDialog(roomID string, id int64, current string) {
+	entry := widget.NewMultiLineEntry()
+	entry.SetText(current)
+	entry.Wrapping = fyne.TextWrapWord
+	dialog.ShowForm("Edit Message", "Save", "Cancel", []*widget.FormItem{
+		widget.NewFormItem("", entry),
+	}, func(ok bool) {
+		if !ok || entry.Text == "" || entry.Text == current {
+			return
+		}
+		go func() {
+			if err := Client.EditMessage(roomID, id, entry.Text); err != nil {
+				fyne.Do(func() { dialog.ShowError(err, window) })
+			}
+		}()
+	}, window)
+}
+
+// applyDelete removes a deleted message's bubble from its room.
+func applyDelete(m *pb.ChatMessage) {
+	mb, ok := messageBodies[m.Id]
+	if !ok {
+		return
+	}
+	delete(messageBodies, m.Id)
+	delete(shownMessages, mb.obj)
+	if box, ok := roomBoxes[mb.roomID]; ok {
+		box.Remove(mb.obj)
+		layoutRoom(mb.roomID)
+	}
+	roomMessages[mb.roomID] = slices.DeleteFunc(roomMessages[mb.roomID], func(rm *pb.ChatMessage) bool {
+		return rm.Id == m.Id
+	})
+}
+
+// applyEdit re-renders an edited message in place, if it is on screen.
+func applyEdit(m *pb.ChatMessage) {
+	mb, ok := messageBodies[m.Id]
+	if !ok {
+		return
+	}
+	mb.text = decryptContent(m)
+	SetMessageText(mb.body, mb.text)
+	for i, rm := range roomMessages[mb.roomID] {
+		if rm.Id == m.Id {
+			edited := proto.Clone(rm).(*pb.ChatMessage)
+			edited.Payload = m.Payload
+			edited.Iv = m.Iv
+			edited.HotSauce = m.HotSauce
+			roomMessages[mb.roomID][i] = edited
+			break
+		}
+	}
+	if !strings.HasSuffix(mb.header.Text, " (edited)") {
+		mb.header.Text += " (edited)"
+		mb.header.Refresh()
+	}
+}
+
+// loadOlderHistory prepends the previous page of messages when the user
+// scrolls to the top of a room.
+func loadOlderHistory(name string) {
+	if loadingHistory[name] || !Client.HasOlderHistory(name) {
+		return
+	}
+	loadingHistory[name] = true
+
+	go func() {
+		msgs, err := Client.GetHistory(name)
+		fyne.Do(func() {
+			loadingHistory[name] = false
+			if err != nil {
+				fmt.Printf("History Error [%s]: %v\n", name, err)
+				return
+			}
+			prependHistory(name, msgs)
+		})
+	}()
+}
+
+// prependHistory adds an older page of messages above what a room shows.
+func prependHistory(name string, msgs []*pb.ChatMessage) {
+	box, ok := roomBoxes[name]
+	if !ok || len(msgs) == 0 {
+		return
+	}
+	var older []fyne.CanvasObject
+	var olderMsgs []*pb.ChatMessage
+	for _, m := range msgs {
+		if m.Type == pb.ChatMessage_TEXT {
+			older = append(older, makeTextMessage(m))
+			olderMsgs = append(olderMsgs, m)
+		}
+	}
+	box.Objects = append(older, box.Objects...)
+	layoutRoom(name)
+	roomMessages[name] = append(olderMsgs, roomMessages[name]...)
 }
 
 func handleFileControl(m *pb.ChatMessage) {
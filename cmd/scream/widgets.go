@@ -7,10 +7,18 @@ import (
 	"fyne.io/fyne/v2/widget"
 )
 
-// SubmitEntry is a MultiLineEntry that submits on Enter, and newlines on Shift+Enter
+// maxInputHistory is how many submitted texts SubmitEntry remembers.
+const maxInputHistory = 50
+
+// SubmitEntry is a MultiLineEntry that submits on Enter, and newlines on Shift+Enter.
+// Up and Down on the first line recall previously submitted texts.
 type SubmitEntry struct {
 	widget.Entry
 	OnSubmit func(string)
+
+	history []string // Oldest first, at most maxInputHistory
+	histPos int      // Index into history being shown, len(history) when not recalling
+	draft   string   // What was typed before recall started
 }
 
 func NewSubmitEntry() *SubmitEntry {
@@ -44,16 +52,81 @@ func (e *SubmitEntry) TypedKey(key *fyne.KeyEvent) {
 
 		// 3. Otherwise, Submit
 		if e.OnSubmit != nil && e.Text != "" {
+			e.remember(e.Text)
 			e.OnSubmit(e.Text)
 			// We do NOT call e.Entry.TypedKey(key) here to prevent the newline
 		}
 		return
 	}
 
+	if key.Name == fyne.KeyUp && e.recallOlder() {
+		return
+	}
+	if key.Name == fyne.KeyDown && e.recallNewer() {
+		return
+	}
+
 	// Process all other keys normally
 	e.Entry.TypedKey(key)
 }
 
+// remember adds a submitted text to the history and ends any recall.
+func (e *SubmitEntry) remember(text string) {
+	if n := len(e.history); n == 0 || e.history[n-1] != text {
+		e.history = append(e.history, text)
+		if len(e.history) > maxInputHistory {
+			e.history = e.history[len(e.history)-maxInputHistory:]
+		}
+	}
+	e.histPos = len(e.history)
+	e.draft = ""
+}
+
+// recalling reports whether a history entry is shown and still unedited.
+func (e *SubmitEntry) recalling() bool {
+	return e.histPos < len(e.history) && e.Text == e.history[e.histPos]
+}
+
+// recallOlder shows the previous history entry. It only acts when the entry
+// is empty, the cursor is on the first line, or an entry is being recalled,
+// so Up still moves through multi-line text.
+func (e *SubmitEntry) recallOlder() bool {
+	if len(e.history) == 0 || (e.Text != "" && e.CursorRow != 0 && !e.recalling()) {
+		return false
+	}
+	if !e.recalling() {
+		e.draft = e.Text
+		e.histPos = len(e.history)
+	}
+	if e.histPos == 0 {
+		return true
+	}
+	e.histPos--
+	e.showRecalled(e.history[e.histPos])
+	return true
+}
+
+// recallNewer steps back toward the newest entry and then the draft.
+func (e *SubmitEntry) recallNewer() bool {
+	if !e.recalling() {
+		return false
+	}
+	e.histPos++
+	if e.histPos == len(e.history) {
+		e.showRecalled(e.draft)
+		e.draft = ""
+		return true
+	}
+	e.showRecalled(e.history[e.histPos])
+	return true
+}
+
+func (e *SubmitEntry) showRecalled(text string) {
+	e.SetText(text)
+	e.CursorRow, e.CursorColumn = 0, 0
+	e.Refresh()
+}
+
 func (e *SubmitEntry) Keyboard() mobile.KeyboardType {
 	return mobile.DefaultKeyboard
 }
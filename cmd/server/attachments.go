@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rexlx/squall/internal"
+	pb "github.com/rexlx/squall/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Attachment limits used when Config leaves them unset.
+const (
+	DefaultMaxAttachmentBytes = 10 << 20
+	DefaultAttachmentTypes    = "image/png,image/jpeg,image/gif,image/webp,application/pdf,text/plain,application/zip,application/octet-stream"
+)
+
+// attachmentChunkSize is how much DownloadAttachment sends per message.
+const attachmentChunkSize = 256 << 10
+
+// sniffBytes is how much of an upload http.DetectContentType looks at.
+const sniffBytes = 512
+
+// AttachmentStore holds attachment contents by ID. Who uploaded what, and
+// to which room, is kept in the Database, so the store can be a directory
+// or an object store.
+type AttachmentStore interface {
+	Put(ctx context.Context, id string, r io.Reader) error
+	Open(ctx context.Context, id string) (io.ReadCloser, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// DirStore keeps each attachment in a file named by its ID.
+type DirStore struct {
+	Dir string
+}
+
+func NewDirStore(dir string) (*DirStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &DirStore{Dir: dir}, nil
+}
+
+// Put writes to a temporary file first, so a failed upload never leaves a
+// partial attachment under id.
+func (d *DirStore) Put(ctx context.Context, id string, r io.Reader) error {
+	tmp, err := os.CreateTemp(d.Dir, id+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(d.Dir, id))
+}
+
+func (d *DirStore) Open(ctx context.Context, id string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(d.Dir, id))
+}
+
+func (d *DirStore) Delete(ctx context.Context, id string) error {
+	err := os.Remove(filepath.Join(d.Dir, id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// ParseAttachmentTypes splits a comma separated list of media types.
+func ParseAttachmentTypes(list string) []string {
+	var types []string
+	for _, t := range strings.Split(list, ",") {
+		if t = mediaType(t); t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// mediaType strips parameters such as charset and lowercases t.
+func mediaType(t string) string {
+	if mt, _, err := mime.ParseMediaType(t); err == nil {
+		return mt
+	}
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+// uploadReader reads an UploadAttachment stream's data as one file,
+// hashing it and keeping its first bytes for content sniffing. It fails
+// with err once more than max bytes arrive.
+type uploadReader struct {
+	stream pb.ChatService_UploadAttachmentServer
+	buf    []byte
+	size   int64
+	max    int64
+	sum    hash.Hash
+	head   []byte
+	err    error
+}
+
+func (r *uploadReader) take(data []byte) error {
+	r.size += int64(len(data))
+	if r.size > r.max {
+		r.err = status.Errorf(codes.InvalidArgument, "attachment is larger than %d bytes", r.max)
+		return r.err
+	}
+	r.buf = data
+	return nil
+}
+
+func (r *uploadReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		msg, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		if err := r.take(msg.Data); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.sum.Write(p[:n])
+	if len(r.head) < sniffBytes {
+		r.head = append(r.head, p[:min(n, sniffBytes-len(r.head))]...)
+	}
+	return n, nil
+}
+
+// UploadAttachment stores a file for a room the caller has joined and
+// returns the Attachment to send in a ChatMessage. Unencrypted files are
+// typed by their content rather than by what the client claims.
+func (s *GrpcServer) UploadAttachment(stream pb.ChatService_UploadAttachmentServer) error {
+	ctx := stream.Context()
+	user, err := GetUserFromContext(ctx)
+	if err != nil {
+		return status.Error(codes.Unauthenticated, "upload is not authenticated")
+	}
+	if s.Attachments == nil {
+		return status.Error(codes.Unimplemented, "attachments are disabled on this server")
+	}
+
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if first.RoomId == "" || first.FileName == "" {
+		return status.Error(codes.InvalidArgument, "room_id and file_name are required")
+	}
+	if err := s.checkMembership(ctx, user, first.RoomId); err != nil {
+		return err
+	}
+	contentType := mediaType(first.ContentType)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if !slices.Contains(s.AttachmentTypes, contentType) {
+		return status.Errorf(codes.InvalidArgument, "attachments of type %s are not allowed", contentType)
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return status.Error(codes.Internal, "failed to create attachment")
+	}
+	a := internal.Attachment{
+		ID:          hex.EncodeToString(b),
+		RoomID:      first.RoomId,
+		UserID:      user.ID,
+		FileName:    filepath.Base(first.FileName),
+		ContentType: contentType,
+		IV:          first.Iv,
+		HotSauce:    first.HotSauce,
+	}
+
+	up := &uploadReader{stream: stream, max: s.MaxAttachmentBytes, sum: sha256.New()}
+	if err := up.take(first.Data); err != nil {
+		return err
+	}
+	if err := s.Attachments.Put(ctx, a.ID, up); err != nil {
+		if up.err != nil {
+			return up.err
+		}
+		s.appServer.Logger.Printf("Failed to store attachment from %s: %v", user.Email, err)
+		return status.Error(codes.Internal, "failed to store attachment")
+	}
+	discard := func() { s.Attachments.Delete(context.Background(), a.ID) }
+
+	if up.size == 0 {
+		discard()
+		return status.Error(codes.InvalidArgument, "attachment is empty")
+	}
+	if a.HotSauce == "" {
+		if sniffed := mediaType(http.DetectContentType(up.head)); sniffed != "application/octet-stream" {
+			a.ContentType = sniffed
+		}
+		if !slices.Contains(s.AttachmentTypes, a.ContentType) {
+			discard()
+			return status.Errorf(codes.InvalidArgument, "attachments of type %s are not allowed", a.ContentType)
+		}
+	}
+	a.Size = up.size
+	a.SHA256 = hex.EncodeToString(up.sum.Sum(nil))
+
+	if err := s.appServer.DB.StoreAttachment(ctx, a); err != nil {
+		discard()
+		s.appServer.Logger.Printf("Failed to record attachment from %s: %v", user.Email, err)
+		return status.Error(codes.Internal, "failed to store attachment")
+	}
+	s.appServer.Events.Info("attachment uploaded", "event", "attachment_upload", "user_id", user.ID,
+		"room_id", a.RoomID, "attachment_id", a.ID, "bytes", a.Size, "content_type", a.ContentType)
+	return stream.SendAndClose(AttachmentToProto(a))
+}
+
+// DownloadAttachment streams an attachment to anyone allowed to read its
+// room's history.
+func (s *GrpcServer) DownloadAttachment(req *pb.AttachmentRequest, stream pb.ChatService_DownloadAttachmentServer) error {
+	ctx := stream.Context()
+	if s.Attachments == nil {
+		return status.Error(codes.Unimplemented, "attachments are disabled on this server")
+	}
+	a, err := s.appServer.DB.GetAttachment(ctx, req.Id)
+	if err != nil {
+		return status.Error(codes.NotFound, "attachment not found")
+	}
+	if err := s.checkRoomAccess(ctx, a.RoomID); err != nil {
+		return err
+	}
+
+	f, err := s.Attachments.Open(ctx, a.ID)
+	if err != nil {
+		s.appServer.Logger.Printf("Failed to open attachment %s: %v", a.ID, err)
+		return status.Error(codes.Internal, "failed to read attachment")
+	}
+	defer f.Close()
+
+	chunk := &pb.AttachmentChunk{Attachment: AttachmentToProto(a)}
+	buf := make([]byte, attachmentChunkSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 || chunk.Attachment != nil {
+			chunk.Data = buf[:n]
+			if err := stream.Send(chunk); err != nil {
+				return err
+			}
+			chunk = &pb.AttachmentChunk{}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return status.Error(codes.Internal, "failed to read attachment")
+		}
+	}
+}
+
+// resolveAttachment replaces the attachment a client put on msg with the
+// server's record of it. Senders may only attach their own uploads to the
+// room they were uploaded to.
+// StartAttachmentReaper deletes attachments no live message refers to every
+// checkInterval until ctx is cancelled: uploads that were never posted, and
+// those whose messages were since pruned or deleted. grace gives a fresh
+// upload time to be posted first.
+func (s *GrpcServer) StartAttachmentReaper(ctx context.Context, checkInterval, grace time.Duration) {
+	s.appServer.Logger.Printf("Attachment Reaper started (Check every %s, grace %s)", checkInterval, grace)
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		start := time.Now()
+		ids, err := s.appServer.DB.ReapAttachments(ctx, grace)
+		if err != nil {
+			s.appServer.Logger.Printf("Attachment Reaper failed: %v", err)
+			continue
+		}
+		s.deleteAttachmentFiles(ctx, ids)
+		s.appServer.Logger.Printf("Attachment Reaper removed %d attachments in %v", len(ids), time.Since(start))
+	}
+}
+
+// deleteAttachmentFiles removes the stored files of attachments whose rows
+// are already gone. Failures are logged; an orphaned file costs only disk.
+func (s *GrpcServer) deleteAttachmentFiles(ctx context.Context, ids []string) {
+	if s.Attachments == nil {
+		return
+	}
+	for _, id := range ids {
+		if err := s.Attachments.Delete(ctx, id); err != nil {
+			s.appServer.Logger.Printf("Failed to delete attachment %s: %v", id, err)
+		}
+	}
+}
+
+func (s *GrpcServer) resolveAttachment(cs *clientStream, msg *pb.ChatMessage) bool {
+	if s.Attachments == nil || msg.Type != pb.ChatMessage_TEXT {
+		return false
+	}
+	a, err := s.appServer.DB.GetAttachment(cs.Context(), msg.Attachment.Id)
+	if err != nil || a.RoomID != msg.RoomId || a.UserID != cs.user.ID {
+		return false
+	}
+	msg.Attachment = AttachmentToProto(a)
+	return true
+}
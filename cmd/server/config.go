@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// insecureDevDSN is only used with -db postgres, no DSN and SQUALL_DEV=true.
+const insecureDevDSN = "user=rxlx password=thereISnosp0)n host=localhost dbname=chaps sslmode=disable"
+
+// Config is everything the server reads at startup. LoadConfig fills it
+// from flags and the environment; nothing else in the server reads flags
+// or startup environment variables.
+type Config struct {
+	FirstUse bool
+
+	// ListenAddr is the gRPC listen address, from -addr or PORT
+	ListenAddr  string
+	MetricsAddr string
+	// GatewayAddr serves browser clients over HTTP; empty disables it
+	GatewayAddr string
+	// GatewayREST adds the JSON API to the gateway
+	GatewayREST bool
+	// CORSOrigins lists the web origins allowed to call the gateway;
+	// empty turns CORS off
+	CORSOrigins     string
+	CORSMethods     string
+	CORSHeaders     string
+	CORSCredentials bool
+
+	// TLS is off with DISABLE_TLS=true, when TLS is terminated upstream
+	TLS         bool
+	TLSCertFile string
+	TLSKeyFile  string
+
+	DBBackend  string
+	DSN        string
+	SQLitePath string
+	Pool       PoolConfig
+	// DBTimeout bounds each database call, except the prune and reap jobs'
+	// statements, which DBMaintenanceTimeout bounds
+	DBTimeout            time.Duration
+	DBMaintenanceTimeout time.Duration
+	// DevDSN is set when DSN fell back to insecureDevDSN
+	DevDSN bool
+
+	JWTAlg    string
+	JWTSecret string
+	// JWTRandomSecret signs with a secret generated at startup (dev only)
+	JWTRandomSecret   bool
+	JWTPrivateKeyFile string
+	JWTPublicKeyFile  string
+	TokenTTL          time.Duration
+	RefreshTTL        time.Duration
+	TokenIssuer       string
+
+	RateRPS       int
+	RateBurst     int
+	UserRateRPS   int
+	UserRateBurst int
+
+	PruneInterval time.Duration
+	PruneKeep     int
+	PruneMaxAge   time.Duration
+
+	QueueSize      int
+	QueueBlock     bool
+	DeadLetterPath string
+	OutboxSize     int
+	SlowClient     string
+	// MaxMessageBytes caps chat message content, in bytes
+	MaxMessageBytes int
+	Heartbeat       time.Duration
+
+	// AttachmentsDir holds uploaded files; empty disables attachments
+	AttachmentsDir     string
+	MaxAttachmentBytes int64
+	AttachmentTypes    string
+
+	BcryptCost     int
+	PasswordPolicy PasswordPolicy
+
+	LogFormat    string
+	LogPath      string
+	LogMaxSizeMB int
+	LogBackups   int
+	LogToStdout  bool
+}
+
+// LoadConfig parses args (without the program name) and the environment.
+// Flags win over environment variables. It doesn't check the result; call
+// Validate once logging is set up.
+func LoadConfig(args []string) (Config, error) {
+	var cfg Config
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+
+	fs.BoolVar(&cfg.FirstUse, "firstuse", false, "Initialize the server by creating the first admin user")
+	fs.StringVar(&cfg.ListenAddr, "addr", defaultListenAddr(), "gRPC listen address (env PORT sets the port of the default)")
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", ":9090", "Listen address for the HTTP /metrics, /healthz and /readyz endpoints (empty disables)")
+	fs.StringVar(&cfg.GatewayAddr, "gateway-addr", "", "Listen address for browser clients, with the chat WebSocket at /ws (empty disables); uses TLS like gRPC")
+	fs.BoolVar(&cfg.GatewayREST, "gateway-rest", false, "Also serve a JSON API (/api/login, /api/rooms, history) on -gateway-addr")
+	fs.StringVar(&cfg.CORSOrigins, "cors-origins", "", "Comma separated origins (e.g. https://chat.example.com) whose pages may call the gateway; * allows any (empty disables CORS)")
+	fs.StringVar(&cfg.CORSMethods, "cors-methods", DefaultCORSMethods, "Comma separated methods allowed in CORS requests")
+	fs.StringVar(&cfg.CORSHeaders, "cors-headers", DefaultCORSHeaders, "Comma separated request headers allowed in CORS requests")
+	fs.BoolVar(&cfg.CORSCredentials, "cors-credentials", false, "Allow CORS requests with credentials (cookies, TLS client certificates); not with -cors-origins *")
+	fs.StringVar(&cfg.TLSCertFile, "tls-cert", "data/server-cert.pem", "Server TLS certificate (unless DISABLE_TLS=true)")
+	fs.StringVar(&cfg.TLSKeyFile, "tls-key", "data/server-key.pem", "Server TLS private key (unless DISABLE_TLS=true)")
+
+	fs.StringVar(&cfg.DBBackend, "db", "postgres", "Database backend: postgres or sqlite")
+	fs.StringVar(&cfg.DSN, "dsn", "", "Postgres DSN (falls back to the SQUALL_DSN environment variable)")
+	fs.StringVar(&cfg.SQLitePath, "sqlite-path", "data/squall.db", "Path to the SQLite database file (with -db sqlite)")
+	fs.IntVar(&cfg.Pool.MaxOpenConns, "db-max-open", DefaultPoolConfig.MaxOpenConns, "Maximum open Postgres connections (0 means unlimited)")
+	fs.IntVar(&cfg.Pool.MaxIdleConns, "db-max-idle", DefaultPoolConfig.MaxIdleConns, "Idle Postgres connections kept in the pool")
+	fs.DurationVar(&cfg.Pool.ConnMaxLifetime, "db-conn-lifetime", DefaultPoolConfig.ConnMaxLifetime, "Recycle Postgres connections after this long; keep it below any server or proxy idle timeout (0 keeps them forever)")
+	fs.DurationVar(&cfg.Pool.ConnMaxIdleTime, "db-conn-idle-time", DefaultPoolConfig.ConnMaxIdleTime, "Close Postgres connections idle for this long (0 keeps them)")
+	fs.DurationVar(&cfg.DBTimeout, "db-timeout", DefaultQueryTimeout, "Longest a single database call may run before it is cancelled (pruning and reaping use -db-maintenance-timeout)")
+	fs.DurationVar(&cfg.DBMaintenanceTimeout, "db-maintenance-timeout", DefaultMaintenanceTimeout, "Longest a single prune or reap statement may run before it is cancelled")
+
+	fs.StringVar(&cfg.JWTAlg, "jwt-alg", "HS256", "JWT signing algorithm: HS256 (JWT_SECRET) or RS256 (key files)")
+	fs.BoolVar(&cfg.JWTRandomSecret, "jwt-secret-random", false, "Sign HS256 tokens with a random secret instead of JWT_SECRET; tokens stop working on restart (ephemeral dev runs only)")
+	fs.StringVar(&cfg.JWTPrivateKeyFile, "jwt-private-key", "data/jwt-private.pem", "RSA private key PEM used to sign tokens (with -jwt-alg RS256)")
+	fs.StringVar(&cfg.JWTPublicKeyFile, "jwt-public-key", "", "RSA public key PEM used to verify tokens (default: derived from the private key)")
+	fs.DurationVar(&cfg.TokenTTL, "token-ttl", envDuration("SQUALL_TOKEN_TTL", DefaultAccessTokenTTL), "Access token lifetime (env SQUALL_TOKEN_TTL)")
+	fs.DurationVar(&cfg.RefreshTTL, "refresh-ttl", envDuration("SQUALL_REFRESH_TTL", DefaultRefreshTokenTTL), "Refresh token lifetime (env SQUALL_REFRESH_TTL)")
+	fs.StringVar(&cfg.TokenIssuer, "token-issuer", envString("SQUALL_TOKEN_ISSUER", DefaultTokenIssuer), "JWT issuer, distinct per instance (env SQUALL_TOKEN_ISSUER)")
+
+	fs.IntVar(&cfg.RateRPS, "rate-rps", 5, "Per-IP requests per second")
+	fs.IntVar(&cfg.RateBurst, "rate-burst", 10, "Per-IP burst size")
+	fs.IntVar(&cfg.UserRateRPS, "user-rate-rps", 10, "Per-user requests per second for authenticated calls (0 disables)")
+	fs.IntVar(&cfg.UserRateBurst, "user-rate-burst", 20, "Per-user burst size for authenticated calls")
+
+	fs.DurationVar(&cfg.PruneInterval, "prune-interval", time.Hour, "How often to prune old messages (0 disables pruning)")
+	fs.IntVar(&cfg.PruneKeep, "prune-keep", DefaultRoomMaxMessages, "Messages kept in rooms that have no limit of their own")
+	fs.DurationVar(&cfg.PruneMaxAge, "prune-max-age", 0, "Delete messages older than this (0 disables age-based pruning)")
+
+	fs.IntVar(&cfg.QueueSize, "queue-size", DefaultQueueSize, "Buffer size of the message persistence queue")
+	fs.BoolVar(&cfg.QueueBlock, "queue-block", false, "Block senders when the persistence queue is full instead of dropping messages")
+	fs.StringVar(&cfg.DeadLetterPath, "dead-letter", "data/dead-letter.jsonl", "File that receives messages the DB would not take after retries (empty only logs them)")
+	fs.IntVar(&cfg.OutboxSize, "stream-buffer", DefaultOutboxSize, "Outbound queue length per client stream")
+	fs.StringVar(&cfg.SlowClient, "slow-client", OverflowDropOldest, "When a client's outbound queue is full: drop-oldest or disconnect")
+	fs.IntVar(&cfg.MaxMessageBytes, "max-message-bytes", DefaultMaxMessageBytes, "Largest chat message content accepted, in bytes; bigger messages are dropped and logged")
+	fs.StringVar(&cfg.AttachmentsDir, "attachments-dir", "data/attachments", "Directory that stores uploaded attachments (empty disables attachments)")
+	fs.Int64Var(&cfg.MaxAttachmentBytes, "max-attachment-bytes", DefaultMaxAttachmentBytes, "Largest attachment accepted, in bytes")
+	fs.StringVar(&cfg.AttachmentTypes, "attachment-types", DefaultAttachmentTypes, "Comma separated media types attachments may have")
+	fs.DurationVar(&cfg.Heartbeat, "heartbeat", 30*time.Second, "Interval between stream pings used to detect dead connections (0 disables)")
+
+	fs.IntVar(&cfg.BcryptCost, "bcrypt-cost", bcrypt.DefaultCost, fmt.Sprintf("bcrypt cost for password hashes (%d-%d); weaker stored hashes are upgraded at login", bcrypt.MinCost, bcrypt.MaxCost))
+	fs.IntVar(&cfg.PasswordPolicy.MinLength, "password-min-length", MinPasswordLength, "Shortest password accepted, in characters")
+	complexity := fs.Bool("password-complexity", false, "Require an uppercase and a lowercase letter, a digit and a symbol in passwords")
+
+	fs.StringVar(&cfg.LogFormat, "log-format", LogFormatText, "Log output: text for human-readable lines, json for one JSON object per line")
+	fs.StringVar(&cfg.LogPath, "log", "", "Also append logs to this file (empty logs to stdout only)")
+	fs.IntVar(&cfg.LogMaxSizeMB, "log-max-size", 100, "Rotate the -log file when it reaches this many megabytes (0 never rotates)")
+	fs.IntVar(&cfg.LogBackups, "log-backups", 5, "Rotated -log files to keep as file.1 ... file.N")
+	fs.BoolVar(&cfg.LogToStdout, "log-stdout", true, "Write logs to stdout; set false with -log to log only to the file")
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	cfg.PasswordPolicy.RequireUpper = *complexity
+	cfg.PasswordPolicy.RequireLower = *complexity
+	cfg.PasswordPolicy.RequireDigit = *complexity
+	cfg.PasswordPolicy.RequireSymbol = *complexity
+
+	cfg.TLS = os.Getenv("DISABLE_TLS") != "true"
+	cfg.JWTSecret = os.Getenv("JWT_SECRET")
+
+	// Precedence: -dsn flag, then SQUALL_DSN, then the older DB_DSN variable
+	if cfg.DSN == "" {
+		cfg.DSN = os.Getenv("SQUALL_DSN")
+	}
+	if cfg.DSN == "" {
+		cfg.DSN = os.Getenv("DB_DSN")
+	}
+	if cfg.DSN == "" && cfg.DBBackend == "postgres" && os.Getenv("SQUALL_DEV") == "true" {
+		// Last-resort fallback for local dev only, never use this in a deploy
+		cfg.DSN = insecureDevDSN
+		cfg.DevDSN = true
+	}
+	return cfg, nil
+}
+
+// defaultListenAddr listens on all interfaces, on PORT or 8080.
+func defaultListenAddr() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":8080"
+}
+
+// Validate reports the first setting the server can't start with.
+func (c Config) Validate() error {
+	if c.ListenAddr == "" {
+		return errors.New("-addr must not be empty")
+	}
+	if c.GatewayAddr != "" && (c.GatewayAddr == c.ListenAddr || c.GatewayAddr == c.MetricsAddr) {
+		return errors.New("-gateway-addr must differ from -addr and -metrics-addr")
+	}
+	if c.GatewayREST && c.GatewayAddr == "" {
+		return errors.New("-gateway-rest needs -gateway-addr")
+	}
+	if c.CORSOrigins != "" {
+		if c.GatewayAddr == "" {
+			return errors.New("-cors-origins needs -gateway-addr")
+		}
+		for _, origin := range splitList(c.CORSOrigins) {
+			switch {
+			case origin == "*" && c.CORSCredentials:
+				return errors.New("-cors-credentials can't be used with -cors-origins *")
+			case origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://"):
+				return fmt.Errorf("-cors-origins entry %q must be * or start with http:// or https://", origin)
+			case strings.HasSuffix(origin, "/"):
+				return fmt.Errorf("-cors-origins entry %q must not end with /", origin)
+			}
+		}
+	}
+	if c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("-bcrypt-cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if c.PasswordPolicy.MinLength < 1 {
+		return errors.New("-password-min-length must be at least 1")
+	}
+	switch c.DBBackend {
+	case "postgres":
+		if c.DSN == "" {
+			return errors.New("CRITICAL: no database DSN configured. Pass -dsn or set SQUALL_DSN " +
+				"(e.g. \"user=squall password=... host=localhost dbname=squall sslmode=disable\").")
+		}
+	case "sqlite":
+	default:
+		return fmt.Errorf("Unknown database backend %q (want postgres or sqlite)", c.DBBackend)
+	}
+	switch c.JWTAlg {
+	case "HS256":
+		switch {
+		case c.JWTRandomSecret && c.JWTSecret != "":
+			return errors.New("set JWT_SECRET or -jwt-secret-random, not both")
+		case c.JWTRandomSecret:
+		case c.JWTSecret == "":
+			return errors.New("CRITICAL: JWT_SECRET environment variable must be set (or pass -jwt-secret-random for a throwaway dev server).")
+		case CheckJWTSecret(c.JWTSecret) != nil:
+			return errors.New("CRITICAL: JWT_SECRET is a well-known default; anyone could forge tokens with it. Set a long random secret.")
+		}
+	case "RS256":
+	default:
+		return fmt.Errorf("Unknown JWT algorithm %q (want HS256 or RS256)", c.JWTAlg)
+	}
+	if c.DBTimeout <= 0 {
+		return errors.New("-db-timeout must be positive")
+	}
+	if c.DBMaintenanceTimeout <= 0 {
+		return errors.New("-db-maintenance-timeout must be positive")
+	}
+	if c.AttachmentsDir != "" {
+		if c.MaxAttachmentBytes < 1 {
+			return errors.New("-max-attachment-bytes must be at least 1")
+		}
+		if len(ParseAttachmentTypes(c.AttachmentTypes)) == 0 {
+			return errors.New("-attachment-types must list at least one media type")
+		}
+	}
+	if c.MaxMessageBytes < 1 {
+		return errors.New("-max-message-bytes must be at least 1")
+	}
+	switch c.SlowClient {
+	case OverflowDropOldest, OverflowDisconnect:
+	default:
+		return fmt.Errorf("Unknown -slow-client policy %q (want drop-oldest or disconnect)", c.SlowClient)
+	}
+	return nil
+}
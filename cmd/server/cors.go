@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS defaults for the gateway; the origins have none on purpose.
+const (
+	DefaultCORSMethods = "GET,POST,OPTIONS"
+	DefaultCORSHeaders = "Authorization,Content-Type"
+	corsMaxAge         = 10 * time.Minute
+)
+
+// CORS lets pages from other origins call the browser gateway. Only the
+// listed Origins are answered; "*" has to be listed explicitly and can't
+// be combined with Credentials.
+type CORS struct {
+	Origins     []string
+	Methods     string
+	Headers     string
+	Credentials bool
+}
+
+// NewCORS builds a CORS policy from the comma separated flag values.
+func NewCORS(origins, methods, headers string, credentials bool) *CORS {
+	return &CORS{
+		Origins:     splitList(origins),
+		Methods:     strings.Join(splitList(methods), ", "),
+		Headers:     strings.Join(splitList(headers), ", "),
+		Credentials: credentials,
+	}
+}
+
+func (c *CORS) allowed(origin string) bool {
+	return slices.Contains(c.Origins, "*") || slices.Contains(c.Origins, origin)
+}
+
+// Handler adds CORS headers to next's answers for allowed origins and
+// answers preflight requests itself. Requests without an Origin header,
+// from scripts or same-origin pages, pass through untouched.
+func (c *CORS) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if !c.allowed(origin) {
+			if preflight {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			// Without the headers the browser keeps the answer from the page
+			next.ServeHTTP(w, r)
+			return
+		}
+		if slices.Contains(c.Origins, "*") && !c.Credentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if c.Credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if preflight {
+			h.Set("Access-Control-Allow-Methods", c.Methods)
+			h.Set("Access-Control-Allow-Headers", c.Headers)
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
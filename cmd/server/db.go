@@ -1,50 +1,229 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/rexlx/squall/internal"
 )
 
+// History page sizes for GetHistory; JoinRoom uses the default.
+const (
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 200
+)
+
+// ErrLastAdmin is returned when a purge or role change would remove the only
+// remaining admin.
+var ErrLastAdmin = errors.New("cannot purge the last admin")
+
+// ErrNotAuthor is returned when a user tries to change someone else's message.
+var ErrNotAuthor = errors.New("not the message author")
+
+// Notification preferences as stored in notification_prefs.
+const (
+	NotifyAll      = "all"
+	NotifyMentions = "mentions"
+	NotifyMuted    = "muted"
+)
+
 type Database interface {
-	GetMessage(roomid, messageid string) (internal.Message, error)
-	StoreMessage(roomid string, message internal.Message) error
-	GetUser(userid string) (User, error)
-	StoreUser(user User) error
-	GetRoom(roomid string) (Room, error)
-	StoreRoom(room Room) error
-	GetUserByEmail(email string) (User, error)
-	PruneMessages(keep int) error
-	ReapStaleRooms(threshold time.Duration) error
+	CreateTables(ctx context.Context) error
+	Ping(ctx context.Context) error
+	GetMessage(ctx context.Context, roomid, messageid string) (internal.Message, error)
+	GetReplies(ctx context.Context, roomid string, messageID int64) ([]internal.Message, error)
+	StoreMessage(ctx context.Context, roomid string, message internal.Message) error
+	// StoreMessages stores a batch, all or nothing; each message carries
+	// its own RoomID. It is the save worker's fast path. On success every
+	// message's ID is set to the one it was stored under.
+	StoreMessages(ctx context.Context, messages []internal.Message) error
+	GetUser(ctx context.Context, userid string) (User, error)
+	// StoreUser inserts or updates a user. On update stats and posts are
+	// left alone; AddUserPosts is their only writer.
+	StoreUser(ctx context.Context, user User) error
+	GetRoom(ctx context.Context, roomid string) (Room, error)
+	StoreRoom(ctx context.Context, room Room) error
+	RecordJoin(ctx context.Context, newRoom *Room, email, roomName string) error
+	// SetRole changes only the user's role and returns the one it replaced.
+	// It returns ErrLastAdmin rather than demote the only admin.
+	SetRole(ctx context.Context, userID, role string) (string, error)
+	SetLastLogin(ctx context.Context, userID string, at time.Time) error
+	SetLastActive(ctx context.Context, userID string, at time.Time) error
+	GetUserByEmail(ctx context.Context, email string) (User, error)
+	PruneMessages(ctx context.Context, defaultKeep int) (PruneSummary, error)
+	// PruneMessagesByAge returns how many messages it deleted.
+	PruneMessagesByAge(ctx context.Context, maxAge time.Duration) (int64, error)
+	// ReapStaleRooms deletes the rooms created more than threshold ago that
+	// have had no messages since, with everything DeleteRoom removes. It
+	// returns their IDs and the IDs of the attachments deleted with them.
+	ReapStaleRooms(ctx context.Context, threshold time.Duration) ([]string, []string, error)
+	PurgeUser(ctx context.Context, userid, actorID string, deleteMessages bool) (int64, []string, error)
+	DeleteRoom(ctx context.Context, roomid string) (int64, []string, error)
+	GetHistory(ctx context.Context, roomid string, beforeID int64, limit int) ([]internal.Message, int64, error)
+	// LastSeq returns the highest Seq stored in a room, or 0 for none.
+	LastSeq(ctx context.Context, roomid string) (int64, error)
+	EditMessage(ctx context.Context, messageID int64, userID, content, iv, hotSauce string) (internal.Message, error)
+	DeleteMessage(ctx context.Context, messageID int64, userID string, asAdmin bool) (internal.Message, error)
+	BanUser(ctx context.Context, roomID, userID, bannedBy string) error
+	UnbanUser(ctx context.Context, roomID, userID string) error
+	IsBanned(ctx context.Context, roomID, userID string) (bool, error)
+	MarkRead(ctx context.Context, userID, roomID string, lastMessageID int64) (int64, error)
+	UnreadCounts(ctx context.Context, userID string, roomIDs []string) (map[string]int64, error)
+	// NotificationPrefs returns the user's notification preference for each
+	// room not left at NotifyAll.
+	NotificationPrefs(ctx context.Context, userID string) (map[string]string, error)
+	// SetNotificationPref records one of the Notify values; NotifyAll
+	// clears the room's entry.
+	SetNotificationPref(ctx context.Context, userID, roomID, pref string) error
+	StoreRefreshToken(ctx context.Context, tokenHash, userID string, expiresAt time.Time) error
+	// ConsumeRefreshToken revokes a live (unrevoked, unexpired) refresh
+	// token and returns its user in one statement, so a token can only be
+	// redeemed once. It returns sql.ErrNoRows for any other token.
+	ConsumeRefreshToken(ctx context.Context, tokenHash string) (string, error)
+	RevokeRefreshToken(ctx context.Context, tokenHash string) error
+	// RevokeUserRefreshTokens revokes every refresh token issued to userID.
+	RevokeUserRefreshTokens(ctx context.Context, userID string) error
+	MessageCounts(ctx context.Context) (map[string]int64, error)
+	ListUsers(ctx context.Context) ([]User, error)
+	SearchMessages(ctx context.Context, roomIDs []string, query string, limit int) ([]internal.Message, error)
+	// AddUserPosts adds counts (by user ID) to each user's StatPosts counter
+	// in the hour containing at. Unknown users are skipped.
+	AddUserPosts(ctx context.Context, counts map[string]int64, at time.Time) error
+	// RoomLeaderboard ranks a room's posters by live messages sent in the
+	// last window, most first.
+	RoomLeaderboard(ctx context.Context, roomID string, window time.Duration, limit int) ([]LeaderboardEntry, error)
+	StoreAttachment(ctx context.Context, a internal.Attachment) error
+	GetAttachment(ctx context.Context, id string) (internal.Attachment, error)
+	// ReapAttachments deletes attachments older than grace that no live
+	// message refers to, and returns their IDs so the files can go too.
+	ReapAttachments(ctx context.Context, grace time.Duration) ([]string, error)
+}
+
+// PruneSummary describes one PruneMessages run.
+type PruneSummary struct {
+	Rooms       int           // Rooms with a limit that were checked
+	RoomsPruned int           // Rooms that lost messages
+	Deleted     int64         // Messages deleted
+	Errors      int           // Rooms skipped because their limit or delete failed
+	Failures    []error       // Why each of those rooms was skipped
+	Duration    time.Duration // Time taken
+}
+
+// LeaderboardEntry is one poster's row in a RoomLeaderboard.
+type LeaderboardEntry struct {
+	UserID string
+	Email  string
+	Posts  int64
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx, so a write can run on
+// its own or as part of a transaction.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// DefaultQueryTimeout bounds a single Database call when the caller's
+// context has no earlier deadline.
+const DefaultQueryTimeout = 5 * time.Second
+
+// queryContext derives the context one Database call runs under: the
+// caller's ctx, cut off after timeout. A gRPC deadline or cancellation
+// carries through, so a query stops when the client gives up. Calls that
+// run several statements, like CreateTables, apply it to each one.
+func queryContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = DefaultQueryTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// DefaultMaintenanceTimeout bounds each statement of the prune and reap
+// jobs, which may delete a large backlog in one go.
+const DefaultMaintenanceTimeout = 5 * time.Minute
+
+// maintenanceContext is queryContext for the background prune and reap
+// jobs, defaulting to DefaultMaintenanceTimeout.
+func maintenanceContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = DefaultMaintenanceTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
 }
 
 type PostgresDB struct {
 	Conn *sql.DB
+	// QueryTimeout bounds each call; 0 means DefaultQueryTimeout
+	QueryTimeout time.Duration
+	// MaintenanceTimeout bounds each prune or reap statement instead; 0
+	// means DefaultMaintenanceTimeout
+	MaintenanceTimeout time.Duration
+
+	// Prepared multi-row INSERTs for StoreMessages, keyed by row count
+	batchMu    sync.Mutex
+	batchStmts map[int]*sql.Stmt
+}
+
+// PoolConfig sizes the Postgres connection pool.
+//
+// The save worker and the prune worker are single goroutines, each holding
+// at most one connection at a time. The rest of the pool serves RPC reads
+// and writes (history, logins, room updates), so MaxOpenConns should leave
+// those two spare. When the pool is exhausted, a batch insert waits for a
+// free connection while the persistence queue keeps filling. The prepared
+// batch INSERTs are re-prepared transparently on whichever connection runs
+// them, so recycling connections is safe.
+type PoolConfig struct {
+	MaxOpenConns    int           // 0 means unlimited
+	MaxIdleConns    int           // Kept warm between bursts; capped at MaxOpenConns
+	ConnMaxLifetime time.Duration // Recycle before Postgres or a proxy drops the connection
+	ConnMaxIdleTime time.Duration // Close idle connections sooner than their lifetime
+}
+
+// DefaultPoolConfig suits a single chat server instance. Postgres allows 100
+// connections by default, which leaves room for a few instances and admin
+// tools.
+var DefaultPoolConfig = PoolConfig{
+	MaxOpenConns:    25,
+	MaxIdleConns:    10,
+	ConnMaxLifetime: 30 * time.Minute,
+	ConnMaxIdleTime: 5 * time.Minute,
 }
 
-func NewPostgresDB(connStr string) (*PostgresDB, error) {
+func NewPostgresDB(connStr string, pool PoolConfig) (*PostgresDB, error) {
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		return nil, err
 	}
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(pool.ConnMaxIdleTime)
 	if err = db.Ping(); err != nil {
 		return nil, err
 	}
-	return &PostgresDB{Conn: db}, nil
+	return &PostgresDB{Conn: db, batchStmts: make(map[int]*sql.Stmt)}, nil
 }
 
-func (db *PostgresDB) CreateTables() error {
+func (db *PostgresDB) Ping(ctx context.Context) error {
+	return db.Conn.PingContext(ctx)
+}
+
+func (db *PostgresDB) CreateTables(ctx context.Context) error {
 	queries := []string{
 		`CREATE TABLE IF NOT EXISTS users (
 			id TEXT PRIMARY KEY,
 			email TEXT UNIQUE NOT NULL,
 			password TEXT,
 			name TEXT,
+			about TEXT,
 			role TEXT,
 			created TIMESTAMP,
 			updated TIMESTAMP,
@@ -58,8 +237,19 @@ func (db *PostgresDB) CreateTables() error {
 			name TEXT,
 			max_messages INT,
 			stats JSONB,
+			private BOOLEAN NOT NULL DEFAULT FALSE,
+			members JSONB,
+			owner_id TEXT,
+			topic TEXT,
 			created_at TIMESTAMP DEFAULT NOW()
 		);`,
+		`ALTER TABLE rooms ADD COLUMN IF NOT EXISTS private BOOLEAN NOT NULL DEFAULT FALSE;`,
+		`ALTER TABLE rooms ADD COLUMN IF NOT EXISTS members JSONB;`,
+		`ALTER TABLE rooms ADD COLUMN IF NOT EXISTS owner_id TEXT;`,
+		`ALTER TABLE rooms ADD COLUMN IF NOT EXISTS topic TEXT;`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS about TEXT;`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS last_login TIMESTAMP;`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS last_active TIMESTAMP;`,
 		`CREATE TABLE IF NOT EXISTS messages (
 			id SERIAL PRIMARY KEY,
 			room_id TEXT NOT NULL,
@@ -70,84 +260,366 @@ func (db *PostgresDB) CreateTables() error {
 			reply_to TEXT,
 			iv TEXT,
 			hot_sauce TEXT,
+			attachment JSONB,
+			seq BIGINT NOT NULL DEFAULT 0,
+			time_ms BIGINT NOT NULL DEFAULT 0,
+			created_at TIMESTAMP DEFAULT NOW(),
+			deleted_at TIMESTAMP
+		);`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS attachment JSONB;`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS seq BIGINT NOT NULL DEFAULT 0;`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS time_ms BIGINT NOT NULL DEFAULT 0;`,
+		`CREATE TABLE IF NOT EXISTS attachments (
+			id TEXT PRIMARY KEY,
+			room_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			file_name TEXT,
+			content_type TEXT,
+			size BIGINT NOT NULL,
+			sha256 TEXT,
+			iv TEXT,
+			hot_sauce TEXT,
 			created_at TIMESTAMP DEFAULT NOW()
 		);`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id SERIAL PRIMARY KEY,
+			action TEXT NOT NULL,
+			actor_id TEXT,
+			created_at TIMESTAMP DEFAULT NOW()
+		);`,
+		`CREATE TABLE IF NOT EXISTS message_edits (
+			id SERIAL PRIMARY KEY,
+			message_id BIGINT NOT NULL,
+			msg_content TEXT,
+			iv TEXT,
+			hot_sauce TEXT,
+			edited_by TEXT,
+			edited_at TIMESTAMP DEFAULT NOW()
+		);`,
+		`CREATE TABLE IF NOT EXISTS room_bans (
+			room_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			banned_by TEXT,
+			created_at TIMESTAMP DEFAULT NOW(),
+			PRIMARY KEY (room_id, user_id)
+		);`,
+		`CREATE TABLE IF NOT EXISTS last_read (
+			user_id TEXT NOT NULL,
+			room_id TEXT NOT NULL,
+			last_message_id BIGINT NOT NULL DEFAULT 0,
+			updated_at TIMESTAMP DEFAULT NOW(),
+			PRIMARY KEY (user_id, room_id)
+		);`,
+		`CREATE TABLE IF NOT EXISTS notification_prefs (
+			user_id TEXT NOT NULL,
+			room_id TEXT NOT NULL,
+			pref TEXT NOT NULL,
+			updated_at TIMESTAMP DEFAULT NOW(),
+			PRIMARY KEY (user_id, room_id)
+		);`,
+		`CREATE TABLE IF NOT EXISTS refresh_tokens (
+			token_hash TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			revoked BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMP DEFAULT NOW()
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_room_id_id ON messages(room_id, id);`,
+		`CREATE INDEX IF NOT EXISTS idx_message_edits_message_id ON message_edits(message_id);`,
 		`CREATE INDEX IF NOT EXISTS idx_messages_room_id ON messages(room_id);`,
 		`CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_reply_to ON messages(reply_to);`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_fts ON messages USING GIN (to_tsvector('english', msg_content));`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_attachment_id ON messages ((attachment->>'id'));`,
 	}
 
 	for _, q := range queries {
-		if _, err := db.Conn.Exec(q); err != nil {
+		qctx, cancel := queryContext(ctx, db.QueryTimeout)
+		_, err := db.Conn.ExecContext(qctx, q)
+		cancel()
+		if err != nil {
 			return fmt.Errorf("failed to create table: %w", err)
 		}
 	}
 	return nil
 }
 
-func (db *PostgresDB) GetMessage(roomid, messageid string) (internal.Message, error) {
-	query := `SELECT room_id, user_id, email, msg_content, time_str, reply_to, iv, hot_sauce 
-	          FROM messages WHERE room_id = $1 AND id = $2`
+func (db *PostgresDB) GetMessage(ctx context.Context, roomid, messageid string) (internal.Message, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	query := `SELECT id, room_id, user_id, email, msg_content, time_str, COALESCE(reply_to, ''), COALESCE(iv, ''), COALESCE(hot_sauce, ''), COALESCE(attachment::text, ''), seq, time_ms
+	          FROM messages WHERE room_id = $1 AND id = $2 AND deleted_at IS NULL`
 
-	row := db.Conn.QueryRow(query, roomid, messageid)
+	row := db.Conn.QueryRowContext(ctx, query, roomid, messageid)
 
 	var m internal.Message
-	err := row.Scan(&m.RoomID, &m.UserID, &m.Email, &m.Message, &m.Time, &m.ReplyTo, &m.InitialVector, &m.HotSauce)
+	err := row.Scan(&m.ID, &m.RoomID, &m.UserID, &m.Email, &m.Message, &m.Time, &m.ReplyTo, &m.InitialVector, &m.HotSauce, &m.Attachment, &m.Seq, &m.TimeMs)
 	if err != nil {
 		return internal.Message{}, err
 	}
 	return m, nil
 }
 
-func (db *PostgresDB) StoreMessage(roomid string, m internal.Message) error {
-	query := `INSERT INTO messages (room_id, user_id, email, msg_content, time_str, reply_to, iv, hot_sauce)
-	          VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+// GetReplies returns the live messages in roomid whose reply_to points at
+// messageID, oldest first.
+func (db *PostgresDB) GetReplies(ctx context.Context, roomid string, messageID int64) ([]internal.Message, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	query := `SELECT id, room_id, user_id, email, msg_content, time_str, COALESCE(reply_to, ''), COALESCE(iv, ''), COALESCE(hot_sauce, ''), COALESCE(attachment::text, ''), seq, time_ms
+	          FROM messages WHERE room_id = $1 AND reply_to = $2 AND deleted_at IS NULL
+	          ORDER BY id`
 
-	_, err := db.Conn.Exec(query, roomid, m.UserID, m.Email, m.Message, m.Time, m.ReplyTo, m.InitialVector, m.HotSauce)
+	rows, err := db.Conn.QueryContext(ctx, query, roomid, strconv.FormatInt(messageID, 10))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []internal.Message
+	for rows.Next() {
+		var m internal.Message
+		if err := rows.Scan(&m.ID, &m.RoomID, &m.UserID, &m.Email, &m.Message, &m.Time, &m.ReplyTo, &m.InitialVector, &m.HotSauce, &m.Attachment, &m.Seq, &m.TimeMs); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+func (db *PostgresDB) StoreMessage(ctx context.Context, roomid string, m internal.Message) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	query := `INSERT INTO messages (room_id, user_id, email, msg_content, time_str, reply_to, iv, hot_sauce, attachment, seq, time_ms)
+	          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+
+	_, err := db.Conn.ExecContext(ctx, query, roomid, m.UserID, m.Email, m.Message, m.Time, m.ReplyTo, m.InitialVector, m.HotSauce, attachmentArg(m), m.Seq, m.TimeMs)
 	return err
 }
 
-func (db *PostgresDB) PruneMessages(keep int) error {
-	rows, err := db.Conn.Query(`SELECT DISTINCT room_id FROM messages`)
+// attachmentArg stores a message without an attachment as NULL.
+func attachmentArg(m internal.Message) sql.NullString {
+	return sql.NullString{String: m.Attachment, Valid: m.Attachment != ""}
+}
+
+// Each message binds insertColumns parameters, so maxInsertRows is the
+// most rows one INSERT can carry under Postgres' 65535 parameter limit.
+const (
+	insertColumns = 11
+	maxInsertRows = 65535 / insertColumns
+)
+
+// StoreMessages writes a batch of messages (possibly spanning rooms) with
+// multi-row INSERTs in one transaction, so the batch is stored all or
+// nothing. Statements are prepared once per batch size, and batches over
+// maxInsertRows are split across INSERTs.
+//
+// Postgres doesn't promise RETURNING rows in VALUES order, so each row's ID
+// is matched back on (room_id, seq). Messages that don't have a key unique
+// within the batch, such as unsequenced ones, are inserted one at a time.
+func (db *PostgresDB) StoreMessages(ctx context.Context, msgs []internal.Message) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	keys := make(map[insertKey]int, len(msgs))
+	for _, m := range msgs {
+		keys[insertKey{m.RoomID, m.Seq}]++
+	}
+	var batch, single []int
+	for i, m := range msgs {
+		if m.Seq > 0 && keys[insertKey{m.RoomID, m.Seq}] == 1 {
+			batch = append(batch, i)
+		} else {
+			single = append(single, i)
+		}
+	}
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for start := 0; start < len(batch); start += maxInsertRows {
+		if err := db.insertMessages(ctx, tx, msgs, batch[start:min(start+maxInsertRows, len(batch))]); err != nil {
+			return err
+		}
+	}
+	for _, i := range single {
+		if err := db.insertMessages(ctx, tx, msgs, []int{i}); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// insertKey identifies a row returned by a multi-row INSERT.
+type insertKey struct {
+	room string
+	seq  int64
+}
+
+// insertMessages runs one multi-row INSERT in tx for the messages of msgs
+// at idx, which must have distinct insertKeys, and sets their IDs.
+func (db *PostgresDB) insertMessages(ctx context.Context, tx *sql.Tx, msgs []internal.Message, idx []int) error {
+	stmt, err := db.batchStmt(ctx, len(idx))
+	if err != nil {
+		return err
+	}
+	stmt = tx.Stmt(stmt)
+
+	byKey := make(map[insertKey]int, len(idx))
+	args := make([]interface{}, 0, len(idx)*insertColumns)
+	for _, i := range idx {
+		m := msgs[i]
+		byKey[insertKey{m.RoomID, m.Seq}] = i
+		args = append(args, m.RoomID, m.UserID, m.Email, m.Message, m.Time, m.ReplyTo, m.InitialVector, m.HotSauce, attachmentArg(m), m.Seq, m.TimeMs)
+	}
+
+	rows, err := stmt.QueryContext(ctx, args...)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var k insertKey
+		if err := rows.Scan(&id, &k.room, &k.seq); err != nil {
+			return err
+		}
+		i, ok := byKey[k]
+		if !ok {
+			return fmt.Errorf("insert returned unexpected row for room %s seq %d", k.room, k.seq)
+		}
+		msgs[i].ID = id
+	}
+	return rows.Err()
+}
+
+func (db *PostgresDB) batchStmt(ctx context.Context, rows int) (*sql.Stmt, error) {
+	db.batchMu.Lock()
+	defer db.batchMu.Unlock()
+
+	if stmt, ok := db.batchStmts[rows]; ok {
+		return stmt, nil
+	}
+
+	values := make([]string, rows)
+	params := make([]string, insertColumns)
+	for i := range values {
+		for j := range params {
+			params[j] = fmt.Sprintf("$%d", i*insertColumns+j+1)
+		}
+		values[i] = "(" + strings.Join(params, ", ") + ")"
+	}
+	query := `INSERT INTO messages (room_id, user_id, email, msg_content, time_str, reply_to, iv, hot_sauce, attachment, seq, time_ms)
+	          VALUES ` + strings.Join(values, ", ") + ` RETURNING id, room_id, seq`
 
-	var rooms []string
+	stmt, err := db.Conn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	db.batchStmts[rows] = stmt
+	return stmt, nil
+}
+
+// PruneMessages trims every room to its own max_messages and summarizes
+// what it removed. Rooms without a rooms row fall back to defaultKeep; a
+// limit <= 0 leaves the room alone.
+func (db *PostgresDB) PruneMessages(ctx context.Context, defaultKeep int) (PruneSummary, error) {
+	start := time.Now()
+	qctx, cancel := maintenanceContext(ctx, db.MaintenanceTimeout)
+	defer cancel()
+	rows, err := db.Conn.QueryContext(qctx, `SELECT m.room_id, COALESCE(r.max_messages, $1)
+	          FROM (SELECT DISTINCT room_id FROM messages) m
+	          LEFT JOIN rooms r ON r.id = m.room_id`, defaultKeep)
+	if err != nil {
+		return PruneSummary{}, err
+	}
+	defer rows.Close()
+
+	var summary PruneSummary
+	limits := make(map[string]int)
 	for rows.Next() {
 		var r string
-		if err := rows.Scan(&r); err == nil {
-			rooms = append(rooms, r)
+		var keep int
+		if err := rows.Scan(&r, &keep); err != nil {
+			summary.Errors++
+			summary.Failures = append(summary.Failures, fmt.Errorf("reading room limit: %w", err))
+			continue
 		}
+		if keep > 0 {
+			limits[r] = keep
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return PruneSummary{}, err
 	}
 
-	query := `DELETE FROM messages 
-	          WHERE room_id = $1 AND id NOT IN (
-	              SELECT id FROM messages 
-	              WHERE room_id = $1 
-	              ORDER BY id DESC 
-	              LIMIT $2
-	          )`
+	cond := `room_id = $1 AND id NOT IN (
+	             SELECT id FROM messages
+	             WHERE room_id = $1
+	             ORDER BY id DESC
+	             LIMIT $2
+	         )`
 
-	for _, room := range rooms {
-		if _, err := db.Conn.Exec(query, room, keep); err != nil {
-			log.Printf("Error pruning room %s: %v", room, err)
+	for room, keep := range limits {
+		summary.Rooms++
+		qctx, cancel := maintenanceContext(ctx, db.MaintenanceTimeout)
+		n, err := db.deleteMessages(qctx, cond, room, keep)
+		cancel()
+		if err != nil {
+			summary.Errors++
+			summary.Failures = append(summary.Failures, fmt.Errorf("room %s: %w", room, err))
+			continue
+		}
+		if n > 0 {
+			summary.RoomsPruned++
+			summary.Deleted += n
 		}
 	}
-	return nil
+	summary.Duration = time.Since(start)
+	return summary, nil
 }
 
-func (db *PostgresDB) GetUser(userid string) (User, error) {
-	query := `SELECT id, email, password, name, role, created, updated, rooms, history, stats, posts FROM users WHERE id = $1`
-	row := db.Conn.QueryRow(query, userid)
+// PruneMessagesByAge deletes messages older than maxAge in every room, so
+// quiet rooms don't keep ancient history alive under the count-based prune.
+func (db *PostgresDB) PruneMessagesByAge(ctx context.Context, maxAge time.Duration) (int64, error) {
+	ctx, cancel := maintenanceContext(ctx, db.MaintenanceTimeout)
+	defer cancel()
+	cutoff := time.Now().Add(-maxAge)
+	return db.deleteMessages(ctx, `created_at < $1`, cutoff)
+}
+
+// deleteMessages deletes the messages matching cond, a WHERE clause over
+// messages, together with their edit history in one statement, so pruned
+// content doesn't live on in message_edits. It returns how many messages
+// were deleted.
+func (db *PostgresDB) deleteMessages(ctx context.Context, cond string, args ...interface{}) (int64, error) {
+	var n int64
+	err := db.Conn.QueryRowContext(ctx, `WITH gone AS (DELETE FROM messages WHERE `+cond+` RETURNING id),
+	          edits AS (DELETE FROM message_edits WHERE message_id IN (SELECT id FROM gone))
+	          SELECT COUNT(*) FROM gone`, args...).Scan(&n)
+	return n, err
+}
+
+func (db *PostgresDB) GetUser(ctx context.Context, userid string) (User, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	query := `SELECT id, email, password, name, COALESCE(about, ''), role, created, updated, last_login, last_active, rooms, history, stats, posts FROM users WHERE id = $1`
+	row := db.Conn.QueryRowContext(ctx, query, userid)
 
 	var u User
 	var roomsJSON, historyJSON, statsJSON, postsJSON []byte
+	var lastLogin, lastActive sql.NullTime
 
-	err := row.Scan(&u.ID, &u.Email, &u.Password, &u.Name, &u.Role, &u.Created, &u.Updated, &roomsJSON, &historyJSON, &statsJSON, &postsJSON)
+	err := row.Scan(&u.ID, &u.Email, &u.Password, &u.Name, &u.About, &u.Role, &u.Created, &u.Updated, &lastLogin, &lastActive, &roomsJSON, &historyJSON, &statsJSON, &postsJSON)
 	if err != nil {
 		return User{}, err
 	}
+	u.LastLogin, u.LastActive = lastLogin.Time, lastActive.Time
 
 	_ = json.Unmarshal(roomsJSON, &u.Rooms)
 	_ = json.Unmarshal(historyJSON, &u.History)
@@ -157,14 +629,16 @@ func (db *PostgresDB) GetUser(userid string) (User, error) {
 	return u, nil
 }
 
-func (db *PostgresDB) StoreUser(u User) error {
+func (db *PostgresDB) StoreUser(ctx context.Context, u User) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
 	roomsJSON, _ := json.Marshal(u.Rooms)
 	historyJSON, _ := json.Marshal(u.History)
 	statsJSON, _ := json.Marshal(u.Stats)
 	postsJSON, _ := json.Marshal(u.Posts)
 
-	query := `INSERT INTO users (id, email, password, name, role, created, updated, rooms, history, stats, posts)
-          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	query := `INSERT INTO users (id, email, password, name, role, created, updated, rooms, history, stats, posts, about)
+          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
           ON CONFLICT (id) DO UPDATE SET
           email = EXCLUDED.email,
           password = EXCLUDED.password,
@@ -173,100 +647,792 @@ func (db *PostgresDB) StoreUser(u User) error {
           updated = EXCLUDED.updated,
           rooms = EXCLUDED.rooms,
           history = EXCLUDED.history,
-          stats = EXCLUDED.stats,
-          posts = EXCLUDED.posts;`
+          about = EXCLUDED.about;`
 
-	_, err := db.Conn.Exec(query, u.ID, u.Email, u.Password, u.Name, u.Role, u.Created, time.Now(), roomsJSON, historyJSON, statsJSON, postsJSON)
+	_, err := db.Conn.ExecContext(ctx, query, u.ID, u.Email, u.Password, u.Name, u.Role, u.Created, time.Now(), roomsJSON, historyJSON, statsJSON, postsJSON, u.About)
 	return err
 }
 
-func (db *PostgresDB) GetRoom(roomid string) (Room, error) {
-	query := `SELECT id, name, max_messages, stats FROM rooms WHERE id = $1`
-	row := db.Conn.QueryRow(query, roomid)
+func (db *PostgresDB) GetRoom(ctx context.Context, roomid string) (Room, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	query := `SELECT id, name, max_messages, stats, private, members, COALESCE(owner_id, ''), COALESCE(topic, '') FROM rooms WHERE id = $1`
+	row := db.Conn.QueryRowContext(ctx, query, roomid)
 
 	var r Room
-	var statsJSON []byte
+	var statsJSON, membersJSON []byte
 
-	err := row.Scan(&r.ID, &r.Name, &r.MaxMessages, &statsJSON)
+	err := row.Scan(&r.ID, &r.Name, &r.MaxMessages, &statsJSON, &r.Private, &membersJSON, &r.OwnerID, &r.Topic)
 	if err != nil {
 		return Room{}, err
 	}
 	_ = json.Unmarshal(statsJSON, &r.Stats)
+	_ = json.Unmarshal(membersJSON, &r.Members)
+
+	return r, nil
+}
 
-	msgQuery := `SELECT room_id, user_id, email, msg_content, time_str, reply_to, iv, hot_sauce 
-	             FROM messages WHERE room_id = $1 ORDER BY id DESC LIMIT 50`
+// GetHistory returns up to limit messages older than beforeID (or the newest
+// messages when beforeID is 0), oldest first. The second return value is the
+// cursor for the next older page, or 0 once the start of the room is reached.
+// A row that fails to scan fails the page, since skipping it would make a
+// short page look like the start of the room; the nullable columns are
+// coalesced so old rows scan.
+func (db *PostgresDB) GetHistory(ctx context.Context, roomid string, beforeID int64, limit int) ([]internal.Message, int64, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	query := `SELECT id, room_id, user_id, email, msg_content, time_str, COALESCE(reply_to, ''), COALESCE(iv, ''), COALESCE(hot_sauce, ''), COALESCE(attachment::text, ''), seq, time_ms
+	          FROM messages WHERE room_id = $1 AND deleted_at IS NULL AND ($2::bigint = 0 OR id < $2) 
+	          ORDER BY id DESC LIMIT $3`
 
-	rows, err := db.Conn.Query(msgQuery, roomid)
+	rows, err := db.Conn.QueryContext(ctx, query, roomid, beforeID, limit)
 	if err != nil {
-		log.Printf("Warning: failed to fetch messages for room %s: %v", roomid, err)
-	} else {
-		defer rows.Close()
-		var msgs []internal.Message
-		for rows.Next() {
-			var m internal.Message
-			if err := rows.Scan(&m.RoomID, &m.UserID, &m.Email, &m.Message, &m.Time, &m.ReplyTo, &m.InitialVector, &m.HotSauce); err == nil {
-				msgs = append([]internal.Message{m}, msgs...)
-			}
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var msgs []internal.Message
+	var oldest int64
+	for rows.Next() {
+		var m internal.Message
+		if err := rows.Scan(&m.ID, &m.RoomID, &m.UserID, &m.Email, &m.Message, &m.Time, &m.ReplyTo, &m.InitialVector, &m.HotSauce, &m.Attachment, &m.Seq, &m.TimeMs); err != nil {
+			return nil, 0, err
 		}
-		r.Messages = msgs
+		msgs = append([]internal.Message{m}, msgs...)
+		oldest = m.ID
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
 	}
 
-	return r, nil
+	if len(msgs) < limit {
+		oldest = 0
+	}
+	return msgs, oldest, nil
+}
+
+// EditMessage replaces a message's content after copying the previous version
+// into message_edits. It returns the updated message for broadcasting.
+func (db *PostgresDB) EditMessage(ctx context.Context, messageID int64, userID, content, iv, hotSauce string) (internal.Message, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return internal.Message{}, err
+	}
+
+	m := internal.Message{ID: messageID}
+	err = tx.QueryRowContext(ctx, `SELECT room_id, user_id, email, msg_content, time_str, COALESCE(reply_to, ''), COALESCE(iv, ''), COALESCE(hot_sauce, ''), COALESCE(attachment::text, ''), seq, time_ms
+	                   FROM messages WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, messageID).
+		Scan(&m.RoomID, &m.UserID, &m.Email, &m.Message, &m.Time, &m.ReplyTo, &m.InitialVector, &m.HotSauce, &m.Attachment, &m.Seq, &m.TimeMs)
+	if err != nil {
+		tx.Rollback()
+		return internal.Message{}, err
+	}
+
+	if m.UserID != userID {
+		tx.Rollback()
+		return internal.Message{}, ErrNotAuthor
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO message_edits (message_id, msg_content, iv, hot_sauce, edited_by)
+	                  VALUES ($1, $2, $3, $4, $5)`, messageID, m.Message, m.InitialVector, m.HotSauce, userID)
+	if err != nil {
+		tx.Rollback()
+		return internal.Message{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE messages SET msg_content = $1, iv = $2, hot_sauce = $3 WHERE id = $4`,
+		content, iv, hotSauce, messageID)
+	if err != nil {
+		tx.Rollback()
+		return internal.Message{}, err
+	}
+
+	m.Message, m.InitialVector, m.HotSauce = content, iv, hotSauce
+	return m, tx.Commit()
+}
+
+// DeleteMessage tombstones a message by setting deleted_at, leaving the row
+// for audit and pruning. Unless asAdmin is set, userID must be the author.
+func (db *PostgresDB) DeleteMessage(ctx context.Context, messageID int64, userID string, asAdmin bool) (internal.Message, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return internal.Message{}, err
+	}
+
+	m := internal.Message{ID: messageID}
+	err = tx.QueryRowContext(ctx, `SELECT room_id, user_id, email FROM messages
+	                   WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, messageID).Scan(&m.RoomID, &m.UserID, &m.Email)
+	if err != nil {
+		tx.Rollback()
+		return internal.Message{}, err
+	}
+
+	if !asAdmin && m.UserID != userID {
+		tx.Rollback()
+		return internal.Message{}, ErrNotAuthor
+	}
+
+	if _, err = tx.ExecContext(ctx, `UPDATE messages SET deleted_at = NOW() WHERE id = $1`, messageID); err != nil {
+		tx.Rollback()
+		return internal.Message{}, err
+	}
+
+	return m, tx.Commit()
+}
+
+// BanUser records that userID may not join roomID.
+func (db *PostgresDB) BanUser(ctx context.Context, roomID, userID, bannedBy string) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	_, err := db.Conn.ExecContext(ctx, `INSERT INTO room_bans (room_id, user_id, banned_by) VALUES ($1, $2, $3)
+	          ON CONFLICT (room_id, user_id) DO NOTHING`, roomID, userID, bannedBy)
+	return err
+}
+
+func (db *PostgresDB) UnbanUser(ctx context.Context, roomID, userID string) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	_, err := db.Conn.ExecContext(ctx, `DELETE FROM room_bans WHERE room_id = $1 AND user_id = $2`, roomID, userID)
+	return err
+}
+
+func (db *PostgresDB) IsBanned(ctx context.Context, roomID, userID string) (bool, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	var banned bool
+	err := db.Conn.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM room_bans WHERE room_id = $1 AND user_id = $2)`, roomID, userID).Scan(&banned)
+	return banned, err
+}
+
+// MarkRead moves the user's read marker in a room forward to lastMessageID,
+// or to the newest stored message when lastMessageID is 0. Markers never move
+// backwards. It returns the marker now in effect.
+func (db *PostgresDB) MarkRead(ctx context.Context, userID, roomID string, lastMessageID int64) (int64, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	if lastMessageID == 0 {
+		err := db.Conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM messages WHERE room_id = $1`, roomID).Scan(&lastMessageID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	query := `INSERT INTO last_read (user_id, room_id, last_message_id, updated_at)
+	          VALUES ($1, $2, $3, NOW())
+	          ON CONFLICT (user_id, room_id) DO UPDATE SET
+	          last_message_id = GREATEST(last_read.last_message_id, EXCLUDED.last_message_id),
+	          updated_at = EXCLUDED.updated_at
+	          RETURNING last_message_id`
+
+	var marker int64
+	err := db.Conn.QueryRowContext(ctx, query, userID, roomID, lastMessageID).Scan(&marker)
+	return marker, err
+}
+
+// UnreadCounts returns, per room, how many live messages are newer than the
+// user's read marker. Each count is a range scan on messages(room_id, id).
+func (db *PostgresDB) UnreadCounts(ctx context.Context, userID string, roomIDs []string) (map[string]int64, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	query := `SELECT COUNT(*) FROM messages
+	          WHERE room_id = $1 AND deleted_at IS NULL AND id > COALESCE(
+	              (SELECT last_message_id FROM last_read WHERE user_id = $2 AND room_id = $1), 0)`
+
+	counts := make(map[string]int64, len(roomIDs))
+	for _, roomID := range roomIDs {
+		var n int64
+		if err := db.Conn.QueryRowContext(ctx, query, roomID, userID).Scan(&n); err != nil {
+			return nil, err
+		}
+		counts[roomID] = n
+	}
+	return counts, nil
+}
+
+// NotificationPrefs returns the user's non-default notification preferences
+// by room.
+func (db *PostgresDB) NotificationPrefs(ctx context.Context, userID string) (map[string]string, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	rows, err := db.Conn.QueryContext(ctx, `SELECT room_id, pref FROM notification_prefs WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prefs := make(map[string]string)
+	for rows.Next() {
+		var room, pref string
+		if err := rows.Scan(&room, &pref); err != nil {
+			return nil, err
+		}
+		prefs[room] = pref
+	}
+	return prefs, rows.Err()
 }
 
-func (db *PostgresDB) StoreRoom(r Room) error {
+func (db *PostgresDB) SetNotificationPref(ctx context.Context, userID, roomID, pref string) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	if pref == NotifyAll {
+		_, err := db.Conn.ExecContext(ctx, `DELETE FROM notification_prefs WHERE user_id = $1 AND room_id = $2`, userID, roomID)
+		return err
+	}
+	_, err := db.Conn.ExecContext(ctx, `INSERT INTO notification_prefs (user_id, room_id, pref, updated_at)
+	          VALUES ($1, $2, $3, NOW())
+	          ON CONFLICT (user_id, room_id) DO UPDATE SET pref = EXCLUDED.pref, updated_at = EXCLUDED.updated_at`,
+		userID, roomID, pref)
+	return err
+}
+
+func (db *PostgresDB) StoreRefreshToken(ctx context.Context, tokenHash, userID string, expiresAt time.Time) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	_, err := db.Conn.ExecContext(ctx, `INSERT INTO refresh_tokens (token_hash, user_id, expires_at) VALUES ($1, $2, $3)`,
+		tokenHash, userID, expiresAt)
+	return err
+}
+
+func (db *PostgresDB) ConsumeRefreshToken(ctx context.Context, tokenHash string) (string, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	var userID string
+	err := db.Conn.QueryRowContext(ctx, `UPDATE refresh_tokens SET revoked = TRUE
+	          WHERE token_hash = $1 AND NOT revoked AND expires_at > NOW()
+	          RETURNING user_id`, tokenHash).Scan(&userID)
+	return userID, err
+}
+
+func (db *PostgresDB) RevokeRefreshToken(ctx context.Context, tokenHash string) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	_, err := db.Conn.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = TRUE WHERE token_hash = $1`, tokenHash)
+	return err
+}
+
+func (db *PostgresDB) RevokeUserRefreshTokens(ctx context.Context, userID string) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	_, err := db.Conn.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = TRUE WHERE user_id = $1 AND NOT revoked`, userID)
+	return err
+}
+
+func (db *PostgresDB) LastSeq(ctx context.Context, roomid string) (int64, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	var seq int64
+	err := db.Conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) FROM messages WHERE room_id = $1`, roomid).Scan(&seq)
+	return seq, err
+}
+
+// MessageCounts returns the number of live messages in each room.
+func (db *PostgresDB) MessageCounts(ctx context.Context) (map[string]int64, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	rows, err := db.Conn.QueryContext(ctx, `SELECT room_id, COUNT(*) FROM messages WHERE deleted_at IS NULL GROUP BY room_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var room string
+		var n int64
+		if err := rows.Scan(&room, &n); err != nil {
+			return nil, err
+		}
+		counts[room] = n
+	}
+	return counts, rows.Err()
+}
+
+func (db *PostgresDB) SetRole(ctx context.Context, userID, role string) (string, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	admins, err := lockAdmins(ctx, tx)
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	var previous string
+	if err := tx.QueryRowContext(ctx, `SELECT role FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&previous); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	if previous == "admin" && role != "admin" && admins <= 1 {
+		tx.Rollback()
+		return "", ErrLastAdmin
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET role = $1, updated = $2 WHERE id = $3`, role, time.Now(), userID); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	return previous, tx.Commit()
+}
+
+func (db *PostgresDB) SetLastLogin(ctx context.Context, userID string, at time.Time) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	_, err := db.Conn.ExecContext(ctx, `UPDATE users SET last_login = $1 WHERE id = $2`, at, userID)
+	return err
+}
+
+func (db *PostgresDB) SetLastActive(ctx context.Context, userID string, at time.Time) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	_, err := db.Conn.ExecContext(ctx, `UPDATE users SET last_active = $1 WHERE id = $2`, at, userID)
+	return err
+}
+
+// ListUsers returns every user's account details, oldest account first.
+// Passwords, rooms and stats are left empty.
+func (db *PostgresDB) ListUsers(ctx context.Context) ([]User, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	rows, err := db.Conn.QueryContext(ctx, `SELECT id, email, COALESCE(name, ''), COALESCE(role, ''), created, last_login, last_active FROM users ORDER BY created, email`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		var lastLogin, lastActive sql.NullTime
+		if err := rows.Scan(&u.ID, &u.Email, &u.Name, &u.Role, &u.Created, &lastLogin, &lastActive); err != nil {
+			return nil, err
+		}
+		u.LastLogin, u.LastActive = lastLogin.Time, lastActive.Time
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// SearchMessages full-text matches query against the plaintext messages in
+// roomIDs, newest first. Encrypted messages (hot_sauce set) hold ciphertext
+// the server can't read, so they are never matched.
+func (db *PostgresDB) SearchMessages(ctx context.Context, roomIDs []string, query string, limit int) ([]internal.Message, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	rows, err := db.Conn.QueryContext(ctx, `SELECT id, room_id, user_id, email, msg_content, time_str, COALESCE(reply_to, ''), COALESCE(iv, ''), COALESCE(hot_sauce, ''), COALESCE(attachment::text, ''), seq, time_ms
+	          FROM messages
+	          WHERE room_id = ANY($1) AND deleted_at IS NULL AND COALESCE(hot_sauce, '') = ''
+	            AND to_tsvector('english', msg_content) @@ plainto_tsquery('english', $2)
+	          ORDER BY id DESC LIMIT $3`, pq.Array(roomIDs), query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []internal.Message
+	for rows.Next() {
+		var m internal.Message
+		if err := rows.Scan(&m.ID, &m.RoomID, &m.UserID, &m.Email, &m.Message, &m.Time, &m.ReplyTo, &m.InitialVector, &m.HotSauce, &m.Attachment, &m.Seq, &m.TimeMs); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+func (db *PostgresDB) StoreRoom(ctx context.Context, r Room) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	return db.storeRoom(ctx, db.Conn, r)
+}
+
+func (db *PostgresDB) storeRoom(ctx context.Context, ex execer, r Room) error {
 	statsJSON, _ := json.Marshal(r.Stats)
+	membersJSON, _ := json.Marshal(r.Members)
 
-	query := `INSERT INTO rooms (id, name, max_messages, stats)
-	          VALUES ($1, $2, $3, $4)
+	query := `INSERT INTO rooms (id, name, max_messages, stats, private, members, owner_id, topic)
+	          VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''))
 	          ON CONFLICT (id) DO UPDATE SET
 	          name = EXCLUDED.name,
 	          max_messages = EXCLUDED.max_messages,
-	          stats = EXCLUDED.stats;`
+	          stats = EXCLUDED.stats,
+	          private = EXCLUDED.private,
+	          members = EXCLUDED.members,
+	          owner_id = EXCLUDED.owner_id,
+	          topic = EXCLUDED.topic;`
 
-	_, err := db.Conn.Exec(query, r.ID, r.Name, r.MaxMessages, statsJSON)
+	_, err := ex.ExecContext(ctx, query, r.ID, r.Name, r.MaxMessages, statsJSON, r.Private, membersJSON, r.OwnerID, r.Topic)
 	return err
 }
 
-func (db *PostgresDB) GetUserByEmail(email string) (User, error) {
+// RecordJoin stores newRoom, when it is not nil, and records roomName in the
+// saved rooms and history of the user with the given email, all in one
+// transaction. Either both changes land or neither does.
+func (db *PostgresDB) RecordJoin(ctx context.Context, newRoom *Room, email, roomName string) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if newRoom != nil {
+		if err = db.storeRoom(ctx, tx, *newRoom); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	var u User
+	var roomsJSON, historyJSON []byte
+	err = tx.QueryRowContext(ctx, `SELECT id, rooms, history FROM users WHERE email = $1 FOR UPDATE`, email).
+		Scan(&u.ID, &roomsJSON, &historyJSON)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_ = json.Unmarshal(roomsJSON, &u.Rooms)
+	_ = json.Unmarshal(historyJSON, &u.History)
+
+	u.RecordJoin(roomName)
+	roomsJSON, _ = json.Marshal(u.Rooms)
+	historyJSON, _ = json.Marshal(u.History)
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET rooms = $1, history = $2, updated = $3 WHERE id = $4`,
+		roomsJSON, historyJSON, time.Now(), u.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *PostgresDB) GetUserByEmail(ctx context.Context, email string) (User, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
 	query := `SELECT id FROM users WHERE email = $1`
-	row := db.Conn.QueryRow(query, email)
+	row := db.Conn.QueryRowContext(ctx, query, email)
 
 	var id string
 	if err := row.Scan(&id); err != nil {
 		return User{}, err
 	}
 
-	return db.GetUser(id)
+	return db.GetUser(ctx, id)
 }
 
-func (db *PostgresDB) ReapStaleRooms(threshold time.Duration) error {
+func (db *PostgresDB) ReapStaleRooms(ctx context.Context, threshold time.Duration) ([]string, []string, error) {
+	ctx, cancel := maintenanceContext(ctx, db.MaintenanceTimeout)
+	defer cancel()
 	interval := fmt.Sprintf("%d hours", int(threshold.Hours()))
 
-	tx, err := db.Conn.Begin()
+	tx, err := db.Conn.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	staleRoomsQuery := `
+	rooms, err := queryIDs(ctx, tx, `
 		SELECT id FROM rooms 
 		WHERE created_at < NOW() - $1::interval
 		AND id NOT IN (
 			SELECT DISTINCT room_id FROM messages 
 			WHERE created_at > NOW() - $1::interval
-		)`
+		)`, interval)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	var files []string
+	for _, room := range rooms {
+		_, f, err := db.deleteRoom(ctx, tx, room)
+		if err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+		files = append(files, f...)
+	}
 
-	_, err = tx.Exec(fmt.Sprintf(`DELETE FROM messages WHERE room_id IN (%s)`, staleRoomsQuery), interval)
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return rooms, files, nil
+}
+
+// PurgeUser removes a user row and either deletes or anonymizes their messages
+// and attachments in a single transaction, along with their edit history,
+// bans, read markers, notification preferences and refresh tokens. Rooms are
+// left untouched. The audit entry only records that a purge happened and who
+// ran it, never whose data was removed. It returns the number of messages
+// deleted or anonymized and the IDs of the attachments deleted, whose files
+// the caller removes once the purge has committed.
+func (db *PostgresDB) PurgeUser(ctx context.Context, userid, actorID string, deleteMessages bool) (int64, []string, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	admins, err := lockAdmins(ctx, tx)
 	if err != nil {
 		tx.Rollback()
-		return err
+		return 0, nil, err
+	}
+	var role string
+	if err := tx.QueryRowContext(ctx, `SELECT role FROM users WHERE id = $1 FOR UPDATE`, userid).Scan(&role); err != nil {
+		tx.Rollback()
+		return 0, nil, err
+	}
+	if role == "admin" && admins <= 1 {
+		tx.Rollback()
+		return 0, nil, ErrLastAdmin
+	}
+
+	// Earlier versions of the user's messages, and any edits they made
+	if _, err = tx.ExecContext(ctx, `DELETE FROM message_edits WHERE edited_by = $1
+	          OR message_id IN (SELECT id FROM messages WHERE user_id = $1)`, userid); err != nil {
+		tx.Rollback()
+		return 0, nil, err
 	}
 
-	_, err = tx.Exec(fmt.Sprintf(`DELETE FROM rooms WHERE id IN (%s)`, staleRoomsQuery), interval)
+	var res sql.Result
+	var files []string
+	if deleteMessages {
+		res, err = tx.ExecContext(ctx, `DELETE FROM messages WHERE user_id = $1`, userid)
+		if err == nil {
+			files, err = queryIDs(ctx, tx, `DELETE FROM attachments WHERE user_id = $1 RETURNING id`, userid)
+		}
+	} else {
+		res, err = tx.ExecContext(ctx, `UPDATE messages SET user_id = 'deleted', email = 'deleted-user' WHERE user_id = $1`, userid)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, `UPDATE attachments SET user_id = 'deleted' WHERE user_id = $1`, userid)
+		}
+	}
 	if err != nil {
 		tx.Rollback()
+		return 0, nil, err
+	}
+	affected, _ := res.RowsAffected()
+
+	// Bans the user placed stay in force without naming them
+	for _, q := range []string{
+		`DELETE FROM room_bans WHERE user_id = $1`,
+		`UPDATE room_bans SET banned_by = NULL WHERE banned_by = $1`,
+		`DELETE FROM last_read WHERE user_id = $1`,
+		`DELETE FROM notification_prefs WHERE user_id = $1`,
+		`DELETE FROM refresh_tokens WHERE user_id = $1`,
+		`DELETE FROM users WHERE id = $1`,
+	} {
+		if _, err = tx.ExecContext(ctx, q, userid); err != nil {
+			tx.Rollback()
+			return 0, nil, err
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, `INSERT INTO audit_log (action, actor_id) VALUES ('purge_user', $1)`, actorID); err != nil {
+		tx.Rollback()
+		return 0, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return affected, files, nil
+}
+
+// lockAdmins locks every admin row for the rest of tx and returns how many
+// there are. Taking the whole set, always in id order, before touching a
+// user means two transactions that each remove a different admin run one
+// after the other, so the second sees the first's change and can't leave
+// the server without an admin.
+func lockAdmins(ctx context.Context, tx *sql.Tx) (int, error) {
+	ids, err := queryIDs(ctx, tx, `SELECT id FROM users WHERE role = 'admin' ORDER BY id FOR UPDATE`)
+	return len(ids), err
+}
+
+// queryIDs runs a query returning one id column in tx, such as a DELETE ...
+// RETURNING id, and collects the ids.
+func queryIDs(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// DeleteRoom removes a room with its messages, edit history, attachments,
+// bans, read markers and notification preferences in a single transaction,
+// and strips the room from every user's saved rooms and history. It returns
+// the number of messages deleted and the IDs of the attachments deleted,
+// whose files the caller removes once the room is gone.
+func (db *PostgresDB) DeleteRoom(ctx context.Context, roomid string) (int64, []string, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	deleted, files, err := db.deleteRoom(ctx, tx, roomid)
+	if err != nil {
+		tx.Rollback()
+		return 0, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return deleted, files, nil
+}
+
+// deleteRoom does DeleteRoom's work within tx; the caller commits or rolls
+// back.
+func (db *PostgresDB) deleteRoom(ctx context.Context, tx *sql.Tx, roomid string) (int64, []string, error) {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM message_edits
+	          WHERE message_id IN (SELECT id FROM messages WHERE room_id = $1)`, roomid); err != nil {
+		return 0, nil, err
+	}
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE room_id = $1`, roomid)
+	if err != nil {
+		return 0, nil, err
+	}
+	deleted, _ := res.RowsAffected()
+
+	files, err := queryIDs(ctx, tx, `DELETE FROM attachments WHERE room_id = $1 RETURNING id`, roomid)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for _, q := range []string{
+		`DELETE FROM room_bans WHERE room_id = $1`,
+		`DELETE FROM last_read WHERE room_id = $1`,
+		`DELETE FROM notification_prefs WHERE room_id = $1`,
+		`DELETE FROM rooms WHERE id = $1`,
+	} {
+		if _, err = tx.ExecContext(ctx, q, roomid); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	// rooms and history are JSONB string arrays (or a JSON null), so only
+	// strip the name from columns that actually contain it
+	_, err = tx.ExecContext(ctx, `UPDATE users SET
+	                  rooms = CASE WHEN rooms ? $1::text THEN rooms - $1::text ELSE rooms END,
+	                  history = CASE WHEN history ? $1::text THEN history - $1::text ELSE history END
+	                  WHERE rooms ? $1::text OR history ? $1::text`, roomid)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return deleted, files, nil
+}
+
+func (db *PostgresDB) AddUserPosts(ctx context.Context, counts map[string]int64, at time.Time) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
 		return err
 	}
 
+	for userID, n := range counts {
+		var statsJSON []byte
+		err := tx.QueryRowContext(ctx, `SELECT stats FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&statsJSON)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		stats := make(internal.AppStats)
+		_ = json.Unmarshal(statsJSON, &stats)
+		if stats == nil {
+			stats = make(internal.AppStats)
+		}
+		stats.Record(StatPosts, at, float64(n), statBucket, maxStatSamples)
+		statsJSON, _ = json.Marshal(stats)
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET stats = $1 WHERE id = $2`, statsJSON, userID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
 	return tx.Commit()
 }
+
+func (db *PostgresDB) RoomLeaderboard(ctx context.Context, roomID string, window time.Duration, limit int) ([]LeaderboardEntry, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	rows, err := db.Conn.QueryContext(ctx, `SELECT user_id, COALESCE(MAX(email), ''), COUNT(*) AS posts FROM messages
+	          WHERE room_id = $1 AND created_at >= $2 AND deleted_at IS NULL AND user_id IS NOT NULL
+	          GROUP BY user_id ORDER BY posts DESC, user_id LIMIT $3`, roomID, time.Now().Add(-window), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var board []LeaderboardEntry
+	for rows.Next() {
+		var e LeaderboardEntry
+		if err := rows.Scan(&e.UserID, &e.Email, &e.Posts); err != nil {
+			return nil, err
+		}
+		board = append(board, e)
+	}
+	return board, rows.Err()
+}
+
+func (db *PostgresDB) StoreAttachment(ctx context.Context, a internal.Attachment) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	_, err := db.Conn.ExecContext(ctx, `INSERT INTO attachments (id, room_id, user_id, file_name, content_type, size, sha256, iv, hot_sauce)
+	          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		a.ID, a.RoomID, a.UserID, a.FileName, a.ContentType, a.Size, a.SHA256, a.IV, a.HotSauce)
+	return err
+}
+
+func (db *PostgresDB) GetAttachment(ctx context.Context, id string) (internal.Attachment, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	a := internal.Attachment{ID: id}
+	err := db.Conn.QueryRowContext(ctx, `SELECT room_id, user_id, COALESCE(file_name, ''), COALESCE(content_type, ''), size,
+	          COALESCE(sha256, ''), COALESCE(iv, ''), COALESCE(hot_sauce, ''), created_at FROM attachments WHERE id = $1`, id).
+		Scan(&a.RoomID, &a.UserID, &a.FileName, &a.ContentType, &a.Size, &a.SHA256, &a.IV, &a.HotSauce, &a.Created)
+	return a, err
+}
+
+func (db *PostgresDB) ReapAttachments(ctx context.Context, grace time.Duration) ([]string, error) {
+	ctx, cancel := maintenanceContext(ctx, db.MaintenanceTimeout)
+	defer cancel()
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := queryIDs(ctx, tx, `DELETE FROM attachments a
+	          WHERE a.created_at < NOW() - $1::interval
+	          AND NOT EXISTS (
+	              SELECT 1 FROM messages m
+	              WHERE m.attachment->>'id' = a.id AND m.deleted_at IS NULL
+	          )
+	          RETURNING a.id`, fmt.Sprintf("%d seconds", int64(grace.Seconds())))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return ids, tx.Commit()
+}
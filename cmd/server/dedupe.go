@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultDedupeWindow is how long an idempotency key is remembered. It only
+// has to outlast a client's reconnect and resend of its offline queue.
+const DefaultDedupeWindow = 5 * time.Minute
+
+// maxIdempotencyKey bounds the keys kept in memory; a UUID needs 36 bytes.
+const maxIdempotencyKey = 64
+
+// seenKeys remembers recently used idempotency keys per user so a resent
+// message is only broadcast and stored once.
+type seenKeys struct {
+	mu     sync.Mutex
+	window time.Duration
+	keys   map[string]time.Time
+	swept  time.Time
+}
+
+func newSeenKeys(window time.Duration) *seenKeys {
+	return &seenKeys{window: window, keys: make(map[string]time.Time)}
+}
+
+// first records userID's key and reports whether it was not already seen
+// within the window. Expired keys are swept out at most once per window.
+func (k *seenKeys) first(userID, key string, now time.Time) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if now.Sub(k.swept) > k.window {
+		for id, at := range k.keys {
+			if now.Sub(at) > k.window {
+				delete(k.keys, id)
+			}
+		}
+		k.swept = now
+	}
+
+	id := userID + "\x00" + key
+	if at, ok := k.keys[id]; ok && now.Sub(at) <= k.window {
+		return false
+	}
+	k.keys[id] = now
+	return true
+}
@@ -3,40 +3,93 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/rexlx/squall/internal"
 	pb "github.com/rexlx/squall/proto"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 type GrpcServer struct {
 	pb.UnimplementedChatServiceServer
 	appServer *Server
-	streams   map[string]map[string]pb.ChatService_StreamServer
+	streams   map[string]map[*clientStream]bool
 	streamMu  sync.RWMutex
+
+	// Per-stream outbound queue length and what to do when it overflows;
+	// NewGrpcServer sets DefaultOutboxSize and OverflowDropOldest.
+	OutboxSize     int
+	OverflowPolicy string
+
+	// MaxMessageBytes caps the content of a chat message; NewGrpcServer
+	// sets DefaultMaxMessageBytes.
+	MaxMessageBytes int
+
+	// Attachments stores uploaded files; nil disables attachments. Uploads
+	// over MaxAttachmentBytes, or of a media type not in AttachmentTypes,
+	// are refused.
+	Attachments        AttachmentStore
+	MaxAttachmentBytes int64
+	AttachmentTypes    []string
+
+	// When each user's last_active was last written, so stream traffic
+	// updates it at most once per activeWriteInterval
+	activeMu      sync.Mutex
+	activeWritten map[string]time.Time
+
+	// Idempotency keys seen in the last DefaultDedupeWindow
+	seen *seenKeys
+
+	// Each room's next message sequence number
+	seqs *roomSeqs
 }
 
+// activeWriteInterval limits how often stream activity updates a user's
+// last_active column.
+const activeWriteInterval = time.Minute
+
 func NewGrpcServer(app *Server) *GrpcServer {
 	return &GrpcServer{
-		appServer: app,
-		streams:   make(map[string]map[string]pb.ChatService_StreamServer),
+		appServer:       app,
+		streams:         make(map[string]map[*clientStream]bool),
+		activeWritten:   make(map[string]time.Time),
+		seen:            newSeenKeys(DefaultDedupeWindow),
+		seqs:            newRoomSeqs(),
+		OutboxSize:      DefaultOutboxSize,
+		OverflowPolicy:  OverflowDropOldest,
+		MaxMessageBytes: DefaultMaxMessageBytes,
+
+		MaxAttachmentBytes: DefaultMaxAttachmentBytes,
+		AttachmentTypes:    ParseAttachmentTypes(DefaultAttachmentTypes),
 	}
 }
 
 func (s *GrpcServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginResponse, error) {
+	start := time.Now()
+	loginFailed := func(reason string) {
+		metricLogins.WithLabelValues("failure").Inc()
+		s.appServer.Events.Warn("login failed", "event", "login_failed", "email", req.Email, "reason", reason,
+			"latency_ms", time.Since(start).Milliseconds())
+	}
+
 	// 1. Validate input
 	if req.Email == "" {
 		return nil, status.Error(codes.InvalidArgument, "email and password are required")
 	}
 
 	// 2. Attempt to fetch user from DB
-	user, err := s.appServer.DB.GetUserByEmail(req.Email)
+	user, err := s.appServer.DB.GetUserByEmail(ctx, req.Email)
 	if err != nil {
 		// 3. If user is missing, check the global whitelist
 		WhitelistMu.RLock()
@@ -48,6 +101,7 @@ func (s *GrpcServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.Login
 			return nil, status.Error(codes.AlreadyExists, "WHITELIST_PENDING_PASSWORD")
 		}
 
+		loginFailed("unknown user")
 		return nil, status.Error(codes.Unauthenticated, "invalid credentials")
 	}
 
@@ -57,13 +111,37 @@ func (s *GrpcServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.Login
 		return nil, status.Error(codes.Internal, "internal auth error")
 	}
 	if !ok {
+		loginFailed("bad password")
 		return nil, status.Error(codes.Unauthenticated, "invalid credentials")
 	}
 
-	// 5. Generate session token
-	token, err := GenerateJWT(user.ID, user.Role, user.Email, s.appServer.Key)
+	// The plaintext is only on hand now, so upgrade weak hashes while we can.
+	// A failure just leaves the old hash, which still works.
+	if user.NeedsRehash() {
+		if err := user.SetPassword(req.Password); err != nil {
+			s.appServer.Logger.Printf("Failed to rehash password for %s: %v", user.Email, err)
+		} else if err := s.appServer.DB.StoreUser(ctx, user); err != nil {
+			s.appServer.Logger.Printf("Failed to store rehashed password for %s: %v", user.Email, err)
+		}
+	}
+
+	// 5. Generate session tokens
+	token, refresh, err := s.issueTokens(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	s.appServer.IncrementStat(StatLogins)
+	metricLogins.WithLabelValues("success").Inc()
+	if err := s.appServer.DB.SetLastLogin(ctx, user.ID, time.Now()); err != nil {
+		s.appServer.Logger.Printf("Failed to record last login for %s: %v", user.Email, err)
+	}
+	s.appServer.Events.Info("login", "event", "login", "user_id", user.ID, "email", user.Email,
+		"latency_ms", time.Since(start).Milliseconds())
+	// Without them the client notifies for everything, which beats failing
+	// the login
+	prefs, err := s.appServer.DB.NotificationPrefs(ctx, user.ID)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "failed to generate token")
+		s.appServer.Logger.Printf("Failed to load notification prefs for %s: %v", user.Email, err)
 	}
 
 	return &pb.LoginResponse{
@@ -73,11 +151,77 @@ func (s *GrpcServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.Login
 			FirstName: user.Name,
 			Rooms:     user.Rooms,
 			History:   user.History,
+			About:     user.About,
 		},
-		Token: token,
+		Token:             token,
+		RefreshToken:      refresh,
+		NotificationPrefs: NotificationPrefsToProto(prefs),
 	}, nil
 }
 
+// RefreshToken exchanges a valid refresh token for a new access token. The
+// refresh token is rotated: the old one is revoked and a new one returned.
+func (s *GrpcServer) RefreshToken(ctx context.Context, req *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error) {
+	if req.RefreshToken == "" {
+		return nil, status.Error(codes.InvalidArgument, "refresh_token is required")
+	}
+
+	// Revoking and checking in one step means two concurrent refreshes with
+	// the same token can't both succeed
+	userID, err := s.appServer.DB.ConsumeRefreshToken(ctx, HashRefreshToken(req.RefreshToken))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Error(codes.Unauthenticated, "refresh token is invalid")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to rotate refresh token")
+	}
+
+	// Re-read the user so role changes apply and purged users are locked out
+	user, err := s.appServer.DB.GetUser(ctx, userID)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "refresh token is invalid")
+	}
+
+	token, refresh, err := s.issueTokens(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.RefreshTokenResponse{Token: token, RefreshToken: refresh}, nil
+}
+
+// Logout revokes a refresh token. Access tokens already issued remain valid
+// until they expire, which the server's TokenTTL keeps short.
+func (s *GrpcServer) Logout(ctx context.Context, req *pb.LogoutRequest) (*pb.LogoutResponse, error) {
+	if req.RefreshToken == "" {
+		return nil, status.Error(codes.InvalidArgument, "refresh_token is required")
+	}
+
+	if err := s.appServer.DB.RevokeRefreshToken(ctx, HashRefreshToken(req.RefreshToken)); err != nil {
+		return nil, status.Error(codes.Internal, "failed to revoke refresh token")
+	}
+
+	return &pb.LogoutResponse{Success: true}, nil
+}
+
+// issueTokens creates an access token and a stored refresh token for user.
+func (s *GrpcServer) issueTokens(ctx context.Context, user User) (string, string, error) {
+	token, err := GenerateJWT(user.ID, user.Role, user.Email, s.appServer.JWTKeys, s.appServer.TokenIssuer, s.appServer.TokenTTL)
+	if err != nil {
+		return "", "", status.Error(codes.Internal, "failed to generate token")
+	}
+
+	refresh, hash, err := NewRefreshToken()
+	if err != nil {
+		return "", "", status.Error(codes.Internal, "failed to generate token")
+	}
+	if err := s.appServer.DB.StoreRefreshToken(ctx, hash, user.ID, time.Now().Add(s.appServer.RefreshTTL)); err != nil {
+		return "", "", status.Error(codes.Internal, "failed to store refresh token")
+	}
+
+	return token, refresh, nil
+}
+
 func (s *GrpcServer) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
 	caller, err := GetUserFromContext(ctx)
 	if err != nil {
@@ -87,6 +231,9 @@ func (s *GrpcServer) CreateUser(ctx context.Context, req *pb.CreateUserRequest)
 	if caller.Role != "admin" {
 		return nil, status.Error(codes.PermissionDenied, "only admins can create users")
 	}
+	if err := s.appServer.PasswordPolicy.Validate(req.Password); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	randBytes := make([]byte, 16)
 	rand.Read(randBytes)
@@ -105,10 +252,11 @@ func (s *GrpcServer) CreateUser(ctx context.Context, req *pb.CreateUserRequest)
 		return nil, status.Error(codes.Internal, "failed to hash password")
 	}
 
-	if err := s.appServer.DB.StoreUser(newUser); err != nil {
+	if err := s.appServer.DB.StoreUser(ctx, newUser); err != nil {
 		return nil, status.Error(codes.Internal, "failed to store user")
 	}
 
+	s.appServer.Audit("user_create", caller, "user_id", newID, "email", newUser.Email, "role", newUser.Role)
 	return &pb.CreateUserResponse{Success: true, UserId: newID}, nil
 }
 
@@ -123,10 +271,13 @@ func (s *GrpcServer) UpdatePassword(ctx context.Context, req *pb.UpdatePasswordR
 	WhitelistMu.RUnlock()
 
 	if isWhitelisted {
-		user, err := s.appServer.DB.GetUserByEmail(req.Email)
+		user, err := s.appServer.DB.GetUserByEmail(ctx, req.Email)
 
 		// Redeem if user record is missing OR their password is currently empty
 		if err != nil || user.Password == "" {
+			if err := s.appServer.PasswordPolicy.Validate(req.NewPassword); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
 			if err != nil {
 				// Initialize new user record if they don't exist in DB yet
 				randBytes := make([]byte, 16)
@@ -144,7 +295,7 @@ func (s *GrpcServer) UpdatePassword(ctx context.Context, req *pb.UpdatePasswordR
 			if err := user.SetPassword(req.NewPassword); err != nil {
 				return nil, status.Error(codes.Internal, "failed to hash password")
 			}
-			if err := s.appServer.DB.StoreUser(user); err != nil {
+			if err := s.appServer.DB.StoreUser(ctx, user); err != nil {
 				return nil, status.Error(codes.Internal, "failed to store whitelisted user")
 			}
 
@@ -168,36 +319,85 @@ func (s *GrpcServer) UpdatePassword(ctx context.Context, req *pb.UpdatePasswordR
 		return nil, status.Error(codes.Unauthenticated, "authentication required for this operation")
 	}
 
+	if err := s.changePassword(ctx, caller, req.Email, req.OldPassword, req.NewPassword); err != nil {
+		return nil, err
+	}
+
+	return &pb.UpdatePasswordResponse{
+		Success: true,
+		Message: "Password updated successfully",
+	}, nil
+}
+
+// ChangePassword changes the caller's own password, or with an email set, lets
+// an admin reset another user's password without knowing the old one.
+func (s *GrpcServer) ChangePassword(ctx context.Context, req *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+	caller, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "authentication required")
+	}
+
+	email := req.Email
+	if email == "" {
+		email = caller.Email
+	}
+
+	if err := s.changePassword(ctx, caller, email, req.OldPassword, req.NewPassword); err != nil {
+		return nil, err
+	}
+
+	return &pb.ChangePasswordResponse{
+		Success: true,
+		Message: "Password updated successfully",
+	}, nil
+}
+
+// changePassword sets a new password for the user with email. Users must
+// prove their current password; admins may reset anyone else's outright.
+func (s *GrpcServer) changePassword(ctx context.Context, caller User, email, oldPassword, newPassword string) error {
+	self := caller.Email == email
+
 	// Security: Only allow self-updates or Admin overrides
-	if caller.Email != req.Email && caller.Role != "admin" {
-		return nil, status.Error(codes.PermissionDenied, "unauthorized password update")
+	if !self && caller.Role != "admin" {
+		return status.Error(codes.PermissionDenied, "unauthorized password update")
+	}
+
+	if err := s.appServer.PasswordPolicy.Validate(newPassword); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	user, err := s.appServer.DB.GetUserByEmail(req.Email)
+	user, err := s.appServer.DB.GetUserByEmail(ctx, email)
 	if err != nil {
-		return nil, status.Error(codes.NotFound, "user not found")
+		return status.Error(codes.NotFound, "user not found")
 	}
 
-	// Verify old password (Admins skip this check)
-	if caller.Role != "admin" {
-		ok, _ := user.PasswordMatches(req.OldPassword)
+	// Verify old password (Admins resetting someone else skip this check)
+	if self {
+		ok, _ := user.PasswordMatches(oldPassword)
 		if !ok {
-			return nil, status.Error(codes.Unauthenticated, "incorrect old password")
+			return status.Error(codes.Unauthenticated, "incorrect old password")
 		}
 	}
 
-	if err := user.SetPassword(req.NewPassword); err != nil {
-		return nil, status.Error(codes.Internal, "failed to hash password")
+	if err := user.SetPassword(newPassword); err != nil {
+		return status.Error(codes.Internal, "failed to hash password")
 	}
+	user.Updated = time.Now()
 
-	if err := s.appServer.DB.StoreUser(user); err != nil {
-		return nil, status.Error(codes.Internal, "failed to update user")
+	if err := s.appServer.DB.StoreUser(ctx, user); err != nil {
+		return status.Error(codes.Internal, "failed to update user")
+	}
+	// Sessions started with the old password end at their next refresh
+	if err := s.appServer.DB.RevokeUserRefreshTokens(ctx, user.ID); err != nil {
+		return status.Error(codes.Internal, "failed to revoke sessions")
 	}
 
-	return &pb.UpdatePasswordResponse{
-		Success: true,
-		Message: "Password updated successfully",
-	}, nil
+	if self {
+		s.appServer.Events.Info("password changed", "event", "password_change", "user_id", caller.ID, "email", caller.Email)
+	} else {
+		s.appServer.Audit("password_reset", caller, "user_id", user.ID, "email", email)
+	}
+	return nil
 }
 
 func (s *GrpcServer) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb.UpdateUserResponse, error) {
@@ -213,18 +413,30 @@ func (s *GrpcServer) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest)
 	}
 
 	// Fetch the user from database
-	user, err := s.appServer.DB.GetUserByEmail(req.User.Email)
+	user, err := s.appServer.DB.GetUserByEmail(ctx, req.User.Email)
 	if err != nil {
 		return nil, status.Error(codes.NotFound, "user not found")
 	}
 
-	// Update the rooms and history fields
-	user.Rooms = req.User.Rooms
-	user.History = req.User.History
+	if req.Role != "" {
+		return s.setRole(ctx, caller, user, req.Role)
+	}
+
+	if req.UpdateProfile {
+		if err := ValidateProfile(req.User.FirstName, req.User.About); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		user.Name = strings.TrimSpace(req.User.FirstName)
+		user.About = req.User.About
+	} else {
+		// Update the rooms and history fields
+		user.Rooms = req.User.Rooms
+		user.History = req.User.History
+	}
 	user.Updated = time.Now()
 
 	// Store updated user
-	if err := s.appServer.DB.StoreUser(user); err != nil {
+	if err := s.appServer.DB.StoreUser(ctx, user); err != nil {
 		return nil, status.Error(codes.Internal, "failed to update user")
 	}
 
@@ -234,164 +446,1304 @@ func (s *GrpcServer) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest)
 	}, nil
 }
 
-func (s *GrpcServer) JoinRoom(ctx context.Context, req *pb.JoinRoomRequest) (*pb.RoomResponse, error) {
-	roomName := req.RoomName
-	room, err := s.appServer.DB.GetRoom(roomName)
+// setRole changes user's role for an admin caller. The last admin can't be
+// demoted. The new role takes effect in tokens issued after the change.
+func (s *GrpcServer) setRole(ctx context.Context, caller, user User, role string) (*pb.UpdateUserResponse, error) {
+	if caller.Role != "admin" {
+		return nil, status.Error(codes.PermissionDenied, "only admins can change roles")
+	}
+	if role != "user" && role != "admin" {
+		return nil, status.Error(codes.InvalidArgument, `role must be "user" or "admin"`)
+	}
 
+	// The check and the update happen in one transaction, so two admins
+	// demoting each other can't both succeed, and only the role is written
+	previous, err := s.appServer.DB.SetRole(ctx, user.ID, role)
+	if errors.Is(err, ErrLastAdmin) {
+		return nil, status.Error(codes.FailedPrecondition, "cannot demote the last admin")
+	}
 	if err != nil {
-		room = Room{ID: roomName, Name: roomName, MaxMessages: 1000}
-		s.appServer.DB.StoreRoom(room)
+		return nil, status.Error(codes.Internal, "failed to update user")
 	}
+	s.appServer.Audit("role_change", caller, "user_id", user.ID, "email", user.Email, "from", previous, "to", role)
+
+	return &pb.UpdateUserResponse{
+		Success:      true,
+		Message:      "Role updated",
+		PreviousRole: previous,
+		Role:         role,
+	}, nil
+}
 
-	// --- FIX: Persist History and Saved Rooms ---
+// PurgeUserData permanently removes a user and deletes or anonymizes their
+// message history. Unlike a ban, nothing identifying the user is kept.
+func (s *GrpcServer) PurgeUserData(ctx context.Context, req *pb.PurgeUserDataRequest) (*pb.PurgeUserDataResponse, error) {
 	caller, err := GetUserFromContext(ctx)
-	if err == nil {
-		fmt.Println("no user in context:", err)
-		dbUser, _ := s.appServer.DB.GetUserByEmail(caller.Email)
-
-		// 1. Update Saved Rooms (Unique list)
-		found := false
-		for _, r := range dbUser.Rooms {
-			if r == roomName {
-				found = true
-				break
-			}
-		}
-		if !found {
-			dbUser.Rooms = append(dbUser.Rooms, roomName)
-		}
+	if err != nil {
+		return nil, err
+	}
 
-		// 2. Update History (Move current room to the front, limit to 10)
-		newHistory := []string{roomName}
-		for _, r := range dbUser.History {
-			if r != roomName {
-				newHistory = append(newHistory, r)
-			}
-		}
-		if len(newHistory) > 10 {
-			newHistory = newHistory[:10]
-		}
-		dbUser.History = newHistory
+	if caller.Role != "admin" {
+		return nil, status.Error(codes.PermissionDenied, "only admins can purge user data")
+	}
 
-		// Persist changes to database
-		s.appServer.DB.StoreUser(dbUser)
+	user, err := s.appServer.DB.GetUserByEmail(ctx, req.Email)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "user not found")
 	}
 
-	var history []*pb.ChatMessage
-	for _, m := range room.Messages {
-		history = append(history, ToProto(m))
+	affected, files, err := s.appServer.DB.PurgeUser(ctx, user.ID, caller.ID, req.DeleteMessages)
+	if errors.Is(err, ErrLastAdmin) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to purge user data")
 	}
 
-	return &pb.RoomResponse{
-		RoomId:  room.ID,
-		Name:    room.Name,
-		Success: true,
-		History: history,
+	s.deleteAttachmentFiles(ctx, files)
+
+	WhitelistMu.Lock()
+	delete(Whitelist, req.Email)
+	WhitelistMu.Unlock()
+
+	s.appServer.Audit("user_purge", caller, "user_id", user.ID, "delete_messages", req.DeleteMessages, "messages_affected", affected)
+
+	return &pb.PurgeUserDataResponse{
+		Success:          true,
+		MessagesAffected: affected,
+		Message:          "User data purged",
 	}, nil
 }
 
-func (s *GrpcServer) Stream(stream pb.ChatService_StreamServer) error {
-	user, err := GetUserFromContext(stream.Context())
+// DeleteRoom removes a room with all of its messages and disconnects anyone
+// still streaming in it.
+func (s *GrpcServer) DeleteRoom(ctx context.Context, req *pb.RoomRequest) (*pb.DeleteRoomResponse, error) {
+	caller, err := GetUserFromContext(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	firstMsg, err := stream.Recv()
+	if caller.Role != "admin" {
+		return nil, status.Error(codes.PermissionDenied, "only admins can delete rooms")
+	}
+
+	if _, err := s.appServer.DB.GetRoom(ctx, req.Name); err != nil {
+		return nil, status.Error(codes.NotFound, "room not found")
+	}
+
+	deleted, files, err := s.appServer.DB.DeleteRoom(ctx, req.Name)
 	if err != nil {
-		return err
+		return nil, status.Error(codes.Internal, "failed to delete room")
 	}
+	s.deleteAttachmentFiles(ctx, files)
+	s.forgetRoom(req.Name)
+	s.appServer.Audit("room_delete", caller, "room_id", req.Name, "messages_deleted", deleted)
 
-	roomID := firstMsg.RoomId
-	userID := user.ID
+	return &pb.DeleteRoomResponse{Success: true, MessagesDeleted: deleted}, nil
+}
 
-	s.registerStream(roomID, userID, stream)
-	defer s.deregisterStream(roomID, userID)
+// forgetRoom lets go of what the server holds for a room whose rows are
+// gone: its streams are closed and its sequence counter dropped.
+func (s *GrpcServer) forgetRoom(roomID string) {
+	s.closeRoomStreams(roomID)
+	s.seqs.forget(roomID)
+}
 
-	// Use GetMessageContent() accessor for the oneof field
-	if firstMsg.GetMessageContent() != "" {
-		s.processMessage(user, firstMsg)
-	}
+// StartRoomReaper deletes stale rooms every checkInterval until ctx is
+// cancelled, cleaning up after each one as DeleteRoom does.
+func (s *GrpcServer) StartRoomReaper(ctx context.Context, checkInterval time.Duration, staleThreshold time.Duration) {
+	s.appServer.Logger.Printf("Room Reaper started (Check every %s, stale threshold %s)", checkInterval, staleThreshold)
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
 
 	for {
-		msg, err := stream.Recv()
-		if err == io.EOF {
-			return nil
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
 		}
+		start := time.Now()
+		s.appServer.Logger.Println("Room Reaper: Checking for stale rooms...")
+
+		rooms, files, err := s.appServer.DB.ReapStaleRooms(ctx, staleThreshold)
 		if err != nil {
-			return err
+			s.appServer.Logger.Printf("Room Reaper failed: %v", err)
+			continue
 		}
-		s.processMessage(user, msg)
+		s.deleteAttachmentFiles(ctx, files)
+		for _, roomID := range rooms {
+			s.forgetRoom(roomID)
+		}
+		s.appServer.Logger.Printf("Room Reaper removed %d rooms in %v", len(rooms), time.Since(start))
 	}
 }
 
-func (s *GrpcServer) processMessage(user User, msg *pb.ChatMessage) {
-	msg.Timestamp = time.Now().Unix()
-	s.Broadcast(msg)
+// SetRoomLimit changes how many messages the prune worker keeps for a room.
+// A limit <= 0 makes the room unlimited.
+func (s *GrpcServer) SetRoomLimit(ctx context.Context, req *pb.SetRoomLimitRequest) (*pb.SetRoomLimitResponse, error) {
+	caller, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	// Don't save binary chunks to the DB
-	if msg.Type == pb.ChatMessage_FILE_CHUNK {
-		return
+	if caller.Role != "admin" {
+		return nil, status.Error(codes.PermissionDenied, "only admins can change room limits")
 	}
 
-	var dbContent string
-	switch msg.Type {
-	case pb.ChatMessage_TEXT:
-		dbContent = msg.GetMessageContent()
-	case pb.ChatMessage_FILE_CONTROL:
-		if meta := msg.GetFileMeta(); meta != nil {
-			dbContent = fmt.Sprintf("FILE:%s|HASH:%s|ACTION:%s", meta.FileName, meta.FileHash, meta.Action)
-		}
+	room, err := s.appServer.DB.GetRoom(ctx, req.RoomId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "room not found")
 	}
 
-	internalMsg := internal.Message{
-		RoomID:        msg.RoomId,
-		UserID:        user.ID,
-		Email:         user.Email,
-		Message:       dbContent,
-		InitialVector: msg.Iv,
-		HotSauce:      msg.HotSauce,
-		Time:          fmt.Sprintf("%d", msg.Timestamp),
+	room.MaxMessages = int(req.MaxMessages)
+	if err := s.appServer.DB.StoreRoom(ctx, room); err != nil {
+		return nil, status.Error(codes.Internal, "failed to update room")
 	}
 
-	select {
-	case s.appServer.Queue <- SaveRequest{RoomID: msg.RoomId, Message: internalMsg}:
-	default:
-		s.appServer.Logger.Println("DB Queue full, dropping persistence.")
+	s.appServer.Audit("room_limit", caller, "room_id", room.ID, "max_messages", room.MaxMessages)
+	return &pb.SetRoomLimitResponse{Success: true}, nil
+}
+
+// SetRoomTopic changes what a room says it is about and tells everyone
+// connected to it.
+func (s *GrpcServer) SetRoomTopic(ctx context.Context, req *pb.SetRoomTopicRequest) (*pb.SetRoomTopicResponse, error) {
+	caller, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	topic := strings.TrimSpace(req.Topic)
+	if len(topic) > MaxTopicBytes {
+		return nil, status.Errorf(codes.InvalidArgument, "topic is longer than %d bytes", MaxTopicBytes)
 	}
+
+	room, err := s.appServer.DB.GetRoom(ctx, req.RoomId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "room not found")
+	}
+	if !room.CanModerate(caller) {
+		return nil, status.Error(codes.PermissionDenied, "only the room owner or an admin can set the topic")
+	}
+
+	room.Topic = topic
+	if err := s.appServer.DB.StoreRoom(ctx, room); err != nil {
+		return nil, status.Error(codes.Internal, "failed to update room")
+	}
+
+	now := time.Now()
+	s.Broadcast(&pb.ChatMessage{
+		RoomId:      room.ID,
+		UserId:      caller.ID,
+		Email:       caller.Email,
+		Timestamp:   now.Unix(),
+		TimestampMs: now.UnixMilli(),
+		Type:        pb.ChatMessage_TEXT,
+		Command:     CommandTopic,
+		Payload:     &pb.ChatMessage_MessageContent{MessageContent: topic},
+	})
+	s.appServer.Audit("room_topic", caller, "room_id", room.ID, "topic", topic)
+	return &pb.SetRoomTopicResponse{Success: true}, nil
 }
 
-func (s *GrpcServer) Broadcast(msg *pb.ChatMessage) {
-	s.streamMu.RLock()
-	roomStreams, exists := s.streams[msg.RoomId]
-	if !exists || len(roomStreams) == 0 {
-		s.streamMu.RUnlock()
-		return
+// moderator checks that the caller may moderate req.RoomId and returns the
+// caller and the user being moderated.
+func (s *GrpcServer) moderator(ctx context.Context, req *pb.AdminRequest) (User, User, error) {
+	caller, err := GetUserFromContext(ctx)
+	if err != nil {
+		return User{}, User{}, err
+	}
+	if req.RoomId == "" || req.UserId == "" {
+		return User{}, User{}, status.Error(codes.InvalidArgument, "room_id and user_id are required")
 	}
+	room, err := s.appServer.DB.GetRoom(ctx, req.RoomId)
+	if err != nil {
+		return User{}, User{}, status.Error(codes.NotFound, "room not found")
+	}
+	if !room.CanModerate(caller) {
+		return User{}, User{}, status.Error(codes.PermissionDenied, "only the room owner or an admin can moderate this room")
+	}
+	target, err := s.appServer.DB.GetUser(ctx, req.UserId)
+	if err != nil {
+		return User{}, User{}, status.Error(codes.NotFound, "user not found")
+	}
+	return caller, target, nil
+}
 
-	activeStreams := make([]pb.ChatService_StreamServer, 0, len(roomStreams))
-	for _, stream := range roomStreams {
-		activeStreams = append(activeStreams, stream)
+// kick tells the room a user is being removed, then disconnects them.
+func (s *GrpcServer) kick(target User, roomID string) {
+	s.announce(target, roomID, CommandKicked)
+	s.dropUser(roomID, target.ID)
+}
+
+// KickUser disconnects a user's streams from a room. They may rejoin.
+func (s *GrpcServer) KickUser(ctx context.Context, req *pb.AdminRequest) (*pb.AdminResponse, error) {
+	caller, target, err := s.moderator(ctx, req)
+	if err != nil {
+		return nil, err
 	}
-	s.streamMu.RUnlock()
+	s.kick(target, req.RoomId)
+	s.appServer.Audit("kick", caller, "room_id", req.RoomId, "user_id", target.ID, "email", target.Email)
+	return &pb.AdminResponse{Success: true}, nil
+}
 
-	for _, stream := range activeStreams {
-		_ = stream.Send(msg)
+// BanUser kicks a user from a room and stops them joining it again.
+func (s *GrpcServer) BanUser(ctx context.Context, req *pb.AdminRequest) (*pb.AdminResponse, error) {
+	caller, target, err := s.moderator(ctx, req)
+	if err != nil {
+		return nil, err
 	}
+	if err := s.appServer.DB.BanUser(ctx, req.RoomId, target.ID, caller.ID); err != nil {
+		return nil, status.Error(codes.Internal, "failed to ban user")
+	}
+	s.kick(target, req.RoomId)
+	s.appServer.Audit("ban", caller, "room_id", req.RoomId, "user_id", target.ID, "email", target.Email)
+	return &pb.AdminResponse{Success: true}, nil
 }
 
-func (s *GrpcServer) registerStream(roomID, userID string, stream pb.ChatService_StreamServer) {
-	s.streamMu.Lock()
-	defer s.streamMu.Unlock()
-	if _, ok := s.streams[roomID]; !ok {
-		s.streams[roomID] = make(map[string]pb.ChatService_StreamServer)
+func (s *GrpcServer) UnbanUser(ctx context.Context, req *pb.AdminRequest) (*pb.AdminResponse, error) {
+	caller, target, err := s.moderator(ctx, req)
+	if err != nil {
+		return nil, err
 	}
-	s.streams[roomID][userID] = stream
+	if err := s.appServer.DB.UnbanUser(ctx, req.RoomId, target.ID); err != nil {
+		return nil, status.Error(codes.Internal, "failed to unban user")
+	}
+	s.appServer.Audit("unban", caller, "room_id", req.RoomId, "user_id", target.ID, "email", target.Email)
+	return &pb.AdminResponse{Success: true}, nil
 }
 
-func (s *GrpcServer) deregisterStream(roomID, userID string) {
-	s.streamMu.Lock()
-	defer s.streamMu.Unlock()
-	if _, ok := s.streams[roomID]; ok {
-		delete(s.streams[roomID], userID)
+// TransferRoomOwnership hands a room to another user. The current owner or
+// an admin may do this, including for rooms that have no owner yet.
+func (s *GrpcServer) TransferRoomOwnership(ctx context.Context, req *pb.TransferRoomOwnershipRequest) (*pb.AdminResponse, error) {
+	caller, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.RoomId == "" || req.NewOwnerId == "" {
+		return nil, status.Error(codes.InvalidArgument, "room_id and new_owner_id are required")
+	}
+
+	room, err := s.appServer.DB.GetRoom(ctx, req.RoomId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "room not found")
+	}
+	if !room.CanModerate(caller) {
+		return nil, status.Error(codes.PermissionDenied, "only the room owner or an admin can transfer this room")
+	}
+	if _, err := s.appServer.DB.GetUser(ctx, req.NewOwnerId); err != nil {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+
+	room.OwnerID = req.NewOwnerId
+	if err := s.appServer.DB.StoreRoom(ctx, room); err != nil {
+		return nil, status.Error(codes.Internal, "failed to update room")
+	}
+
+	s.appServer.Audit("room_transfer", caller, "room_id", room.ID, "user_id", req.NewOwnerId)
+	return &pb.AdminResponse{Success: true}, nil
+}
+
+// LeaveRoom removes a room from the caller's saved rooms and history and
+// disconnects their streams from it.
+func (s *GrpcServer) LeaveRoom(ctx context.Context, req *pb.RoomRequest) (*pb.LeaveRoomResponse, error) {
+	caller, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "room name is required")
+	}
+
+	dbUser, err := s.appServer.DB.GetUser(ctx, caller.ID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	dbUser.Rooms = slices.DeleteFunc(dbUser.Rooms, func(r string) bool { return r == req.Name })
+	dbUser.History = slices.DeleteFunc(dbUser.History, func(r string) bool { return r == req.Name })
+	if err := s.appServer.DB.StoreUser(ctx, dbUser); err != nil {
+		return nil, status.Error(codes.Internal, "failed to update user")
+	}
+
+	s.dropUser(req.Name, caller.ID)
+	return &pb.LeaveRoomResponse{Success: true}, nil
+}
+
+// CreateRoom creates a public room up front with a chosen history limit.
+// MaxMessages 0 picks DefaultRoomMaxMessages; a negative value keeps the
+// room's history indefinitely.
+func (s *GrpcServer) CreateRoom(ctx context.Context, req *pb.CreateRoomRequest) (*pb.RoomResponse, error) {
+	caller, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "room name is required")
+	}
+	if strings.HasPrefix(name, DirectRoomPrefix) {
+		return nil, status.Error(codes.InvalidArgument, "room names may not start with "+DirectRoomPrefix)
+	}
+
+	if _, err := s.appServer.DB.GetRoom(ctx, name); err == nil {
+		return nil, status.Error(codes.AlreadyExists, "room already exists")
+	}
+
+	limit := int(req.MaxMessages)
+	if limit == 0 {
+		limit = DefaultRoomMaxMessages
+	}
+	room := Room{ID: name, Name: name, MaxMessages: limit, OwnerID: caller.ID}
+	if err := s.appServer.DB.StoreRoom(ctx, room); err != nil {
+		return nil, status.Error(codes.Internal, "failed to create room")
+	}
+
+	s.appServer.Logger.Printf("Room %s created by %s (max messages %d)", room.ID, caller.Email, room.MaxMessages)
+	return &pb.RoomResponse{RoomId: room.ID, Name: room.Name, Success: true}, nil
+}
+
+func (s *GrpcServer) JoinRoom(ctx context.Context, req *pb.JoinRoomRequest) (*pb.RoomResponse, error) {
+	roomName := req.RoomName
+	caller, callerErr := GetUserFromContext(ctx)
+	room, err := s.appServer.DB.GetRoom(ctx, roomName)
+
+	// A new room is only written once the join is allowed, together with
+	// the caller's room lists
+	var newRoom *Room
+	if err != nil {
+		// Direct message rooms only come into being through OpenDirectMessage
+		if strings.HasPrefix(roomName, DirectRoomPrefix) {
+			return nil, status.Error(codes.NotFound, "direct message room not found")
+		}
+		// Strict joins never create rooms, so a typo can't spawn one
+		if req.Strict {
+			return nil, status.Error(codes.NotFound, "room not found")
+		}
+		room = Room{ID: roomName, Name: roomName, MaxMessages: DefaultRoomMaxMessages}
+		if callerErr == nil {
+			room.OwnerID = caller.ID
+		}
+		newRoom = &room
+	}
+
+	if room.Private && (callerErr != nil || !room.CanAccess(caller.ID)) {
+		return nil, status.Error(codes.PermissionDenied, "not a member of this room")
+	}
+	if callerErr == nil {
+		if banned, err := s.appServer.DB.IsBanned(ctx, room.ID, caller.ID); err != nil {
+			return nil, status.Error(codes.Internal, "failed to check room bans")
+		} else if banned {
+			return nil, status.Error(codes.PermissionDenied, "banned from this room")
+		}
+	}
+
+	// Persist the new room with the caller's saved rooms and history
+	if callerErr == nil {
+		if err := s.appServer.DB.RecordJoin(ctx, newRoom, caller.Email, roomName); err != nil {
+			s.appServer.Logger.Printf("Failed to record join of %s by %s: %v", roomName, caller.Email, err)
+			return nil, status.Error(codes.Internal, "failed to join room")
+		}
+	} else if newRoom != nil {
+		if err := s.appServer.DB.StoreRoom(ctx, *newRoom); err != nil {
+			s.appServer.Logger.Printf("Failed to create room %s: %v", roomName, err)
+			return nil, status.Error(codes.Internal, "failed to create room")
+		}
+	}
+
+	msgs, nextBefore, err := s.appServer.DB.GetHistory(ctx, room.ID, 0, DefaultHistoryLimit)
+	if err != nil {
+		s.appServer.Logger.Printf("Warning: failed to fetch messages for room %s: %v", room.ID, err)
+	}
+
+	var history []*pb.ChatMessage
+	for _, m := range msgs {
+		history = append(history, ToProto(m))
+	}
+
+	return &pb.RoomResponse{
+		RoomId:       room.ID,
+		Name:         room.Name,
+		Success:      true,
+		History:      history,
+		NextBeforeId: nextBefore,
+		Topic:        room.Topic,
+	}, nil
+}
+
+// OpenDirectMessage creates (if needed) and joins the private room shared by
+// the caller and the user with the given email.
+func (s *GrpcServer) OpenDirectMessage(ctx context.Context, req *pb.OpenDirectMessageRequest) (*pb.RoomResponse, error) {
+	caller, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.Email == "" {
+		return nil, status.Error(codes.InvalidArgument, "email is required")
+	}
+
+	peer, err := s.appServer.DB.GetUserByEmail(ctx, req.Email)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	if peer.ID == caller.ID {
+		return nil, status.Error(codes.InvalidArgument, "cannot open a direct message with yourself")
+	}
+
+	roomID := DirectRoomID(caller.ID, peer.ID)
+	if _, err := s.appServer.DB.GetRoom(ctx, roomID); err != nil {
+		names := []string{caller.Email, peer.Email}
+		sort.Strings(names)
+		room := Room{
+			ID:          roomID,
+			Name:        strings.Join(names, " & "),
+			MaxMessages: DefaultRoomMaxMessages,
+			Private:     true,
+			Members:     []string{caller.ID, peer.ID},
+		}
+		if err := s.appServer.DB.StoreRoom(ctx, room); err != nil {
+			return nil, status.Error(codes.Internal, "failed to create direct message room")
+		}
+	}
+
+	return s.JoinRoom(ctx, &pb.JoinRoomRequest{Email: caller.Email, RoomName: roomID})
+}
+
+// checkRoomAccess returns PermissionDenied if the caller is banned from
+// roomID, or if the room is private and the caller is not one of its
+// members. A room with no row is treated as public; any other lookup
+// failure denies access rather than letting the caller through.
+func (s *GrpcServer) checkRoomAccess(ctx context.Context, roomID string) error {
+	caller, err := GetUserFromContext(ctx)
+	if err != nil {
+		return status.Error(codes.PermissionDenied, "not a member of this room")
+	}
+	banned, err := s.appServer.DB.IsBanned(ctx, roomID, caller.ID)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to check room bans")
+	}
+	if banned {
+		return status.Error(codes.PermissionDenied, "banned from this room")
+	}
+
+	room, err := s.appServer.DB.GetRoom(ctx, roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return status.Error(codes.Internal, "failed to load room")
+	}
+	if room.Private && !room.CanAccess(caller.ID) {
+		return status.Error(codes.PermissionDenied, "not a member of this room")
+	}
+	return nil
+}
+
+// GetHistory pages backwards through a room's messages, starting before the
+// given cursor. Messages are returned oldest first.
+func (s *GrpcServer) GetHistory(ctx context.Context, req *pb.HistoryRequest) (*pb.HistoryResponse, error) {
+	if req.RoomId == "" {
+		return nil, status.Error(codes.InvalidArgument, "room_id is required")
+	}
+	if err := s.checkRoomAccess(ctx, req.RoomId); err != nil {
+		return nil, err
+	}
+
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	if limit > MaxHistoryLimit {
+		limit = MaxHistoryLimit
+	}
+
+	msgs, nextBefore, err := s.appServer.DB.GetHistory(ctx, req.RoomId, req.BeforeId, limit)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch history")
+	}
+
+	var history []*pb.ChatMessage
+	for _, m := range msgs {
+		history = append(history, ToProto(m))
+	}
+
+	return &pb.HistoryResponse{Messages: history, NextBeforeId: nextBefore}, nil
+}
+
+// SearchMessages finds plaintext messages matching a query in one room, or
+// in every room the caller has joined when no room is given. Encrypted
+// messages can't be searched by the server and are never returned.
+func (s *GrpcServer) SearchMessages(ctx context.Context, req *pb.SearchMessagesRequest) (*pb.SearchMessagesResponse, error) {
+	caller, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query := strings.TrimSpace(req.Query)
+	if query == "" {
+		return nil, status.Error(codes.InvalidArgument, "query is required")
+	}
+
+	var rooms []string
+	if req.RoomId != "" {
+		if err := s.checkRoomAccess(ctx, req.RoomId); err != nil {
+			return nil, err
+		}
+		rooms = []string{req.RoomId}
+	} else {
+		dbUser, err := s.appServer.DB.GetUser(ctx, caller.ID)
+		if err != nil {
+			return nil, status.Error(codes.NotFound, "user not found")
+		}
+		for _, roomID := range dbUser.Rooms {
+			if s.checkRoomAccess(ctx, roomID) == nil {
+				rooms = append(rooms, roomID)
+			}
+		}
+	}
+
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	if limit > MaxHistoryLimit {
+		limit = MaxHistoryLimit
+	}
+
+	msgs, err := s.appServer.DB.SearchMessages(ctx, rooms, query, limit)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to search messages")
+	}
+
+	var results []*pb.ChatMessage
+	for _, m := range msgs {
+		results = append(results, ToProto(m))
+	}
+	return &pb.SearchMessagesResponse{Messages: results}, nil
+}
+
+// GetMessageThread returns a message together with the message it replies
+// to and its direct replies. A reply_to pointing at a pruned or deleted
+// message is reported through ParentMissing rather than as an error.
+func (s *GrpcServer) GetMessageThread(ctx context.Context, req *pb.MessageThreadRequest) (*pb.MessageThreadResponse, error) {
+	if req.RoomId == "" || req.MessageId <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "room_id and message_id are required")
+	}
+	if err := s.checkRoomAccess(ctx, req.RoomId); err != nil {
+		return nil, err
+	}
+
+	msg, err := s.appServer.DB.GetMessage(ctx, req.RoomId, strconv.FormatInt(req.MessageId, 10))
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "message not found")
+	}
+	resp := &pb.MessageThreadResponse{Message: ToProto(msg)}
+
+	if msg.ReplyTo != "" {
+		if _, err := strconv.ParseInt(msg.ReplyTo, 10, 64); err != nil {
+			resp.ParentMissing = true
+		} else if parent, err := s.appServer.DB.GetMessage(ctx, req.RoomId, msg.ReplyTo); err != nil {
+			resp.ParentMissing = true
+		} else {
+			resp.Parent = ToProto(parent)
+		}
+	}
+
+	replies, err := s.appServer.DB.GetReplies(ctx, req.RoomId, req.MessageId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch replies")
+	}
+	for _, m := range replies {
+		resp.Replies = append(resp.Replies, ToProto(m))
+	}
+	return resp, nil
+}
+
+// EditMessage lets the author of a stored message replace its content and
+// tells the room about it with an "edited" control message.
+func (s *GrpcServer) EditMessage(ctx context.Context, req *pb.EditMessageRequest) (*pb.EditMessageResponse, error) {
+	caller, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.MessageId <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "message_id is required")
+	}
+	if req.MessageContent == "" {
+		return nil, status.Error(codes.InvalidArgument, "message_content is required")
+	}
+
+	m, err := s.appServer.DB.EditMessage(ctx, req.MessageId, caller.ID, req.MessageContent, req.Iv, req.HotSauce)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Error(codes.NotFound, "message not found")
+	}
+	if errors.Is(err, ErrNotAuthor) {
+		return nil, status.Error(codes.PermissionDenied, "only the author can edit a message")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to edit message")
+	}
+
+	edited := ToProto(m)
+	edited.Command = CommandEdited
+	s.Broadcast(edited)
+
+	return &pb.EditMessageResponse{Success: true}, nil
+}
+
+// DeleteMessage soft-deletes a message and tells the room to drop it.
+func (s *GrpcServer) DeleteMessage(ctx context.Context, req *pb.DeleteMessageRequest) (*pb.DeleteMessageResponse, error) {
+	caller, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.MessageId <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "message_id is required")
+	}
+
+	m, err := s.appServer.DB.DeleteMessage(ctx, req.MessageId, caller.ID, caller.Role == "admin")
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Error(codes.NotFound, "message not found")
+	}
+	if errors.Is(err, ErrNotAuthor) {
+		return nil, status.Error(codes.PermissionDenied, "only the author or an admin can delete a message")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to delete message")
+	}
+
+	if m.UserID != caller.ID {
+		s.appServer.Audit("message_delete", caller, "room_id", m.RoomID, "message_id", m.ID, "author_id", m.UserID)
+	}
+
+	s.Broadcast(&pb.ChatMessage{
+		Id:        m.ID,
+		RoomId:    m.RoomID,
+		UserId:    m.UserID,
+		Email:     m.Email,
+		Timestamp: time.Now().Unix(),
+		Command:   CommandDeleted,
+	})
+
+	return &pb.DeleteMessageResponse{Success: true}, nil
+}
+
+func (s *GrpcServer) MarkRead(ctx context.Context, req *pb.MarkReadRequest) (*pb.MarkReadResponse, error) {
+	caller, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.RoomId == "" {
+		return nil, status.Error(codes.InvalidArgument, "room_id is required")
+	}
+
+	marker, err := s.appServer.DB.MarkRead(ctx, caller.ID, req.RoomId, req.LastMessageId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to update read marker")
+	}
+
+	return &pb.MarkReadResponse{LastMessageId: marker}, nil
+}
+
+func (s *GrpcServer) UnreadCounts(ctx context.Context, req *pb.UnreadCountsRequest) (*pb.UnreadCountsResponse, error) {
+	caller, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rooms := req.RoomIds
+	if len(rooms) == 0 {
+		dbUser, err := s.appServer.DB.GetUser(ctx, caller.ID)
+		if err != nil {
+			return nil, status.Error(codes.NotFound, "user not found")
+		}
+		rooms = dbUser.Rooms
+	}
+
+	counts, err := s.appServer.DB.UnreadCounts(ctx, caller.ID, rooms)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to count unread messages")
+	}
+
+	return &pb.UnreadCountsResponse{Counts: counts}, nil
+}
+
+// SetRoomNotificationPref records how the caller wants to be notified about
+// a room, for all of their devices.
+func (s *GrpcServer) SetRoomNotificationPref(ctx context.Context, req *pb.SetRoomNotificationPrefRequest) (*pb.SetRoomNotificationPrefResponse, error) {
+	caller, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.RoomId == "" {
+		return nil, status.Error(codes.InvalidArgument, "room_id is required")
+	}
+	pref, ok := notificationPrefFromProto(req.Pref)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "unknown notification preference")
+	}
+
+	if err := s.appServer.DB.SetNotificationPref(ctx, caller.ID, req.RoomId, pref); err != nil {
+		return nil, status.Error(codes.Internal, "failed to save notification preference")
+	}
+
+	return &pb.SetRoomNotificationPrefResponse{Success: true}, nil
+}
+
+// BroadcastSystemMessage sends an operator notice to every room that has a
+// connected stream. Notices are not persisted.
+func (s *GrpcServer) BroadcastSystemMessage(ctx context.Context, req *pb.SystemMessageRequest) (*pb.SystemMessageResponse, error) {
+	caller, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if caller.Role != "admin" {
+		return nil, status.Error(codes.PermissionDenied, "only admins can send system messages")
+	}
+	text := strings.TrimSpace(req.Text)
+	if text == "" {
+		return nil, status.Error(codes.InvalidArgument, "text is required")
+	}
+
+	s.streamMu.RLock()
+	rooms := make([]string, 0, len(s.streams))
+	for roomID := range s.streams {
+		rooms = append(rooms, roomID)
+	}
+	s.streamMu.RUnlock()
+
+	// Fan out per room so a stalled stream in one room can't hold up the rest
+	now := time.Now()
+	for _, roomID := range rooms {
+		go s.Broadcast(&pb.ChatMessage{
+			RoomId:      roomID,
+			UserId:      SystemSender,
+			Email:       SystemSender,
+			Timestamp:   now.Unix(),
+			TimestampMs: now.UnixMilli(),
+			Type:        pb.ChatMessage_TEXT,
+			Command:     CommandSystem,
+			Payload:     &pb.ChatMessage_MessageContent{MessageContent: text},
+		})
+	}
+
+	s.appServer.Audit("system_message", caller, "rooms", len(rooms), "text", text)
+	return &pb.SystemMessageResponse{Rooms: int32(len(rooms))}, nil
+}
+
+// ServerStats reports uptime and activity counters to admins.
+func (s *GrpcServer) ServerStats(ctx context.Context, req *pb.ServerStatsRequest) (*pb.ServerStatsResponse, error) {
+	caller, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if caller.Role != "admin" {
+		return nil, status.Error(codes.PermissionDenied, "only admins can view server stats")
+	}
+
+	counts, err := s.appServer.DB.MessageCounts(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to count messages")
+	}
+
+	return &pb.ServerStatsResponse{
+		UptimeSeconds:     int64(time.Since(s.appServer.StartTime).Seconds()),
+		TotalLogins:       s.appServer.StatTotal(StatLogins),
+		ActiveStreams:     int32(len(s.openStreams())),
+		RoomMessageCounts: counts,
+		DroppedMessages:   s.appServer.DroppedMessages.Load(),
+		TotalMessages:     s.appServer.StatTotal(StatMessages),
+		TotalBroadcasts:   s.appServer.StatTotal(StatBroadcasts),
+		Series:            StatsToProto(s.appServer.StatSeries()),
+	}, nil
+}
+
+// ListUsers returns every account for admins.
+func (s *GrpcServer) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	caller, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if caller.Role != "admin" {
+		return nil, status.Error(codes.PermissionDenied, "only admins can list users")
+	}
+
+	users, err := s.appServer.DB.ListUsers(ctx)
+	if err != nil {
+		s.appServer.Logger.Printf("ListUsers failed: %v", err)
+		return nil, status.Error(codes.Internal, "failed to list users")
+	}
+
+	resp := &pb.ListUsersResponse{Users: make([]*pb.UserSummary, 0, len(users))}
+	for _, u := range users {
+		resp.Users = append(resp.Users, &pb.UserSummary{
+			Id:         u.ID,
+			Email:      u.Email,
+			Name:       u.Name,
+			Role:       u.Role,
+			Created:    u.Created.Unix(),
+			LastLogin:  unixOrZero(u.LastLogin),
+			LastActive: unixOrZero(u.LastActive),
+		})
+	}
+	return resp, nil
+}
+
+// RoomLeaderboard window and size bounds.
+const (
+	DefaultLeaderboardWindow = 7 * 24 * time.Hour
+	MaxLeaderboardWindow     = 90 * 24 * time.Hour
+	DefaultLeaderboardLimit  = 10
+	MaxLeaderboardLimit      = 50
+)
+
+// RoomLeaderboard ranks a room's top posters over a recent window for
+// anyone allowed to read the room.
+func (s *GrpcServer) RoomLeaderboard(ctx context.Context, req *pb.LeaderboardRequest) (*pb.LeaderboardResponse, error) {
+	if req.RoomId == "" {
+		return nil, status.Error(codes.InvalidArgument, "room_id is required")
+	}
+	if req.WindowSeconds < 0 {
+		return nil, status.Error(codes.InvalidArgument, "window_seconds must not be negative")
+	}
+	if err := s.checkRoomAccess(ctx, req.RoomId); err != nil {
+		return nil, err
+	}
+
+	window := time.Duration(req.WindowSeconds) * time.Second
+	if window == 0 {
+		window = DefaultLeaderboardWindow
+	}
+	if window > MaxLeaderboardWindow {
+		window = MaxLeaderboardWindow
+	}
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = DefaultLeaderboardLimit
+	}
+	if limit > MaxLeaderboardLimit {
+		limit = MaxLeaderboardLimit
+	}
+
+	board, err := s.appServer.DB.RoomLeaderboard(ctx, req.RoomId, window, limit)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to build leaderboard")
+	}
+
+	resp := &pb.LeaderboardResponse{RoomId: req.RoomId, WindowSeconds: int64(window / time.Second)}
+	for _, e := range board {
+		resp.Entries = append(resp.Entries, &pb.LeaderboardEntry{UserId: e.UserID, Email: e.Email, Posts: e.Posts})
+	}
+	return resp, nil
+}
+
+// ProfileCacheTTL is how long clients are told they may reuse a profile.
+const ProfileCacheTTL = 5 * time.Minute
+
+// GetProfile returns the public profile of any user to any signed-in
+// caller. Only fields a room member could already learn are included.
+func (s *GrpcServer) GetProfile(ctx context.Context, req *pb.ProfileRequest) (*pb.ProfileResponse, error) {
+	if _, err := GetUserFromContext(ctx); err != nil {
+		return nil, err
+	}
+	if req.UserId == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+
+	user, err := s.appServer.DB.GetUser(ctx, req.UserId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	return &pb.ProfileResponse{
+		UserId:       user.ID,
+		Name:         user.Name,
+		Email:        user.Email,
+		About:        user.About,
+		Created:      unixOrZero(user.Created),
+		Updated:      unixOrZero(user.Updated),
+		CacheSeconds: int64(ProfileCacheTTL / time.Second),
+	}, nil
+}
+
+// unixOrZero is t in Unix seconds, or 0 for the zero time ("never").
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// RoomPresence lists the users with an open stream in a room, derived from the
+// live stream registry rather than the database.
+func (s *GrpcServer) RoomPresence(ctx context.Context, req *pb.RoomRequest) (*pb.PresenceResponse, error) {
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "room name is required")
+	}
+	if err := s.checkRoomAccess(ctx, req.Name); err != nil {
+		return nil, err
+	}
+
+	s.streamMu.RLock()
+	byUser := make(map[string]*pb.PresentUser)
+	var users []*pb.PresentUser
+	for stream := range s.streams[req.Name] {
+		u, ok := byUser[stream.user.ID]
+		if !ok {
+			u = &pb.PresentUser{UserId: stream.user.ID, Email: stream.user.Email}
+			byUser[stream.user.ID] = u
+			users = append(users, u)
+		}
+		u.Connections++
+	}
+	s.streamMu.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool { return users[i].Email < users[j].Email })
+
+	return &pb.PresenceResponse{RoomId: req.Name, Users: users}, nil
+}
+
+func (s *GrpcServer) Stream(stream pb.ChatService_StreamServer) error {
+	// The user comes from the token verified by StreamAuthInterceptor; the
+	// UserId a client puts in its messages is never used for identity.
+	ctx := stream.Context()
+	user, err := GetUserFromContext(ctx)
+	if err != nil {
+		return status.Error(codes.Unauthenticated, "stream is not authenticated")
+	}
+
+	firstMsg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if err := s.checkMembership(ctx, user, firstMsg.RoomId); err != nil {
+		return err
+	}
+
+	// The handshake room is always subscribed. Multiplexing clients add and
+	// remove further rooms on the same stream with control commands.
+	cs := newClientStream(stream, user, s.OutboxSize)
+	cs.handshakeRoom = firstMsg.RoomId
+	s.subscribe(cs, firstMsg.RoomId)
+	defer s.unsubscribeAll(cs)
+	s.markActive(user)
+
+	connected := time.Now()
+	s.appServer.Events.Info("stream connected", "event", "stream_connect", "user_id", user.ID, "room_id", firstMsg.RoomId)
+	defer func() {
+		s.appServer.Events.Info("stream disconnected", "event", "stream_disconnect", "user_id", user.ID,
+			"room_id", firstMsg.RoomId, "duration_ms", time.Since(connected).Milliseconds())
+	}()
+
+	// Use GetMessageContent() accessor for the oneof field
+	if firstMsg.Command == "" && firstMsg.GetMessageContent() != "" && s.acceptMessage(cs, firstMsg) {
+		s.processMessage(cs, firstMsg)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			switch msg.Command {
+			case CommandSubscribe:
+				if err := s.checkMembership(ctx, user, msg.RoomId); err != nil {
+					s.appServer.Logger.Printf("Refused subscribe of %s to %s: %v", user.Email, msg.RoomId, err)
+					continue
+				}
+				s.subscribe(cs, msg.RoomId)
+			case CommandUnsubscribe:
+				s.unsubscribe(cs, msg.RoomId)
+			case CommandTyping:
+				s.relayTyping(cs, msg.RoomId)
+			default:
+				if s.acceptMessage(cs, msg) {
+					s.processMessage(cs, msg)
+				}
+			}
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	case <-cs.done:
+		return cs.closeErr
+	}
+}
+
+// checkMembership allows a stream into roomID only once the user has joined
+// it with JoinRoom (or OpenDirectMessage), is still allowed into a private
+// room, and isn't banned from it.
+func (s *GrpcServer) checkMembership(ctx context.Context, user User, roomID string) error {
+	if roomID == "" {
+		return status.Error(codes.InvalidArgument, "room is required")
+	}
+	dbUser, err := s.appServer.DB.GetUser(ctx, user.ID)
+	if err != nil {
+		return status.Error(codes.PermissionDenied, "user not found")
+	}
+	if !slices.Contains(dbUser.Rooms, roomID) {
+		return status.Error(codes.PermissionDenied, "not a member of this room")
+	}
+	room, err := s.appServer.DB.GetRoom(ctx, roomID)
+	if err != nil {
+		return status.Error(codes.NotFound, "room not found")
+	}
+	if !room.CanAccess(user.ID) {
+		return status.Error(codes.PermissionDenied, "not a member of this room")
+	}
+	banned, err := s.appServer.DB.IsBanned(ctx, roomID, user.ID)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to check room bans")
+	}
+	if banned {
+		return status.Error(codes.PermissionDenied, "banned from this room")
+	}
+	return nil
+}
+
+// markActive records stream activity in the user's last_active, writing
+// at most once per activeWriteInterval per user. The write happens off the
+// stream's receive loop.
+func (s *GrpcServer) markActive(user User) {
+	now := time.Now()
+	s.activeMu.Lock()
+	if now.Sub(s.activeWritten[user.ID]) < activeWriteInterval {
+		s.activeMu.Unlock()
+		return
+	}
+	s.activeWritten[user.ID] = now
+	s.activeMu.Unlock()
+
+	go func() {
+		if err := s.appServer.DB.SetLastActive(context.Background(), user.ID, now); err != nil {
+			s.appServer.Logger.Printf("Failed to record activity for %s: %v", user.Email, err)
+		}
+	}()
+}
+
+// DefaultMaxMessageBytes is the largest message content accepted when no
+// limit is configured.
+const DefaultMaxMessageBytes = 64 << 10
+
+// maxChunkBytes bounds a FILE_CHUNK's data: the clients' 1MB chunks plus
+// room for the encryption overhead.
+const maxChunkBytes = 1<<20 + 1024
+
+// acceptMessage checks a chat message from cs before it is broadcast or
+// stored. Rejected messages are dropped, logged and counted by reason; the
+// stream stays open.
+func (s *GrpcServer) acceptMessage(cs *clientStream, msg *pb.ChatMessage) bool {
+	if msg.Command != "" {
+		// Left to processMessage, which drops unknown commands
+		return true
+	}
+	// RoomId is never trusted to pick a room the stream hasn't joined. An
+	// empty one means the handshake room; anything else must be subscribed.
+	if msg.RoomId == "" {
+		msg.RoomId = cs.handshakeRoom
+	}
+	reason := ""
+	switch {
+	case !cs.inRoom(msg.RoomId):
+		reason = "wrong_room"
+	case msg.Type == pb.ChatMessage_FILE_CHUNK:
+		if len(msg.GetDataChunk()) > maxChunkBytes {
+			reason = "too_large"
+		}
+	case msg.Type == pb.ChatMessage_TEXT && msg.GetMessageContent() == "" && msg.Attachment == nil:
+		reason = "empty"
+	case len(msg.GetMessageContent()) > s.MaxMessageBytes || len(msg.ReplyTo) > s.MaxMessageBytes,
+		len(msg.IdempotencyKey) > maxIdempotencyKey:
+		reason = "too_large"
+	case msg.GetFileMeta() != nil && proto.Size(msg.GetFileMeta()) > s.MaxMessageBytes:
+		reason = "too_large"
+	case msg.Attachment != nil && !s.resolveAttachment(cs, msg):
+		reason = "bad_attachment"
+	}
+	if reason == "" {
+		return true
+	}
+	metricMessagesRejected.WithLabelValues(reason).Inc()
+	s.appServer.Events.Warn("message rejected", "event", "message_rejected", "reason", reason,
+		"user_id", cs.user.ID, "room_id", msg.RoomId, "handshake_room", cs.handshakeRoom, "bytes", proto.Size(msg))
+	s.ack(cs, msg.RoomId, msg.IdempotencyKey, pb.ChatMessage_REJECTED, 0)
+	return false
+}
+
+// processMessage broadcasts a chat message from cs and queues it for
+// storage. When the message has an idempotency key, cs is acked once it
+// is stored, or as soon as it is clear it won't be.
+func (s *GrpcServer) processMessage(cs *clientStream, msg *pb.ChatMessage) {
+	// Unknown commands are control traffic from a newer client; drop them
+	// rather than broadcasting or persisting them as chat.
+	if msg.Command != "" {
+		return
+	}
+	user := cs.user
+	roomID, key := msg.RoomId, msg.IdempotencyKey
+	// A client resending after a reconnect reuses the key; the first copy
+	// has already been broadcast and queued for storage.
+	if key != "" && !s.seen.first(user.ID, key, time.Now()) {
+		metricDuplicateMessages.Inc()
+		s.ack(cs, roomID, key, pb.ChatMessage_DUPLICATE, 0)
+		return
+	}
+
+	// The server is authoritative for who sent a message and when. Whatever
+	// identity or ID the client filled in is overwritten before anyone sees it.
+	msg.UserId = user.ID
+	msg.Email = user.Email
+	msg.Id = 0
+	s.markActive(user)
+	now := time.Now()
+	msg.Timestamp = now.Unix()
+	msg.TimestampMs = now.UnixMilli()
+	s.markMentions(msg)
+	metricMessagesProcessed.Inc()
+	s.appServer.IncrementStat(StatMessages)
+	s.appServer.CountPost(user.ID)
+
+	// Don't save binary chunks to the DB, or number them; the transfer's
+	// FILE_CONTROL messages carry its place in the room
+	if msg.Type == pb.ChatMessage_FILE_CHUNK {
+		s.Broadcast(msg)
+		s.ack(cs, roomID, key, pb.ChatMessage_BROADCAST_ONLY, 0)
+		return
+	}
+	s.broadcastInOrder(msg)
+
+	// Store through the same mapping history is read back with, so the
+	// content, iv, hot_sauce and time come back exactly as sent
+	internalMsg := FromProto(msg)
+	if msg.Type == pb.ChatMessage_FILE_CONTROL {
+		if meta := msg.GetFileMeta(); meta != nil {
+			internalMsg.Message = fmt.Sprintf("FILE:%s|HASH:%s|ACTION:%s", meta.FileName, meta.FileHash, meta.Action)
+		}
+	}
+
+	req := SaveRequest{RoomID: roomID, Message: internalMsg}
+	if key != "" {
+		req.Done = func(id int64, err error) {
+			if err != nil {
+				s.ack(cs, roomID, key, pb.ChatMessage_BROADCAST_ONLY, 0)
+				return
+			}
+			s.ack(cs, roomID, key, pb.ChatMessage_STORED, id)
+		}
+	}
+	if !s.appServer.Enqueue(req) {
+		s.ack(cs, roomID, key, pb.ChatMessage_BROADCAST_ONLY, 0)
+	}
+}
+
+// ack tells cs what became of its message with the given idempotency key.
+// Messages sent without a key are never acked.
+func (s *GrpcServer) ack(cs *clientStream, roomID, key string, result pb.ChatMessage_AckStatus, id int64) {
+	if key == "" {
+		return
+	}
+	s.deliver(cs, &pb.ChatMessage{
+		RoomId:         roomID,
+		Timestamp:      time.Now().Unix(),
+		Command:        CommandAck,
+		IdempotencyKey: key,
+		Ack:            result,
+		Id:             id,
+	})
+}
+
+func (s *GrpcServer) Broadcast(msg *pb.ChatMessage) {
+	s.streamMu.RLock()
+	roomStreams, exists := s.streams[msg.RoomId]
+	if !exists || len(roomStreams) == 0 {
+		s.streamMu.RUnlock()
+		return
+	}
+
+	activeStreams := make([]*clientStream, 0, len(roomStreams))
+	for stream := range roomStreams {
+		activeStreams = append(activeStreams, stream)
+	}
+	s.streamMu.RUnlock()
+
+	// Each stream has its own queue and writer, so a slow client only
+	// delays itself
+	for _, stream := range activeStreams {
+		s.deliver(stream, msg)
+	}
+	s.appServer.AddStat(StatBroadcasts, float64(len(activeStreams)))
+}
+
+// registerStream adds stream to roomID and reports whether it is the user's
+// first stream there. A user may be connected from several devices at once.
+// The stream's writer goroutine starts on its first registration and exits
+// when the stream is closed.
+func (s *GrpcServer) registerStream(roomID string, stream *clientStream) bool {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	if _, ok := s.streams[roomID]; !ok {
+		s.streams[roomID] = make(map[*clientStream]bool)
+	}
+	first := s.userStreams(roomID, stream.user.ID) == 0
+	s.streams[roomID][stream] = true
+	stream.writerOnce.Do(func() { go s.writeLoop(stream) })
+	return first
+}
+
+// deregisterStream removes stream from roomID and reports whether it was the
+// user's last stream there.
+func (s *GrpcServer) deregisterStream(roomID string, stream *clientStream) bool {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	if !s.streams[roomID][stream] {
+		return false
+	}
+	delete(s.streams[roomID], stream)
+	if len(s.streams[roomID]) == 0 {
+		delete(s.streams, roomID)
+	}
+	return s.userStreams(roomID, stream.user.ID) == 0
+}
+
+// closeRoomStreams removes roomID from every stream subscribed to it, ending
+// the streams that were only carrying that room.
+func (s *GrpcServer) closeRoomStreams(roomID string) {
+	s.streamMu.Lock()
+	roomStreams := s.streams[roomID]
+	delete(s.streams, roomID)
+	s.streamMu.Unlock()
+
+	for stream := range roomStreams {
+		if stream.dropRoom(roomID) == 0 {
+			stream.Close()
+		}
+	}
+}
+
+// CloseAllStreams ends every open Stream call with a clean EOF. It is used
+// during shutdown, before GracefulStop waits on the handlers; clients
+// reconnect once the server is back.
+func (s *GrpcServer) CloseAllStreams() int {
+	open := s.openStreams()
+	for stream := range open {
+		stream.Close()
+	}
+	return len(open)
+}
+
+// openStreams returns every registered stream once, however many rooms it
+// is subscribed to.
+func (s *GrpcServer) openStreams() map[*clientStream]bool {
+	s.streamMu.RLock()
+	defer s.streamMu.RUnlock()
+	open := make(map[*clientStream]bool)
+	for _, roomStreams := range s.streams {
+		for stream := range roomStreams {
+			open[stream] = true
+		}
 	}
+	return open
 }
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/rexlx/squall/proto"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestGrpc serves a GrpcServer over an in-memory listener with the auth
+// interceptors main installs, and returns it with a client connected to it.
+func newTestGrpc(t *testing.T, cfg Config) (*GrpcServer, pb.ChatServiceClient) {
+	t.Helper()
+	app := newTestServer(t, newTestDB(t), cfg)
+	impl := NewGrpcServer(app)
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(impl.AuthInterceptor),
+		grpc.ChainStreamInterceptor(impl.StreamAuthInterceptor),
+	)
+	pb.RegisterChatServiceServer(srv, impl)
+	go srv.Serve(lis)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		impl.CloseAllStreams()
+		srv.Stop()
+	})
+	return impl, pb.NewChatServiceClient(conn)
+}
+
+// signIn stores a user who has joined rooms, creating any room that doesn't
+// exist yet, and returns a context carrying an access token for them.
+func signIn(t *testing.T, s *GrpcServer, id string, rooms ...string) context.Context {
+	t.Helper()
+	ctx := context.Background()
+	app := s.appServer
+	user := User{ID: id, Email: id + "@example.com", Role: "user", Rooms: rooms}
+	if err := app.DB.StoreUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	for _, roomID := range rooms {
+		if _, err := app.DB.GetRoom(ctx, roomID); err == nil {
+			continue
+		}
+		if err := app.DB.StoreRoom(ctx, Room{ID: roomID, Name: roomID, MaxMessages: DefaultRoomMaxMessages}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, err := GenerateJWT(user.ID, user.Role, user.Email, app.JWTKeys, app.TokenIssuer, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
+
+// awaitAck reads stream until the ack for key arrives, skipping broadcasts.
+func awaitAck(t *testing.T, stream pb.ChatService_StreamClient, key string) *pb.ChatMessage {
+	t.Helper()
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("waiting for ack of %q: %v", key, err)
+		}
+		if msg.Command == CommandAck && msg.IdempotencyKey == key {
+			return msg
+		}
+	}
+}
+
+// textMessage is a keyed chat message for roomID.
+func textMessage(roomID, key, content string) *pb.ChatMessage {
+	return &pb.ChatMessage{
+		RoomId:         roomID,
+		Type:           pb.ChatMessage_TEXT,
+		IdempotencyKey: key,
+		Payload:        &pb.ChatMessage_MessageContent{MessageContent: content},
+	}
+}
+
+func TestStreamIgnoresForgedSender(t *testing.T) {
+	s, client := newTestGrpc(t, Config{})
+	ctx := signIn(t, s, "alice", "lobby")
+	signIn(t, s, "mallory", "lobby")
+
+	stream, err := client.Stream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := textMessage("lobby", "k1", "it was mallory")
+	msg.UserId = "mallory"
+	msg.Email = "mallory@example.com"
+	if err := stream.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	if ack := awaitAck(t, stream, "k1"); ack.Ack != pb.ChatMessage_STORED {
+		t.Fatalf("ack %v, want STORED", ack.Ack)
+	}
+
+	history, _, err := s.appServer.DB.GetHistory(context.Background(), "lobby", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Fatalf("%d messages stored, want 1", len(history))
+	}
+	if got := history[0]; got.UserID != "alice" || got.Email != "alice@example.com" {
+		t.Errorf("stored as %s <%s>, want alice <alice@example.com>", got.UserID, got.Email)
+	}
+}
+
+func TestStoredAckCarriesHistoryID(t *testing.T) {
+	s, client := newTestGrpc(t, Config{})
+	ctx := signIn(t, s, "alice", "lobby")
+
+	stream, err := client.Stream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]int64)
+	for _, key := range []string{"k1", "k2", "k3"} {
+		if err := stream.Send(textMessage("lobby", key, "content of "+key)); err != nil {
+			t.Fatal(err)
+		}
+		ack := awaitAck(t, stream, key)
+		if ack.Ack != pb.ChatMessage_STORED || ack.Id == 0 {
+			t.Fatalf("ack of %s: %v id %d, want STORED with an id", key, ack.Ack, ack.Id)
+		}
+		ids["content of "+key] = ack.Id
+	}
+
+	resp, err := client.GetHistory(ctx, &pb.HistoryRequest{RoomId: "lobby"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Messages) != len(ids) {
+		t.Fatalf("history has %d messages, want %d", len(resp.Messages), len(ids))
+	}
+	for _, m := range resp.Messages {
+		if want := ids[m.GetMessageContent()]; m.Id != want {
+			t.Errorf("%q has id %d in history, acked as %d", m.GetMessageContent(), m.Id, want)
+		}
+	}
+}
+
+// encryptedMessage is a keyed chat message as the clients send it when
+// encrypting: the content is ciphertext and Iv and HotSauce say how to read it.
+func encryptedMessage(roomID, key string) *pb.ChatMessage {
+	msg := textMessage(roomID, key, "3q2+7wq4VQ2kZ1mJ0vX5cHJpdmF0ZQ==")
+	msg.Iv = "bm9uY2Utb2YtMTI="
+	msg.HotSauce = "tegular-peripatopsidae"
+	return msg
+}
+
+func TestEncryptedMessageRoundTrip(t *testing.T) {
+	s, client := newTestGrpc(t, Config{})
+	ctx := signIn(t, s, "alice", "lobby")
+
+	stream, err := client.Stream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := encryptedMessage("lobby", "k1")
+	if err := stream.Send(sent); err != nil {
+		t.Fatal(err)
+	}
+	if ack := awaitAck(t, stream, "k1"); ack.Ack != pb.ChatMessage_STORED {
+		t.Fatalf("ack %v, want STORED", ack.Ack)
+	}
+
+	resp, err := client.GetHistory(ctx, &pb.HistoryRequest{RoomId: "lobby"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Messages) != 1 {
+		t.Fatalf("history has %d messages, want 1", len(resp.Messages))
+	}
+	got := resp.Messages[0]
+	if got.GetMessageContent() != sent.GetMessageContent() || got.Iv != sent.Iv || got.HotSauce != sent.HotSauce {
+		t.Errorf("history returned content %q iv %q hot_sauce %q, sent %q %q %q",
+			got.GetMessageContent(), got.Iv, got.HotSauce, sent.GetMessageContent(), sent.Iv, sent.HotSauce)
+	}
+}
+
+func TestJoinRoomHistoryKeepsEncryption(t *testing.T) {
+	s, client := newTestGrpc(t, Config{})
+	aliceCtx := signIn(t, s, "alice", "lobby")
+	bobCtx := signIn(t, s, "bob")
+
+	stream, err := client.Stream(aliceCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := encryptedMessage("lobby", "k1")
+	if err := stream.Send(sent); err != nil {
+		t.Fatal(err)
+	}
+	if ack := awaitAck(t, stream, "k1"); ack.Ack != pb.ChatMessage_STORED {
+		t.Fatalf("ack %v, want STORED", ack.Ack)
+	}
+
+	resp, err := client.JoinRoom(bobCtx, &pb.JoinRoomRequest{Email: "bob@example.com", RoomName: "lobby"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.History) != 1 {
+		t.Fatalf("join returned %d messages of history, want 1", len(resp.History))
+	}
+	if got := resp.History[0]; got.Iv != sent.Iv || got.HotSauce != sent.HotSauce {
+		t.Errorf("join history has iv %q hot_sauce %q, want %q %q", got.Iv, got.HotSauce, sent.Iv, sent.HotSauce)
+	}
+}
+
+func TestLoginUpgradesWeakHash(t *testing.T) {
+	s, client := newTestGrpc(t, Config{})
+	saved := PasswordCost
+	t.Cleanup(func() { PasswordCost = saved })
+
+	// Hashed at the old cost, then the configured cost is raised
+	PasswordCost = bcrypt.MinCost
+	user := User{ID: "alice", Email: "alice@example.com", Role: "user"}
+	if err := user.SetPassword("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.appServer.DB.StoreUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	PasswordCost = bcrypt.MinCost + 1
+
+	for range 2 {
+		if _, err := client.Login(context.Background(), &pb.LoginRequest{Email: user.Email, Password: "correct horse"}); err != nil {
+			t.Fatalf("Login: %v", err)
+		}
+		stored, err := s.appServer.DB.GetUser(context.Background(), user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cost, err := bcrypt.Cost([]byte(stored.Password)); err != nil || cost != PasswordCost {
+			t.Fatalf("stored hash cost %d (%v) after login, want %d", cost, err, PasswordCost)
+		}
+	}
+}
+
+func TestStreamRefusesUnjoinedRoom(t *testing.T) {
+	s, client := newTestGrpc(t, Config{})
+	signIn(t, s, "bob", "secret")
+	ctx := signIn(t, s, "alice", "lobby")
+
+	stream, err := client.Stream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(textMessage("secret", "k1", "let me in")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("stream into an unjoined room ended with %v, want PermissionDenied", err)
+	}
+
+	history, _, err := s.appServer.DB.GetHistory(context.Background(), "secret", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 0 {
+		t.Errorf("%d messages stored in the unjoined room", len(history))
+	}
+}
+
+func TestStreamRejectsOversizedAndMisroutedMessages(t *testing.T) {
+	s, client := newTestGrpc(t, Config{})
+	s.MaxMessageBytes = 32
+	ctx := signIn(t, s, "alice", "lobby")
+	signIn(t, s, "bob", "elsewhere")
+
+	stream, err := client.Stream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	huge := strings.Repeat("x", s.MaxMessageBytes+1)
+	bigReply := textMessage("lobby", "big-reply", "hi")
+	bigReply.ReplyTo = huge
+	for _, tc := range []struct {
+		msg  *pb.ChatMessage
+		want pb.ChatMessage_AckStatus
+	}{
+		{textMessage("lobby", "ok-1", "hello"), pb.ChatMessage_STORED},
+		{textMessage("lobby", "too-big", huge), pb.ChatMessage_REJECTED},
+		{bigReply, pb.ChatMessage_REJECTED},
+		{textMessage("elsewhere", "wrong-room", "hello"), pb.ChatMessage_REJECTED},
+		// The stream stays open after a rejection
+		{textMessage("lobby", "ok-2", strings.Repeat("x", s.MaxMessageBytes)), pb.ChatMessage_STORED},
+	} {
+		key := tc.msg.IdempotencyKey
+		if err := stream.Send(tc.msg); err != nil {
+			t.Fatal(err)
+		}
+		if ack := awaitAck(t, stream, key); ack.Ack != tc.want {
+			t.Errorf("%s acked %v, want %v", key, ack.Ack, tc.want)
+		}
+	}
+
+	for room, want := range map[string]int{"lobby": 2, "elsewhere": 0} {
+		history, _, err := s.appServer.DB.GetHistory(context.Background(), room, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != want {
+			t.Errorf("%d messages stored in %s, want %d", len(history), room, want)
+		}
+	}
+}
+
+func TestStreamRejectsMismatchedRoomID(t *testing.T) {
+	s, client := newTestGrpc(t, Config{})
+	aliceCtx := signIn(t, s, "alice", "lobby", "other")
+	bobCtx := signIn(t, s, "bob", "other")
+
+	bob, err := client.Stream(bobCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Send(textMessage("other", "bob-1", "hi")); err != nil {
+		t.Fatal(err)
+	}
+	awaitAck(t, bob, "bob-1")
+
+	// Alice is a member of other, but her stream only handshook lobby
+	alice, err := client.Stream(aliceCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Send(textMessage("lobby", "alice-1", "hi")); err != nil {
+		t.Fatal(err)
+	}
+	awaitAck(t, alice, "alice-1")
+	if err := alice.Send(textMessage("other", "alice-2", "sneaking in")); err != nil {
+		t.Fatal(err)
+	}
+	if ack := awaitAck(t, alice, "alice-2"); ack.Ack != pb.ChatMessage_REJECTED {
+		t.Errorf("mismatched room acked %v, want REJECTED", ack.Ack)
+	}
+	// An empty RoomId means the handshake room
+	if err := alice.Send(textMessage("", "alice-3", "still here")); err != nil {
+		t.Fatal(err)
+	}
+	if ack := awaitAck(t, alice, "alice-3"); ack.Ack != pb.ChatMessage_STORED || ack.RoomId != "lobby" {
+		t.Errorf("empty room acked %v in %q, want STORED in lobby", ack.Ack, ack.RoomId)
+	}
+
+	// Anything broadcast into other is queued for bob before his next ack
+	if err := bob.Send(textMessage("other", "bob-2", "anyone?")); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := bob.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Command == "" && msg.UserId == "alice" {
+			t.Fatalf("bob received %q from a stream not subscribed to other", msg.GetMessageContent())
+		}
+		if msg.Command == CommandAck && msg.IdempotencyKey == "bob-2" {
+			break
+		}
+	}
+}
+
+func TestDuplicateIdempotencyKey(t *testing.T) {
+	s, client := newTestGrpc(t, Config{})
+	ctx := signIn(t, s, "alice", "lobby")
+
+	stream, err := client.Stream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(textMessage("lobby", "k1", "hello")); err != nil {
+		t.Fatal(err)
+	}
+	if ack := awaitAck(t, stream, "k1"); ack.Ack != pb.ChatMessage_STORED {
+		t.Fatalf("first send acked %v, want STORED", ack.Ack)
+	}
+
+	// A resend after a reconnect arrives on a new stream with the same key
+	retry, err := client.Stream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := retry.Send(textMessage("lobby", "k1", "hello")); err != nil {
+		t.Fatal(err)
+	}
+	if ack := awaitAck(t, retry, "k1"); ack.Ack != pb.ChatMessage_DUPLICATE {
+		t.Errorf("resend acked %v, want DUPLICATE", ack.Ack)
+	}
+
+	history, _, err := s.appServer.DB.GetHistory(context.Background(), "lobby", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Errorf("%d copies stored, want 1", len(history))
+	}
+}
+
+func TestStreamSubscribeAndUnsubscribe(t *testing.T) {
+	s, client := newTestGrpc(t, Config{})
+	aliceCtx := signIn(t, s, "alice", "a", "b")
+	bobCtx := signIn(t, s, "bob", "a", "b", "secret")
+
+	// Control commands aren't acked. An empty keyed message is rejected and
+	// acked at once, so its ack says everything sent before it was handled,
+	// and that whatever was broadcast to the stream by then has been read.
+	n := 0
+	sync := func(stream pb.ChatService_StreamClient, room string) []string {
+		t.Helper()
+		n++
+		key := "sync-" + strconv.Itoa(n)
+		if err := stream.Send(textMessage(room, key, "")); err != nil {
+			t.Fatal(err)
+		}
+		var chat []string
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				t.Fatalf("waiting for ack of %q: %v", key, err)
+			}
+			if msg.Command == "" {
+				chat = append(chat, msg.RoomId+": "+msg.GetMessageContent())
+			}
+			if msg.Command == CommandAck && msg.IdempotencyKey == key {
+				return chat
+			}
+		}
+	}
+	send := func(stream pb.ChatService_StreamClient, msg *pb.ChatMessage) {
+		t.Helper()
+		if err := stream.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	open := func(ctx context.Context, rooms ...string) pb.ChatService_StreamClient {
+		t.Helper()
+		stream, err := client.Stream(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// An empty handshake joins the room without sending anything
+		send(stream, &pb.ChatMessage{RoomId: rooms[0]})
+		for _, room := range rooms[1:] {
+			send(stream, &pb.ChatMessage{RoomId: room, Command: CommandSubscribe})
+		}
+		sync(stream, rooms[0])
+		return stream
+	}
+	alice := open(aliceCtx, "a")
+	bob := open(bobCtx, "a", "b", "secret")
+
+	for _, step := range []struct {
+		name     string
+		command  string // Sent by alice before bob talks, if any
+		room     string
+		syncRoom string // A room alice is still subscribed to
+		want     []string
+	}{
+		{name: "handshake room", syncRoom: "a", want: []string{"a: in a"}},
+		{name: "subscribe b", command: CommandSubscribe, room: "b", syncRoom: "a", want: []string{"a: in a", "b: in b"}},
+		{name: "unsubscribe a", command: CommandUnsubscribe, room: "a", syncRoom: "b", want: []string{"b: in b"}},
+		{name: "subscribe to a room alice hasn't joined", command: CommandSubscribe, room: "secret", syncRoom: "b", want: []string{"b: in b"}},
+	} {
+		if step.command != "" {
+			send(alice, &pb.ChatMessage{RoomId: step.room, Command: step.command})
+		}
+		sync(alice, step.syncRoom)
+		for _, room := range []string{"a", "b", "secret"} {
+			send(bob, textMessage(room, "", "in "+room))
+		}
+		sync(bob, "a")
+		if got := sync(alice, step.syncRoom); !slices.Equal(got, step.want) {
+			t.Errorf("%s: alice got %q, want %q", step.name, got, step.want)
+		}
+	}
+}
+
+// Shutdown and a deleted room both end a stream with a clean EOF; what
+// tells the client apart is whether its reconnect is let back in.
+func TestClosedStreamsEndWithEOF(t *testing.T) {
+	s, client := newTestGrpc(t, Config{})
+	ctx := signIn(t, s, "alice", "lobby")
+
+	n := 0
+	connect := func() pb.ChatService_StreamClient {
+		t.Helper()
+		stream, err := client.Stream(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Send(&pb.ChatMessage{RoomId: "lobby"}); err != nil {
+			t.Fatal(err)
+		}
+		// Rejected empty messages are acked at once, so the ack says the
+		// handshake was accepted
+		n++
+		key := "sync-" + strconv.Itoa(n)
+		if err := stream.Send(textMessage("lobby", key, "")); err != nil {
+			t.Fatal(err)
+		}
+		awaitAck(t, stream, key)
+		return stream
+	}
+	drain := func(stream pb.ChatService_StreamClient) error {
+		for {
+			if _, err := stream.Recv(); err != nil {
+				return err
+			}
+		}
+	}
+
+	stream := connect()
+	if closed := s.CloseAllStreams(); closed != 1 {
+		t.Errorf("CloseAllStreams closed %d streams, want 1", closed)
+	}
+	if err := drain(stream); err != io.EOF {
+		t.Fatalf("stream closed for shutdown ended with %v, want EOF", err)
+	}
+
+	stream = connect()
+	if _, _, err := s.appServer.DB.DeleteRoom(context.Background(), "lobby"); err != nil {
+		t.Fatal(err)
+	}
+	s.forgetRoom("lobby")
+	if err := drain(stream); err != io.EOF {
+		t.Fatalf("stream of a deleted room ended with %v, want EOF", err)
+	}
+
+	stream, err := client.Stream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&pb.ChatMessage{RoomId: "lobby"}); err != nil {
+		t.Fatal(err)
+	}
+	switch err := drain(stream); status.Code(err) {
+	case codes.PermissionDenied, codes.NotFound:
+	default:
+		t.Fatalf("reconnect to a deleted room ended with %v, want it refused", err)
+	}
+}
@@ -1,37 +1,57 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/rexlx/squall/internal"
 	pb "github.com/rexlx/squall/proto"
 )
 
+// Text content is never re-encoded: message_content holds the client's
+// base64 string (ciphertext when hot_sauce names a key), msg_content stores
+// that same string, and ToProto hands it back with iv and hot_sauce as they
+// were sent.
+
+// ToProto maps a stored message to the wire format.
 func ToProto(m internal.Message) *pb.ChatMessage {
 	var ts int64
-	parsedTime, err := time.Parse(time.RFC3339, m.Time)
-	if err == nil {
+	if parsedTime, err := time.Parse(time.RFC3339, m.Time); err == nil {
 		ts = parsedTime.Unix()
+	} else if unix, err := strconv.ParseInt(m.Time, 10, 64); err == nil {
+		// Rows saved before processMessage used FromProto hold Unix seconds
+		ts = unix
 	} else {
 		ts = time.Now().Unix()
 	}
+	ms := m.TimeMs
+	if ms == 0 {
+		ms = ts * 1000
+	}
 
 	return &pb.ChatMessage{
-		RoomId:    m.RoomID,
-		UserId:    m.UserID,
-		Email:     m.Email,
-		Timestamp: ts,
-		ReplyTo:   m.ReplyTo,
-		Iv:        m.InitialVector,
-		HotSauce:  m.HotSauce,
-		Type:      pb.ChatMessage_TEXT,
+		Id:          m.ID,
+		RoomId:      m.RoomID,
+		UserId:      m.UserID,
+		Email:       m.Email,
+		Timestamp:   ts,
+		TimestampMs: ms,
+		ReplyTo:     m.ReplyTo,
+		Iv:          m.InitialVector,
+		HotSauce:    m.HotSauce,
+		Type:        pb.ChatMessage_TEXT,
+		Attachment:  decodeAttachment(m.Attachment),
+		Seq:         m.Seq,
 		Payload: &pb.ChatMessage_MessageContent{
 			MessageContent: m.Message,
 		},
 	}
 }
 
+// FromProto copies UserId and Email as given. Only use it on messages whose
+// identity fields the server has already set, as processMessage does.
 func FromProto(p *pb.ChatMessage) internal.Message {
 	t := time.Unix(p.Timestamp, 0).Format(time.RFC3339)
 
@@ -45,6 +65,7 @@ func FromProto(p *pb.ChatMessage) internal.Message {
 	}
 
 	return internal.Message{
+		ID:            p.Id,
 		RoomID:        p.RoomId,
 		UserID:        p.UserId,
 		Email:         p.Email,
@@ -53,5 +74,92 @@ func FromProto(p *pb.ChatMessage) internal.Message {
 		ReplyTo:       p.ReplyTo,
 		InitialVector: p.Iv,
 		HotSauce:      p.HotSauce,
+		Attachment:    encodeAttachment(p.Attachment),
+		Seq:           p.Seq,
+		TimeMs:        p.TimestampMs,
+	}
+}
+
+// NotificationPrefsToProto maps stored notification preferences to the wire
+// format, leaving out any it doesn't know.
+func NotificationPrefsToProto(prefs map[string]string) map[string]pb.NotificationPref {
+	out := make(map[string]pb.NotificationPref, len(prefs))
+	for room, pref := range prefs {
+		switch pref {
+		case NotifyMentions:
+			out[room] = pb.NotificationPref_NOTIFY_MENTIONS
+		case NotifyMuted:
+			out[room] = pb.NotificationPref_NOTIFY_MUTED
+		}
+	}
+	return out
+}
+
+// notificationPrefFromProto maps a wire preference to its stored value.
+func notificationPrefFromProto(p pb.NotificationPref) (string, bool) {
+	switch p {
+	case pb.NotificationPref_NOTIFY_ALL:
+		return NotifyAll, true
+	case pb.NotificationPref_NOTIFY_MENTIONS:
+		return NotifyMentions, true
+	case pb.NotificationPref_NOTIFY_MUTED:
+		return NotifyMuted, true
+	}
+	return "", false
+}
+
+// StatsToProto maps recorded counter samples to the wire format.
+func StatsToProto(stats internal.AppStats) map[string]*pb.StatSeries {
+	series := make(map[string]*pb.StatSeries, len(stats))
+	for name, samples := range stats {
+		out := &pb.StatSeries{Samples: make([]*pb.StatSample, len(samples))}
+		for i, st := range samples {
+			out.Samples[i] = &pb.StatSample{Time: st.Time.Unix(), Value: st.Value}
+		}
+		series[name] = out
+	}
+	return series
+}
+
+// AttachmentToProto maps a stored attachment to the wire format.
+func AttachmentToProto(a internal.Attachment) *pb.Attachment {
+	return &pb.Attachment{
+		Id:          a.ID,
+		RoomId:      a.RoomID,
+		FileName:    a.FileName,
+		ContentType: a.ContentType,
+		Size:        a.Size,
+		Sha256:      a.SHA256,
+		Iv:          a.IV,
+		HotSauce:    a.HotSauce,
+	}
+}
+
+// encodeAttachment is how an attachment is kept in internal.Message.
+func encodeAttachment(a *pb.Attachment) string {
+	if a == nil {
+		return ""
+	}
+	b, _ := json.Marshal(internal.Attachment{
+		ID:          a.Id,
+		RoomID:      a.RoomId,
+		FileName:    a.FileName,
+		ContentType: a.ContentType,
+		Size:        a.Size,
+		SHA256:      a.Sha256,
+		IV:          a.Iv,
+		HotSauce:    a.HotSauce,
+	})
+	return string(b)
+}
+
+func decodeAttachment(s string) *pb.Attachment {
+	if s == "" {
+		return nil
+	}
+	var a internal.Attachment
+	if err := json.Unmarshal([]byte(s), &a); err != nil {
+		return nil
 	}
+	return AttachmentToProto(a)
 }
@@ -1,5 +1,35 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
 
-func (s *Server) LoginHandler(w http.ResponseWriter, r *http.Request) {}
+// readyTimeout bounds the database ping behind /readyz.
+const readyTimeout = 2 * time.Second
+
+// HealthzHandler is the liveness probe: answering at all means the process
+// is up.
+func (s *Server) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// ReadyzHandler is the readiness probe. It answers 503 with the reason when
+// the database doesn't answer a ping or the save worker has stopped, since
+// either way messages would not be stored.
+func (s *Server) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	if err := s.DB.Ping(ctx); err != nil {
+		http.Error(w, "database unreachable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if !s.saveRunning.Load() {
+		http.Error(w, "save worker not running", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -10,6 +17,93 @@ import (
 // Define your own error for invalid tokens
 var ErrInvalidToken = errors.New("token is invalid")
 
+// JWTKeys holds the signing method and keys for access tokens. With HS256
+// both keys are the shared secret; with RS256 only the server holds SignKey
+// and anyone with VerifyKey can check tokens but not mint them.
+type JWTKeys struct {
+	Method    jwt.SigningMethod
+	SignKey   interface{}
+	VerifyKey interface{}
+}
+
+// ErrInsecureSecret is returned for an HS256 secret that is empty or one of
+// the well-known defaults, since anyone could forge tokens with it.
+var ErrInsecureSecret = errors.New("JWT secret is empty or a well-known default")
+
+// MinJWTSecretLength is the shortest HS256 secret, in bytes, that starts
+// without a warning.
+const MinJWTSecretLength = 32
+
+// insecureJWTSecrets are defaults that have shipped in this repo or are
+// common placeholders.
+var insecureJWTSecrets = map[string]bool{
+	"system-key": true,
+	"secret":     true,
+	"changeme":   true,
+	"change-me":  true,
+	"jwt-secret": true,
+}
+
+// CheckJWTSecret returns ErrInsecureSecret for a secret no server should sign
+// with.
+func CheckJWTSecret(secret string) error {
+	if secret == "" || insecureJWTSecrets[strings.ToLower(secret)] {
+		return ErrInsecureSecret
+	}
+	return nil
+}
+
+// RandomJWTSecret returns a new random HS256 secret. Tokens signed with it
+// stop validating once the process exits.
+func RandomJWTSecret() (string, error) {
+	b := make([]byte, MinJWTSecretLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// NewHMACKeys returns HS256 keys using a shared secret.
+func NewHMACKeys(secret string) *JWTKeys {
+	return &JWTKeys{Method: jwt.SigningMethodHS256, SignKey: []byte(secret), VerifyKey: []byte(secret)}
+}
+
+// check refuses HS256 keys made from an insecure secret, so a server that
+// skipped the startup check still can't sign or accept forgeable tokens.
+func (k *JWTKeys) check() error {
+	if k.Method != jwt.SigningMethodHS256 {
+		return nil
+	}
+	secret, _ := k.SignKey.([]byte)
+	return CheckJWTSecret(string(secret))
+}
+
+// LoadRSAKeys returns RS256 keys from PEM files. publicPath may be empty, in
+// which case the public key is taken from the private key.
+func LoadRSAKeys(privatePath, publicPath string) (*JWTKeys, error) {
+	privPEM, err := os.ReadFile(privatePath)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := jwt.ParseRSAPrivateKeyFromPEM(privPEM)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+
+	var pub *rsa.PublicKey = &priv.PublicKey
+	if publicPath != "" {
+		pubPEM, err := os.ReadFile(publicPath)
+		if err != nil {
+			return nil, err
+		}
+		if pub, err = jwt.ParseRSAPublicKeyFromPEM(pubPEM); err != nil {
+			return nil, fmt.Errorf("parse public key: %w", err)
+		}
+	}
+
+	return &JWTKeys{Method: jwt.SigningMethodRS256, SignKey: priv, VerifyKey: pub}, nil
+}
+
 type UserClaims struct {
 	UserID string `json:"user_id"`
 	Role   string `json:"role"`  // Add Role to claims
@@ -17,32 +111,66 @@ type UserClaims struct {
 	jwt.RegisteredClaims
 }
 
-// GenerateJWT creates a signed token for a specific user that expires in 24 hours
-func GenerateJWT(userID string, role string, email string, secretKey string) (string, error) {
+// Defaults for the Server's token settings. Access tokens are short-lived;
+// clients renew them with a refresh token, which lasts much longer and can be
+// revoked server-side.
+const (
+	DefaultAccessTokenTTL  = 15 * time.Minute
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+	DefaultTokenIssuer     = "squall-server"
+)
+
+// NewRefreshToken returns a random opaque refresh token and its hash. Only
+// the hash is stored, so a database leak does not leak usable tokens.
+func NewRefreshToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(b)
+	return token, HashRefreshToken(token), nil
+}
+
+// HashRefreshToken returns the form of a refresh token that is stored.
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateJWT creates a signed access token for a specific user that expires after ttl
+func GenerateJWT(userID string, role string, email string, keys *JWTKeys, issuer string, ttl time.Duration) (string, error) {
 	claims := UserClaims{
 		UserID: userID,
 		Role:   role,
 		Email:  email,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			Issuer:    "squall-server",
+			Issuer:    issuer,
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secretKey))
+	if err := keys.check(); err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(keys.Method, claims)
+	return token.SignedString(keys.SignKey)
 }
 
-// ValidateJWT parses and validates a token string
-func ValidateJWT(tokenString, secretKey string) (*UserClaims, error) {
+// ValidateJWT parses and validates a token string, which must have been
+// issued by issuer
+func ValidateJWT(tokenString string, keys *JWTKeys, issuer string) (*UserClaims, error) {
+	if err := keys.check(); err != nil {
+		return nil, err
+	}
 	token, err := jwt.ParseWithClaims(tokenString, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// Validate the signing method is what we expect (HMAC)
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		// Only the configured algorithm is accepted, so an RS256 server can't
+		// be handed an HS256 token signed with its public key
+		if token.Method.Alg() != keys.Method.Alg() {
 			return nil, jwt.ErrTokenSignatureInvalid
 		}
-		return []byte(secretKey), nil
-	})
+		return keys.VerifyKey, nil
+	}, jwt.WithIssuer(issuer), jwt.WithValidMethods([]string{keys.Method.Alg()}))
 
 	if err != nil {
 		return nil, err
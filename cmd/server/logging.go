@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// Log formats selectable with -log-format.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// newLoggers returns the free-form Logger and the structured event logger,
+// both writing to w. In text mode the Logger keeps its classic
+// "SERVER: ..." lines and events are key=value pairs. In JSON mode both go
+// through one JSON handler, so free-form lines become {"msg": ...} records
+// next to the events and the whole stream can be shipped as JSON.
+func newLoggers(format string, w io.Writer) (*log.Logger, *slog.Logger, error) {
+	switch format {
+	case LogFormatText:
+		return log.New(w, "SERVER: ", log.LstdFlags|log.Lshortfile), slog.New(slog.NewTextHandler(w, nil)), nil
+	case LogFormatJSON:
+		h := slog.NewJSONHandler(w, &slog.HandlerOptions{AddSource: true})
+		return slog.NewLogLogger(h, slog.LevelInfo), slog.New(h), nil
+	default:
+		return nil, nil, fmt.Errorf("unknown log format %q (want %s or %s)", format, LogFormatText, LogFormatJSON)
+	}
+}
+
+// Audit records an admin or moderator action as an "AUDIT" event, with the
+// acting user and any extra key/value attributes.
+func (s *Server) Audit(event string, actor User, attrs ...any) {
+	s.Events.Info("AUDIT", append([]any{"event", event, "actor_id", actor.ID, "actor", actor.Email}, attrs...)...)
+}
+
+// rotatingFile is an append-only log file that, when maxBytes is set, is
+// rotated before a write would take it past maxBytes: path becomes path.1,
+// path.1 becomes path.2 and so on, keeping at most backups old files.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	backups  int
+	file     *os.File
+	size     int64
+}
+
+// openRotatingFile opens (or creates) path for appending. maxBytes <= 0
+// disables rotation.
+func openRotatingFile(path string, maxBytes int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxBytes: maxBytes, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxBytes > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups up by one, dropping the oldest, and reopens an
+// empty file at path. With no backups the current file is just truncated.
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	if r.backups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.backups))
+		for i := r.backups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// logOutput combines the -log file and stdout into the writer the loggers
+// use. Writes are unbuffered, so the returned close func only releases the
+// file.
+func logOutput(path string, maxMB int, backups int, toStdout bool) (io.Writer, func() error, error) {
+	if path == "" {
+		if !toStdout {
+			return nil, nil, fmt.Errorf("no log output: set -log or -log-stdout")
+		}
+		return os.Stdout, func() error { return nil }, nil
+	}
+	f, err := openRotatingFile(path, int64(maxMB)<<20, backups)
+	if err != nil {
+		return nil, nil, err
+	}
+	if toStdout {
+		return io.MultiWriter(os.Stdout, f), f.Close, nil
+	}
+	return f, f.Close, nil
+}
@@ -2,15 +2,21 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/rexlx/squall/proto"
@@ -21,71 +27,137 @@ import (
 // --- MAIN SERVER LOGIC ---
 
 func main() {
-	// 1. Parse Flags
-	firstUse := flag.Bool("firstuse", false, "Initialize the server by creating the first admin user")
-	// Note: We removed the prune-freq flag for this production-ready file,
-	// but you can add it back if you kept the worker logic from the benchmark discussion.
-	flag.Parse()
+	// 1. Load Configuration (flags and environment)
+	// The flag set has already printed the problem or the usage
+	cfg, err := LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		os.Exit(2)
+	}
 
 	// 2. Setup Logging
-	// For containerized/public deploys, logging to Stdout is preferred over a file
-	logger := log.New(os.Stdout, "SERVER: ", log.LstdFlags|log.Lshortfile)
+	// For containerized/public deploys, logging to Stdout is preferred over a file.
+	// This runs before -firstuse so setup is logged the same way.
+	logWriter, closeLog, err := logOutput(cfg.LogPath, cfg.LogMaxSizeMB, cfg.LogBackups, cfg.LogToStdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeLog()
+	logger, events, err := newLoggers(cfg.LogFormat, logWriter)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// 3. Load Secrets from Environment (Security Fix)
-	dsn := os.Getenv("DB_DSN")
-	if dsn == "" {
-		// Fallback for local dev convenience, but warn heavily
-		logger.Println("WARNING: DB_DSN not set, using default insecure local DSN")
-		dsn = "user=rxlx password=thereISnosp0)n host=localhost dbname=chaps sslmode=disable"
+	// 3. Check Settings and Load Secrets
+	if err := cfg.Validate(); err != nil {
+		logger.Fatal(err)
+	}
+	if cfg.DevDSN {
+		logger.Println("WARNING: SQUALL_DEV=true and no DSN set, using the default INSECURE local DSN")
 	}
+	PasswordCost = cfg.BcryptCost
 
-	jwtKey := os.Getenv("JWT_SECRET")
-	if jwtKey == "" {
-		logger.Fatal("CRITICAL: JWT_SECRET environment variable must be set.")
+	switch {
+	case cfg.JWTAlg != "HS256":
+	case cfg.JWTRandomSecret:
+		if cfg.JWTSecret, err = RandomJWTSecret(); err != nil {
+			logger.Fatal("Failed to generate JWT secret:", err)
+		}
+		logger.Println("WARNING: signing tokens with a random secret; every token is invalidated on restart")
+	case len(cfg.JWTSecret) < MinJWTSecretLength:
+		logger.Printf("WARNING: JWT_SECRET is shorter than %d bytes; use a longer random secret", MinJWTSecretLength)
+	}
+
+	var jwtKeys *JWTKeys
+	if cfg.JWTAlg == "RS256" {
+		jwtKeys, err = LoadRSAKeys(cfg.JWTPrivateKeyFile, cfg.JWTPublicKeyFile)
+		if err != nil {
+			logger.Fatal("Failed to load JWT RSA keys:", err)
+		}
 	}
 	WhitelistMu.Lock()
 	Whitelist["test@example.com"] = true
 	WhitelistMu.Unlock()
 
 	// 4. Connect to Database
-	db, err := NewPostgresDB(dsn)
+	var db Database
+	switch cfg.DBBackend {
+	case "postgres":
+		var pg *PostgresDB
+		if pg, err = NewPostgresDB(cfg.DSN, cfg.Pool); err == nil {
+			pg.QueryTimeout = cfg.DBTimeout
+			pg.MaintenanceTimeout = cfg.DBMaintenanceTimeout
+			db = pg
+		}
+	case "sqlite":
+		var lite *SQLiteDB
+		if lite, err = NewSQLiteDB(cfg.SQLitePath); err == nil {
+			lite.QueryTimeout = cfg.DBTimeout
+			lite.MaintenanceTimeout = cfg.DBMaintenanceTimeout
+			db = lite
+		}
+	}
 	if err != nil {
 		logger.Fatal("Failed to connect to database:", err)
 	}
-	if err = db.CreateTables(); err != nil {
+	if err = db.CreateTables(context.Background()); err != nil {
 		logger.Fatal("Failed to create tables:", err)
 	}
-	logger.Println("Database connected.")
+	logger.Printf("Database connected (%s).", cfg.DBBackend)
 
 	// 5. Handle First Use
-	if *firstUse {
-		createFirstUser(db)
+	if cfg.FirstUse {
+		createFirstUser(db, cfg.PasswordPolicy, events)
+		closeLog()
 		os.Exit(0)
 	}
 
 	// 6. Initialize Application Logic
-	appServer := NewServer("0.0.0.0:8080", jwtKey, logger, db)
-	// Start the SaveWorker (assuming you kept the simplified worker from previous discussions)
-	go appServer.StartSaveWorker()
-	go appServer.StartPruneWorker(1*time.Hour, 1000)
-	go appServer.StartRoomReaper(6*time.Hour, 49*time.Hour)
+	// NewServer also starts the batching SaveWorker
+	appServer := NewServer(cfg, logger, db)
+	appServer.Events = events
+	if jwtKeys != nil {
+		appServer.JWTKeys = jwtKeys
+	}
+	// Cancelled at shutdown to stop maintenance queries mid-run
+	workers, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	go appServer.StartPruneWorker(workers, cfg.PruneInterval, cfg.PruneKeep, cfg.PruneMaxAge)
+	go appServer.StartPostCounter(workers, DefaultPostFlushInterval)
 	grpcImpl := NewGrpcServer(appServer)
+	grpcImpl.OutboxSize = cfg.OutboxSize
+	grpcImpl.OverflowPolicy = cfg.SlowClient
+	grpcImpl.MaxMessageBytes = cfg.MaxMessageBytes
+	if cfg.AttachmentsDir != "" {
+		store, err := NewDirStore(cfg.AttachmentsDir)
+		if err != nil {
+			logger.Fatal("Failed to open attachments directory:", err)
+		}
+		grpcImpl.Attachments = store
+		grpcImpl.MaxAttachmentBytes = cfg.MaxAttachmentBytes
+		grpcImpl.AttachmentTypes = ParseAttachmentTypes(cfg.AttachmentTypes)
+		go grpcImpl.StartAttachmentReaper(workers, 6*time.Hour, 24*time.Hour)
+	}
+	go grpcImpl.StartRoomReaper(workers, 6*time.Hour, 49*time.Hour)
+	go grpcImpl.StartHeartbeat(cfg.Heartbeat)
 
 	// 7. Initialize Rate Limiter
-	// Allow 5 requests per second, with a burst of 10
-	limiter := NewRateLimiter(5, 10)
+	// Defaults allow 5 requests per second per IP, with a burst of 10
+	limiter := NewRateLimiter(cfg.RateRPS, cfg.RateBurst)
 
 	// 8. Configure gRPC Options (TLS vs No-TLS)
 	var opts []grpc.ServerOption
 
-	if os.Getenv("DISABLE_TLS") == "true" {
+	if !cfg.TLS {
 		logger.Println("Running in NO-TLS mode (SSL Termination expected upstream)")
 		// No credentials added, server runs in h2c/plaintext mode
 	} else {
 		logger.Println("Running in TLS mode")
 		// Load certs for standard HTTPS (No mTLS)
 		// Ensure these files exist in your container/server
-		tlsConfig, err := loadServerTLSConfig("data/server-cert.pem", "data/server-key.pem")
+		tlsConfig, err := loadServerTLSConfig(cfg.TLSCertFile, cfg.TLSKeyFile)
 		if err != nil {
 			logger.Fatal("Failed to load TLS keys:", err)
 		}
@@ -93,41 +165,122 @@ func main() {
 		opts = append(opts, grpc.Creds(creds))
 	}
 
-	// 9. Chain Interceptors (Rate Limit -> Auth)
+	// 9. Chain Interceptors (IP Rate Limit -> Auth -> User Rate Limit)
+	// The IP limit runs first so floods are turned away before any token
+	// parsing or DB work. Login is exempt from auth but not from the IP limit,
+	// so a client over its limit gets ResourceExhausted and can retry shortly.
+	unary := []grpc.UnaryServerInterceptor{
+		limiter.UnaryInterceptor, // 1. Check Rate Limit
+		grpcImpl.AuthInterceptor, // 2. Check Auth Token
+	}
+	stream := []grpc.StreamServerInterceptor{
+		limiter.StreamInterceptor,      // 1. Check Rate Limit
+		grpcImpl.StreamAuthInterceptor, // 2. Check Auth Token
+	}
+	// The gateways authenticate on their own, so they get userLimiter too
+	var userLimiter *RateLimiter
+	if cfg.UserRateRPS > 0 {
+		// 3. Per-user limit, keyed on the identity the auth step verified
+		userLimiter = NewUserRateLimiter(cfg.UserRateRPS, cfg.UserRateBurst)
+		unary = append(unary, userLimiter.UnaryInterceptor)
+		stream = append(stream, userLimiter.StreamInterceptor)
+	}
 	opts = append(opts,
-		grpc.ChainUnaryInterceptor(
-			limiter.UnaryInterceptor, // 1. Check Rate Limit
-			grpcImpl.AuthInterceptor, // 2. Check Auth Token
-		),
-		grpc.ChainStreamInterceptor(
-			limiter.StreamInterceptor,      // 1. Check Rate Limit
-			grpcImpl.StreamAuthInterceptor, // 2. Check Auth Token
-		),
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
 	)
 
 	// 10. Setup Listener
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-	lis, err := net.Listen("tcp", ":"+port)
+	lis, err := net.Listen("tcp", appServer.Address)
 	if err != nil {
 		logger.Fatal("Failed to listen:", err)
 	}
-	logger.Printf("Server listening on port %s", port)
+	logger.Printf("Server listening on %s", lis.Addr())
 
 	// 11. Start Server
 	grpcServer := grpc.NewServer(opts...)
 	proto.RegisterChatServiceServer(grpcServer, grpcImpl)
 
+	// Metrics and health probes are served over plain HTTP on their own port
+	// so scrapers and orchestrators don't need gRPC or client certificates.
+	var metricsServer *http.Server
+	if cfg.MetricsAddr != "" {
+		grpcImpl.RegisterMetrics(appServer.Gateway)
+		metricsServer = &http.Server{Addr: cfg.MetricsAddr, Handler: appServer.Gateway}
+		go func() {
+			logger.Printf("Metrics and health probes listening on %s", cfg.MetricsAddr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Printf("Metrics server failed: %v", err)
+			}
+		}()
+	}
+
+	// Browsers can't speak gRPC; they get the chat stream as a WebSocket,
+	// and optionally a JSON API, on a listener of their own with the same
+	// certificate as gRPC.
+	var gatewayServer *http.Server
+	if cfg.GatewayAddr != "" {
+		grpcImpl.RegisterWebSocket(appServer.WebGateway, limiter, userLimiter)
+		if cfg.GatewayREST {
+			grpcImpl.RegisterREST(appServer.WebGateway, limiter, userLimiter)
+		}
+		var handler http.Handler = appServer.WebGateway
+		if cfg.CORSOrigins != "" {
+			handler = NewCORS(cfg.CORSOrigins, cfg.CORSMethods, cfg.CORSHeaders, cfg.CORSCredentials).Handler(handler)
+		}
+		gatewayServer = &http.Server{Addr: cfg.GatewayAddr, Handler: handler}
+		go func() {
+			logger.Printf("Browser gateway listening on %s", cfg.GatewayAddr)
+			var err error
+			if cfg.TLS {
+				err = gatewayServer.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+			} else {
+				err = gatewayServer.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				logger.Printf("Browser gateway failed: %v", err)
+			}
+		}()
+	}
+
+	// 12. Graceful Shutdown
+	// On SIGINT/SIGTERM: end open streams, let in-flight RPCs finish, then
+	// flush whatever is still waiting in the message queue.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		sig := <-stop
+		logger.Printf("Received %s, shutting down", sig)
+		if gatewayServer != nil {
+			// Stop new sockets first; open ones are streams and close below
+			gatewayServer.Shutdown(context.Background())
+		}
+		closed := grpcImpl.CloseAllStreams()
+		logger.Printf("Closed %d open streams", closed)
+		grpcServer.GracefulStop()
+		if metricsServer != nil {
+			metricsServer.Close()
+		}
+		stopWorkers()
+		flushed := appServer.StopSaveWorker()
+		logger.Printf("Flushed %d queued messages", flushed)
+		if err := appServer.FlushPostCounts(context.Background()); err != nil {
+			logger.Printf("Failed to record post counts: %v", err)
+		}
+		close(done)
+	}()
+
 	if err := grpcServer.Serve(lis); err != nil {
 		logger.Fatal("Failed to serve gRPC:", err)
 	}
+	<-done
+	logger.Println("Shutdown complete.")
 }
 
 // --- HELPER FUNCTIONS ---
 
-func createFirstUser(db Database) {
+func createFirstUser(db Database, policy PasswordPolicy, events *slog.Logger) {
 	reader := bufio.NewReader(os.Stdin)
 	fmt.Println("--- FIRST USE SETUP (Creating ADMIN User) ---")
 
@@ -147,6 +300,10 @@ func createFirstUser(db Database) {
 		fmt.Println("Error: Email and Password are required.")
 		os.Exit(1)
 	}
+	if err := policy.Validate(password); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
 
 	randBytes := make([]byte, 16)
 	rand.Read(randBytes)
@@ -166,15 +323,39 @@ func createFirstUser(db Database) {
 		os.Exit(1)
 	}
 
-	if err := db.StoreUser(newUser); err != nil {
+	if err := db.StoreUser(context.Background(), newUser); err != nil {
 		fmt.Printf("Error storing user: %v\n", err)
 		os.Exit(1)
 	}
 
+	events.Info("AUDIT", "event", "user_create", "actor", "firstuse", "user_id", id, "email", email, "role", "admin")
 	fmt.Println("Successfully created ADMIN user:", email)
 	fmt.Println("Setup complete. Restart server without -firstuse flag.")
 }
 
+// envString returns the environment variable key, or def when it is unset.
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envDuration parses the environment variable key as a duration, falling
+// back to def when it is unset or malformed.
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("WARNING: ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return d
+}
+
 // loadServerTLSConfig loads keys for standard HTTPS (Server-Side TLS only)
 func loadServerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
 	serverCert, err := tls.LoadX509KeyPair(certFile, keyFile)
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	pb "github.com/rexlx/squall/proto"
+)
+
+// maxMentions bounds how many @tokens of one message are looked up.
+const maxMentions = 20
+
+// parseMentions returns the distinct @tokens in text, lowercased and
+// without the @. A token starts a word and runs over letters, digits and
+// ".-_+@", so both @alice and @alice@example.com are found; a trailing
+// ".", "-" or "@" is dropped.
+func parseMentions(text string) []string {
+	var tokens []string
+	for i := 0; i < len(text) && len(tokens) < maxMentions; i++ {
+		if text[i] != '@' {
+			continue
+		}
+		if i > 0 {
+			if r, _ := utf8.DecodeLastRuneInString(text[:i]); unicode.IsLetter(r) || unicode.IsDigit(r) {
+				continue
+			}
+		}
+		end := i + 1
+		for end < len(text) {
+			r, size := utf8.DecodeRuneInString(text[end:])
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(".-_+@", r) {
+				break
+			}
+			end += size
+		}
+		token := strings.ToLower(strings.TrimRight(text[i+1:end], ".-@"))
+		if token != "" && !slices.Contains(tokens, token) {
+			tokens = append(tokens, token)
+		}
+		i = end - 1
+	}
+	return tokens
+}
+
+// mentionedUsers returns the IDs of the users streaming roomID whose email
+// or name is one of tokens. Only users connected to the room can be
+// notified, so nobody else is looked up; names are read from the DB only
+// when some token isn't an email.
+func (s *GrpcServer) mentionedUsers(roomID string, tokens []string) []string {
+	if len(tokens) == 0 {
+		return nil
+	}
+	s.streamMu.RLock()
+	users := make(map[string]User)
+	for cs := range s.streams[roomID] {
+		users[cs.user.ID] = cs.user
+	}
+	s.streamMu.RUnlock()
+
+	var ids, rest []string
+	for id, u := range users {
+		if slices.Contains(tokens, strings.ToLower(u.Email)) {
+			ids = append(ids, id)
+		} else {
+			rest = append(rest, id)
+		}
+	}
+	if len(ids) == len(tokens) {
+		return ids
+	}
+	for _, id := range rest {
+		u, err := s.appServer.DB.GetUser(context.Background(), id)
+		if err == nil && u.Name != "" && slices.Contains(tokens, strings.ToLower(u.Name)) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// markMentions sets msg.Mentions for a plaintext chat message. Encrypted
+// content is opaque to the server, so those messages are never marked;
+// clients have to find their own mentions after decrypting.
+func (s *GrpcServer) markMentions(msg *pb.ChatMessage) {
+	msg.Mentions = nil
+	if msg.Type != pb.ChatMessage_TEXT || msg.HotSauce != "" {
+		return
+	}
+	msg.Mentions = s.mentionedUsers(msg.RoomId, parseMentions(msg.GetMessageContent()))
+}
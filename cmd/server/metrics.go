@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus counters. They live on a private registry so /metrics only
+// reports squall's own series plus the standard Go and process collectors.
+var (
+	metricMessagesProcessed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "squall_messages_processed_total",
+		Help: "Chat messages accepted from streams.",
+	})
+	metricBroadcastsSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "squall_broadcasts_sent_total",
+		Help: "Messages delivered to individual streams.",
+	})
+	metricQueueDrops = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "squall_queue_drops_total",
+		Help: "Messages not persisted because the DB queue was full.",
+	})
+	metricSaveRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "squall_save_retries_total",
+		Help: "DB writes retried by the save worker after a transient error.",
+	})
+	metricDeadLetters = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "squall_dead_letters_total",
+		Help: "Messages the save worker gave up on and dead-lettered.",
+	})
+	metricStreamOverflows = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "squall_stream_overflows_total",
+		Help: "Messages that found a stream's outbound queue full.",
+	})
+	metricMessagesRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "squall_messages_rejected_total",
+		Help: "Chat messages dropped by validation, by reason (too_large, empty or wrong_room).",
+	}, []string{"reason"})
+	metricDuplicateMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "squall_duplicate_messages_total",
+		Help: "Resent chat messages dropped because their idempotency key was already seen.",
+	})
+	metricLogins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "squall_logins_total",
+		Help: "Login attempts by result (success or failure).",
+	}, []string{"result"})
+)
+
+// RegisterMetrics mounts the Prometheus handler at /metrics on mux.
+func (s *GrpcServer) RegisterMetrics(mux *http.ServeMux) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		metricMessagesProcessed,
+		metricBroadcastsSent,
+		metricQueueDrops,
+		metricSaveRetries,
+		metricDeadLetters,
+		metricStreamOverflows,
+		metricMessagesRejected,
+		metricDuplicateMessages,
+		metricLogins,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "squall_active_streams",
+			Help: "Currently connected chat streams.",
+		}, func() float64 {
+			return float64(len(s.openStreams()))
+		}),
+	)
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+}
@@ -19,8 +19,10 @@ const userContextKey contextKey = "user"
 // cmd/server/middleware.go
 
 func (s *GrpcServer) AuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	// 1. Skip Auth for Login
-	if info.FullMethod == "/chat.ChatService/Login" {
+	// 1. Skip Auth for Login and for the refresh token endpoints, which are
+	// used precisely when the access token has expired
+	switch info.FullMethod {
+	case "/chat.ChatService/Login", "/chat.ChatService/RefreshToken", "/chat.ChatService/Logout":
 		return handler(ctx, req)
 	}
 
@@ -48,7 +50,7 @@ func (s *GrpcServer) AuthInterceptor(ctx context.Context, req interface{}, info
 	}
 
 	// 5. Validate Token
-	claims, err := ValidateJWT(token, s.appServer.Key)
+	claims, err := ValidateJWT(token, s.appServer.JWTKeys, s.appServer.TokenIssuer)
 	if err != nil {
 		return nil, status.Error(codes.Unauthenticated, "access token is invalid: "+err.Error())
 	}
@@ -93,7 +95,7 @@ func (s *GrpcServer) StreamAuthInterceptor(srv interface{}, ss grpc.ServerStream
 	token := strings.TrimPrefix(values[0], "Bearer ")
 
 	// 2. Validate Token
-	claims, err := ValidateJWT(token, s.appServer.Key)
+	claims, err := ValidateJWT(token, s.appServer.JWTKeys, s.appServer.TokenIssuer)
 	if err != nil {
 		return status.Error(codes.Unauthenticated, "access token is invalid")
 	}
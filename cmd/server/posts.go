@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultPostFlushInterval is how often per-user post counts are written.
+const DefaultPostFlushInterval = time.Minute
+
+// CountPost records that userID sent a chat message. It only bumps an
+// in-memory counter; FlushPostCounts writes the totals to the users' stats.
+func (s *Server) CountPost(userID string) {
+	s.postMu.Lock()
+	s.postCounts[userID]++
+	s.postMu.Unlock()
+}
+
+// FlushPostCounts adds the posts counted since the last flush to each
+// user's StatPosts counter, one DB transaction for all of them. Counts that
+// fail to write are put back for the next flush.
+func (s *Server) FlushPostCounts(ctx context.Context) error {
+	s.postMu.Lock()
+	counts := s.postCounts
+	s.postCounts = make(map[string]int64)
+	s.postMu.Unlock()
+	if len(counts) == 0 {
+		return nil
+	}
+
+	err := s.DB.AddUserPosts(ctx, counts, time.Now())
+	if err != nil {
+		s.postMu.Lock()
+		for userID, n := range counts {
+			s.postCounts[userID] += n
+		}
+		s.postMu.Unlock()
+	}
+	return err
+}
+
+// StartPostCounter flushes post counts every interval until ctx is
+// cancelled. main flushes once more after the last stream has closed.
+func (s *Server) StartPostCounter(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultPostFlushInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.FlushPostCounts(ctx); err != nil {
+				s.Logger.Printf("Failed to record post counts: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
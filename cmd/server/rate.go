@@ -13,18 +13,26 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// Visitors idle for longer than visitorTTL are evicted every cleanupInterval.
+const (
+	visitorTTL      = 10 * time.Minute
+	cleanupInterval = 1 * time.Minute
+)
+
 // visitor wraps the rate limiter with a timestamp for TTL pruning
 type visitor struct {
 	limiter  *rate.Limiter
 	lastSeen time.Time
 }
 
-// RateLimiter manages rate limits per IP address with automated cleanup
+// RateLimiter manages rate limits per IP address (or per authenticated user)
+// with automated cleanup
 type RateLimiter struct {
 	mu       sync.Mutex
 	visitors map[string]*visitor
 	r        rate.Limit // Request limit (requests/sec)
 	b        int        // Burst limit
+	byUser   bool       // Key on the JWT user ID, falling back to IP
 }
 
 // NewRateLimiter initializes the limiter and starts the background cleanup goroutine
@@ -41,6 +49,15 @@ func NewRateLimiter(rps int, burst int) *RateLimiter {
 	return rl
 }
 
+// NewUserRateLimiter returns a limiter keyed on the authenticated user ID.
+// Its interceptors must be chained after the auth interceptors so the user
+// is in the context; unauthenticated calls such as Login fall back to IP.
+func NewUserRateLimiter(rps int, burst int) *RateLimiter {
+	rl := NewRateLimiter(rps, burst)
+	rl.byUser = true
+	return rl
+}
+
 // getLimiter returns (or creates) the limiter for a specific IP and updates its TTL
 func (rl *RateLimiter) getLimiter(ip string) *rate.Limiter {
 	rl.mu.Lock()
@@ -60,24 +77,28 @@ func (rl *RateLimiter) getLimiter(ip string) *rate.Limiter {
 	return v.limiter
 }
 
-// cleanupVisitors periodically removes IPs that haven't been seen in over 3 minutes
+// cleanupVisitors periodically removes IPs that haven't been seen in over visitorTTL
 func (rl *RateLimiter) cleanupVisitors() {
 	for {
-		time.Sleep(1 * time.Minute)
+		time.Sleep(cleanupInterval)
+		rl.evictStale(time.Now())
+	}
+}
 
-		rl.mu.Lock()
-		for ip, v := range rl.visitors {
-			if time.Since(v.lastSeen) > 3*time.Minute {
-				delete(rl.visitors, ip)
-			}
+// evictStale drops visitors last seen more than visitorTTL before now.
+func (rl *RateLimiter) evictStale(now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for ip, v := range rl.visitors {
+		if now.Sub(v.lastSeen) > visitorTTL {
+			delete(rl.visitors, ip)
 		}
-		rl.mu.Unlock()
 	}
 }
 
 // UnaryInterceptor protects unary calls (Login, CreateUser, etc.)
 func (rl *RateLimiter) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	ip := rl.extractIP(ctx)
+	ip := rl.visitorKey(ctx)
 
 	if !rl.getLimiter(ip).Allow() {
 		return nil, status.Errorf(codes.ResourceExhausted, "too many requests - slow down")
@@ -88,7 +109,7 @@ func (rl *RateLimiter) UnaryInterceptor(ctx context.Context, req interface{}, in
 
 // StreamInterceptor for stream limits (like Connect/Stream)
 func (rl *RateLimiter) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-	ip := rl.extractIP(ss.Context())
+	ip := rl.visitorKey(ss.Context())
 
 	if !rl.getLimiter(ip).Allow() {
 		return status.Errorf(codes.ResourceExhausted, "too many requests - slow down")
@@ -97,6 +118,24 @@ func (rl *RateLimiter) StreamInterceptor(srv interface{}, ss grpc.ServerStream,
 	return handler(srv, ss)
 }
 
+// visitorKey picks the bucket for a call: the user ID for per-user limiters
+// when the caller is authenticated, the remote IP otherwise.
+func (rl *RateLimiter) visitorKey(ctx context.Context) string {
+	if rl.byUser {
+		if user, err := GetUserFromContext(ctx); err == nil && user.ID != "" {
+			return "user:" + user.ID
+		}
+	}
+	return rl.extractIP(ctx)
+}
+
+// allowUser reports whether userID may make another call, for gateways
+// that authenticate outside the gRPC interceptors. A nil limiter allows
+// everything.
+func (rl *RateLimiter) allowUser(userID string) bool {
+	return rl == nil || rl.getLimiter("user:"+userID).Allow()
+}
+
 // extractIP helper to get the remote IP from gRPC context
 func (rl *RateLimiter) extractIP(ctx context.Context) string {
 	if p, ok := peer.FromContext(ctx); ok {
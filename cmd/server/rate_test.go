@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterEvictsIdleVisitors(t *testing.T) {
+	rl := NewRateLimiter(10, 10)
+	for i := range 100 {
+		rl.getLimiter("10.0.0." + strconv.Itoa(i))
+	}
+	start := time.Now()
+
+	// A visitor seen after the others survives the sweep that evicts them
+	rl.getLimiter("10.0.1.1")
+	rl.mu.Lock()
+	rl.visitors["10.0.1.1"].lastSeen = start.Add(visitorTTL)
+	rl.mu.Unlock()
+
+	rl.evictStale(start.Add(visitorTTL / 2))
+	if got := visitorCount(rl); got != 101 {
+		t.Fatalf("%d visitors before the TTL, want 101", got)
+	}
+
+	rl.evictStale(start.Add(visitorTTL + time.Second))
+	rl.mu.Lock()
+	_, kept := rl.visitors["10.0.1.1"]
+	rl.mu.Unlock()
+	if got := visitorCount(rl); got != 1 || !kept {
+		t.Errorf("%d visitors after the TTL (recent one kept: %v), want only the recent one", got, kept)
+	}
+}
+
+func visitorCount(rl *RateLimiter) int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return len(rl.visitors)
+}
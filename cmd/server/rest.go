@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	pb "github.com/rexlx/squall/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxRESTBody bounds the JSON body of a REST request.
+const maxRESTBody = 64 << 10
+
+// RegisterREST mounts a small JSON API on mux for scripts and browser
+// clients that can't use gRPC:
+//
+//	POST /api/login                  {"email","password"} -> LoginResponse
+//	POST /api/refresh                {"refresh_token"} -> RefreshTokenResponse
+//	GET  /api/rooms                  the caller's rooms and notification prefs
+//	GET  /api/rooms/{room}/messages  HistoryResponse; before_id and limit
+//	                                 query parameters page back as in GetHistory
+//
+// Bodies are protobuf JSON with the proto field names, as on the WebSocket.
+// Everything but login and refresh needs "Authorization: Bearer <token>".
+// The handlers call the gRPC methods, so the checks are the same. Requests
+// are rate limited by IP and, when userLimiter is non-nil, authenticated
+// ones by user as well.
+func (s *GrpcServer) RegisterREST(mux *http.ServeMux, limiter, userLimiter *RateLimiter) {
+	handle := func(pattern string, h http.HandlerFunc) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			if limiter != nil && !limiter.getLimiter(remoteIP(r)).Allow() {
+				writeRESTError(w, status.Error(codes.ResourceExhausted, "too many requests - slow down"))
+				return
+			}
+			h(w, r)
+		})
+	}
+
+	handle("POST /api/login", func(w http.ResponseWriter, r *http.Request) {
+		req := &pb.LoginRequest{}
+		if readREST(w, r, req) {
+			resp, err := s.Login(r.Context(), req)
+			writeREST(w, resp, err)
+		}
+	})
+	handle("POST /api/refresh", func(w http.ResponseWriter, r *http.Request) {
+		req := &pb.RefreshTokenRequest{}
+		if readREST(w, r, req) {
+			resp, err := s.RefreshToken(r.Context(), req)
+			writeREST(w, resp, err)
+		}
+	})
+	handle("GET /api/rooms", s.restAuth(userLimiter, s.restRooms))
+	handle("GET /api/rooms/{room}/messages", s.restAuth(userLimiter, func(w http.ResponseWriter, r *http.Request) {
+		req := &pb.HistoryRequest{RoomId: r.PathValue("room")}
+		q := r.URL.Query()
+		var err error
+		if v := q.Get("before_id"); v != "" {
+			if req.BeforeId, err = strconv.ParseInt(v, 10, 64); err != nil {
+				writeRESTError(w, status.Error(codes.InvalidArgument, "before_id must be an integer"))
+				return
+			}
+		}
+		if v := q.Get("limit"); v != "" {
+			limit, err := strconv.ParseInt(v, 10, 32)
+			if err != nil {
+				writeRESTError(w, status.Error(codes.InvalidArgument, "limit must be an integer"))
+				return
+			}
+			req.Limit = int32(limit)
+		}
+		resp, err := s.GetHistory(r.Context(), req)
+		writeREST(w, resp, err)
+	}))
+}
+
+// restAuth validates the bearer token like AuthInterceptor, applies the
+// per-user rate limit and puts the user in the request context for the
+// gRPC methods.
+func (s *GrpcServer) restAuth(userLimiter *RateLimiter, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			writeRESTError(w, status.Error(codes.Unauthenticated, "authorization token is not provided"))
+			return
+		}
+		claims, err := ValidateJWT(token, s.appServer.JWTKeys, s.appServer.TokenIssuer)
+		if err != nil {
+			writeRESTError(w, status.Error(codes.Unauthenticated, "access token is invalid"))
+			return
+		}
+		if !userLimiter.allowUser(claims.UserID) {
+			writeRESTError(w, status.Error(codes.ResourceExhausted, "too many requests - slow down"))
+			return
+		}
+		user := User{ID: claims.UserID, Role: claims.Role, Email: claims.Email}
+		h(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	}
+}
+
+// restRoom is one entry of GET /api/rooms.
+type restRoom struct {
+	ID      string `json:"room_id"`
+	Name    string `json:"name"`
+	Private bool   `json:"private"`
+	OwnerID string `json:"owner_id,omitempty"`
+	Topic   string `json:"topic,omitempty"`
+	// Notifications is the caller's preference for the room: "all",
+	// "mentions" or "muted"
+	Notifications string `json:"notifications"`
+}
+
+// restRooms lists the rooms the caller has joined and may still read.
+func (s *GrpcServer) restRooms(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	caller, err := GetUserFromContext(ctx)
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+	dbUser, err := s.appServer.DB.GetUser(ctx, caller.ID)
+	if err != nil {
+		writeRESTError(w, status.Error(codes.NotFound, "user not found"))
+		return
+	}
+	prefs, err := s.appServer.DB.NotificationPrefs(ctx, caller.ID)
+	if err != nil {
+		writeRESTError(w, status.Error(codes.Internal, "failed to load notification preferences"))
+		return
+	}
+	rooms := []restRoom{}
+	for _, roomID := range dbUser.Rooms {
+		room, err := s.appServer.DB.GetRoom(ctx, roomID)
+		if err != nil || !room.CanAccess(caller.ID) {
+			continue
+		}
+		notify := NotifyAll
+		if pref, ok := prefs[room.ID]; ok {
+			notify = pref
+		}
+		rooms = append(rooms, restRoom{ID: room.ID, Name: room.Name, Private: room.Private, OwnerID: room.OwnerID, Topic: room.Topic, Notifications: notify})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]restRoom{"rooms": rooms})
+}
+
+// readREST decodes a protobuf JSON body into req, answering 400 itself
+// when it can't.
+func readREST(w http.ResponseWriter, r *http.Request, req proto.Message) bool {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRESTBody))
+	if err == nil {
+		err = jsonIn.Unmarshal(body, req)
+	}
+	if err != nil {
+		writeRESTError(w, status.Error(codes.InvalidArgument, "request body is not valid JSON"))
+		return false
+	}
+	return true
+}
+
+// writeREST answers with resp as protobuf JSON, or with err.
+func writeREST(w http.ResponseWriter, resp proto.Message, err error) {
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+	data, err := jsonOut.Marshal(resp)
+	if err != nil {
+		writeRESTError(w, status.Error(codes.Internal, "failed to encode response"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// writeRESTError answers with the HTTP status matching err's gRPC code and
+// a body like the WebSocket's error frame.
+func writeRESTError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus(st.Code()))
+	json.NewEncoder(w).Encode(map[string]string{"code": st.Code().String(), "error": st.Message()})
+}
+
+// httpStatus maps the gRPC codes the service returns to HTTP statuses.
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/rexlx/squall/internal"
+)
+
+// A failed batch is retried saveMaxAttempts times in all, backing off from
+// saveRetryBase and doubling up to saveRetryMax. That keeps the worker busy
+// for under a second per batch, so the queue absorbs a short hiccup rather
+// than the worker stalling behind a dead database.
+const (
+	saveMaxAttempts = 4
+	saveRetryBase   = 100 * time.Millisecond
+	saveRetryMax    = 2 * time.Second
+)
+
+// isTransientDBError reports whether err is worth retrying: lost or refused
+// connections, deadlocks and serialization failures, a server that is
+// shutting down or out of resources, or a busy SQLite file. Anything else,
+// such as a constraint violation, fails the same way on every attempt.
+func isTransientDBError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "08", // connection exception
+			"53", // insufficient resources
+			"57": // operator intervention, e.g. admin shutdown
+			return true
+		}
+		return pqErr.Code == "40001" || pqErr.Code == "40P01" // serialization failure, deadlock
+	}
+	var liteErr sqlite3.Error
+	if errors.As(err, &liteErr) {
+		return liteErr.Code == sqlite3.ErrBusy || liteErr.Code == sqlite3.ErrLocked
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.As(err, &netErr)
+}
+
+// storeBatch writes reqs, retrying transient failures with backoff. A batch
+// that fails permanently is retried one message at a time so a single bad
+// row doesn't lose the rest. Messages that still can't be written go to the
+// dead letter file. Each request's Done hears how it went. Writes aren't
+// tied to any request, so the shutdown flush still runs after every RPC
+// context is gone.
+func (s *Server) storeBatch(reqs []SaveRequest) {
+	msgs := make([]internal.Message, len(reqs))
+	for i, req := range reqs {
+		msgs[i] = req.Message
+	}
+	err := s.storeWithRetry(func() error { return s.DB.StoreMessages(context.Background(), msgs) })
+	if err == nil {
+		for i, req := range reqs {
+			req.done(msgs[i].ID, nil)
+		}
+		return
+	}
+	if isTransientDBError(err) || len(msgs) == 1 {
+		s.Logger.Printf("Error saving message batch to DB after %d attempts: %v", saveMaxAttempts, err)
+		s.deadLetter(msgs, err)
+		for _, req := range reqs {
+			req.done(0, err)
+		}
+		return
+	}
+
+	s.Logger.Printf("Message batch of %d rejected (%v), saving one at a time", len(msgs), err)
+	for i, req := range reqs {
+		one := msgs[i : i+1]
+		if err := s.storeWithRetry(func() error { return s.DB.StoreMessages(context.Background(), one) }); err != nil {
+			s.Logger.Printf("Error saving message to DB for room %s: %v", one[0].RoomID, err)
+			s.deadLetter(one, err)
+			req.done(0, err)
+			continue
+		}
+		req.done(one[0].ID, nil)
+	}
+}
+
+// storeWithRetry runs store until it succeeds, fails permanently, or has
+// been tried saveMaxAttempts times, and returns the last error.
+func (s *Server) storeWithRetry(store func() error) error {
+	delay := saveRetryBase
+	var err error
+	for attempt := 1; attempt <= saveMaxAttempts; attempt++ {
+		if err = store(); err == nil || !isTransientDBError(err) {
+			return err
+		}
+		if attempt < saveMaxAttempts {
+			metricSaveRetries.Inc()
+			time.Sleep(delay)
+			delay = min(delay*2, saveRetryMax)
+		}
+	}
+	return err
+}
+
+// deadLetterRecord is one line of the dead letter file.
+type deadLetterRecord struct {
+	Time    time.Time        `json:"time"`
+	Error   string           `json:"error"`
+	Message internal.Message `json:"message"`
+}
+
+// deadLetter records messages that could not be saved. They are appended
+// as JSON lines to DeadLetterPath, from where they can be replayed by hand.
+// With no path set, or if the file can't be written, they are only logged.
+func (s *Server) deadLetter(msgs []internal.Message, cause error) {
+	metricDeadLetters.Add(float64(len(msgs)))
+	if s.DeadLetterPath == "" {
+		s.Logger.Printf("%d messages lost (no dead letter file configured)", len(msgs))
+		return
+	}
+
+	f, err := os.OpenFile(s.DeadLetterPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		s.Logger.Printf("%d messages lost, can't open dead letter file: %v", len(msgs), err)
+		return
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	now := time.Now()
+	for _, m := range msgs {
+		if err := enc.Encode(deadLetterRecord{Time: now, Error: cause.Error(), Message: m}); err != nil {
+			s.Logger.Printf("Failed to write dead letter for room %s: %v", m.RoomID, err)
+		}
+	}
+	s.Logger.Printf("%d messages written to dead letter file %s", len(msgs), s.DeadLetterPath)
+}
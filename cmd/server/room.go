@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
 	"sync"
 
 	"github.com/rexlx/squall/internal"
@@ -12,9 +15,51 @@ type Room struct {
 	ID          string             `json:"id"`
 	Name        string             `json:"name"`
 	MaxMessages int                `json:"max_messages"`
+	Private     bool               `json:"private"`
+	Members     []string           `json:"members"`  // User IDs allowed in a private room
+	OwnerID     string             `json:"owner_id"` // Empty for rooms created before ownership existed
+	Topic       string             `json:"topic"`    // What the room is about; may be empty
 	Memory      *sync.RWMutex      `json:"-"`
 }
 
+// DefaultRoomMaxMessages is the history limit given to newly created rooms.
+// A room whose MaxMessages is <= 0 keeps its history indefinitely.
+const DefaultRoomMaxMessages = 1000
+
+// MaxTopicBytes caps a room topic.
+const MaxTopicBytes = 256
+
+// DirectRoomPrefix marks the IDs of private one-to-one rooms.
+const DirectRoomPrefix = "dm-"
+
+// DirectRoomID derives the private room shared by two users. The pair is
+// sorted so both sides arrive at the same ID.
+func DirectRoomID(a, b string) string {
+	ids := []string{a, b}
+	sort.Strings(ids)
+	sum := sha256.Sum256([]byte(ids[0] + ":" + ids[1]))
+	return DirectRoomPrefix + hex.EncodeToString(sum[:16])
+}
+
+// CanModerate reports whether user may kick, ban or hand over the room:
+// admins anywhere, owners in their own room.
+func (rm *Room) CanModerate(user User) bool {
+	return user.Role == "admin" || (rm.OwnerID != "" && rm.OwnerID == user.ID)
+}
+
+// CanAccess reports whether userID may join or read the room.
+func (rm *Room) CanAccess(userID string) bool {
+	if !rm.Private {
+		return true
+	}
+	for _, m := range rm.Members {
+		if m == userID {
+			return true
+		}
+	}
+	return false
+}
+
 func (rm *Room) GetRoomStats() internal.AppStats {
 	rm.Memory.RLock()
 	defer rm.Memory.RUnlock()
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	pb "github.com/rexlx/squall/proto"
+)
+
+// roomSeqs hands out each room's message sequence numbers. A room's counter
+// is seeded from the highest stored seq the first time it is used, so
+// numbering carries on across restarts.
+type roomSeqs struct {
+	mu    sync.Mutex
+	rooms map[string]*roomSeq
+}
+
+// roomSeq is one room's counter. Its lock is held from assigning a number
+// until the message is in every stream's outbox, so all streams see the
+// room's messages in seq order.
+type roomSeq struct {
+	mu     sync.Mutex
+	last   int64
+	seeded bool
+}
+
+func newRoomSeqs() *roomSeqs {
+	return &roomSeqs{rooms: make(map[string]*roomSeq)}
+}
+
+func (r *roomSeqs) room(roomID string) *roomSeq {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rs, ok := r.rooms[roomID]
+	if !ok {
+		rs = &roomSeq{}
+		r.rooms[roomID] = rs
+	}
+	return rs
+}
+
+// forget drops a deleted room's counter.
+func (r *roomSeqs) forget(roomID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.rooms, roomID)
+}
+
+// broadcastInOrder numbers msg within its room and broadcasts it. If the
+// room's counter can't be seeded the message still goes out, unnumbered,
+// and seeding is tried again on the next one.
+func (s *GrpcServer) broadcastInOrder(msg *pb.ChatMessage) {
+	rs := s.seqs.room(msg.RoomId)
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if !rs.seeded {
+		last, err := s.appServer.DB.LastSeq(context.Background(), msg.RoomId)
+		if err != nil {
+			s.appServer.Logger.Printf("Failed to load last seq for room %s: %v", msg.RoomId, err)
+			s.Broadcast(msg)
+			return
+		}
+		rs.last, rs.seeded = last, true
+	}
+	rs.last++
+	msg.Seq = rs.last
+	s.Broadcast(msg)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rexlx/squall/internal"
+	pb "github.com/rexlx/squall/proto"
+)
+
+func TestBroadcastInOrderNumbersEachRoom(t *testing.T) {
+	const senders, perSender = 8, 12
+	const perRoom = senders * perSender
+	db := newTestDB(t)
+	// lobby already has history from before a restart; quiet has none
+	var stored []internal.Message
+	for i := range 5 {
+		stored = append(stored, internal.Message{RoomID: "lobby", UserID: "u1", Message: "old", Seq: int64(i + 1)})
+	}
+	if err := db.StoreMessages(context.Background(), stored); err != nil {
+		t.Fatal(err)
+	}
+	s := NewGrpcServer(newTestServer(t, db, Config{}))
+
+	listeners := make(map[string]chan *pb.ChatMessage)
+	for _, room := range []string{"lobby", "quiet"} {
+		sent := make(chan *pb.ChatMessage, 2*perRoom)
+		cs := newClientStream(&fakeStream{sent: sent}, User{ID: "listener-" + room}, 2*perRoom)
+		s.subscribe(cs, room)
+		t.Cleanup(func() { s.unsubscribeAll(cs) })
+		listeners[room] = sent
+	}
+
+	// Several senders race in each room
+	var wg sync.WaitGroup
+	for _, room := range []string{"lobby", "quiet"} {
+		for range senders {
+			wg.Go(func() {
+				for range perSender {
+					s.broadcastInOrder(&pb.ChatMessage{RoomId: room, Type: pb.ChatMessage_TEXT})
+				}
+			})
+		}
+	}
+	wg.Wait()
+
+	for room, first := range map[string]int64{"lobby": 6, "quiet": 1} {
+		want := first
+		deadline := time.After(time.Second)
+		for want < first+perRoom {
+			select {
+			case msg := <-listeners[room]:
+				if msg.Command != "" {
+					continue
+				}
+				if msg.Seq != want {
+					t.Fatalf("%s: got seq %d, want %d", room, msg.Seq, want)
+				}
+				want++
+			case <-deadline:
+				t.Fatalf("%s: stopped at seq %d", room, want-1)
+			}
+		}
+	}
+}
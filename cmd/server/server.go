@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"log"
+	"log/slog"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rexlx/squall/internal"
@@ -25,31 +28,117 @@ type Server struct {
 	StartTime time.Time         `json:"start_time"`
 	Memory    *sync.RWMutex     `json:"-"`
 	Logger    *log.Logger       `json:"-"`
-	Gateway   *http.ServeMux    `json:"-"`
-	DB        Database          `json:"-"`
+	// Events takes structured records (logins, streams, queue drops, audit
+	// entries). NewServer points it at Logger's writer as text; main swaps
+	// in the -log-format handler.
+	Events  *slog.Logger   `json:"-"`
+	Gateway *http.ServeMux `json:"-"`
+	// WebGateway is what browser clients reach on -gateway-addr. Unlike
+	// Gateway, which holds metrics and probes, it is meant to be public.
+	WebGateway *http.ServeMux `json:"-"`
+	DB         Database       `json:"-"`
+
+	// Token settings from Config; NewServer uses the Default* values for
+	// unset ones and HS256 keys from Key
+	JWTKeys     *JWTKeys      `json:"-"`
+	TokenTTL    time.Duration `json:"-"`
+	RefreshTTL  time.Duration `json:"-"`
+	TokenIssuer string        `json:"-"`
+
+	// QueueBlock makes Enqueue wait for room in Queue instead of dropping
+	// the message, pushing back on senders when the DB falls behind.
+	QueueBlock bool `json:"-"`
+	// DroppedMessages counts messages Enqueue discarded because Queue was full
+	DroppedMessages atomic.Int64 `json:"-"`
+	// PasswordPolicy is enforced on every new password; NewServer falls
+	// back to DefaultPasswordPolicy when Config leaves it empty.
+	PasswordPolicy PasswordPolicy `json:"-"`
+	// DeadLetterPath is the JSON lines file that takes messages the save
+	// worker gave up on. Empty only logs them.
+	DeadLetterPath string `json:"-"`
+
+	saveQuit chan struct{}
+	saveDone chan int
+	// saveRunning is true while StartSaveWorker is draining the Queue
+	saveRunning atomic.Bool
+	pruning     atomic.Bool
+
+	// postCounts holds chat messages per user ID since the last
+	// FlushPostCounts
+	postMu     sync.Mutex
+	postCounts map[string]int64
 }
 
 type SaveRequest struct {
 	RoomID  string
 	Message internal.Message
+	// Done, if set, is called by the save worker once the message is
+	// stored, with the ID it got, or given up on, with the error.
+	Done func(id int64, err error)
 }
 
-func NewServer(address, key string, logger *log.Logger, db Database) *Server {
+func (r SaveRequest) done(id int64, err error) {
+	if r.Done != nil {
+		r.Done(id, err)
+	}
+}
+
+// DefaultQueueSize is the buffer of the persistence queue when none is given.
+const DefaultQueueSize = 100
+
+// dropLogEvery limits how often a full queue is logged while it stays full.
+const dropLogEvery = 100
+
+// NewServer builds the Server described by cfg. Address is cfg.ListenAddr,
+// the same address main listens on.
+func NewServer(cfg Config, logger *log.Logger, db Database) *Server {
 	start := time.Now()
-	sQ := make(chan SaveRequest, 100)
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	sQ := make(chan SaveRequest, queueSize)
 	svr := &Server{
-		Queue:     sQ,
-		Rooms:     make(map[string]*Room),
-		Address:   address,
-		ID:        "server-001",
-		ValidKeys: make(internal.KeyLib),
-		Key:       key,
-		Stats:     make(internal.AppStats),
-		StartTime: start,
-		Memory:    &sync.RWMutex{},
-		Logger:    logger,
-		Gateway:   http.NewServeMux(),
-		DB:        db,
+		Queue:      sQ,
+		Rooms:      make(map[string]*Room),
+		Address:    cfg.ListenAddr,
+		ID:         "server-001",
+		ValidKeys:  make(internal.KeyLib),
+		Key:        cfg.JWTSecret,
+		Stats:      make(internal.AppStats),
+		StartTime:  start,
+		Memory:     &sync.RWMutex{},
+		Logger:     logger,
+		Events:     slog.New(slog.NewTextHandler(logger.Writer(), nil)),
+		Gateway:    http.NewServeMux(),
+		WebGateway: http.NewServeMux(),
+		DB:         db,
+
+		JWTKeys:     NewHMACKeys(cfg.JWTSecret),
+		TokenTTL:    cfg.TokenTTL,
+		RefreshTTL:  cfg.RefreshTTL,
+		TokenIssuer: cfg.TokenIssuer,
+
+		QueueBlock:     cfg.QueueBlock,
+		PasswordPolicy: cfg.PasswordPolicy,
+		DeadLetterPath: cfg.DeadLetterPath,
+
+		saveQuit: make(chan struct{}),
+		saveDone: make(chan int, 1),
+
+		postCounts: make(map[string]int64),
+	}
+	if svr.TokenTTL <= 0 {
+		svr.TokenTTL = DefaultAccessTokenTTL
+	}
+	if svr.RefreshTTL <= 0 {
+		svr.RefreshTTL = DefaultRefreshTokenTTL
+	}
+	if svr.TokenIssuer == "" {
+		svr.TokenIssuer = DefaultTokenIssuer
+	}
+	if svr.PasswordPolicy == (PasswordPolicy{}) {
+		svr.PasswordPolicy = DefaultPasswordPolicy
 	}
 	svr.ValidKeys["undefined"] = internal.Key{
 		Value:       "undefined",
@@ -57,58 +146,206 @@ func NewServer(address, key string, logger *log.Logger, db Database) *Server {
 		Issued:      start,
 		RequestedBy: "system",
 	}
-	svr.Gateway.HandleFunc("/login", svr.LoginHandler)
+	svr.Gateway.HandleFunc("/healthz", svr.HealthzHandler)
+	svr.Gateway.HandleFunc("/readyz", svr.ReadyzHandler)
+	svr.saveRunning.Store(true)
+	go svr.StartSaveWorker()
 	return svr
 }
 
+// Stats are rolled up into statBucket-long samples, and maxStatSamples of
+// them (30 days) are kept per stat name, however busy the server gets.
+const (
+	statBucket     = time.Hour
+	maxStatSamples = 30 * 24
+)
+
+// Counter names recorded with IncrementStat and AddStat.
+const (
+	StatLogins     = "logins"
+	StatMessages   = "messages"
+	StatBroadcasts = "broadcasts"
+	// StatPosts is kept per user, in User.Stats, by FlushPostCounts
+	StatPosts = "posts"
+)
+
+// IncrementStat records one more occurrence of the named counter. Each sample
+// holds the running total at the end of its hour, so the newest sample is
+// the count so far.
+func (s *Server) IncrementStat(name string) {
+	s.AddStat(name, 1)
+}
+
+// AddStat records n more occurrences of the named counter.
+func (s *Server) AddStat(name string, n float64) {
+	if n <= 0 {
+		return
+	}
+	s.Memory.Lock()
+	defer s.Memory.Unlock()
+	s.Stats.Record(name, time.Now(), n, statBucket, maxStatSamples)
+}
+
+// StatTotal returns the running total of a counter recorded with IncrementStat.
+func (s *Server) StatTotal(name string) int64 {
+	s.Memory.RLock()
+	defer s.Memory.RUnlock()
+	samples := s.Stats[name]
+	if len(samples) == 0 {
+		return 0
+	}
+	return int64(samples[len(samples)-1].Value)
+}
+
+// StatSeries returns a copy of the samples kept for every counter.
+func (s *Server) StatSeries() internal.AppStats {
+	s.Memory.RLock()
+	defer s.Memory.RUnlock()
+	series := make(internal.AppStats, len(s.Stats))
+	for name, samples := range s.Stats {
+		series[name] = append([]internal.Stat(nil), samples...)
+	}
+	return series
+}
+
+// Enqueue hands req to the save worker. Unless QueueBlock is set, a full
+// queue drops the message and reports false.
+func (s *Server) Enqueue(req SaveRequest) bool {
+	if s.QueueBlock {
+		s.Queue <- req
+		return true
+	}
+	select {
+	case s.Queue <- req:
+		return true
+	default:
+		metricQueueDrops.Inc()
+		if n := s.DroppedMessages.Add(1); n == 1 || n%dropLogEvery == 0 {
+			s.Events.Warn("DB queue full, dropping persistence",
+				"event", "queue_full", "room_id", req.RoomID, "user_id", req.Message.UserID, "dropped_total", n)
+		}
+		return false
+	}
+}
+
+const (
+	saveBatchSize     = 100
+	saveFlushInterval = 200 * time.Millisecond
+)
+
+// StartSaveWorker drains the Queue, writing messages in batches of up to
+// saveBatchSize or whatever arrived within saveFlushInterval, whichever
+// comes first. Failed writes are retried by storeBatch while the Queue
+// keeps buffering. It runs until StopSaveWorker is called.
 func (s *Server) StartSaveWorker() {
+	s.saveRunning.Store(true)
+	defer s.saveRunning.Store(false)
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
+	flushTimer := time.NewTimer(saveFlushInterval)
+	defer flushTimer.Stop()
+
+	batch := make([]SaveRequest, 0, saveBatchSize)
+	flush := func() {
+		for start := 0; start < len(batch); start += saveBatchSize {
+			end := min(start+saveBatchSize, len(batch))
+			s.storeBatch(batch[start:end])
+		}
+		batch = batch[:0]
+	}
+
 	for {
 		select {
 		case req := <-s.Queue:
-			if err := s.DB.StoreMessage(req.RoomID, req.Message); err != nil {
-				s.Logger.Println("Error saving message to DB:", err)
+			req.Message.RoomID = req.RoomID
+			batch = append(batch, req)
+			if len(batch) >= saveBatchSize {
+				flush()
 			}
+		case <-flushTimer.C:
+			flush()
+			flushTimer.Reset(saveFlushInterval)
 		case <-ticker.C:
 			s.Logger.Println("Save Worker Heartbeat - Queue Length:", len(s.Queue))
+		case <-s.saveQuit:
+			// Drain whatever is still queued, then write it out
+		drain:
+			for {
+				select {
+				case req := <-s.Queue:
+					req.Message.RoomID = req.RoomID
+					batch = append(batch, req)
+				default:
+					break drain
+				}
+			}
+			flushed := len(batch)
+			flush()
+			s.saveDone <- flushed
+			return
 		}
 	}
 }
 
-func (s *Server) StartPruneWorker(interval time.Duration, keep int) {
+// StopSaveWorker stops the save worker after it flushes any queued messages
+// and returns how many were written during the final flush.
+func (s *Server) StopSaveWorker() int {
+	close(s.saveQuit)
+	return <-s.saveDone
+}
+
+// StartPruneWorker trims messages every interval, keeping each room's
+// MaxMessages newest messages and dropping anything older than maxAge. keep
+// is the limit for rooms that have no rooms row; maxAge <= 0 disables the
+// age policy. Cancelling ctx stops the worker and any prune in progress.
+func (s *Server) StartPruneWorker(ctx context.Context, interval time.Duration, keep int, maxAge time.Duration) {
 	if interval <= 0 {
-		s.Logger.Println("Pruning disabled (interval 0)")
+		s.Logger.Println("Pruning disabled")
 		return
 	}
-	s.Logger.Printf("Prune worker started (Every %s, keep %d)", interval, keep)
+	s.Logger.Printf("Prune worker started (Every %s, keep %d, max age %s)", interval, keep, maxAge)
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		start := time.Now()
-		s.Logger.Println("Starting Prune...")
-		if err := s.DB.PruneMessages(keep); err != nil {
-			s.Logger.Printf("Prune failed: %v", err)
-		} else {
-			s.Logger.Printf("Prune finished in %v", time.Since(start))
+	for {
+		select {
+		case <-ticker.C:
+			s.PruneOnce(ctx, keep, maxAge)
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func (s *Server) StartRoomReaper(checkInterval time.Duration, staleThreshold time.Duration) {
-	s.Logger.Printf("Room Reaper started (Check every %s, stale threshold %s)", checkInterval, staleThreshold)
-	ticker := time.NewTicker(checkInterval)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		start := time.Now()
-		s.Logger.Println("Room Reaper: Checking for stale rooms...")
+// PruneOnce runs a single prune cycle. If a previous cycle is still going
+// it logs and returns instead of piling a second run onto the database.
+func (s *Server) PruneOnce(ctx context.Context, keep int, maxAge time.Duration) {
+	if !s.pruning.CompareAndSwap(false, true) {
+		s.Logger.Println("Prune still running, skipping this cycle")
+		return
+	}
+	defer s.pruning.Store(false)
 
-		if err := s.DB.ReapStaleRooms(staleThreshold); err != nil {
-			s.Logger.Printf("Room Reaper failed: %v", err)
-		} else {
-			s.Logger.Printf("Room Reaper finished in %v", time.Since(start))
+	start := time.Now()
+	s.Logger.Println("Starting Prune...")
+	summary, err := s.DB.PruneMessages(ctx, keep)
+	if err != nil {
+		s.Logger.Printf("Prune failed: %v", err)
+	}
+	for _, err := range summary.Failures {
+		s.Logger.Printf("Prune error: %v", err)
+	}
+	var aged int64
+	var agedIn time.Duration
+	if maxAge > 0 {
+		ageStart := time.Now()
+		n, err := s.DB.PruneMessagesByAge(ctx, maxAge)
+		if err != nil {
+			s.Logger.Printf("Prune by age failed: %v", err)
 		}
+		aged, agedIn = n, time.Since(ageStart)
 	}
+	s.Logger.Printf("Prune finished in %v (%d of %d rooms pruned, %d messages deleted: %d by count in %v, %d by age in %v; %d rooms failed)",
+		time.Since(start), summary.RoomsPruned, summary.Rooms, summary.Deleted+aged,
+		summary.Deleted, summary.Duration, aged, agedIn, summary.Errors)
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rexlx/squall/internal"
+)
+
+// testJWTSecret signs the tokens of test servers.
+const testJWTSecret = "test-secret-that-is-long-enough-for-hs256"
+
+// newTestServer returns a Server on db whose save worker is stopped when
+// the test ends.
+func newTestServer(t testing.TB, db Database, cfg Config) *Server {
+	t.Helper()
+	cfg.JWTSecret = testJWTSecret
+	app := NewServer(cfg, log.New(io.Discard, "", 0), db)
+	t.Cleanup(func() {
+		if app.saveRunning.Load() {
+			app.StopSaveWorker()
+		}
+	})
+	return app
+}
+
+// countingDB counts the StoreMessages round trips that reach the database.
+type countingDB struct {
+	Database
+	batches atomic.Int64
+}
+
+func (c *countingDB) StoreMessages(ctx context.Context, msgs []internal.Message) error {
+	c.batches.Add(1)
+	return c.Database.StoreMessages(ctx, msgs)
+}
+
+func TestSaveWorkerBatchesInserts(t *testing.T) {
+	const n = 250
+	db := &countingDB{Database: newTestDB(t)}
+	app := newTestServer(t, db, Config{QueueSize: n})
+
+	for i := range n {
+		msg := internal.Message{UserID: "u1", Message: "hello " + strconv.Itoa(i), Seq: int64(i + 1)}
+		if !app.Enqueue(SaveRequest{RoomID: "lobby", Message: msg}) {
+			t.Fatalf("message %d dropped", i)
+		}
+	}
+	app.StopSaveWorker()
+
+	if got := countRows(t, db.Database.(*SQLiteDB), `SELECT COUNT(*) FROM messages`); got != n {
+		t.Fatalf("stored %d messages, want %d", got, n)
+	}
+	// One INSERT per saveBatchSize messages, give or take a flush timer
+	// firing mid-burst, instead of one per message
+	if got, limit := db.batches.Load(), int64(n/saveBatchSize+2); got > limit {
+		t.Errorf("%d round trips for %d messages, want at most %d", got, n, limit)
+	}
+}
+
+func BenchmarkSaveWorker(b *testing.B) {
+	db := &countingDB{Database: newTestDB(b)}
+	app := newTestServer(b, db, Config{QueueBlock: true})
+
+	for i := 0; b.Loop(); i++ {
+		app.Enqueue(SaveRequest{RoomID: "lobby", Message: internal.Message{UserID: "u1", Message: "hello", Seq: int64(i + 1)}})
+	}
+	app.StopSaveWorker()
+	b.ReportMetric(float64(db.batches.Load())/float64(b.N), "roundtrips/msg")
+}
@@ -0,0 +1,1233 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rexlx/squall/internal"
+)
+
+// SQLiteDB is a file-backed Database for local development and small
+// deployments. JSONB columns from the Postgres schema are stored as TEXT.
+type SQLiteDB struct {
+	Conn *sql.DB
+	// QueryTimeout bounds each call; 0 means DefaultQueryTimeout
+	QueryTimeout time.Duration
+	// MaintenanceTimeout bounds each prune or reap statement instead; 0
+	// means DefaultMaintenanceTimeout
+	MaintenanceTimeout time.Duration
+}
+
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; one connection avoids "database is locked"
+	db.SetMaxOpenConns(1)
+	if err = db.Ping(); err != nil {
+		return nil, err
+	}
+	return &SQLiteDB{Conn: db}, nil
+}
+
+func (db *SQLiteDB) Ping(ctx context.Context) error {
+	return db.Conn.PingContext(ctx)
+}
+
+func (db *SQLiteDB) CreateTables(ctx context.Context) error {
+	queries := []string{
+		`CREATE TABLE IF NOT EXISTS users (
+			id TEXT PRIMARY KEY,
+			email TEXT UNIQUE NOT NULL,
+			password TEXT,
+			name TEXT,
+			about TEXT,
+			role TEXT,
+			created TIMESTAMP,
+			updated TIMESTAMP,
+			rooms TEXT,
+			history TEXT,
+			stats TEXT,
+			posts TEXT
+		);`,
+		`CREATE TABLE IF NOT EXISTS rooms (
+			id TEXT PRIMARY KEY,
+			name TEXT,
+			max_messages INT,
+			stats TEXT,
+			private BOOLEAN NOT NULL DEFAULT FALSE,
+			members TEXT,
+			owner_id TEXT,
+			topic TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			room_id TEXT NOT NULL,
+			user_id TEXT,
+			email TEXT,
+			msg_content TEXT,
+			time_str TEXT,
+			reply_to TEXT,
+			iv TEXT,
+			hot_sauce TEXT,
+			attachment TEXT,
+			seq INTEGER NOT NULL DEFAULT 0,
+			time_ms INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			deleted_at TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS attachments (
+			id TEXT PRIMARY KEY,
+			room_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			file_name TEXT,
+			content_type TEXT,
+			size BIGINT NOT NULL,
+			sha256 TEXT,
+			iv TEXT,
+			hot_sauce TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			action TEXT NOT NULL,
+			actor_id TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS message_edits (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			message_id BIGINT NOT NULL,
+			msg_content TEXT,
+			iv TEXT,
+			hot_sauce TEXT,
+			edited_by TEXT,
+			edited_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS room_bans (
+			room_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			banned_by TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (room_id, user_id)
+		);`,
+		`CREATE TABLE IF NOT EXISTS last_read (
+			user_id TEXT NOT NULL,
+			room_id TEXT NOT NULL,
+			last_message_id BIGINT NOT NULL DEFAULT 0,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (user_id, room_id)
+		);`,
+		`CREATE TABLE IF NOT EXISTS notification_prefs (
+			user_id TEXT NOT NULL,
+			room_id TEXT NOT NULL,
+			pref TEXT NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (user_id, room_id)
+		);`,
+		`CREATE TABLE IF NOT EXISTS refresh_tokens (
+			token_hash TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			revoked BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_room_id_id ON messages(room_id, id);`,
+		`CREATE INDEX IF NOT EXISTS idx_message_edits_message_id ON message_edits(message_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_room_id ON messages(room_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_reply_to ON messages(reply_to);`,
+	}
+
+	for _, q := range queries {
+		qctx, cancel := queryContext(ctx, db.QueryTimeout)
+		_, err := db.Conn.ExecContext(qctx, q)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to create table: %w", err)
+		}
+	}
+
+	// Columns added after the first release. SQLite has no ADD COLUMN IF NOT
+	// EXISTS, so tolerate the duplicate column error on databases that have them.
+	migrations := []string{
+		`ALTER TABLE messages ADD COLUMN deleted_at TIMESTAMP`,
+		`ALTER TABLE rooms ADD COLUMN private BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE rooms ADD COLUMN members TEXT`,
+		`ALTER TABLE rooms ADD COLUMN owner_id TEXT`,
+		`ALTER TABLE rooms ADD COLUMN topic TEXT`,
+		`ALTER TABLE users ADD COLUMN about TEXT`,
+		`ALTER TABLE users ADD COLUMN last_login TIMESTAMP`,
+		`ALTER TABLE users ADD COLUMN last_active TIMESTAMP`,
+		`ALTER TABLE messages ADD COLUMN attachment TEXT`,
+		`ALTER TABLE messages ADD COLUMN seq INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE messages ADD COLUMN time_ms INTEGER NOT NULL DEFAULT 0`,
+	}
+	for _, m := range migrations {
+		qctx, cancel := queryContext(ctx, db.QueryTimeout)
+		_, err := db.Conn.ExecContext(qctx, m)
+		cancel()
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return fmt.Errorf("failed to migrate table: %w", err)
+		}
+	}
+
+	// Needs the attachment column, which older databases only have once
+	// migrated
+	qctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	if _, err := db.Conn.ExecContext(qctx, `CREATE INDEX IF NOT EXISTS idx_messages_attachment_id ON messages(json_extract(attachment, '$.id'))`); err != nil {
+		return fmt.Errorf("failed to create index: %w", err)
+	}
+	return nil
+}
+
+func (db *SQLiteDB) GetMessage(ctx context.Context, roomid, messageid string) (internal.Message, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	query := `SELECT id, room_id, user_id, email, msg_content, time_str, COALESCE(reply_to, ''), COALESCE(iv, ''), COALESCE(hot_sauce, ''), COALESCE(attachment, ''), seq, time_ms
+	          FROM messages WHERE room_id = ?1 AND id = ?2 AND deleted_at IS NULL`
+
+	row := db.Conn.QueryRowContext(ctx, query, roomid, messageid)
+
+	var m internal.Message
+	err := row.Scan(&m.ID, &m.RoomID, &m.UserID, &m.Email, &m.Message, &m.Time, &m.ReplyTo, &m.InitialVector, &m.HotSauce, &m.Attachment, &m.Seq, &m.TimeMs)
+	if err != nil {
+		return internal.Message{}, err
+	}
+	return m, nil
+}
+
+// GetReplies returns the live messages in roomid whose reply_to points at
+// messageID, oldest first.
+func (db *SQLiteDB) GetReplies(ctx context.Context, roomid string, messageID int64) ([]internal.Message, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	query := `SELECT id, room_id, user_id, email, msg_content, time_str, COALESCE(reply_to, ''), COALESCE(iv, ''), COALESCE(hot_sauce, ''), COALESCE(attachment, ''), seq, time_ms
+	          FROM messages WHERE room_id = ?1 AND reply_to = ?2 AND deleted_at IS NULL
+	          ORDER BY id`
+
+	rows, err := db.Conn.QueryContext(ctx, query, roomid, strconv.FormatInt(messageID, 10))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []internal.Message
+	for rows.Next() {
+		var m internal.Message
+		if err := rows.Scan(&m.ID, &m.RoomID, &m.UserID, &m.Email, &m.Message, &m.Time, &m.ReplyTo, &m.InitialVector, &m.HotSauce, &m.Attachment, &m.Seq, &m.TimeMs); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+func (db *SQLiteDB) StoreMessage(ctx context.Context, roomid string, m internal.Message) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	query := `INSERT INTO messages (room_id, user_id, email, msg_content, time_str, reply_to, iv, hot_sauce, attachment, seq, time_ms)
+	          VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11)`
+
+	_, err := db.Conn.ExecContext(ctx, query, roomid, m.UserID, m.Email, m.Message, m.Time, m.ReplyTo, m.InitialVector, m.HotSauce, attachmentArg(m), m.Seq, m.TimeMs)
+	return err
+}
+
+// StoreMessages writes a batch inside one transaction, which is what makes
+// bulk inserts fast on SQLite.
+func (db *SQLiteDB) StoreMessages(ctx context.Context, msgs []internal.Message) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO messages (room_id, user_id, email, msg_content, time_str, reply_to, iv, hot_sauce, attachment, seq, time_ms)
+	                         VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for i, m := range msgs {
+		res, err := stmt.ExecContext(ctx, m.RoomID, m.UserID, m.Email, m.Message, m.Time, m.ReplyTo, m.InitialVector, m.HotSauce, attachmentArg(m), m.Seq, m.TimeMs)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if msgs[i].ID, err = res.LastInsertId(); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) PruneMessages(ctx context.Context, defaultKeep int) (PruneSummary, error) {
+	start := time.Now()
+	qctx, cancel := maintenanceContext(ctx, db.MaintenanceTimeout)
+	defer cancel()
+	rows, err := db.Conn.QueryContext(qctx, `SELECT m.room_id, COALESCE(r.max_messages, ?1)
+	          FROM (SELECT DISTINCT room_id FROM messages) m
+	          LEFT JOIN rooms r ON r.id = m.room_id`, defaultKeep)
+	if err != nil {
+		return PruneSummary{}, err
+	}
+
+	var summary PruneSummary
+	limits := make(map[string]int)
+	for rows.Next() {
+		var r string
+		var keep int
+		if err := rows.Scan(&r, &keep); err != nil {
+			summary.Errors++
+			summary.Failures = append(summary.Failures, fmt.Errorf("reading room limit: %w", err))
+			continue
+		}
+		if keep > 0 {
+			limits[r] = keep
+		}
+	}
+	err = rows.Err()
+	// Release the only connection before issuing the deletes
+	rows.Close()
+	if err != nil {
+		return PruneSummary{}, err
+	}
+
+	// SQLite accepts LIMIT inside the NOT IN subquery, so this matches the
+	// Postgres prune row for row.
+	cond := `room_id = ?1 AND id NOT IN (
+	             SELECT id FROM messages
+	             WHERE room_id = ?1
+	             ORDER BY id DESC
+	             LIMIT ?2
+	         )`
+
+	for room, keep := range limits {
+		summary.Rooms++
+		qctx, cancel := maintenanceContext(ctx, db.MaintenanceTimeout)
+		n, err := db.deleteMessages(qctx, cond, room, keep)
+		cancel()
+		if err != nil {
+			summary.Errors++
+			summary.Failures = append(summary.Failures, fmt.Errorf("room %s: %w", room, err))
+			continue
+		}
+		if n > 0 {
+			summary.RoomsPruned++
+			summary.Deleted += n
+		}
+	}
+	summary.Duration = time.Since(start)
+	return summary, nil
+}
+
+func (db *SQLiteDB) PruneMessagesByAge(ctx context.Context, maxAge time.Duration) (int64, error) {
+	ctx, cancel := maintenanceContext(ctx, db.MaintenanceTimeout)
+	defer cancel()
+	return db.deleteMessages(ctx, `created_at < datetime('now', ?1)`, sqliteOffset(maxAge))
+}
+
+// deleteMessages deletes the messages matching cond, a WHERE clause over
+// messages, together with their edit history in one transaction, so pruned
+// content doesn't live on in message_edits. It returns how many messages
+// were deleted.
+func (db *SQLiteDB) deleteMessages(ctx context.Context, cond string, args ...interface{}) (int64, error) {
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM message_edits WHERE message_id IN (SELECT id FROM messages WHERE `+cond+`)`, args...); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE `+cond, args...)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (db *SQLiteDB) GetUser(ctx context.Context, userid string) (User, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	query := `SELECT id, email, password, name, COALESCE(about, ''), role, created, updated, last_login, last_active, rooms, history, stats, posts FROM users WHERE id = ?1`
+	row := db.Conn.QueryRowContext(ctx, query, userid)
+
+	var u User
+	var roomsJSON, historyJSON, statsJSON, postsJSON []byte
+	var lastLogin, lastActive sql.NullTime
+
+	err := row.Scan(&u.ID, &u.Email, &u.Password, &u.Name, &u.About, &u.Role, &u.Created, &u.Updated, &lastLogin, &lastActive, &roomsJSON, &historyJSON, &statsJSON, &postsJSON)
+	if err != nil {
+		return User{}, err
+	}
+	u.LastLogin, u.LastActive = lastLogin.Time, lastActive.Time
+
+	_ = json.Unmarshal(roomsJSON, &u.Rooms)
+	_ = json.Unmarshal(historyJSON, &u.History)
+	_ = json.Unmarshal(statsJSON, &u.Stats)
+	_ = json.Unmarshal(postsJSON, &u.Posts)
+
+	return u, nil
+}
+
+func (db *SQLiteDB) StoreUser(ctx context.Context, u User) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	roomsJSON, _ := json.Marshal(u.Rooms)
+	historyJSON, _ := json.Marshal(u.History)
+	statsJSON, _ := json.Marshal(u.Stats)
+	postsJSON, _ := json.Marshal(u.Posts)
+
+	query := `INSERT INTO users (id, email, password, name, role, created, updated, rooms, history, stats, posts, about)
+	          VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12)
+	          ON CONFLICT (id) DO UPDATE SET
+	          email = excluded.email,
+	          password = excluded.password,
+	          name = excluded.name,
+	          role = excluded.role,
+	          updated = excluded.updated,
+	          rooms = excluded.rooms,
+	          history = excluded.history,
+	          about = excluded.about;`
+
+	_, err := db.Conn.ExecContext(ctx, query, u.ID, u.Email, u.Password, u.Name, u.Role, u.Created, time.Now(),
+		string(roomsJSON), string(historyJSON), string(statsJSON), string(postsJSON), u.About)
+	return err
+}
+
+func (db *SQLiteDB) GetRoom(ctx context.Context, roomid string) (Room, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	query := `SELECT id, name, max_messages, stats, private, members, COALESCE(owner_id, ''), COALESCE(topic, '') FROM rooms WHERE id = ?1`
+	row := db.Conn.QueryRowContext(ctx, query, roomid)
+
+	var r Room
+	var statsJSON, membersJSON []byte
+
+	err := row.Scan(&r.ID, &r.Name, &r.MaxMessages, &statsJSON, &r.Private, &membersJSON, &r.OwnerID, &r.Topic)
+	if err != nil {
+		return Room{}, err
+	}
+	_ = json.Unmarshal(statsJSON, &r.Stats)
+	_ = json.Unmarshal(membersJSON, &r.Members)
+
+	return r, nil
+}
+
+func (db *SQLiteDB) GetHistory(ctx context.Context, roomid string, beforeID int64, limit int) ([]internal.Message, int64, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	query := `SELECT id, room_id, user_id, email, msg_content, time_str, COALESCE(reply_to, ''), COALESCE(iv, ''), COALESCE(hot_sauce, ''), COALESCE(attachment, ''), seq, time_ms
+	          FROM messages WHERE room_id = ?1 AND deleted_at IS NULL AND (?2 = 0 OR id < ?2)
+	          ORDER BY id DESC LIMIT ?3`
+
+	rows, err := db.Conn.QueryContext(ctx, query, roomid, beforeID, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var msgs []internal.Message
+	var oldest int64
+	for rows.Next() {
+		var m internal.Message
+		if err := rows.Scan(&m.ID, &m.RoomID, &m.UserID, &m.Email, &m.Message, &m.Time, &m.ReplyTo, &m.InitialVector, &m.HotSauce, &m.Attachment, &m.Seq, &m.TimeMs); err != nil {
+			return nil, 0, err
+		}
+		msgs = append([]internal.Message{m}, msgs...)
+		oldest = m.ID
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	if len(msgs) < limit {
+		oldest = 0
+	}
+	return msgs, oldest, nil
+}
+
+// EditMessage replaces a message's content after copying the previous version
+// into message_edits. It returns the updated message for broadcasting.
+func (db *SQLiteDB) EditMessage(ctx context.Context, messageID int64, userID, content, iv, hotSauce string) (internal.Message, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return internal.Message{}, err
+	}
+
+	m := internal.Message{ID: messageID}
+	err = tx.QueryRowContext(ctx, `SELECT room_id, user_id, email, msg_content, time_str, COALESCE(reply_to, ''), COALESCE(iv, ''), COALESCE(hot_sauce, ''), COALESCE(attachment, ''), seq, time_ms
+	                   FROM messages WHERE id = ?1 AND deleted_at IS NULL`, messageID).
+		Scan(&m.RoomID, &m.UserID, &m.Email, &m.Message, &m.Time, &m.ReplyTo, &m.InitialVector, &m.HotSauce, &m.Attachment, &m.Seq, &m.TimeMs)
+	if err != nil {
+		tx.Rollback()
+		return internal.Message{}, err
+	}
+
+	if m.UserID != userID {
+		tx.Rollback()
+		return internal.Message{}, ErrNotAuthor
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO message_edits (message_id, msg_content, iv, hot_sauce, edited_by)
+	                  VALUES (?1, ?2, ?3, ?4, ?5)`, messageID, m.Message, m.InitialVector, m.HotSauce, userID)
+	if err != nil {
+		tx.Rollback()
+		return internal.Message{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE messages SET msg_content = ?1, iv = ?2, hot_sauce = ?3 WHERE id = ?4`,
+		content, iv, hotSauce, messageID)
+	if err != nil {
+		tx.Rollback()
+		return internal.Message{}, err
+	}
+
+	m.Message, m.InitialVector, m.HotSauce = content, iv, hotSauce
+	return m, tx.Commit()
+}
+
+// DeleteMessage tombstones a message by setting deleted_at, leaving the row
+// for audit and pruning. Unless asAdmin is set, userID must be the author.
+func (db *SQLiteDB) DeleteMessage(ctx context.Context, messageID int64, userID string, asAdmin bool) (internal.Message, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return internal.Message{}, err
+	}
+
+	m := internal.Message{ID: messageID}
+	err = tx.QueryRowContext(ctx, `SELECT room_id, user_id, email FROM messages
+	                   WHERE id = ?1 AND deleted_at IS NULL`, messageID).Scan(&m.RoomID, &m.UserID, &m.Email)
+	if err != nil {
+		tx.Rollback()
+		return internal.Message{}, err
+	}
+
+	if !asAdmin && m.UserID != userID {
+		tx.Rollback()
+		return internal.Message{}, ErrNotAuthor
+	}
+
+	if _, err = tx.ExecContext(ctx, `UPDATE messages SET deleted_at = CURRENT_TIMESTAMP WHERE id = ?1`, messageID); err != nil {
+		tx.Rollback()
+		return internal.Message{}, err
+	}
+
+	return m, tx.Commit()
+}
+
+// BanUser records that userID may not join roomID.
+func (db *SQLiteDB) BanUser(ctx context.Context, roomID, userID, bannedBy string) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	_, err := db.Conn.ExecContext(ctx, `INSERT INTO room_bans (room_id, user_id, banned_by) VALUES (?1, ?2, ?3)
+	          ON CONFLICT (room_id, user_id) DO NOTHING`, roomID, userID, bannedBy)
+	return err
+}
+
+func (db *SQLiteDB) UnbanUser(ctx context.Context, roomID, userID string) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	_, err := db.Conn.ExecContext(ctx, `DELETE FROM room_bans WHERE room_id = ?1 AND user_id = ?2`, roomID, userID)
+	return err
+}
+
+func (db *SQLiteDB) IsBanned(ctx context.Context, roomID, userID string) (bool, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	var banned bool
+	err := db.Conn.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM room_bans WHERE room_id = ?1 AND user_id = ?2)`, roomID, userID).Scan(&banned)
+	return banned, err
+}
+
+// MarkRead moves the user's read marker in a room forward to lastMessageID,
+// or to the newest stored message when lastMessageID is 0. Markers never move
+// backwards. It returns the marker now in effect.
+func (db *SQLiteDB) MarkRead(ctx context.Context, userID, roomID string, lastMessageID int64) (int64, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	if lastMessageID == 0 {
+		err := db.Conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM messages WHERE room_id = ?1`, roomID).Scan(&lastMessageID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	query := `INSERT INTO last_read (user_id, room_id, last_message_id, updated_at)
+	          VALUES (?1, ?2, ?3, CURRENT_TIMESTAMP)
+	          ON CONFLICT (user_id, room_id) DO UPDATE SET
+	          last_message_id = MAX(last_read.last_message_id, excluded.last_message_id),
+	          updated_at = excluded.updated_at
+	          RETURNING last_message_id`
+
+	var marker int64
+	err := db.Conn.QueryRowContext(ctx, query, userID, roomID, lastMessageID).Scan(&marker)
+	return marker, err
+}
+
+// UnreadCounts returns, per room, how many live messages are newer than the
+// user's read marker. Each count is a range scan on messages(room_id, id).
+func (db *SQLiteDB) UnreadCounts(ctx context.Context, userID string, roomIDs []string) (map[string]int64, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	query := `SELECT COUNT(*) FROM messages
+	          WHERE room_id = ?1 AND deleted_at IS NULL AND id > COALESCE(
+	              (SELECT last_message_id FROM last_read WHERE user_id = ?2 AND room_id = ?1), 0)`
+
+	counts := make(map[string]int64, len(roomIDs))
+	for _, roomID := range roomIDs {
+		var n int64
+		if err := db.Conn.QueryRowContext(ctx, query, roomID, userID).Scan(&n); err != nil {
+			return nil, err
+		}
+		counts[roomID] = n
+	}
+	return counts, nil
+}
+
+// NotificationPrefs returns the user's non-default notification preferences
+// by room.
+func (db *SQLiteDB) NotificationPrefs(ctx context.Context, userID string) (map[string]string, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	rows, err := db.Conn.QueryContext(ctx, `SELECT room_id, pref FROM notification_prefs WHERE user_id = ?1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prefs := make(map[string]string)
+	for rows.Next() {
+		var room, pref string
+		if err := rows.Scan(&room, &pref); err != nil {
+			return nil, err
+		}
+		prefs[room] = pref
+	}
+	return prefs, rows.Err()
+}
+
+func (db *SQLiteDB) SetNotificationPref(ctx context.Context, userID, roomID, pref string) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	if pref == NotifyAll {
+		_, err := db.Conn.ExecContext(ctx, `DELETE FROM notification_prefs WHERE user_id = ?1 AND room_id = ?2`, userID, roomID)
+		return err
+	}
+	_, err := db.Conn.ExecContext(ctx, `INSERT INTO notification_prefs (user_id, room_id, pref, updated_at)
+	          VALUES (?1, ?2, ?3, CURRENT_TIMESTAMP)
+	          ON CONFLICT (user_id, room_id) DO UPDATE SET pref = excluded.pref, updated_at = excluded.updated_at`,
+		userID, roomID, pref)
+	return err
+}
+
+func (db *SQLiteDB) StoreRefreshToken(ctx context.Context, tokenHash, userID string, expiresAt time.Time) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	_, err := db.Conn.ExecContext(ctx, `INSERT INTO refresh_tokens (token_hash, user_id, expires_at) VALUES (?1, ?2, ?3)`,
+		tokenHash, userID, expiresAt)
+	return err
+}
+
+// ConsumeRefreshToken checks expiry in Go: expires_at is stored as text,
+// which doesn't compare reliably against another timestamp in SQL. An
+// expired token revoked along the way was unusable anyway.
+func (db *SQLiteDB) ConsumeRefreshToken(ctx context.Context, tokenHash string) (string, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	var userID string
+	var expiresAt time.Time
+	err := db.Conn.QueryRowContext(ctx, `UPDATE refresh_tokens SET revoked = TRUE
+	          WHERE token_hash = ?1 AND NOT revoked
+	          RETURNING user_id, expires_at`, tokenHash).Scan(&userID, &expiresAt)
+	if err != nil {
+		return "", err
+	}
+	if !time.Now().Before(expiresAt) {
+		return "", sql.ErrNoRows
+	}
+	return userID, nil
+}
+
+func (db *SQLiteDB) RevokeRefreshToken(ctx context.Context, tokenHash string) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	_, err := db.Conn.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = TRUE WHERE token_hash = ?1`, tokenHash)
+	return err
+}
+
+func (db *SQLiteDB) RevokeUserRefreshTokens(ctx context.Context, userID string) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	_, err := db.Conn.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = TRUE WHERE user_id = ?1 AND NOT revoked`, userID)
+	return err
+}
+
+func (db *SQLiteDB) LastSeq(ctx context.Context, roomid string) (int64, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	var seq int64
+	err := db.Conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) FROM messages WHERE room_id = ?1`, roomid).Scan(&seq)
+	return seq, err
+}
+
+// MessageCounts returns the number of live messages in each room.
+func (db *SQLiteDB) MessageCounts(ctx context.Context) (map[string]int64, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	rows, err := db.Conn.QueryContext(ctx, `SELECT room_id, COUNT(*) FROM messages WHERE deleted_at IS NULL GROUP BY room_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var room string
+		var n int64
+		if err := rows.Scan(&room, &n); err != nil {
+			return nil, err
+		}
+		counts[room] = n
+	}
+	return counts, rows.Err()
+}
+
+func (db *SQLiteDB) SetRole(ctx context.Context, userID, role string) (string, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	// The single connection runs one transaction at a time, so the admin
+	// count can't change before this one commits
+	var previous string
+	if err := tx.QueryRowContext(ctx, `SELECT role FROM users WHERE id = ?1`, userID).Scan(&previous); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	if previous == "admin" && role != "admin" {
+		var admins int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE role = 'admin'`).Scan(&admins); err != nil {
+			tx.Rollback()
+			return "", err
+		}
+		if admins <= 1 {
+			tx.Rollback()
+			return "", ErrLastAdmin
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET role = ?1, updated = ?2 WHERE id = ?3`, role, time.Now(), userID); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	return previous, tx.Commit()
+}
+
+func (db *SQLiteDB) SetLastLogin(ctx context.Context, userID string, at time.Time) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	_, err := db.Conn.ExecContext(ctx, `UPDATE users SET last_login = ?1 WHERE id = ?2`, at, userID)
+	return err
+}
+
+func (db *SQLiteDB) SetLastActive(ctx context.Context, userID string, at time.Time) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	_, err := db.Conn.ExecContext(ctx, `UPDATE users SET last_active = ?1 WHERE id = ?2`, at, userID)
+	return err
+}
+
+// ListUsers returns every user's account details, oldest account first.
+// Passwords, rooms and stats are left empty.
+func (db *SQLiteDB) ListUsers(ctx context.Context) ([]User, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	rows, err := db.Conn.QueryContext(ctx, `SELECT id, email, COALESCE(name, ''), COALESCE(role, ''), created, last_login, last_active FROM users ORDER BY created, email`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		var lastLogin, lastActive sql.NullTime
+		if err := rows.Scan(&u.ID, &u.Email, &u.Name, &u.Role, &u.Created, &lastLogin, &lastActive); err != nil {
+			return nil, err
+		}
+		u.LastLogin, u.LastActive = lastLogin.Time, lastActive.Time
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// SearchMessages matches query as a case-insensitive substring of the
+// plaintext messages in roomIDs, newest first. SQLite has no Postgres-style
+// full-text search without an extension, so this is a LIKE scan.
+func (db *SQLiteDB) SearchMessages(ctx context.Context, roomIDs []string, query string, limit int) ([]internal.Message, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	if len(roomIDs) == 0 {
+		return nil, nil
+	}
+	placeholders := make([]string, len(roomIDs))
+	args := []any{"%" + likeEscaper.Replace(query) + "%", limit}
+	for i, id := range roomIDs {
+		placeholders[i] = fmt.Sprintf("?%d", i+3)
+		args = append(args, id)
+	}
+
+	rows, err := db.Conn.QueryContext(ctx, `SELECT id, room_id, user_id, email, msg_content, time_str, COALESCE(reply_to, ''), COALESCE(iv, ''), COALESCE(hot_sauce, ''), COALESCE(attachment, ''), seq, time_ms
+	          FROM messages
+	          WHERE room_id IN (`+strings.Join(placeholders, ", ")+`) AND deleted_at IS NULL
+	            AND COALESCE(hot_sauce, '') = '' AND msg_content LIKE ?1 ESCAPE '\'
+	          ORDER BY id DESC LIMIT ?2`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []internal.Message
+	for rows.Next() {
+		var m internal.Message
+		if err := rows.Scan(&m.ID, &m.RoomID, &m.UserID, &m.Email, &m.Message, &m.Time, &m.ReplyTo, &m.InitialVector, &m.HotSauce, &m.Attachment, &m.Seq, &m.TimeMs); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+// likeEscaper escapes LIKE wildcards so a search matches them literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (db *SQLiteDB) StoreRoom(ctx context.Context, r Room) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	return db.storeRoom(ctx, db.Conn, r)
+}
+
+func (db *SQLiteDB) storeRoom(ctx context.Context, ex execer, r Room) error {
+	statsJSON, _ := json.Marshal(r.Stats)
+	membersJSON, _ := json.Marshal(r.Members)
+
+	query := `INSERT INTO rooms (id, name, max_messages, stats, private, members, owner_id, topic)
+	          VALUES (?1, ?2, ?3, ?4, ?5, ?6, NULLIF(?7, ''), NULLIF(?8, ''))
+	          ON CONFLICT (id) DO UPDATE SET
+	          name = excluded.name,
+	          max_messages = excluded.max_messages,
+	          stats = excluded.stats,
+	          private = excluded.private,
+	          members = excluded.members,
+	          owner_id = excluded.owner_id,
+	          topic = excluded.topic;`
+
+	_, err := ex.ExecContext(ctx, query, r.ID, r.Name, r.MaxMessages, string(statsJSON), r.Private, string(membersJSON), r.OwnerID, r.Topic)
+	return err
+}
+
+// RecordJoin stores newRoom, when it is not nil, and records roomName in the
+// saved rooms and history of the user with the given email, all in one
+// transaction. Either both changes land or neither does.
+func (db *SQLiteDB) RecordJoin(ctx context.Context, newRoom *Room, email, roomName string) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if newRoom != nil {
+		if err = db.storeRoom(ctx, tx, *newRoom); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	var u User
+	var roomsJSON, historyJSON []byte
+	err = tx.QueryRowContext(ctx, `SELECT id, rooms, history FROM users WHERE email = ?1`, email).
+		Scan(&u.ID, &roomsJSON, &historyJSON)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_ = json.Unmarshal(roomsJSON, &u.Rooms)
+	_ = json.Unmarshal(historyJSON, &u.History)
+
+	u.RecordJoin(roomName)
+	roomsJSON, _ = json.Marshal(u.Rooms)
+	historyJSON, _ = json.Marshal(u.History)
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET rooms = ?1, history = ?2, updated = ?3 WHERE id = ?4`,
+		string(roomsJSON), string(historyJSON), time.Now(), u.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) GetUserByEmail(ctx context.Context, email string) (User, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	query := `SELECT id FROM users WHERE email = ?1`
+	row := db.Conn.QueryRowContext(ctx, query, email)
+
+	var id string
+	if err := row.Scan(&id); err != nil {
+		return User{}, err
+	}
+
+	return db.GetUser(ctx, id)
+}
+
+func (db *SQLiteDB) ReapStaleRooms(ctx context.Context, threshold time.Duration) ([]string, []string, error) {
+	ctx, cancel := maintenanceContext(ctx, db.MaintenanceTimeout)
+	defer cancel()
+	offset := sqliteOffset(threshold)
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rooms, err := queryIDs(ctx, tx, `
+		SELECT id FROM rooms
+		WHERE created_at < datetime('now', ?1)
+		AND id NOT IN (
+			SELECT DISTINCT room_id FROM messages
+			WHERE created_at > datetime('now', ?1)
+		)`, offset)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	var files []string
+	for _, room := range rooms {
+		_, f, err := db.deleteRoom(ctx, tx, room)
+		if err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+		files = append(files, f...)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return rooms, files, nil
+}
+
+func (db *SQLiteDB) PurgeUser(ctx context.Context, userid, actorID string, deleteMessages bool) (int64, []string, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var role string
+	if err := tx.QueryRowContext(ctx, `SELECT role FROM users WHERE id = ?1`, userid).Scan(&role); err != nil {
+		tx.Rollback()
+		return 0, nil, err
+	}
+
+	// The single connection runs one transaction at a time, so the admin
+	// count can't change before this one commits
+	if role == "admin" {
+		var admins int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE role = 'admin'`).Scan(&admins); err != nil {
+			tx.Rollback()
+			return 0, nil, err
+		}
+		if admins <= 1 {
+			tx.Rollback()
+			return 0, nil, ErrLastAdmin
+		}
+	}
+
+	// Earlier versions of the user's messages, and any edits they made
+	if _, err = tx.ExecContext(ctx, `DELETE FROM message_edits WHERE edited_by = ?1
+	          OR message_id IN (SELECT id FROM messages WHERE user_id = ?1)`, userid); err != nil {
+		tx.Rollback()
+		return 0, nil, err
+	}
+
+	var res sql.Result
+	var files []string
+	if deleteMessages {
+		res, err = tx.ExecContext(ctx, `DELETE FROM messages WHERE user_id = ?1`, userid)
+		if err == nil {
+			files, err = queryIDs(ctx, tx, `DELETE FROM attachments WHERE user_id = ?1 RETURNING id`, userid)
+		}
+	} else {
+		res, err = tx.ExecContext(ctx, `UPDATE messages SET user_id = 'deleted', email = 'deleted-user' WHERE user_id = ?1`, userid)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, `UPDATE attachments SET user_id = 'deleted' WHERE user_id = ?1`, userid)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, nil, err
+	}
+	affected, _ := res.RowsAffected()
+
+	// Bans the user placed stay in force without naming them
+	for _, q := range []string{
+		`DELETE FROM room_bans WHERE user_id = ?1`,
+		`UPDATE room_bans SET banned_by = NULL WHERE banned_by = ?1`,
+		`DELETE FROM last_read WHERE user_id = ?1`,
+		`DELETE FROM notification_prefs WHERE user_id = ?1`,
+		`DELETE FROM refresh_tokens WHERE user_id = ?1`,
+		`DELETE FROM users WHERE id = ?1`,
+	} {
+		if _, err = tx.ExecContext(ctx, q, userid); err != nil {
+			tx.Rollback()
+			return 0, nil, err
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, `INSERT INTO audit_log (action, actor_id) VALUES ('purge_user', ?1)`, actorID); err != nil {
+		tx.Rollback()
+		return 0, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return affected, files, nil
+}
+
+// DeleteRoom mirrors the Postgres version, but rewrites the users' rooms and
+// history arrays in Go since SQLite has no JSONB operators.
+func (db *SQLiteDB) DeleteRoom(ctx context.Context, roomid string) (int64, []string, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	deleted, files, err := db.deleteRoom(ctx, tx, roomid)
+	if err != nil {
+		tx.Rollback()
+		return 0, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return deleted, files, nil
+}
+
+// deleteRoom does DeleteRoom's work within tx; the caller commits or rolls
+// back.
+func (db *SQLiteDB) deleteRoom(ctx context.Context, tx *sql.Tx, roomid string) (int64, []string, error) {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM message_edits
+	          WHERE message_id IN (SELECT id FROM messages WHERE room_id = ?1)`, roomid); err != nil {
+		return 0, nil, err
+	}
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE room_id = ?1`, roomid)
+	if err != nil {
+		return 0, nil, err
+	}
+	deleted, _ := res.RowsAffected()
+
+	files, err := queryIDs(ctx, tx, `DELETE FROM attachments WHERE room_id = ?1 RETURNING id`, roomid)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for _, q := range []string{
+		`DELETE FROM room_bans WHERE room_id = ?1`,
+		`DELETE FROM last_read WHERE room_id = ?1`,
+		`DELETE FROM notification_prefs WHERE room_id = ?1`,
+		`DELETE FROM rooms WHERE id = ?1`,
+	} {
+		if _, err = tx.ExecContext(ctx, q, roomid); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT id, rooms, history FROM users`)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	type userRooms struct {
+		id             string
+		rooms, history []string
+	}
+	var changed []userRooms
+	for rows.Next() {
+		var id string
+		var roomsJSON, historyJSON []byte
+		if err := rows.Scan(&id, &roomsJSON, &historyJSON); err != nil {
+			continue
+		}
+		var u userRooms
+		u.id = id
+		_ = json.Unmarshal(roomsJSON, &u.rooms)
+		_ = json.Unmarshal(historyJSON, &u.history)
+
+		rooms, r := withoutRoom(u.rooms, roomid)
+		history, h := withoutRoom(u.history, roomid)
+		if r || h {
+			u.rooms, u.history = rooms, history
+			changed = append(changed, u)
+		}
+	}
+	rows.Close()
+
+	for _, u := range changed {
+		roomsJSON, _ := json.Marshal(u.rooms)
+		historyJSON, _ := json.Marshal(u.history)
+		if _, err = tx.ExecContext(ctx, `UPDATE users SET rooms = ?1, history = ?2 WHERE id = ?3`, string(roomsJSON), string(historyJSON), u.id); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return deleted, files, nil
+}
+
+func (db *SQLiteDB) AddUserPosts(ctx context.Context, counts map[string]int64, at time.Time) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for userID, n := range counts {
+		var statsJSON []byte
+		err := tx.QueryRowContext(ctx, `SELECT stats FROM users WHERE id = ?1`, userID).Scan(&statsJSON)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		stats := make(internal.AppStats)
+		_ = json.Unmarshal(statsJSON, &stats)
+		if stats == nil {
+			stats = make(internal.AppStats)
+		}
+		stats.Record(StatPosts, at, float64(n), statBucket, maxStatSamples)
+		statsJSON, _ = json.Marshal(stats)
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET stats = ?1 WHERE id = ?2`, string(statsJSON), userID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) RoomLeaderboard(ctx context.Context, roomID string, window time.Duration, limit int) ([]LeaderboardEntry, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	rows, err := db.Conn.QueryContext(ctx, `SELECT user_id, COALESCE(MAX(email), ''), COUNT(*) AS posts FROM messages
+	          WHERE room_id = ?1 AND created_at >= datetime('now', ?2) AND deleted_at IS NULL AND user_id IS NOT NULL
+	          GROUP BY user_id ORDER BY posts DESC, user_id LIMIT ?3`, roomID, sqliteOffset(window), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var board []LeaderboardEntry
+	for rows.Next() {
+		var e LeaderboardEntry
+		if err := rows.Scan(&e.UserID, &e.Email, &e.Posts); err != nil {
+			return nil, err
+		}
+		board = append(board, e)
+	}
+	return board, rows.Err()
+}
+
+func (db *SQLiteDB) StoreAttachment(ctx context.Context, a internal.Attachment) error {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	_, err := db.Conn.ExecContext(ctx, `INSERT INTO attachments (id, room_id, user_id, file_name, content_type, size, sha256, iv, hot_sauce)
+	          VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9)`,
+		a.ID, a.RoomID, a.UserID, a.FileName, a.ContentType, a.Size, a.SHA256, a.IV, a.HotSauce)
+	return err
+}
+
+func (db *SQLiteDB) GetAttachment(ctx context.Context, id string) (internal.Attachment, error) {
+	ctx, cancel := queryContext(ctx, db.QueryTimeout)
+	defer cancel()
+	a := internal.Attachment{ID: id}
+	err := db.Conn.QueryRowContext(ctx, `SELECT room_id, user_id, COALESCE(file_name, ''), COALESCE(content_type, ''), size,
+	          COALESCE(sha256, ''), COALESCE(iv, ''), COALESCE(hot_sauce, ''), created_at FROM attachments WHERE id = ?1`, id).
+		Scan(&a.RoomID, &a.UserID, &a.FileName, &a.ContentType, &a.Size, &a.SHA256, &a.IV, &a.HotSauce, &a.Created)
+	return a, err
+}
+
+func (db *SQLiteDB) ReapAttachments(ctx context.Context, grace time.Duration) ([]string, error) {
+	ctx, cancel := maintenanceContext(ctx, db.MaintenanceTimeout)
+	defer cancel()
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := queryIDs(ctx, tx, `DELETE FROM attachments
+	          WHERE created_at < datetime('now', ?1)
+	          AND NOT EXISTS (
+	              SELECT 1 FROM messages m
+	              WHERE json_extract(m.attachment, '$.id') = attachments.id AND m.deleted_at IS NULL
+	          )
+	          RETURNING id`, sqliteOffset(grace))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return ids, tx.Commit()
+}
+
+// withoutRoom returns rooms minus roomid and whether anything was removed.
+func withoutRoom(rooms []string, roomid string) ([]string, bool) {
+	out := make([]string, 0, len(rooms))
+	for _, r := range rooms {
+		if r != roomid {
+			out = append(out, r)
+		}
+	}
+	return out, len(out) != len(rooms)
+}
+
+// sqliteOffset formats d as a datetime() modifier reaching back in time.
+func sqliteOffset(d time.Duration) string {
+	return fmt.Sprintf("-%d seconds", int64(d.Seconds()))
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rexlx/squall/internal"
+)
+
+// newTestDB opens a fresh SQLite database with every table created.
+func newTestDB(t testing.TB) *SQLiteDB {
+	t.Helper()
+	db, err := NewSQLiteDB(filepath.Join(t.TempDir(), "squall.db"))
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	t.Cleanup(func() { db.Conn.Close() })
+	if err := db.CreateTables(context.Background()); err != nil {
+		t.Fatalf("create tables: %v", err)
+	}
+	return db
+}
+
+func TestConsumeRefreshToken(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	if err := db.StoreRefreshToken(ctx, "live", "u1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.StoreRefreshToken(ctx, "expired", "u1", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	userID, err := db.ConsumeRefreshToken(ctx, "live")
+	if err != nil || userID != "u1" {
+		t.Fatalf("first use = %q, %v; want u1", userID, err)
+	}
+	if _, err := db.ConsumeRefreshToken(ctx, "live"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("second use err = %v, want sql.ErrNoRows", err)
+	}
+	if _, err := db.ConsumeRefreshToken(ctx, "expired"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expired err = %v, want sql.ErrNoRows", err)
+	}
+	if _, err := db.ConsumeRefreshToken(ctx, "unknown"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("unknown err = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestRevokeUserRefreshTokens(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	exp := time.Now().Add(time.Hour)
+	for _, tok := range []struct{ hash, user string }{{"a", "u1"}, {"b", "u1"}, {"c", "u2"}} {
+		if err := db.StoreRefreshToken(ctx, tok.hash, tok.user, exp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.RevokeUserRefreshTokens(ctx, "u1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hash := range []string{"a", "b"} {
+		if _, err := db.ConsumeRefreshToken(ctx, hash); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("token %s err = %v, want revoked", hash, err)
+		}
+	}
+	if _, err := db.ConsumeRefreshToken(ctx, "c"); err != nil {
+		t.Errorf("other user's token: %v", err)
+	}
+}
+
+// countRows returns the COUNT(*) of query.
+func countRows(t *testing.T, db *SQLiteDB, query string, args ...interface{}) int {
+	t.Helper()
+	var n int
+	if err := db.Conn.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+// seedUser stores a user who has posted, edited, uploaded, read and been
+// banned in roomID, and returns their message's ID.
+func seedUser(t *testing.T, db *SQLiteDB, id, roomID string) int64 {
+	t.Helper()
+	ctx := context.Background()
+	if err := db.StoreUser(ctx, User{ID: id, Email: id + "@example.com", Role: "user", Rooms: []string{roomID}, Created: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.StoreAttachment(ctx, internal.Attachment{ID: "file-" + id, RoomID: roomID, UserID: id, FileName: "a.txt", Size: 1}); err != nil {
+		t.Fatal(err)
+	}
+	msg := internal.Message{RoomID: roomID, UserID: id, Email: id + "@example.com", Message: "first", Seq: 1,
+		Attachment: `{"id":"file-` + id + `"}`}
+	if err := db.StoreMessages(ctx, []internal.Message{msg}); err != nil {
+		t.Fatal(err)
+	}
+	var msgID int64
+	if err := db.Conn.QueryRow(`SELECT id FROM messages WHERE user_id = ?1`, id).Scan(&msgID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.EditMessage(ctx, msgID, id, "second", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.MarkRead(ctx, id, roomID, msgID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetNotificationPref(ctx, id, roomID, NotifyMuted); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.StoreRefreshToken(ctx, "token-"+id, id, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	return msgID
+}
+
+func TestPurgeUserRemovesPersonalData(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	if err := db.StoreRoom(ctx, Room{ID: "lobby", Name: "lobby", MaxMessages: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.StoreUser(ctx, User{ID: "admin", Email: "admin@example.com", Role: "admin", Created: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	seedUser(t, db, "gone", "lobby")
+	keptMsg := seedUser(t, db, "kept", "lobby")
+	if err := db.BanUser(ctx, "lobby", "kept", "gone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.BanUser(ctx, "lobby", "gone", "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	affected, files, err := db.PurgeUser(ctx, "gone", "admin", true)
+	if err != nil {
+		t.Fatalf("PurgeUser: %v", err)
+	}
+	if affected != 1 {
+		t.Errorf("affected = %d, want 1", affected)
+	}
+	if len(files) != 1 || files[0] != "file-gone" {
+		t.Errorf("files = %v, want [file-gone]", files)
+	}
+
+	for _, q := range []string{
+		`SELECT COUNT(*) FROM users WHERE id = ?1`,
+		`SELECT COUNT(*) FROM messages WHERE user_id = ?1`,
+		`SELECT COUNT(*) FROM message_edits WHERE edited_by = ?1`,
+		`SELECT COUNT(*) FROM attachments WHERE user_id = ?1`,
+		`SELECT COUNT(*) FROM room_bans WHERE user_id = ?1 OR banned_by = ?1`,
+		`SELECT COUNT(*) FROM last_read WHERE user_id = ?1`,
+		`SELECT COUNT(*) FROM notification_prefs WHERE user_id = ?1`,
+		`SELECT COUNT(*) FROM refresh_tokens WHERE user_id = ?1`,
+	} {
+		if n := countRows(t, db, q, "gone"); n != 0 {
+			t.Errorf("%s: %d rows left", q, n)
+		}
+	}
+	if n := countRows(t, db, `SELECT COUNT(*) FROM message_edits`); n != 1 {
+		t.Errorf("message_edits has %d rows, want only the other user's", n)
+	}
+
+	// The room and everyone else in it are untouched
+	if _, err := db.GetRoom(ctx, "lobby"); err != nil {
+		t.Errorf("room gone: %v", err)
+	}
+	if _, err := db.GetMessage(ctx, "lobby", strconv.FormatInt(keptMsg, 10)); err != nil {
+		t.Errorf("other user's message gone: %v", err)
+	}
+	if banned, err := db.IsBanned(ctx, "lobby", "kept"); err != nil || !banned {
+		t.Errorf("ban placed by the purged user lifted: %v, %v", banned, err)
+	}
+	if _, err := db.GetAttachment(ctx, "file-kept"); err != nil {
+		t.Errorf("other user's attachment gone: %v", err)
+	}
+	if _, err := db.ConsumeRefreshToken(ctx, "token-kept"); err != nil {
+		t.Errorf("other user's refresh token gone: %v", err)
+	}
+}
+
+func TestDeleteRoomRemovesRoomData(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	for _, id := range []string{"doomed", "other"} {
+		if err := db.StoreRoom(ctx, Room{ID: id, Name: id, MaxMessages: 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seedUser(t, db, "u1", "doomed")
+	seedUser(t, db, "u2", "other")
+	if err := db.BanUser(ctx, "doomed", "u2", "u1"); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, files, err := db.DeleteRoom(ctx, "doomed")
+	if err != nil {
+		t.Fatalf("DeleteRoom: %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("deleted = %d, want 1", deleted)
+	}
+	if len(files) != 1 || files[0] != "file-u1" {
+		t.Errorf("files = %v, want [file-u1]", files)
+	}
+
+	for _, q := range []string{
+		`SELECT COUNT(*) FROM rooms WHERE id = ?1`,
+		`SELECT COUNT(*) FROM messages WHERE room_id = ?1`,
+		`SELECT COUNT(*) FROM attachments WHERE room_id = ?1`,
+		`SELECT COUNT(*) FROM room_bans WHERE room_id = ?1`,
+		`SELECT COUNT(*) FROM last_read WHERE room_id = ?1`,
+		`SELECT COUNT(*) FROM notification_prefs WHERE room_id = ?1`,
+	} {
+		if n := countRows(t, db, q, "doomed"); n != 0 {
+			t.Errorf("%s: %d rows left", q, n)
+		}
+	}
+	if n := countRows(t, db, `SELECT COUNT(*) FROM message_edits`); n != 1 {
+		t.Errorf("message_edits has %d rows, want only the other room's", n)
+	}
+	if u, err := db.GetUser(ctx, "u1"); err != nil || len(u.Rooms) != 0 {
+		t.Errorf("u1 rooms = %v, %v; want none", u.Rooms, err)
+	}
+	if n := countRows(t, db, `SELECT COUNT(*) FROM notification_prefs WHERE room_id = ?1`, "other"); n != 1 {
+		t.Errorf("other room lost its notification prefs")
+	}
+}
+
+func TestReapAttachments(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	for _, id := range []string{"posted", "deleted", "stale", "fresh"} {
+		if err := db.StoreAttachment(ctx, internal.Attachment{ID: id, RoomID: "lobby", UserID: "u1", Size: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Conn.Exec(`UPDATE attachments SET created_at = datetime('now', '-2 days') WHERE id != 'fresh'`); err != nil {
+		t.Fatal(err)
+	}
+	msgs := []internal.Message{
+		{RoomID: "lobby", UserID: "u1", Seq: 1, Attachment: `{"id":"posted"}`},
+		{RoomID: "lobby", UserID: "u1", Seq: 2, Attachment: `{"id":"deleted"}`},
+	}
+	if err := db.StoreMessages(ctx, msgs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DeleteMessage(ctx, msgs[1].ID, "u1", false); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := db.ReapAttachments(ctx, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("ReapAttachments: %v", err)
+	}
+	slices.Sort(ids)
+	if want := []string{"deleted", "stale"}; !slices.Equal(ids, want) {
+		t.Errorf("reaped %v, want %v", ids, want)
+	}
+	for _, id := range []string{"posted", "fresh"} {
+		if _, err := db.GetAttachment(ctx, id); err != nil {
+			t.Errorf("attachment %s: %v", id, err)
+		}
+	}
+}
+
+func TestPruneMessagesByAge(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	// Each message's age in days, set on created_at after storing
+	ages := []int{0, 3, 6, 8, 30}
+	for i, days := range ages {
+		msg := internal.Message{RoomID: "quiet", UserID: "u1", Message: strconv.Itoa(days), Seq: int64(i + 1)}
+		if err := db.StoreMessages(ctx, []internal.Message{msg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Conn.Exec(`UPDATE messages SET created_at = datetime('now', ?1) WHERE seq = ?2`,
+			fmt.Sprintf("-%d days", days), i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleted, err := db.PruneMessagesByAge(ctx, 7*24*time.Hour)
+	if err != nil {
+		t.Fatalf("PruneMessagesByAge: %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("PruneMessagesByAge deleted %d messages, want 2", deleted)
+	}
+
+	rows, err := db.Conn.Query(`SELECT msg_content FROM messages ORDER BY seq`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var kept []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		kept = append(kept, s)
+	}
+	if want := []string{"0", "3", "6"}; !slices.Equal(kept, want) {
+		t.Errorf("kept messages aged %v days, want %v", kept, want)
+	}
+}
+
+func TestPruneMessagesPerRoomLimit(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	for _, r := range []Room{
+		{ID: "small", Name: "small", MaxMessages: 2},
+		{ID: "big", Name: "big", MaxMessages: 5},
+		{ID: "forever", Name: "forever", MaxMessages: 0},
+	} {
+		if err := db.StoreRoom(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "orphan" has no rooms row, so it falls back to the default limit
+	const perRoom, defaultKeep = 6, 3
+	for _, room := range []string{"small", "big", "forever", "orphan"} {
+		var msgs []internal.Message
+		for i := range perRoom {
+			msgs = append(msgs, internal.Message{RoomID: room, UserID: "u1", Message: "m", Seq: int64(i + 1)})
+		}
+		if err := db.StoreMessages(ctx, msgs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	summary, err := db.PruneMessages(ctx, defaultKeep)
+	if err != nil {
+		t.Fatalf("PruneMessages: %v", err)
+	}
+	if summary.Errors != 0 {
+		t.Fatalf("prune failures: %v", summary.Failures)
+	}
+	if summary.Deleted != 4+1+3 {
+		t.Errorf("deleted %d messages, want 8", summary.Deleted)
+	}
+
+	for room, keep := range map[string]int{"small": 2, "big": 5, "forever": perRoom, "orphan": defaultKeep} {
+		if got := countRows(t, db, `SELECT COUNT(*) FROM messages WHERE room_id = ?1`, room); got != keep {
+			t.Errorf("room %s kept %d messages, want %d", room, got, keep)
+		}
+		// The newest messages are the ones kept
+		if got := countRows(t, db, `SELECT MIN(seq) FROM messages WHERE room_id = ?1`, room); got != perRoom-keep+1 {
+			t.Errorf("room %s kept from seq %d, want %d", room, got, perRoom-keep+1)
+		}
+	}
+}
+
+func TestRecordJoinRollsBackNewRoom(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	// The user update fails after the room insert, so neither may stick
+	room := Room{ID: "fresh", Name: "fresh", MaxMessages: DefaultRoomMaxMessages}
+	if err := db.RecordJoin(ctx, &room, "nobody@example.com", room.ID); err == nil {
+		t.Fatal("RecordJoin succeeded for an unknown user")
+	}
+	if _, err := db.GetRoom(ctx, room.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("room left behind by a failed join: %v", err)
+	}
+
+	if err := db.StoreUser(ctx, User{ID: "u1", Email: "u1@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RecordJoin(ctx, &room, "u1@example.com", room.ID); err != nil {
+		t.Fatalf("RecordJoin: %v", err)
+	}
+	if _, err := db.GetRoom(ctx, room.ID); err != nil {
+		t.Errorf("room missing after a successful join: %v", err)
+	}
+	u, err := db.GetUser(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(u.Rooms, room.ID) {
+		t.Errorf("user rooms %v, want %s", u.Rooms, room.ID)
+	}
+}
+
+// BenchmarkStoreMessages compares storing a batch of messages in one
+// StoreMessages call with storing them one StoreMessage call at a time.
+func BenchmarkStoreMessages(b *testing.B) {
+	const batch = 100
+	ctx := context.Background()
+	msg := func(seq int64) internal.Message {
+		return internal.Message{RoomID: "lobby", UserID: "u1", Email: "u1@example.com", Message: "hello", Seq: seq}
+	}
+
+	b.Run("single", func(b *testing.B) {
+		db := newTestDB(b)
+		var seq int64
+		for b.Loop() {
+			for range batch {
+				seq++
+				if err := db.StoreMessage(ctx, "lobby", msg(seq)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*batch), "ns/msg")
+	})
+
+	b.Run("batch", func(b *testing.B) {
+		db := newTestDB(b)
+		var seq int64
+		msgs := make([]internal.Message, batch)
+		for b.Loop() {
+			for i := range msgs {
+				seq++
+				msgs[i] = msg(seq)
+			}
+			if err := db.StoreMessages(ctx, msgs); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*batch), "ns/msg")
+	})
+}
+
+func TestSetRoleKeepsLastAdmin(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	for _, u := range []User{
+		{ID: "a1", Email: "a1@example.com", Role: "admin", Password: "hash-a1"},
+		{ID: "a2", Email: "a2@example.com", Role: "admin", Password: "hash-a2"},
+	} {
+		if err := db.StoreUser(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previous, err := db.SetRole(ctx, "a1", "user")
+	if err != nil || previous != "admin" {
+		t.Fatalf("demoting a1: previous %q, %v", previous, err)
+	}
+	if _, err := db.SetRole(ctx, "a2", "user"); !errors.Is(err, ErrLastAdmin) {
+		t.Errorf("demoting the last admin: %v, want ErrLastAdmin", err)
+	}
+
+	// Only the role column is written
+	u, err := db.GetUser(ctx, "a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Role != "user" || u.Password != "hash-a1" || u.Email != "a1@example.com" {
+		t.Errorf("a1 after demotion: role %q password %q email %q", u.Role, u.Password, u.Email)
+	}
+	if got := countRows(t, db, `SELECT COUNT(*) FROM users WHERE role = 'admin'`); got != 1 {
+		t.Errorf("%d admins left, want 1", got)
+	}
+}
+
+func TestPruneRemovesEditHistory(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	if err := db.StoreRoom(ctx, Room{ID: "lobby", Name: "lobby", MaxMessages: 2}); err != nil {
+		t.Fatal(err)
+	}
+	var msgs []internal.Message
+	for i := range 5 {
+		msgs = append(msgs, internal.Message{RoomID: "lobby", UserID: "u1", Message: "v1", Seq: int64(i + 1)})
+	}
+	if err := db.StoreMessages(ctx, msgs); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range msgs {
+		if _, err := db.EditMessage(ctx, m.ID, "u1", "v2", "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The oldest message also ages out under the age prune
+	if _, err := db.Conn.Exec(`UPDATE messages SET created_at = datetime('now', '-30 days') WHERE id = ?1`, msgs[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.PruneMessagesByAge(ctx, 7*24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PruneMessages(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := countRows(t, db, `SELECT COUNT(*) FROM messages`); got != 2 {
+		t.Fatalf("%d messages kept, want 2", got)
+	}
+	if got := countRows(t, db, `SELECT COUNT(*) FROM message_edits WHERE message_id NOT IN (SELECT id FROM messages)`); got != 0 {
+		t.Errorf("%d edits of pruned messages left behind", got)
+	}
+	if got := countRows(t, db, `SELECT COUNT(*) FROM message_edits`); got != 2 {
+		t.Errorf("%d edits left, want the 2 of the kept messages", got)
+	}
+}
+
+func TestReapStaleRoomsRemovesRoomData(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	for _, id := range []string{"stale", "active"} {
+		if err := db.StoreRoom(ctx, Room{ID: id, Name: id, MaxMessages: 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seedUser(t, db, "u1", "stale")
+	seedUser(t, db, "u2", "active")
+	if err := db.BanUser(ctx, "stale", "u2", "u1"); err != nil {
+		t.Fatal(err)
+	}
+	// Both rooms are old, but only active has had a message since
+	for _, q := range []string{
+		`UPDATE rooms SET created_at = datetime('now', '-100 hours')`,
+		`UPDATE messages SET created_at = datetime('now', '-100 hours') WHERE room_id = 'stale'`,
+	} {
+		if _, err := db.Conn.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rooms, files, err := db.ReapStaleRooms(ctx, 49*time.Hour)
+	if err != nil {
+		t.Fatalf("ReapStaleRooms: %v", err)
+	}
+	if !slices.Equal(rooms, []string{"stale"}) || !slices.Equal(files, []string{"file-u1"}) {
+		t.Errorf("reaped rooms %v and files %v, want [stale] and [file-u1]", rooms, files)
+	}
+
+	// A room recreated under the same name must start clean
+	for _, q := range []string{
+		`SELECT COUNT(*) FROM rooms WHERE id = ?1`,
+		`SELECT COUNT(*) FROM messages WHERE room_id = ?1`,
+		`SELECT COUNT(*) FROM attachments WHERE room_id = ?1`,
+		`SELECT COUNT(*) FROM room_bans WHERE room_id = ?1`,
+		`SELECT COUNT(*) FROM last_read WHERE room_id = ?1`,
+		`SELECT COUNT(*) FROM notification_prefs WHERE room_id = ?1`,
+	} {
+		if n := countRows(t, db, q, "stale"); n != 0 {
+			t.Errorf("%s: %d rows left", q, n)
+		}
+	}
+	if n := countRows(t, db, `SELECT COUNT(*) FROM message_edits`); n != 1 {
+		t.Errorf("message_edits has %d rows, want only the active room's", n)
+	}
+	if u, err := db.GetUser(ctx, "u1"); err != nil || len(u.Rooms) != 0 {
+		t.Errorf("u1 rooms = %v, %v; want none", u.Rooms, err)
+	}
+	if n := countRows(t, db, `SELECT COUNT(*) FROM rooms WHERE id = 'active'`); n != 1 {
+		t.Error("active room was reaped")
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/rexlx/squall/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Stream control commands carried in ChatMessage.Command.
+const (
+	CommandSubscribe   = "subscribe"
+	CommandUnsubscribe = "unsubscribe"
+	CommandTyping      = "typing"
+
+	// Sent by the server when a user's first stream joins a room, or their
+	// last one leaves it.
+	CommandJoin  = "join"
+	CommandLeave = "leave"
+
+	// Sent by the server with the new content of an edited message, or when
+	// a message has been deleted.
+	CommandEdited  = "edited"
+	CommandDeleted = "deleted"
+
+	// Sent by the server when a moderator removes a user from a room.
+	CommandKicked = "kicked"
+
+	// An operator notice. The text is in MessageContent and the sender is
+	// SystemSender rather than a user.
+	CommandSystem = "system"
+
+	// Sent by the server on every stream each heartbeat interval so dead
+	// connections are noticed. Clients ignore it.
+	CommandPing = "ping"
+
+	// Sent by the server to the stream a keyed message came from, saying
+	// whether it was stored (see ChatMessage.ack).
+	CommandAck = "ack"
+
+	// Sent by the server when a room's topic changes. The new topic is in
+	// MessageContent and the sender is whoever changed it.
+	CommandTopic = "topic"
+)
+
+const (
+	// sendTimeout bounds how long a stream's writer waits on one send.
+	sendTimeout = 5 * time.Second
+	// maxSendFailures consecutive failed sends close the stream.
+	maxSendFailures = 3
+)
+
+var (
+	errSendTimeout  = errors.New("stream send timed out")
+	errStreamClosed = errors.New("stream closed")
+	// errStreamDropped ends a stream the server gave up on, telling the
+	// client to reconnect rather than treat it as a kick.
+	errStreamDropped = status.Error(codes.Unavailable, "stream dropped by server, reconnect")
+)
+
+// What Broadcast does when a stream's outbound queue is full.
+const (
+	OverflowDropOldest = "drop-oldest" // Discard the oldest queued message
+	OverflowDisconnect = "disconnect"  // Close the slow stream
+)
+
+// DefaultOutboxSize is the outbound queue length of each stream.
+const DefaultOutboxSize = 64
+
+// SystemSender is the UserId and Email of server-originated messages.
+const SystemSender = "system"
+
+// clientStream is a registered Stream connection. A single connection may be
+// subscribed to several rooms when the client multiplexes. Closing it makes
+// the owning Stream handler return: Close ends the RPC with a clean EOF,
+// Drop with Unavailable.
+type clientStream struct {
+	pb.ChatService_StreamServer
+	user User
+	done chan struct{}
+	once sync.Once
+	// closeErr is what the handler returns once done is closed
+	closeErr error
+
+	// handshakeRoom is the room named by the stream's first message. Chat
+	// messages that leave RoomId empty are sent there.
+	handshakeRoom string
+
+	mu     sync.Mutex
+	rooms  map[string]bool
+	closed bool
+
+	// out feeds the stream's writer goroutine, started on first register
+	out        chan *pb.ChatMessage
+	writerOnce sync.Once
+
+	// sendMu serializes writes; gRPC streams don't allow concurrent Send.
+	sendMu   sync.Mutex
+	failures atomic.Int32
+}
+
+func newClientStream(stream pb.ChatService_StreamServer, user User, outboxSize int) *clientStream {
+	if outboxSize <= 0 {
+		outboxSize = DefaultOutboxSize
+	}
+	return &clientStream{
+		ChatService_StreamServer: stream,
+		user:                     user,
+		done:                     make(chan struct{}),
+		rooms:                    make(map[string]bool),
+		out:                      make(chan *pb.ChatMessage, outboxSize),
+	}
+}
+
+// Close ends the stream with a clean EOF, for a kick, a leave, a deleted
+// room or shutdown. A client that reconnects afterwards is turned away by
+// the membership check unless it is still allowed in.
+func (c *clientStream) Close() {
+	c.closeWith(nil)
+}
+
+// Drop ends the stream because its connection is too slow or dead to keep.
+// The client sees Unavailable and reconnects.
+func (c *clientStream) Drop() {
+	c.closeWith(errStreamDropped)
+}
+
+func (c *clientStream) closeWith(err error) {
+	c.once.Do(func() {
+		c.closeErr = err
+		close(c.done)
+	})
+}
+
+// send delivers msg within sendTimeout. A send that times out is abandoned
+// and never delivered late. After maxSendFailures failures in a row the
+// stream is closed, which ends its handler and unblocks any wedged write.
+func (c *clientStream) send(msg *pb.ChatMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		c.sendMu.Lock()
+		defer c.sendMu.Unlock()
+		if ctx.Err() != nil {
+			errCh <- ctx.Err()
+			return
+		}
+		errCh <- c.ChatService_StreamServer.Send(msg)
+	}()
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		err = errSendTimeout
+	case <-c.done:
+		return errStreamClosed
+	}
+	if err == nil {
+		c.failures.Store(0)
+		return nil
+	}
+	if c.failures.Add(1) >= maxSendFailures {
+		c.Drop()
+	}
+	return err
+}
+
+// dropRoom forgets roomID and reports how many rooms remain subscribed.
+func (c *clientStream) dropRoom(roomID string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.rooms, roomID)
+	return len(c.rooms)
+}
+
+func (c *clientStream) inRoom(roomID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rooms[roomID]
+}
+
+// relayTyping tells the room that the stream's user is typing. It goes out
+// through Broadcast only and never touches the save Queue.
+func (s *GrpcServer) relayTyping(cs *clientStream, roomID string) {
+	if !cs.inRoom(roomID) {
+		return
+	}
+	s.announce(cs.user, roomID, CommandTyping)
+}
+
+// announce broadcasts a content-free control message about user to a room.
+func (s *GrpcServer) announce(user User, roomID, command string) {
+	s.Broadcast(&pb.ChatMessage{
+		RoomId:    roomID,
+		UserId:    user.ID,
+		Email:     user.Email,
+		Timestamp: time.Now().Unix(),
+		Command:   command,
+	})
+}
+
+func (s *GrpcServer) subscribe(cs *clientStream, roomID string) {
+	cs.mu.Lock()
+	if cs.closed || cs.rooms[roomID] {
+		cs.mu.Unlock()
+		return
+	}
+	cs.rooms[roomID] = true
+	first := s.registerStream(roomID, cs)
+	cs.mu.Unlock()
+
+	if first {
+		s.announce(cs.user, roomID, CommandJoin)
+	}
+}
+
+func (s *GrpcServer) unsubscribe(cs *clientStream, roomID string) {
+	cs.mu.Lock()
+	if !cs.rooms[roomID] {
+		cs.mu.Unlock()
+		return
+	}
+	delete(cs.rooms, roomID)
+	last := s.deregisterStream(roomID, cs)
+	cs.mu.Unlock()
+
+	if last {
+		s.announce(cs.user, roomID, CommandLeave)
+	}
+}
+
+// unsubscribeAll removes cs from every room it joined. It runs when the
+// Stream handler exits, so late subscribes from the receive loop are ignored.
+func (s *GrpcServer) unsubscribeAll(cs *clientStream) {
+	cs.mu.Lock()
+	cs.closed = true
+	var left []string
+	for roomID := range cs.rooms {
+		if s.deregisterStream(roomID, cs) {
+			left = append(left, roomID)
+		}
+	}
+	cs.rooms = make(map[string]bool)
+	cs.mu.Unlock()
+	cs.Close() // Stops the writer goroutine
+
+	for _, roomID := range left {
+		s.announce(cs.user, roomID, CommandLeave)
+	}
+}
+
+// userStreams counts the streams userID has open in roomID. The caller must
+// hold streamMu.
+func (s *GrpcServer) userStreams(roomID, userID string) int {
+	n := 0
+	for stream := range s.streams[roomID] {
+		if stream.user.ID == userID {
+			n++
+		}
+	}
+	return n
+}
+
+// dropUser unsubscribes every stream userID has in roomID and closes any
+// stream left without rooms. It returns how many streams were affected.
+func (s *GrpcServer) dropUser(roomID, userID string) int {
+	s.streamMu.RLock()
+	var streams []*clientStream
+	for stream := range s.streams[roomID] {
+		if stream.user.ID == userID {
+			streams = append(streams, stream)
+		}
+	}
+	s.streamMu.RUnlock()
+
+	for _, cs := range streams {
+		s.unsubscribe(cs, roomID)
+		cs.mu.Lock()
+		empty := len(cs.rooms) == 0
+		cs.mu.Unlock()
+		if empty {
+			cs.Close()
+		}
+	}
+	return len(streams)
+}
+
+// deliver queues msg for cs without blocking. When the queue is full the
+// server's OverflowPolicy either drops the oldest queued message or closes
+// the stream.
+func (s *GrpcServer) deliver(cs *clientStream, msg *pb.ChatMessage) {
+	select {
+	case cs.out <- msg:
+		return
+	case <-cs.done:
+		return
+	default:
+	}
+
+	metricStreamOverflows.Inc()
+	if s.OverflowPolicy == OverflowDisconnect {
+		s.appServer.Logger.Printf("Outbound queue full for %s, disconnecting", cs.user.Email)
+		cs.Drop()
+		return
+	}
+	select {
+	case <-cs.out:
+	default:
+	}
+	select {
+	case cs.out <- msg:
+	default:
+	}
+}
+
+// writeLoop drains cs.out onto the wire until the stream is closed.
+func (s *GrpcServer) writeLoop(cs *clientStream) {
+	for {
+		select {
+		case msg := <-cs.out:
+			if err := cs.send(msg); err != nil {
+				if err != errStreamClosed {
+					s.appServer.Logger.Printf("Send to %s in %s failed: %v", cs.user.Email, msg.RoomId, err)
+				}
+				continue
+			}
+			metricBroadcastsSent.Inc()
+		case <-cs.done:
+			return
+		}
+	}
+}
+
+// StartHeartbeat pings every open stream each interval and closes those the
+// ping can't reach, so dead connections stop counting toward presence. It
+// runs until the process exits; interval <= 0 disables it.
+func (s *GrpcServer) StartHeartbeat(interval time.Duration) {
+	if interval <= 0 {
+		s.appServer.Logger.Println("Stream heartbeat disabled")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for cs := range s.openStreams() {
+			go func() {
+				ping := &pb.ChatMessage{Command: CommandPing, Timestamp: time.Now().Unix()}
+				if err := cs.send(ping); err != nil && err != errStreamClosed {
+					s.appServer.Logger.Printf("Heartbeat to %s failed, closing stream: %v", cs.user.Email, err)
+					cs.Drop()
+				}
+			}()
+		}
+	}
+}
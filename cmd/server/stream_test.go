@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/rexlx/squall/proto"
+)
+
+// fakeStream is the server side of a Stream RPC. Send hands messages to
+// sent, or blocks until release is closed when sent is nil.
+type fakeStream struct {
+	pb.ChatService_StreamServer
+	sent    chan *pb.ChatMessage
+	release chan struct{}
+}
+
+func (f *fakeStream) Send(msg *pb.ChatMessage) error {
+	if f.sent == nil {
+		<-f.release
+		return context.Canceled
+	}
+	f.sent <- msg
+	return nil
+}
+
+func (f *fakeStream) Context() context.Context { return context.Background() }
+
+func TestSlowStreamDoesNotDelayRoom(t *testing.T) {
+	const n = 200
+	s := NewGrpcServer(newTestServer(t, newTestDB(t), Config{}))
+
+	stuck := &fakeStream{release: make(chan struct{})}
+	slow := newClientStream(stuck, User{ID: "slow", Email: "slow@example.com"}, 4)
+	fast := newClientStream(&fakeStream{sent: make(chan *pb.ChatMessage, 2*n)}, User{ID: "fast", Email: "fast@example.com"}, 2*n)
+	s.subscribe(slow, "lobby")
+	s.subscribe(fast, "lobby")
+	t.Cleanup(func() {
+		close(stuck.release)
+		s.unsubscribeAll(slow)
+		s.unsubscribeAll(fast)
+	})
+
+	start := time.Now()
+	for i := range n {
+		s.Broadcast(&pb.ChatMessage{RoomId: "lobby", Id: int64(i + 1)})
+	}
+	if elapsed := time.Since(start); elapsed > sendTimeout/2 {
+		t.Fatalf("broadcasting %d messages took %v with a stream that never reads", n, elapsed)
+	}
+
+	sent := fast.ChatService_StreamServer.(*fakeStream).sent
+	deadline := time.After(sendTimeout / 2)
+	for got := 0; got < n; {
+		select {
+		case msg := <-sent:
+			if msg.Command == "" {
+				got++
+			}
+		case <-deadline:
+			t.Fatalf("fast stream got %d of %d messages", got, n)
+		}
+	}
+}
@@ -2,29 +2,157 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/rexlx/squall/internal"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
-	Role     string            `json:"role"`
-	Rooms    []string          `json:"rooms"`
-	History  []string          `json:"history"`
-	ID       string            `json:"id"`
-	Email    string            `json:"email"`
-	Password string            `json:"password"`
-	Name     string            `json:"name"`
-	Created  time.Time         `json:"created"`
-	Updated  time.Time         `json:"updated"`
-	Stats    internal.AppStats `json:"stats"`
-	Posts    []internal.Post   `json:"posts"`
+	Role     string    `json:"role"`
+	Rooms    []string  `json:"rooms"`
+	History  []string  `json:"history"`
+	ID       string    `json:"id"`
+	Email    string    `json:"email"`
+	Password string    `json:"password"`
+	Name     string    `json:"name"`
+	About    string    `json:"about"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+	// Zero when the user has never logged in or been active
+	LastLogin  time.Time         `json:"last_login"`
+	LastActive time.Time         `json:"last_active"`
+	Stats      internal.AppStats `json:"stats"`
+	Posts      []internal.Post   `json:"posts"`
 }
 
+// maxRoomHistory is how many recently joined rooms a user's History keeps.
+const maxRoomHistory = 10
+
+// RecordJoin adds roomName to the user's saved rooms, if it isn't there
+// yet, and moves it to the front of their history.
+func (u *User) RecordJoin(roomName string) {
+	found := false
+	for _, r := range u.Rooms {
+		if r == roomName {
+			found = true
+			break
+		}
+	}
+	if !found {
+		u.Rooms = append(u.Rooms, roomName)
+	}
+
+	history := []string{roomName}
+	for _, r := range u.History {
+		if r != roomName {
+			history = append(history, r)
+		}
+	}
+	if len(history) > maxRoomHistory {
+		history = history[:maxRoomHistory]
+	}
+	u.History = history
+}
+
+// MinPasswordLength is the default shortest password, in characters.
+const MinPasswordLength = 8
+
+// PasswordPolicy is what a new password must satisfy. Every path that sets
+// a password checks it first: CreateUser, whitelist activation,
+// ChangePassword/UpdatePassword and first-use setup.
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+// DefaultPasswordPolicy only enforces MinPasswordLength.
+var DefaultPasswordPolicy = PasswordPolicy{MinLength: MinPasswordLength}
+
+// Validate returns an error describing every rule input breaks, or nil.
+func (p PasswordPolicy) Validate(input string) error {
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range input {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			hasSymbol = true
+		}
+	}
+
+	var missing []string
+	if p.RequireUpper && !hasUpper {
+		missing = append(missing, "an uppercase letter")
+	}
+	if p.RequireLower && !hasLower {
+		missing = append(missing, "a lowercase letter")
+	}
+	if p.RequireDigit && !hasDigit {
+		missing = append(missing, "a digit")
+	}
+	if p.RequireSymbol && !hasSymbol {
+		missing = append(missing, "a symbol")
+	}
+	short := utf8.RuneCountInString(input) < p.MinLength
+
+	switch {
+	case short && len(missing) > 0:
+		return fmt.Errorf("password must be at least %d characters and contain %s", p.MinLength, joinList(missing))
+	case short:
+		return fmt.Errorf("password must be at least %d characters", p.MinLength)
+	case len(missing) > 0:
+		return fmt.Errorf("password must contain %s", joinList(missing))
+	}
+	return nil
+}
+
+// joinList joins items as "a, b and c".
+func joinList(items []string) string {
+	if len(items) == 1 {
+		return items[0]
+	}
+	return strings.Join(items[:len(items)-1], ", ") + " and " + items[len(items)-1]
+}
+
+// Profile field limits, in characters.
+const (
+	MaxNameLength  = 64
+	MaxAboutLength = 500
+)
+
+// ValidateProfile checks the user-editable profile fields.
+func ValidateProfile(name, about string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("name is required")
+	}
+	if utf8.RuneCountInString(name) > MaxNameLength {
+		return fmt.Errorf("name must be at most %d characters", MaxNameLength)
+	}
+	if utf8.RuneCountInString(about) > MaxAboutLength {
+		return fmt.Errorf("about must be at most %d characters", MaxAboutLength)
+	}
+	return nil
+}
+
+// PasswordCost is the bcrypt cost new password hashes are made with. main
+// sets it from -bcrypt-cost; hashes below it are upgraded at login.
+var PasswordCost = bcrypt.DefaultCost
+
 // SetPassword hashes the input password and stores it in the User struct
 func (u *User) SetPassword(input string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(input), bcrypt.DefaultCost)
+	hash, err := bcrypt.GenerateFromPassword([]byte(input), PasswordCost)
 	if err != nil {
 		return err
 	}
@@ -47,6 +175,13 @@ func (u *User) PasswordMatches(input string) (bool, error) {
 	return true, nil
 }
 
+// NeedsRehash reports whether the stored hash was made with a lower cost
+// than PasswordCost. Hashes are never downgraded.
+func (u *User) NeedsRehash() bool {
+	cost, err := bcrypt.Cost([]byte(u.Password))
+	return err == nil && cost < PasswordCost
+}
+
 func (u *User) GetUserStats() internal.AppStats {
 	return u.Stats
 }
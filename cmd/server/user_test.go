@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	strict := PasswordPolicy{MinLength: 10, RequireUpper: true, RequireLower: true, RequireDigit: true, RequireSymbol: true}
+	for _, tc := range []struct {
+		name   string
+		policy PasswordPolicy
+		input  string
+		want   string // Error text, empty when the password is accepted
+	}{
+		{"default long enough", DefaultPasswordPolicy, "abcdefgh", ""},
+		{"default too short", DefaultPasswordPolicy, "abcdefg", "password must be at least 8 characters"},
+		{"length counts characters not bytes", DefaultPasswordPolicy, "ééééééé", "password must be at least 8 characters"},
+		{"strict satisfied", strict, "Abcdefgh1!", ""},
+		{"strict missing one", strict, "abcdefgh1!", "password must contain an uppercase letter"},
+		{"strict missing two", strict, "ABCDEFGHIJ!", "password must contain a lowercase letter and a digit"},
+		{"strict missing three", strict, "abcdefghij", "password must contain an uppercase letter, a digit and a symbol"},
+		{"strict short and missing", strict, "abc", "password must be at least 10 characters and contain an uppercase letter, a digit and a symbol"},
+		{"symbol from unicode", PasswordPolicy{MinLength: 1, RequireSymbol: true}, "a€", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.policy.Validate(tc.input)
+			switch {
+			case tc.want == "" && err != nil:
+				t.Errorf("Validate(%q) = %v, want nil", tc.input, err)
+			case tc.want != "" && (err == nil || err.Error() != tc.want):
+				t.Errorf("Validate(%q) = %v, want %q", tc.input, err, tc.want)
+			}
+		})
+	}
+}
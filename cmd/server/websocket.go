@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	pb "github.com/rexlx/squall/proto"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Browser clients can't speak gRPC, so the gateway carries the same chat
+// stream over a WebSocket at /ws. Every frame is a JSON object with a type:
+//
+//	{"type":"message","message":{...}}          a ChatMessage, either way
+//	{"type":"ping"} / {"type":"pong"}           keepalive, either way
+//	{"type":"error","code":"...","error":"..."} why the server is closing
+//
+// The message is a ChatMessage in protobuf JSON with the proto field names
+// (room_id, message_content, ...); int64 fields such as timestamp and id
+// are strings, as protobuf JSON has them. As with Stream, the first message names
+// the room, later ones may subscribe and unsubscribe, and everything else
+// goes through the same checks, Broadcast and save queue.
+const (
+	FrameMessage = "message"
+	FramePing    = "ping"
+	FramePong    = "pong"
+	FrameError   = "error"
+)
+
+const (
+	// wsPingInterval is how often the gateway pings an idle browser.
+	wsPingInterval = 30 * time.Second
+	// wsReadTimeout closes a socket that has sent nothing, not even a
+	// pong, for this long.
+	wsReadTimeout = 2*wsPingInterval + 10*time.Second
+	// wsMaxFrameBytes fits a base64 encoded FILE_CHUNK with room to spare.
+	wsMaxFrameBytes = 2 * maxChunkBytes
+)
+
+// wsFrame is one JSON frame on the WebSocket.
+type wsFrame struct {
+	Type    string          `json:"type"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Code    string          `json:"code,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// Protobuf JSON as both browser gateways, WebSocket and REST, speak it.
+var (
+	jsonOut = protojson.MarshalOptions{UseProtoNames: true}
+	jsonIn  = protojson.UnmarshalOptions{DiscardUnknown: true}
+)
+
+// RegisterWebSocket mounts the chat WebSocket at /ws on mux. The access
+// token comes in an Authorization header or, since browsers can't set one
+// on a WebSocket, an access_token query parameter. Connections are rate
+// limited by IP like gRPC calls and, when userLimiter is non-nil, by the
+// token's user as well.
+func (s *GrpcServer) RegisterWebSocket(mux *http.ServeMux, limiter, userLimiter *RateLimiter) {
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		if limiter != nil && !limiter.getLimiter(remoteIP(r)).Allow() {
+			http.Error(w, "too many requests - slow down", http.StatusTooManyRequests)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.URL.Query().Get("access_token")
+		}
+		if token == "" {
+			http.Error(w, "authorization token is not provided", http.StatusUnauthorized)
+			return
+		}
+		claims, err := ValidateJWT(token, s.appServer.JWTKeys, s.appServer.TokenIssuer)
+		if err != nil {
+			http.Error(w, "access token is invalid", http.StatusUnauthorized)
+			return
+		}
+		if !userLimiter.allowUser(claims.UserID) {
+			http.Error(w, "too many requests - slow down", http.StatusTooManyRequests)
+			return
+		}
+		user := User{ID: claims.UserID, Role: claims.Role, Email: claims.Email}
+
+		websocket.Server{
+			// Tokens are never sent as cookies, so a page from another
+			// origin gains nothing by opening a socket; any Origin is
+			// accepted.
+			Handshake: func(*websocket.Config, *http.Request) error { return nil },
+			Handler:   func(conn *websocket.Conn) { s.serveWebSocket(conn, user) },
+		}.ServeHTTP(w, r)
+	})
+}
+
+// serveWebSocket runs Stream over conn until either side closes it. An
+// error that ends the stream is sent to the browser before the close.
+func (s *GrpcServer) serveWebSocket(conn *websocket.Conn, user User) {
+	conn.MaxPayloadBytes = wsMaxFrameBytes
+	ctx, cancel := context.WithCancel(context.WithValue(conn.Request().Context(), userContextKey, user))
+	defer cancel()
+	stream := &wsStream{conn: conn, ctx: ctx}
+	go stream.keepalive()
+
+	err := s.Stream(stream)
+	if err != nil && !errors.Is(err, io.EOF) {
+		st := status.Convert(err)
+		stream.sendFrame(wsFrame{Type: FrameError, Code: st.Code().String(), Error: st.Message()})
+	}
+	conn.Close()
+}
+
+// wsStream adapts a WebSocket to pb.ChatService_StreamServer so Stream
+// can serve it unchanged.
+type wsStream struct {
+	conn *websocket.Conn
+	ctx  context.Context
+}
+
+func (w *wsStream) Context() context.Context { return w.ctx }
+
+// keepalive pings the browser every wsPingInterval until the stream ends.
+func (w *wsStream) keepalive() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if w.sendFrame(wsFrame{Type: FramePing}) != nil {
+				return
+			}
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+// sendFrame writes one frame. websocket.Conn serializes writes, so the
+// keepalive and the stream's writer can share it.
+func (w *wsStream) sendFrame(f wsFrame) error {
+	w.conn.SetWriteDeadline(time.Now().Add(sendTimeout))
+	return websocket.JSON.Send(w.conn, f)
+}
+
+func (w *wsStream) Send(msg *pb.ChatMessage) error {
+	data, err := jsonOut.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return w.sendFrame(wsFrame{Type: FrameMessage, Message: data})
+}
+
+// Recv returns the next chat message, answering pings on the way. A
+// clean close from the browser reads as io.EOF.
+func (w *wsStream) Recv() (*pb.ChatMessage, error) {
+	for {
+		w.conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+		var f wsFrame
+		if err := websocket.JSON.Receive(w.conn, &f); err != nil {
+			return nil, err
+		}
+		switch f.Type {
+		case FrameMessage:
+			msg := &pb.ChatMessage{}
+			if err := jsonIn.Unmarshal(f.Message, msg); err != nil {
+				return nil, status.Error(codes.InvalidArgument, "malformed message frame")
+			}
+			return msg, nil
+		case FramePing:
+			if err := w.sendFrame(wsFrame{Type: FramePong}); err != nil {
+				return nil, err
+			}
+		}
+		// Pongs only extend the read deadline; unknown types are ignored
+		// like unknown commands
+	}
+}
+
+func (w *wsStream) SetHeader(metadata.MD) error  { return nil }
+func (w *wsStream) SendHeader(metadata.MD) error { return nil }
+func (w *wsStream) SetTrailer(metadata.MD)       {}
+
+func (w *wsStream) SendMsg(m any) error {
+	msg, ok := m.(*pb.ChatMessage)
+	if !ok {
+		return status.Error(codes.Internal, "unexpected message type")
+	}
+	return w.Send(msg)
+}
+
+func (w *wsStream) RecvMsg(m any) error {
+	msg, ok := m.(*pb.ChatMessage)
+	if !ok {
+		return status.Error(codes.Internal, "unexpected message type")
+	}
+	in, err := w.Recv()
+	if err != nil {
+		return err
+	}
+	proto.Merge(msg, in)
+	return nil
+}
+
+// remoteIP is the host part of r.RemoteAddr, the key the IP limiter uses.
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
@@ -48,6 +48,10 @@ echo "--- Signing Client Certificate ---"
 openssl x509 -req -in client-req.pem -CA ca-cert.pem -CAkey ca-key.pem -CAcreateserial \
   -out client-cert.pem -days 365 -sha256
 
+echo "--- Generating JWT Signing Key (for -jwt-alg RS256) ---"
+openssl genrsa -out jwt-private.pem 2048
+openssl rsa -in jwt-private.pem -pubout -out jwt-public.pem
+
 echo "--- Cleanup ---"
 rm server-req.pem client-req.pem
 
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// DefaultCAFile is the CA that signs the server certificate in dev setups.
+const DefaultCAFile = "data/ca-cert.pem"
+
+// ClientTLS describes how a client verifies the server and identifies itself.
+type ClientTLS struct {
+	// CAFile is a PEM bundle the server certificate must chain to. Empty
+	// uses the system roots.
+	CAFile string
+	// CertFile and KeyFile load a client certificate from disk. Certificate
+	// is used instead when they are empty; with neither, none is presented.
+	CertFile    string
+	KeyFile     string
+	Certificate *tls.Certificate
+	// InsecureSkipVerify accepts any server certificate. Dev use only.
+	InsecureSkipVerify bool
+}
+
+// ClientTLSConfig builds the tls.Config shared by scream, the admin CLI and
+// the benchmark.
+func ClientTLSConfig(opts ClientTLS) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+
+	if opts.CAFile != "" && !opts.InsecureSkipVerify {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + opts.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	switch {
+	case opts.CertFile != "" || opts.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	case opts.Certificate != nil:
+		cfg.Certificates = []tls.Certificate{*opts.Certificate}
+	}
+	return cfg, nil
+}
@@ -15,7 +15,34 @@ type Post struct {
 type AppStats map[string][]Stat
 type KeyLib map[string]Key
 
+// Record adds n to the named counter, rolling events up into one sample per
+// bucket. Each sample is stamped with its bucket's start and holds the
+// running total at the end of that bucket, so the newest sample is the count
+// so far and the difference between samples is the activity in between. Only
+// the newest keep samples are retained.
+func (a AppStats) Record(name string, at time.Time, n float64, bucket time.Duration, keep int) {
+	samples := a[name]
+	start := at.Truncate(bucket)
+	var total float64
+	if len(samples) > 0 {
+		last := &samples[len(samples)-1]
+		if last.Time.Equal(start) {
+			last.Value += n
+			return
+		}
+		total = last.Value
+	}
+	samples = append(samples, Stat{Time: start, Value: total + n})
+	if keep > 0 && len(samples) > keep {
+		// Shift down in place so the backing array stays keep+1 long
+		copy(samples, samples[len(samples)-keep:])
+		samples = samples[:keep]
+	}
+	a[name] = samples
+}
+
 type Message struct {
+	ID            int64  `json:"id"`
 	RoomID        string `json:"room_id"`
 	Time          string `json:"time"`
 	ReplyTo       string `json:"reply_to"`
@@ -24,6 +51,30 @@ type Message struct {
 	Email         string `json:"email"`
 	InitialVector string `json:"iv"`
 	HotSauce      string `json:"hot_sauce"`
+	// Attachment is the JSON-encoded Attachment sent with the message, or
+	// empty for none
+	Attachment string `json:"attachment,omitempty"`
+	// Seq is the message's position in its room, counting from 1; 0 for
+	// messages stored before rooms were sequenced
+	Seq int64 `json:"seq,omitempty"`
+	// TimeMs is Time in Unix milliseconds; 0 for messages stored before
+	// it was kept
+	TimeMs int64 `json:"time_ms,omitempty"`
+}
+
+// Attachment describes an uploaded file. The server never looks inside
+// encrypted attachments; IV and HotSauce are kept for the recipients.
+type Attachment struct {
+	ID          string    `json:"id"`
+	RoomID      string    `json:"room_id"`
+	UserID      string    `json:"user_id"`
+	FileName    string    `json:"file_name"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	IV          string    `json:"iv,omitempty"`
+	HotSauce    string    `json:"hot_sauce,omitempty"`
+	Created     time.Time `json:"created"`
 }
 
 type Key struct {